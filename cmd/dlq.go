@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	log "log/slog"
+	"os"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/omran95/chatroom/pkg/infrastructure"
+	"github.com/spf13/cobra"
+)
+
+var dlqLimit int
+
+var dlqCmd = &cobra.Command{
+	Use:   "dlq",
+	Short: "Inspect, replay or purge the messages moved to the poison queue",
+}
+
+var dlqInspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Print the pending dead letters without marking them done",
+	Run: func(cmd *cobra.Command, args []string) {
+		dlq := newDeadLetterQueue(loadConfig())
+		defer dlq.Close()
+		err := dlq.Process(context.Background(), dlqLimit, false, func(deadLetter infrastructure.DeadLetter) error {
+			metadata := deadLetter.Message.Metadata
+			fmt.Printf("partition=%d offset=%d uuid=%s topic=%s handler=%s retries=%s poisoned_at=%s\n  reason: %s\n  payload: %s\n",
+				deadLetter.Partition, deadLetter.Offset, deadLetter.Message.UUID,
+				metadata.Get(middleware.PoisonedTopicKey), metadata.Get(middleware.PoisonedHandlerKey),
+				metadata.Get(infrastructure.PoisonedRetriesKey), metadata.Get(infrastructure.PoisonedAtKey),
+				metadata.Get(middleware.ReasonForPoisonedKey), deadLetter.Message.Payload)
+			return nil
+		})
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+var dlqReplayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Republish the pending dead letters to the topic they failed on",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := loadConfig()
+		dlq := newDeadLetterQueue(config)
+		defer dlq.Close()
+		publisher, err := infrastructure.NewKafkaPublisherWithPartitioning(config)
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		defer publisher.Close()
+
+		replayed := 0
+		err = dlq.Process(context.Background(), dlqLimit, true, func(deadLetter infrastructure.DeadLetter) error {
+			topic := deadLetter.Message.Metadata.Get(middleware.PoisonedTopicKey)
+			if topic == "" {
+				return fmt.Errorf("dead letter at partition %d offset %d has no topic", deadLetter.Partition, deadLetter.Offset)
+			}
+			msg := message.NewMessage(deadLetter.Message.UUID, deadLetter.Message.Payload)
+			for key, value := range deadLetter.Message.Metadata {
+				switch key {
+				case middleware.PoisonedTopicKey, middleware.PoisonedHandlerKey, middleware.PoisonedSubscriberKey,
+					middleware.ReasonForPoisonedKey, infrastructure.PoisonedAtKey, infrastructure.PoisonedRetriesKey:
+				default:
+					msg.Metadata.Set(key, value)
+				}
+			}
+			if err := publisher.Publish(topic, msg); err != nil {
+				return fmt.Errorf("error replaying to %s: %w", topic, err)
+			}
+			replayed++
+			return nil
+		})
+		fmt.Printf("replayed %d dead letters\n", replayed)
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+var dlqPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Mark every pending dead letter done without replaying it",
+	Run: func(cmd *cobra.Command, args []string) {
+		dlq := newDeadLetterQueue(loadConfig())
+		defer dlq.Close()
+		purged, err := dlq.Purge(context.Background())
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("purged %d dead letters\n", purged)
+	},
+}
+
+func loadConfig() *config.Config {
+	config, err := config.NewConfig()
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(1)
+	}
+	return config
+}
+
+func newDeadLetterQueue(config *config.Config) *infrastructure.DeadLetterQueue {
+	dlq, err := infrastructure.NewDeadLetterQueue(config)
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(1)
+	}
+	return dlq
+}
+
+func init() {
+	dlqInspectCmd.Flags().IntVar(&dlqLimit, "limit", 0, "maximum dead letters, 0 for all")
+	dlqReplayCmd.Flags().IntVar(&dlqLimit, "limit", 0, "maximum dead letters, 0 for all")
+	dlqCmd.AddCommand(dlqInspectCmd, dlqReplayCmd, dlqPurgeCmd)
+	appCmd.AddCommand(dlqCmd)
+}
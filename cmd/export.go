@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	log "log/slog"
+	"os"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/omran95/chatroom/pkg/room"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportRoomID uint64
+	exportFormat string
+	exportFrom   string
+	exportTo     string
+	exportOutput string
+)
+
+// exportArchive exports the room with its messages as a JSONL archive for the import command.
+const exportArchive = "archive"
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export a room transcript from the message storage",
+	Run: func(cmd *cobra.Command, args []string) {
+		options := room.ExportOptions{Format: exportFormat}
+		var err error
+		if exportFrom != "" {
+			if options.From, err = time.Parse(time.RFC3339, exportFrom); err != nil {
+				log.Error("invalid --from: " + err.Error())
+				os.Exit(1)
+			}
+		}
+		if exportTo != "" {
+			if options.To, err = time.Parse(time.RFC3339, exportTo); err != nil {
+				log.Error("invalid --to: " + err.Error())
+				os.Exit(1)
+			}
+		}
+
+		config, err := config.NewConfig()
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		storage, err := room.NewStorage(config)
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		var out io.Writer = os.Stdout
+		if exportOutput != "" {
+			file, err := os.Create(exportOutput)
+			if err != nil {
+				log.Error(err.Error())
+				os.Exit(1)
+			}
+			defer file.Close()
+			out = file
+		}
+		if exportFormat == exportArchive {
+			err = room.ExportArchive(context.Background(), storage.RoomRepo, storage.MessageRepo, storage.PollRepo, storage.MemberRepo, exportRoomID, out)
+		} else {
+			err = room.ExportTranscript(context.Background(), storage.MessageRepo, exportRoomID, options, out)
+		}
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	exportCmd.Flags().Uint64Var(&exportRoomID, "room", 0, "room ID")
+	exportCmd.Flags().StringVar(&exportFormat, "format", room.ExportJSON, "json, csv, html or archive")
+	exportCmd.Flags().StringVar(&exportFrom, "from", "", "export messages sent at or after this RFC3339 time")
+	exportCmd.Flags().StringVar(&exportTo, "to", "", "export messages sent before this RFC3339 time")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "output file, defaults to stdout")
+	exportCmd.MarkFlagRequired("room")
+	appCmd.AddCommand(exportCmd)
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	log "log/slog"
+	"os"
+
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/omran95/chatroom/pkg/room"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importDryRun     bool
+	importBatchSize  int
+	importCheckpoint string
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import <archive>",
+	Short: "Import rooms and messages from a JSONL archive written by export --format archive",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		archive, err := os.Open(args[0])
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		defer archive.Close()
+
+		config, err := config.NewConfig()
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		storage, err := room.NewStorage(config)
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		options := room.ImportOptions{BatchSize: importBatchSize, DryRun: importDryRun, Checkpoint: importCheckpoint}
+		if options.Checkpoint == "" && !importDryRun {
+			options.Checkpoint = args[0] + ".checkpoint"
+		}
+		summary, err := room.NewImporter(storage.RoomRepo, storage.MessageRepo, storage.PollRepo, storage.MemberRepo, options).Import(context.Background(), archive)
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		action := "imported"
+		if importDryRun {
+			action = "validated"
+		}
+		fmt.Printf("%s %d rooms, %d messages, %d polls and %d members, skipped %d lines before the checkpoint\n", action, summary.Rooms, summary.Messages, summary.Polls, summary.Members, summary.Skipped)
+		if !importDryRun {
+			os.Remove(options.Checkpoint)
+		}
+	},
+}
+
+func init() {
+	importCmd.Flags().BoolVar(&importDryRun, "dry-run", false, "only validate the archive")
+	importCmd.Flags().IntVar(&importBatchSize, "batch-size", 500, "messages written per batch")
+	importCmd.Flags().StringVar(&importCheckpoint, "checkpoint", "", "checkpoint file to resume an interrupted import, defaults to <archive>.checkpoint")
+	appCmd.AddCommand(importCmd)
+}
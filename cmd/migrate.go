@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	log "log/slog"
+	"os"
+
+	"github.com/gocql/gocql"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/omran95/chatroom/pkg/infrastructure"
+	"github.com/omran95/chatroom/pkg/room"
+	"github.com/spf13/cobra"
+)
+
+var migrateDryRun bool
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Cassandra schema migrations",
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Create the keyspace and apply pending migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := config.NewConfig()
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		ctx := context.Background()
+		if !migrateDryRun {
+			if err := createKeyspace(ctx, config); err != nil {
+				log.Error(err.Error())
+				os.Exit(1)
+			}
+		}
+		// a dry run only reads the applied migrations, it works before the keyspace exists
+		migrator, session := newCassandraMigrator(config, !migrateDryRun)
+		defer session.Close()
+		if err := migrator.Up(ctx, migrateDryRun, os.Stdout); err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show applied and pending migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := config.NewConfig()
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		migrator, session := newCassandraMigrator(config, false)
+		defer session.Close()
+		if err := migrator.Status(context.Background(), os.Stdout); err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func createKeyspace(ctx context.Context, config *config.Config) error {
+	adminSession, err := infrastructure.NewCassandraAdminSession(config)
+	if err != nil {
+		return err
+	}
+	defer adminSession.Close()
+	return infrastructure.CreateKeyspace(ctx, adminSession, config.Cassandra.Keyspace, config.Cassandra.ReplicationFactor)
+}
+
+// newCassandraMigrator creates a migrator on a session bound to the keyspace, or on an admin
+// session that only reads the migration state when bindKeyspace is false.
+func newCassandraMigrator(config *config.Config, bindKeyspace bool) (*infrastructure.CassandraMigrator, *gocql.Session) {
+	newSession := infrastructure.NewCassandraAdminSession
+	if bindKeyspace {
+		newSession = infrastructure.NewCassandraSession
+	}
+	session, err := newSession(config)
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(1)
+	}
+	migrator, err := room.NewCassandraMigrator(config, session)
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(1)
+	}
+	return migrator, session
+}
+
+func init() {
+	migrateUpCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "print the pending migrations without applying them")
+	migrateCmd.AddCommand(migrateUpCmd, migrateStatusCmd)
+	appCmd.AddCommand(migrateCmd)
+}
@@ -5,14 +5,29 @@ import (
 	"os"
 
 	"github.com/omran95/chatroom/internal/wire"
+	"github.com/omran95/chatroom/pkg/common"
 	"github.com/spf13/cobra"
 )
 
+var roomMode string
+
 var roomCmd = &cobra.Command{
 	Use:   "room",
 	Short: "Room Service",
 	Run: func(cmd *cobra.Command, args []string) {
-		server, err := wire.InitializeRoomServer("room")
+		var server *common.Server
+		var err error
+		switch roomMode {
+		case "distributed":
+			server, err = wire.InitializeRoomServer("room")
+		case "direct":
+			server, err = wire.InitializeDirectRoomServer("room")
+		case "standalone":
+			server, err = wire.InitializeStandaloneRoomServer("room")
+		default:
+			log.Error("unknown mode: " + roomMode)
+			os.Exit(1)
+		}
 		if err != nil {
 			log.Error(err.Error())
 			os.Exit(1)
@@ -22,5 +37,6 @@ var roomCmd = &cobra.Command{
 }
 
 func init() {
+	roomCmd.Flags().StringVar(&roomMode, "mode", "distributed", "distributed (Kafka + subscriber service), direct (Kafka room partitions, no subscriber service) or standalone (single node, in-memory Pub/Sub)")
 	appCmd.AddCommand(roomCmd)
 }
@@ -4,54 +4,149 @@
 package wire
 
 import (
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
 	"github.com/google/wire"
 	"github.com/omran95/chatroom/pkg/common"
 	"github.com/omran95/chatroom/pkg/config"
 	"github.com/omran95/chatroom/pkg/infrastructure"
 	"github.com/omran95/chatroom/pkg/room"
+	"github.com/omran95/chatroom/pkg/standalone"
 	"github.com/omran95/chatroom/pkg/subscriber"
 )
 
-func InitializeRoomServer(name string) (*common.Server, error) {
-	wire.Build(
-		config.NewConfig,
-		common.NewHttpLog,
-		common.NewSonyFlake,
-		common.NewObservabilityInjector,
-		infrastructure.NewCassandraSession,
+var roomSet = wire.NewSet(
+	config.NewConfig,
+	common.NewHttpLog,
+	common.NewGrpcLog,
+	common.NewSonyFlake,
+	common.NewObservabilityInjector,
 
-		infrastructure.NewKafkaPublisherWithPartitioning,
-		room.NewSubscriberGrpcClient,
+	infrastructure.NewRedisClient,
 
-		infrastructure.NewRedisClient,
+	room.NewMessageDeduplicator,
+	room.NewRoomService,
+	wire.Bind(new(room.RoomService), new(*room.RoomServiceImpl)),
 
-		room.NewMessagePublisher,
-		wire.Bind(new(room.MessagePublisher), new(*room.MessagePublisherImpl)),
+	room.NewStorage,
+	wire.FieldsOf(new(*room.Storage), "RoomRepo", "MessageRepo", "WebhookRepo", "PollRepo", "PinRepo", "ScheduledMessageRepo", "InviteRepo", "MemberRepo"),
 
-		room.NewRoomService,
-		wire.Bind(new(room.RoomService), new(*room.RoomServiceImpl)),
+	room.NewRetentionWorker,
+	room.NewOutboxRelay,
+	room.NewMessageScheduler,
+	room.NewInviteSigner,
 
-		room.NewRoomRepo,
-		wire.Bind(new(room.RoomRepo), new(*room.RoomRepoImpl)),
+	room.NewWebhookCache,
+	room.NewSlashCommands,
+	room.NewWebhookDispatcher,
 
-		room.NewMessageRepo,
-		wire.Bind(new(room.MessageRepo), new(*room.MessageRepoImpl)),
+	room.NewWebSocketConnection,
+	room.NewRoomSessions,
+	room.NewSendQueues,
+	room.NewWsCompression,
 
-		room.NewWebSocketConnection,
+	room.NewGinEngine,
+	room.NewRateLimiterMiddleware,
+	room.NewSessionHandler,
 
-		room.NewGinEngine,
+	room.NewHttpServer,
+	wire.Bind(new(common.HttpServer), new(*room.HttpServer)),
 
-		infrastructure.NewBrokerRouter,
-		infrastructure.NewKafkaSubscriber,
-		room.NewMessageSubscriber,
+	room.NewGrpcServer,
+	wire.Bind(new(common.GrpcServer), new(*room.GrpcServer)),
 
-		room.NewHttpServer,
-		wire.Bind(new(common.HttpServer), new(*room.HttpServer)),
+	common.NewServer,
+)
 
-		room.NewRouter,
-		wire.Bind(new(common.Router), new(*room.Router)),
-		common.NewServer,
-	)
+// distributedRoomSet connects the room service to Kafka and the gRPC subscriber service.
+var distributedRoomSet = wire.NewSet(
+	infrastructure.NewKafkaPublisherWithPartitioning,
+	infrastructure.NewKafkaSubscriber,
+
+	room.NewKafkaWebhookSubscriber,
+	room.NewWebhookTopics,
+
+	room.NewMessagePublisher,
+	wire.Bind(new(room.MessagePublisher), new(*room.MessagePublisherImpl)),
+
+	infrastructure.NewBrokerRouter,
+	room.NewMessageSubscriber,
+	wire.Bind(new(room.RoomMessageSubscriber), new(*room.MessageSubscriber)),
+
+	room.NewSubscriberGrpcClient,
+	room.NewSubscriberEndpoints,
+
+	room.NewRouter,
+	wire.Bind(new(common.Router), new(*room.Router)),
+)
+
+// directRoomSet publishes room messages to room partition topics consumed by the room instances
+// with sessions in the rooms, without the subscriber service.
+var directRoomSet = wire.NewSet(
+	infrastructure.NewKafkaPublisherWithPartitioning,
+	infrastructure.NewKafkaFanoutSubscriber,
+
+	room.NewKafkaWebhookSubscriber,
+	room.NewDirectWebhookTopics,
+
+	room.NewRoomPartitionPublisher,
+	wire.Bind(new(room.MessagePublisher), new(*room.RoomPartitionPublisher)),
+
+	room.NewDirectMessageSubscriber,
+	wire.Bind(new(room.RoomMessageSubscriber), new(*room.DirectMessageSubscriber)),
+	room.NewDirectSubscriberEndpoints,
+
+	room.NewRouter,
+	wire.Bind(new(common.Router), new(*room.Router)),
+)
+
+// standaloneRoomSet runs the subscriber service in-process on top of a GoChannel Pub/Sub
+// and keeps the room subscribers in memory.
+var standaloneRoomSet = wire.NewSet(
+	infrastructure.NewGoChannel,
+	wire.Bind(new(message.Publisher), new(*gochannel.GoChannel)),
+	wire.Bind(new(message.Subscriber), new(*gochannel.GoChannel)),
+
+	room.NewGoChannelWebhookSubscriber,
+	room.NewWebhookTopics,
+
+	room.NewMessagePublisher,
+	wire.Bind(new(room.MessagePublisher), new(*room.MessagePublisherImpl)),
+
+	infrastructure.NewBrokerRouter,
+	room.NewMessageSubscriber,
+	wire.Bind(new(room.RoomMessageSubscriber), new(*room.MessageSubscriber)),
+
+	infrastructure.NewMemoryCache,
+	wire.Bind(new(infrastructure.RedisCache), new(*infrastructure.MemoryCacheImpl)),
+	subscriber.NewSubscriberRepo,
+	wire.Bind(new(subscriber.SubscriberRepo), new(*subscriber.SubscriberRepoImpl)),
+
+	subscriber.NewMessagePublisher,
+	wire.Bind(new(subscriber.MessagePublisher), new(*subscriber.MessagePublisherImpl)),
+
+	subscriber.NewSubscriberService,
+	wire.Bind(new(subscriber.SubscriberService), new(*subscriber.SubscriberServiceImpl)),
+
+	subscriber.NewMessageSubscriber,
+	standalone.NewSubscriberEndpoints,
+
+	standalone.NewRouter,
+	wire.Bind(new(common.Router), new(*standalone.Router)),
+)
+
+func InitializeRoomServer(name string) (*common.Server, error) {
+	wire.Build(roomSet, distributedRoomSet)
+	return &common.Server{}, nil
+}
+
+func InitializeDirectRoomServer(name string) (*common.Server, error) {
+	wire.Build(roomSet, directRoomSet)
+	return &common.Server{}, nil
+}
+
+func InitializeStandaloneRoomServer(name string) (*common.Server, error) {
+	wire.Build(roomSet, standaloneRoomSet)
 	return &common.Server{}, nil
 }
 
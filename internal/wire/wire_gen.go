@@ -7,10 +7,14 @@
 package wire
 
 import (
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/google/wire"
 	"github.com/omran95/chatroom/pkg/common"
 	"github.com/omran95/chatroom/pkg/config"
 	"github.com/omran95/chatroom/pkg/infrastructure"
 	"github.com/omran95/chatroom/pkg/room"
+	"github.com/omran95/chatroom/pkg/standalone"
 	"github.com/omran95/chatroom/pkg/subscriber"
 )
 
@@ -26,28 +30,50 @@ func InitializeRoomServer(name string) (*common.Server, error) {
 		return nil, err
 	}
 	engine := room.NewGinEngine(name, httpLog, configConfig)
-	melodyConn := room.NewWebSocketConnection()
+	wsCompression, err := room.NewWsCompression(name, configConfig)
+	if err != nil {
+		return nil, err
+	}
+	melodyConn := room.NewWebSocketConnection(wsCompression)
 	idGenerator, err := common.NewSonyFlake()
 	if err != nil {
 		return nil, err
 	}
-	session, err := infrastructure.NewCassandraSession(configConfig)
+	storage, err := room.NewStorage(configConfig)
 	if err != nil {
 		return nil, err
 	}
-	roomRepoImpl := room.NewRoomRepo(session)
-	publisher, err := infrastructure.NewKafkaPublisher(configConfig)
+	roomRepo := storage.RoomRepo
+	publisher, err := infrastructure.NewKafkaPublisherWithPartitioning(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	messagePublisherImpl, err := room.NewMessagePublisher(publisher, configConfig)
 	if err != nil {
 		return nil, err
 	}
-	messagePublisherImpl := room.NewMessagePublisher(publisher)
 	subscriberGrpcClient, err := room.NewSubscriberGrpcClient(configConfig)
 	if err != nil {
 		return nil, err
 	}
-	messageRepoImpl := room.NewMessageRepo(session)
-	roomServiceImpl := room.NewRoomService(idGenerator, roomRepoImpl, messagePublisherImpl, subscriberGrpcClient, messageRepoImpl)
-	router, err := infrastructure.NewBrokerRouter(name)
+	subscriberEndpoints := room.NewSubscriberEndpoints(subscriberGrpcClient)
+	messageRepo := storage.MessageRepo
+	universalClient, err := infrastructure.NewRedisClient(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	messageDeduplicator := room.NewMessageDeduplicator(configConfig, universalClient)
+	webhookRepo := storage.WebhookRepo
+	webhookCache := room.NewWebhookCache(configConfig, webhookRepo)
+	slashCommands := room.NewSlashCommands(configConfig, webhookCache)
+	pollRepo := storage.PollRepo
+	pinRepo := storage.PinRepo
+	scheduledMessageRepo := storage.ScheduledMessageRepo
+	inviteRepo := storage.InviteRepo
+	inviteSigner := room.NewInviteSigner(configConfig)
+	memberRepo := storage.MemberRepo
+	roomServiceImpl := room.NewRoomService(idGenerator, roomRepo, messagePublisherImpl, subscriberEndpoints, messageRepo, messageDeduplicator, webhookCache, slashCommands, pollRepo, pinRepo, scheduledMessageRepo, inviteRepo, inviteSigner, memberRepo)
+	router, err := infrastructure.NewBrokerRouter(name, configConfig, publisher)
 	if err != nil {
 		return nil, err
 	}
@@ -55,24 +81,258 @@ func InitializeRoomServer(name string) (*common.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	messageSubscriber, err := room.NewMessageSubscriber(router, configConfig, subscriber, melodyConn)
+	sendQueues, err := room.NewSendQueues(name, configConfig, wsCompression)
 	if err != nil {
 		return nil, err
 	}
-	universalClient, err := infrastructure.NewRedisClient(configConfig)
+	roomSessions := room.NewRoomSessions(sendQueues)
+	messageSubscriber, err := room.NewMessageSubscriber(router, configConfig, subscriber, roomSessions)
+	if err != nil {
+		return nil, err
+	}
+	sessionHandler := room.NewSessionHandler(httpLog, roomServiceImpl, messageSubscriber, roomSessions)
+	rateLimiterMiddleware, err := room.NewRateLimiterMiddleware(configConfig, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	retentionWorker, err := room.NewRetentionWorker(configConfig, httpLog, roomRepo, messageRepo, webhookRepo, pollRepo, pinRepo, scheduledMessageRepo, inviteRepo, memberRepo, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	outboxRelay, err := room.NewOutboxRelay(configConfig, httpLog, messageRepo, messagePublisherImpl, universalClient)
 	if err != nil {
 		return nil, err
 	}
-	httpServer, err := room.NewHttpServer(name, httpLog, engine, melodyConn, configConfig, roomServiceImpl, messageSubscriber, universalClient)
+	webhookSubscriber, err := room.NewKafkaWebhookSubscriber(configConfig)
 	if err != nil {
 		return nil, err
 	}
-	roomRouter := room.NewRouter(httpServer)
+	webhookTopics := room.NewWebhookTopics()
+	webhookDispatcher, err := room.NewWebhookDispatcher(name, configConfig, httpLog, webhookSubscriber, webhookTopics, webhookCache)
+	if err != nil {
+		return nil, err
+	}
+	messageScheduler, err := room.NewMessageScheduler(configConfig, httpLog, roomServiceImpl, roomRepo, scheduledMessageRepo, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	httpServer := room.NewHttpServer(name, httpLog, engine, melodyConn, configConfig, roomServiceImpl, messageSubscriber, sessionHandler, rateLimiterMiddleware, retentionWorker, sendQueues, outboxRelay, webhookDispatcher, messageScheduler)
+	grpcLog, err := common.NewGrpcLog(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	grpcServer := room.NewGrpcServer(name, grpcLog, configConfig, roomServiceImpl, sessionHandler, sendQueues, rateLimiterMiddleware)
+	roomRouter := room.NewRouter(httpServer, grpcServer)
 	observabilityInjector := common.NewObservabilityInjector(configConfig)
 	server := common.NewServer(name, roomRouter, observabilityInjector)
 	return server, nil
 }
 
+func InitializeDirectRoomServer(name string) (*common.Server, error) {
+	configConfig, err := config.NewConfig()
+	if err != nil {
+		return nil, err
+	}
+	httpLog, err := common.NewHttpLog(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	engine := room.NewGinEngine(name, httpLog, configConfig)
+	wsCompression, err := room.NewWsCompression(name, configConfig)
+	if err != nil {
+		return nil, err
+	}
+	melodyConn := room.NewWebSocketConnection(wsCompression)
+	idGenerator, err := common.NewSonyFlake()
+	if err != nil {
+		return nil, err
+	}
+	storage, err := room.NewStorage(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	roomRepo := storage.RoomRepo
+	publisher, err := infrastructure.NewKafkaPublisherWithPartitioning(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	roomPartitionPublisher, err := room.NewRoomPartitionPublisher(publisher, configConfig)
+	if err != nil {
+		return nil, err
+	}
+	subscriberEndpoints := room.NewDirectSubscriberEndpoints()
+	messageRepo := storage.MessageRepo
+	universalClient, err := infrastructure.NewRedisClient(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	messageDeduplicator := room.NewMessageDeduplicator(configConfig, universalClient)
+	webhookRepo := storage.WebhookRepo
+	webhookCache := room.NewWebhookCache(configConfig, webhookRepo)
+	slashCommands := room.NewSlashCommands(configConfig, webhookCache)
+	pollRepo := storage.PollRepo
+	pinRepo := storage.PinRepo
+	scheduledMessageRepo := storage.ScheduledMessageRepo
+	inviteRepo := storage.InviteRepo
+	inviteSigner := room.NewInviteSigner(configConfig)
+	memberRepo := storage.MemberRepo
+	roomServiceImpl := room.NewRoomService(idGenerator, roomRepo, roomPartitionPublisher, subscriberEndpoints, messageRepo, messageDeduplicator, webhookCache, slashCommands, pollRepo, pinRepo, scheduledMessageRepo, inviteRepo, inviteSigner, memberRepo)
+	subscriber, err := infrastructure.NewKafkaFanoutSubscriber(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	sendQueues, err := room.NewSendQueues(name, configConfig, wsCompression)
+	if err != nil {
+		return nil, err
+	}
+	roomSessions := room.NewRoomSessions(sendQueues)
+	directMessageSubscriber, err := room.NewDirectMessageSubscriber(configConfig, subscriber, roomSessions, httpLog)
+	if err != nil {
+		return nil, err
+	}
+	sessionHandler := room.NewSessionHandler(httpLog, roomServiceImpl, directMessageSubscriber, roomSessions)
+	rateLimiterMiddleware, err := room.NewRateLimiterMiddleware(configConfig, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	retentionWorker, err := room.NewRetentionWorker(configConfig, httpLog, roomRepo, messageRepo, webhookRepo, pollRepo, pinRepo, scheduledMessageRepo, inviteRepo, memberRepo, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	outboxRelay, err := room.NewOutboxRelay(configConfig, httpLog, messageRepo, roomPartitionPublisher, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	webhookSubscriber, err := room.NewKafkaWebhookSubscriber(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	webhookTopics := room.NewDirectWebhookTopics(configConfig)
+	webhookDispatcher, err := room.NewWebhookDispatcher(name, configConfig, httpLog, webhookSubscriber, webhookTopics, webhookCache)
+	if err != nil {
+		return nil, err
+	}
+	messageScheduler, err := room.NewMessageScheduler(configConfig, httpLog, roomServiceImpl, roomRepo, scheduledMessageRepo, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	httpServer := room.NewHttpServer(name, httpLog, engine, melodyConn, configConfig, roomServiceImpl, directMessageSubscriber, sessionHandler, rateLimiterMiddleware, retentionWorker, sendQueues, outboxRelay, webhookDispatcher, messageScheduler)
+	grpcLog, err := common.NewGrpcLog(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	grpcServer := room.NewGrpcServer(name, grpcLog, configConfig, roomServiceImpl, sessionHandler, sendQueues, rateLimiterMiddleware)
+	router := room.NewRouter(httpServer, grpcServer)
+	observabilityInjector := common.NewObservabilityInjector(configConfig)
+	server := common.NewServer(name, router, observabilityInjector)
+	return server, nil
+}
+
+func InitializeStandaloneRoomServer(name string) (*common.Server, error) {
+	configConfig, err := config.NewConfig()
+	if err != nil {
+		return nil, err
+	}
+	httpLog, err := common.NewHttpLog(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	engine := room.NewGinEngine(name, httpLog, configConfig)
+	wsCompression, err := room.NewWsCompression(name, configConfig)
+	if err != nil {
+		return nil, err
+	}
+	melodyConn := room.NewWebSocketConnection(wsCompression)
+	idGenerator, err := common.NewSonyFlake()
+	if err != nil {
+		return nil, err
+	}
+	storage, err := room.NewStorage(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	roomRepo := storage.RoomRepo
+	goChannel := infrastructure.NewGoChannel()
+	messagePublisherImpl, err := room.NewMessagePublisher(goChannel, configConfig)
+	if err != nil {
+		return nil, err
+	}
+	memoryCacheImpl := infrastructure.NewMemoryCache()
+	subscriberRepoImpl := subscriber.NewSubscriberRepo(memoryCacheImpl)
+	subscriberMessagePublisherImpl, err := subscriber.NewMessagePublisher(goChannel, configConfig)
+	if err != nil {
+		return nil, err
+	}
+	subscriberServiceImpl := subscriber.NewSubscriberService(subscriberRepoImpl, subscriberMessagePublisherImpl)
+	subscriberEndpoints := standalone.NewSubscriberEndpoints(subscriberServiceImpl)
+	messageRepo := storage.MessageRepo
+	universalClient, err := infrastructure.NewRedisClient(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	messageDeduplicator := room.NewMessageDeduplicator(configConfig, universalClient)
+	webhookRepo := storage.WebhookRepo
+	webhookCache := room.NewWebhookCache(configConfig, webhookRepo)
+	slashCommands := room.NewSlashCommands(configConfig, webhookCache)
+	pollRepo := storage.PollRepo
+	pinRepo := storage.PinRepo
+	scheduledMessageRepo := storage.ScheduledMessageRepo
+	inviteRepo := storage.InviteRepo
+	inviteSigner := room.NewInviteSigner(configConfig)
+	memberRepo := storage.MemberRepo
+	roomServiceImpl := room.NewRoomService(idGenerator, roomRepo, messagePublisherImpl, subscriberEndpoints, messageRepo, messageDeduplicator, webhookCache, slashCommands, pollRepo, pinRepo, scheduledMessageRepo, inviteRepo, inviteSigner, memberRepo)
+	router, err := infrastructure.NewBrokerRouter(name, configConfig, goChannel)
+	if err != nil {
+		return nil, err
+	}
+	sendQueues, err := room.NewSendQueues(name, configConfig, wsCompression)
+	if err != nil {
+		return nil, err
+	}
+	roomSessions := room.NewRoomSessions(sendQueues)
+	messageSubscriber, err := room.NewMessageSubscriber(router, configConfig, goChannel, roomSessions)
+	if err != nil {
+		return nil, err
+	}
+	sessionHandler := room.NewSessionHandler(httpLog, roomServiceImpl, messageSubscriber, roomSessions)
+	rateLimiterMiddleware, err := room.NewRateLimiterMiddleware(configConfig, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	retentionWorker, err := room.NewRetentionWorker(configConfig, httpLog, roomRepo, messageRepo, webhookRepo, pollRepo, pinRepo, scheduledMessageRepo, inviteRepo, memberRepo, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	outboxRelay, err := room.NewOutboxRelay(configConfig, httpLog, messageRepo, messagePublisherImpl, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	webhookSubscriber := room.NewGoChannelWebhookSubscriber(goChannel)
+	webhookTopics := room.NewWebhookTopics()
+	webhookDispatcher, err := room.NewWebhookDispatcher(name, configConfig, httpLog, webhookSubscriber, webhookTopics, webhookCache)
+	if err != nil {
+		return nil, err
+	}
+	messageScheduler, err := room.NewMessageScheduler(configConfig, httpLog, roomServiceImpl, roomRepo, scheduledMessageRepo, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	httpServer := room.NewHttpServer(name, httpLog, engine, melodyConn, configConfig, roomServiceImpl, messageSubscriber, sessionHandler, rateLimiterMiddleware, retentionWorker, sendQueues, outboxRelay, webhookDispatcher, messageScheduler)
+	grpcLog, err := common.NewGrpcLog(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	grpcServer := room.NewGrpcServer(name, grpcLog, configConfig, roomServiceImpl, sessionHandler, sendQueues, rateLimiterMiddleware)
+	subscriberMessageSubscriber, err := subscriber.NewMessageSubscriber(router, goChannel, subscriberServiceImpl, configConfig)
+	if err != nil {
+		return nil, err
+	}
+	standaloneRouter := standalone.NewRouter(httpServer, grpcServer, subscriberMessageSubscriber)
+	observabilityInjector := common.NewObservabilityInjector(configConfig)
+	server := common.NewServer(name, standaloneRouter, observabilityInjector)
+	return server, nil
+}
+
 func InitializeSubscriberServer(name string) (*common.Server, error) {
 	configConfig, err := config.NewConfig()
 	if err != nil {
@@ -92,9 +352,12 @@ func InitializeSubscriberServer(name string) (*common.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	messagePublisherImpl := subscriber.NewMessagePublisher(publisher)
+	messagePublisherImpl, err := subscriber.NewMessagePublisher(publisher, configConfig)
+	if err != nil {
+		return nil, err
+	}
 	subscriberServiceImpl := subscriber.NewSubscriberService(subscriberRepoImpl, messagePublisherImpl)
-	router, err := infrastructure.NewBrokerRouter(name)
+	router, err := infrastructure.NewBrokerRouter(name, configConfig, publisher)
 	if err != nil {
 		return nil, err
 	}
@@ -102,7 +365,7 @@ func InitializeSubscriberServer(name string) (*common.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	subscriberMessageSubscriber, err := subscriber.NewMessageSubscriber(router, messageSubscriber, subscriberServiceImpl)
+	subscriberMessageSubscriber, err := subscriber.NewMessageSubscriber(router, messageSubscriber, subscriberServiceImpl, configConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -112,3 +375,18 @@ func InitializeSubscriberServer(name string) (*common.Server, error) {
 	server := common.NewServer(name, subscriberRouter, observabilityInjector)
 	return server, nil
 }
+
+// wire.go:
+
+var roomSet = wire.NewSet(config.NewConfig, common.NewHttpLog, common.NewGrpcLog, common.NewSonyFlake, common.NewObservabilityInjector, infrastructure.NewRedisClient, room.NewMessageDeduplicator, room.NewRoomService, wire.Bind(new(room.RoomService), new(*room.RoomServiceImpl)), room.NewStorage, wire.FieldsOf(new(*room.Storage), "RoomRepo", "MessageRepo", "WebhookRepo", "PollRepo", "PinRepo", "ScheduledMessageRepo", "InviteRepo", "MemberRepo"), room.NewRetentionWorker, room.NewOutboxRelay, room.NewMessageScheduler, room.NewInviteSigner, room.NewWebhookCache, room.NewSlashCommands, room.NewWebhookDispatcher, room.NewWebSocketConnection, room.NewRoomSessions, room.NewSendQueues, room.NewWsCompression, room.NewGinEngine, room.NewRateLimiterMiddleware, room.NewSessionHandler, room.NewHttpServer, wire.Bind(new(common.HttpServer), new(*room.HttpServer)), room.NewGrpcServer, wire.Bind(new(common.GrpcServer), new(*room.GrpcServer)), common.NewServer)
+
+// distributedRoomSet connects the room service to Kafka and the gRPC subscriber service.
+var distributedRoomSet = wire.NewSet(infrastructure.NewKafkaPublisherWithPartitioning, infrastructure.NewKafkaSubscriber, room.NewKafkaWebhookSubscriber, room.NewWebhookTopics, room.NewMessagePublisher, wire.Bind(new(room.MessagePublisher), new(*room.MessagePublisherImpl)), infrastructure.NewBrokerRouter, room.NewMessageSubscriber, wire.Bind(new(room.RoomMessageSubscriber), new(*room.MessageSubscriber)), room.NewSubscriberGrpcClient, room.NewSubscriberEndpoints, room.NewRouter, wire.Bind(new(common.Router), new(*room.Router)))
+
+// directRoomSet publishes room messages to room partition topics consumed by the room instances
+// with sessions in the rooms, without the subscriber service.
+var directRoomSet = wire.NewSet(infrastructure.NewKafkaPublisherWithPartitioning, infrastructure.NewKafkaFanoutSubscriber, room.NewKafkaWebhookSubscriber, room.NewDirectWebhookTopics, room.NewRoomPartitionPublisher, wire.Bind(new(room.MessagePublisher), new(*room.RoomPartitionPublisher)), room.NewDirectMessageSubscriber, wire.Bind(new(room.RoomMessageSubscriber), new(*room.DirectMessageSubscriber)), room.NewDirectSubscriberEndpoints, room.NewRouter, wire.Bind(new(common.Router), new(*room.Router)))
+
+// standaloneRoomSet runs the subscriber service in-process on top of a GoChannel Pub/Sub
+// and keeps the room subscribers in memory.
+var standaloneRoomSet = wire.NewSet(infrastructure.NewGoChannel, wire.Bind(new(message.Publisher), new(*gochannel.GoChannel)), wire.Bind(new(message.Subscriber), new(*gochannel.GoChannel)), room.NewGoChannelWebhookSubscriber, room.NewWebhookTopics, room.NewMessagePublisher, wire.Bind(new(room.MessagePublisher), new(*room.MessagePublisherImpl)), infrastructure.NewBrokerRouter, room.NewMessageSubscriber, wire.Bind(new(room.RoomMessageSubscriber), new(*room.MessageSubscriber)), infrastructure.NewMemoryCache, wire.Bind(new(infrastructure.RedisCache), new(*infrastructure.MemoryCacheImpl)), subscriber.NewSubscriberRepo, wire.Bind(new(subscriber.SubscriberRepo), new(*subscriber.SubscriberRepoImpl)), subscriber.NewMessagePublisher, wire.Bind(new(subscriber.MessagePublisher), new(*subscriber.MessagePublisherImpl)), subscriber.NewSubscriberService, wire.Bind(new(subscriber.SubscriberService), new(*subscriber.SubscriberServiceImpl)), subscriber.NewMessageSubscriber, standalone.NewSubscriberEndpoints, standalone.NewRouter, wire.Bind(new(common.Router), new(*standalone.Router)))
@@ -5,9 +5,24 @@ import (
 )
 
 var (
-	ErrInvalidParam = errors.New("invalid parameter")
-	ErrServer       = errors.New("internal server error")
-	ErrRoomNotFound = errors.New("room not found")
+	ErrInvalidParam  = errors.New("invalid parameter")
+	ErrServer        = errors.New("internal server error")
+	ErrRoomNotFound  = errors.New("room not found")
+	ErrNotRoomOwner  = errors.New("only the room owner is allowed")
+	ErrNoSession     = errors.New("session not found")
+	ErrNoWebhook     = errors.New("webhook not found")
+	ErrNoMessage     = errors.New("message not found")
+	ErrNoPin         = errors.New("pin not found")
+	ErrTooManyPins   = errors.New("too many pinned messages")
+	ErrBadPassword   = errors.New("invalid password")
+	ErrNoScheduled   = errors.New("scheduled message not found")
+	ErrNoInvite      = errors.New("invite not found")
+	ErrNotPrivate    = errors.New("the room is not private")
+	ErrNotMember     = errors.New("only the room members are allowed")
+	ErrMemberExists  = errors.New("the user already is a member or requested to join")
+	ErrNoMember      = errors.New("member not found")
+	ErrNoJoinRequest = errors.New("join request not found")
+	ErrNoInvites     = errors.New("invites are disabled, room.invite.secret is not set")
 )
 
 // ErrResponse is the error response type
@@ -2,91 +2,232 @@ package common
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/omran95/chatroom/pkg/config"
 	"github.com/redis/go-redis/v9"
 )
 
 var rateLimitRedisKeyPrefix = "chat:ratelimit"
 
-var rateLimiterScript = `
-local tokenBucketKey = KEYS[1]
-local timestampKey = KEYS[2]
+const (
+	TokenBucketAlgorithm   = "token_bucket"
+	SlidingWindowAlgorithm = "sliding_window"
+	GCRAAlgorithm          = "gcra"
+)
+
+// Limiter decides whether a request identified by key may consume tokensRequired tokens.
+// When the request is denied, retryAfter is the number of seconds to wait before retrying.
+type Limiter interface {
+	Allow(ctx context.Context, key string, tokensRequired int) (allowed bool, retryAfter int, err error)
+}
+
+// All scripts receive the current time in milliseconds from the caller, so the
+// decision only depends on the arguments and the state stored under KEYS[1].
+
+// The bucket state (remaining tokens and last refill time) lives in a single hash.
+var tokenBucketScript = `
+local bucketKey = KEYS[1]
 
 local fillingRate = tonumber(ARGV[1])
 local bucketCapacity = tonumber(ARGV[2])
-
 local currentTime = tonumber(ARGV[3])
+local requestedTokens = tonumber(ARGV[4])
+
+local state = redis.call("hmget", bucketKey, "tokens", "ts")
+local remainingTokens = tonumber(state[1]) or bucketCapacity
+local lastRefreshTime = tonumber(state[2]) or currentTime
 
+local elapsedSeconds = math.max(0, currentTime - lastRefreshTime) / 1000
+local refillableTokens = math.min(bucketCapacity, remainingTokens + (elapsedSeconds * fillingRate))
+
+if refillableTokens >= requestedTokens then
+  local remainingTokensAfterRequest = refillableTokens - requestedTokens
+  -- a bucket is full again after (capacity - remaining) / rate seconds, after that the state is not needed
+  local expirationMillis = math.ceil((bucketCapacity - remainingTokensAfterRequest) / fillingRate * 1000)
+  redis.call("hset", bucketKey, "tokens", tostring(remainingTokensAfterRequest), "ts", tostring(currentTime))
+  redis.call("pexpire", bucketKey, math.max(1, expirationMillis))
+  return { 1, 0 }
+end
+
+local tokensNeeded = requestedTokens - refillableTokens
+return { 0, math.ceil(tokensNeeded / fillingRate * 1000) }
+`
+
+// The log keeps one sorted set member per consumed token, scored by its timestamp.
+var slidingWindowScript = `
+local logKey = KEYS[1]
+
+local limit = tonumber(ARGV[1])
+local windowMillis = tonumber(ARGV[2])
+local currentTime = tonumber(ARGV[3])
 local requestedTokens = tonumber(ARGV[4])
+local requestID = ARGV[5]
 
-local expirationSeconds = math.floor(tonumber(ARGV[5]))
+redis.call("zremrangebyscore", logKey, "-inf", currentTime - windowMillis)
+local consumedTokens = redis.call("zcard", logKey)
 
-local lastRefreshTime = tonumber(redis.call("get", timestampKey))
-if lastRefreshTime == nil then
-  lastRefreshTime = 0 -- Fallback for new users
+if consumedTokens + requestedTokens <= limit then
+  for i = 1, requestedTokens do
+    redis.call("zadd", logKey, currentTime, requestID .. ":" .. i)
+  end
+  redis.call("pexpire", logKey, windowMillis)
+  return { 1, 0 }
 end
 
-local remainingTokens = tonumber(redis.call("get", tokenBucketKey))
-if remainingTokens == nil then
-    remainingTokens = bucketCapacity
+if requestedTokens > limit then
+  return { 0, windowMillis }
 end
 
-local elapsedTime = math.max(0, currentTime - lastRefreshTime)
-local refillableTokens = math.min(bucketCapacity, remainingTokens + (elapsedTime * fillingRate))
+-- wait until enough of the oldest entries slide out of the window
+local tokensNeeded = consumedTokens + requestedTokens - limit
+local entry = redis.call("zrange", logKey, tokensNeeded - 1, tokensNeeded - 1, "withscores")
+return { 0, math.max(1, tonumber(entry[2]) + windowMillis - currentTime) }
+`
 
-local allowedRequest = refillableTokens >= requestedTokens
+// GCRA only stores the theoretical arrival time (TAT) of the next request.
+var gcraScript = `
+local tatKey = KEYS[1]
 
-if allowedRequest then
-  local remainingTokensAfterRequest = refillableTokens - requestedTokens
-  redis.call("setex", tokenBucketKey, expirationSeconds, remainingTokensAfterRequest)
-  redis.call("setex", timestampKey, expirationSeconds, currentTime)
-  return { allowedRequest, 0 }
-else
-  local tokensNeeded = math.abs(refillableTokens - requestedTokens)
-  local secondsUntilRetry = tokensNeeded / fillingRate
-  return { allowedRequest, secondsUntilRetry }
+local emissionInterval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local currentTime = tonumber(ARGV[3])
+local requestedTokens = tonumber(ARGV[4])
+
+local delayTolerance = emissionInterval * burst
+
+local tat = tonumber(redis.call("get", tatKey)) or currentTime
+tat = math.max(tat, currentTime)
+
+local newTat = tat + emissionInterval * requestedTokens
+local allowAt = newTat - delayTolerance
+
+if allowAt <= currentTime then
+  redis.call("set", tatKey, tostring(newTat), "px", math.max(1, math.ceil(newTat - currentTime)))
+  return { 1, 0 }
 end
+
+return { 0, math.ceil(allowAt - currentTime) }
 `
 
-type RateLimiter struct {
-	redisClient    redis.UniversalClient
+// NewLimiter creates the limiter selected by policy.Algorithm. Every algorithm shares the same
+// semantic: at most policy.Capacity tokens in a burst, refilled at policy.Rate tokens per second.
+func NewLimiter(redisClient redis.UniversalClient, policy config.RateLimitPolicy) (Limiter, error) {
+	if policy.Rate <= 0 || policy.Capacity <= 0 {
+		return nil, fmt.Errorf("invalid rate limit policy: rate %v, capacity %d", policy.Rate, policy.Capacity)
+	}
+	switch policy.Algorithm {
+	case TokenBucketAlgorithm, "":
+		return NewTokenBucketLimiter(redisClient, policy.Rate, policy.Capacity)
+	case SlidingWindowAlgorithm:
+		window := time.Duration(float64(policy.Capacity) / policy.Rate * float64(time.Second))
+		return NewSlidingWindowLimiter(redisClient, policy.Capacity, window)
+	case GCRAAlgorithm:
+		return NewGCRALimiter(redisClient, policy.Rate, policy.Capacity)
+	}
+	return nil, fmt.Errorf("unknown rate limit algorithm: %s", policy.Algorithm)
+}
+
+type redisScript struct {
+	redisClient redis.UniversalClient
+	scriptSHA   string
+	now         func() time.Time
+}
+
+func loadRedisScript(redisClient redis.UniversalClient, script string) (redisScript, error) {
+	scriptSHA, err := redisClient.ScriptLoad(context.Background(), script).Result()
+	if err != nil {
+		return redisScript{}, err
+	}
+	return redisScript{redisClient, scriptSHA, time.Now}, nil
+}
+
+// eval runs the script and converts its { allowed, retryAfterMillis } reply.
+func (script redisScript) eval(ctx context.Context, key string, args ...interface{}) (bool, int, error) {
+	response, err := script.redisClient.EvalSha(ctx, script.scriptSHA, []string{key}, args...).Result()
+	if err != nil {
+		return false, 0, err
+	}
+
+	result, _ := response.([]interface{})
+	if len(result) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limiter response: %v", response)
+	}
+	retryAfterMillis, _ := result[1].(int64)
+	retryAfter := int(math.Ceil(float64(retryAfterMillis) / 1000))
+	return result[0] == int64(1), retryAfter, nil
+}
+
+func (script redisScript) currentMillis() int64 {
+	return script.now().UnixMilli()
+}
+
+func formatRateLimitKey(key, algorithm string) string {
+	formattedKey := JoinStrings(rateLimitRedisKeyPrefix, ":", key)
+	return JoinStrings("{", formattedKey, "}", ":", algorithm)
+}
+
+type TokenBucketLimiter struct {
+	redisScript
 	FillingRate    float64
 	bucketCapacity int
-	expiration     time.Duration
-	scriptSHA      string
 }
 
-func NewRateLimiter(redisClient redis.UniversalClient, fillingRate float64, bucketCapacity int, expiration time.Duration) (*RateLimiter, error) {
-	scriptSHA, err := redisClient.ScriptLoad(context.Background(), rateLimiterScript).Result()
+func NewTokenBucketLimiter(redisClient redis.UniversalClient, fillingRate float64, bucketCapacity int) (*TokenBucketLimiter, error) {
+	script, err := loadRedisScript(redisClient, tokenBucketScript)
 	if err != nil {
 		return nil, err
 	}
+	return &TokenBucketLimiter{script, fillingRate, bucketCapacity}, nil
+}
 
-	return &RateLimiter{
-		redisClient:    redisClient,
-		FillingRate:    fillingRate,
-		bucketCapacity: bucketCapacity,
-		expiration:     expiration,
-		scriptSHA:      scriptSHA,
-	}, nil
+func (limiter *TokenBucketLimiter) Allow(ctx context.Context, key string, tokensRequired int) (bool, int, error) {
+	return limiter.eval(ctx, formatRateLimitKey(key, TokenBucketAlgorithm), limiter.FillingRate, limiter.bucketCapacity, limiter.currentMillis(), tokensRequired)
+}
 
+type SlidingWindowLimiter struct {
+	redisScript
+	limit  int
+	window time.Duration
 }
 
-func (rateLimiter *RateLimiter) Allow(ctx context.Context, key string, tokensRequired int) (bool, int, error) {
-	formattedKey := JoinStrings(rateLimitRedisKeyPrefix, ":", key)
-	tokenBucketKey := JoinStrings("{", formattedKey, "}", ":tokens")
-	timestampKey := JoinStrings("{", formattedKey, "}", ":ts")
+func NewSlidingWindowLimiter(redisClient redis.UniversalClient, limit int, window time.Duration) (*SlidingWindowLimiter, error) {
+	script, err := loadRedisScript(redisClient, slidingWindowScript)
+	if err != nil {
+		return nil, err
+	}
+	return &SlidingWindowLimiter{script, limit, window}, nil
+}
 
-	response, err := rateLimiter.redisClient.EvalSha(ctx, rateLimiter.scriptSHA, []string{tokenBucketKey, timestampKey}, rateLimiter.FillingRate, rateLimiter.bucketCapacity, time.Now().Unix(), tokensRequired, rateLimiter.expiration.Seconds()).Result()
+func (limiter *SlidingWindowLimiter) Allow(ctx context.Context, key string, tokensRequired int) (bool, int, error) {
+	// log entries of concurrent requests must not overwrite each other
+	requestID := strconv.FormatUint(rand.Uint64(), 36)
+	return limiter.eval(ctx, formatRateLimitKey(key, SlidingWindowAlgorithm), limiter.limit, limiter.window.Milliseconds(), limiter.currentMillis(), tokensRequired, requestID)
+}
+
+type GCRALimiter struct {
+	redisScript
+	emissionInterval time.Duration
+	burst            int
+}
+
+func NewGCRALimiter(redisClient redis.UniversalClient, rate float64, burst int) (*GCRALimiter, error) {
+	script, err := loadRedisScript(redisClient, gcraScript)
 	if err != nil {
-		return false, 0, err
+		return nil, err
 	}
+	emissionInterval := time.Duration(float64(time.Second) / rate)
+	return &GCRALimiter{script, emissionInterval, burst}, nil
+}
 
-	result, _ := response.([]interface{})
-	retryAfter, _ := result[1].(int64)
-	return result[0] == int64(1), int(retryAfter), nil
+func (limiter *GCRALimiter) Allow(ctx context.Context, key string, tokensRequired int) (bool, int, error) {
+	emissionMillis := float64(limiter.emissionInterval) / float64(time.Millisecond)
+	return limiter.eval(ctx, formatRateLimitKey(key, GCRAAlgorithm), emissionMillis, limiter.burst, limiter.currentMillis(), tokensRequired)
 }
 
 func JoinStrings(strs ...string) string {
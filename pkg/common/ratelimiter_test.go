@@ -0,0 +1,272 @@
+package common
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.now = clock.now.Add(d)
+}
+
+// newTestLimiter creates the limiter of policy on a fresh miniredis, reading the time from the returned clock.
+func newTestLimiter(t *testing.T, policy config.RateLimitPolicy) (Limiter, *fakeClock) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+
+	limiter, err := NewLimiter(redisClient, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.UnixMilli(1_700_000_000_000)}
+	switch limiter := limiter.(type) {
+	case *TokenBucketLimiter:
+		limiter.now = clock.Now
+	case *SlidingWindowLimiter:
+		limiter.now = clock.Now
+	case *GCRALimiter:
+		limiter.now = clock.Now
+	}
+	return limiter, clock
+}
+
+type limiterStep struct {
+	advance    time.Duration
+	tokens     int
+	allowed    bool
+	retryAfter int
+}
+
+func TestLimiters(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy config.RateLimitPolicy
+		steps  []limiterStep
+	}{
+		{
+			name:   "token bucket burst then refill",
+			policy: config.RateLimitPolicy{Algorithm: TokenBucketAlgorithm, Rate: 1, Capacity: 3},
+			steps: []limiterStep{
+				{0, 1, true, 0},
+				{0, 1, true, 0},
+				{0, 1, true, 0},
+				{0, 1, false, 1},
+				{999 * time.Millisecond, 1, false, 1},
+				{time.Millisecond, 1, true, 0},
+				{0, 1, false, 1},
+			},
+		},
+		{
+			name:   "token bucket does not refill above capacity",
+			policy: config.RateLimitPolicy{Algorithm: TokenBucketAlgorithm, Rate: 2, Capacity: 2},
+			steps: []limiterStep{
+				{time.Hour, 2, true, 0},
+				{0, 1, false, 1},
+				{time.Hour, 3, false, 1},
+				{0, 2, true, 0},
+			},
+		},
+		{
+			name:   "sliding window frees the oldest entries",
+			policy: config.RateLimitPolicy{Algorithm: SlidingWindowAlgorithm, Rate: 1, Capacity: 2},
+			steps: []limiterStep{
+				{0, 1, true, 0},
+				{500 * time.Millisecond, 1, true, 0},
+				{0, 1, false, 2},
+				{1499 * time.Millisecond, 1, false, 1},
+				{time.Millisecond, 1, true, 0},
+				{0, 1, false, 1},
+				{500 * time.Millisecond, 1, true, 0},
+				{0, 1, false, 2},
+			},
+		},
+		{
+			name:   "sliding window rejects requests above the limit",
+			policy: config.RateLimitPolicy{Algorithm: SlidingWindowAlgorithm, Rate: 1, Capacity: 2},
+			steps: []limiterStep{
+				{0, 3, false, 2},
+				{0, 2, true, 0},
+			},
+		},
+		{
+			name:   "gcra burst then one request per emission interval",
+			policy: config.RateLimitPolicy{Algorithm: GCRAAlgorithm, Rate: 2, Capacity: 2},
+			steps: []limiterStep{
+				{0, 1, true, 0},
+				{0, 1, true, 0},
+				{0, 1, false, 1},
+				{499 * time.Millisecond, 1, false, 1},
+				{time.Millisecond, 1, true, 0},
+				{0, 1, false, 1},
+				{10 * time.Second, 2, true, 0},
+				{0, 1, false, 1},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter, clock := newTestLimiter(t, test.policy)
+			for i, step := range test.steps {
+				clock.Advance(step.advance)
+				allowed, retryAfter, err := limiter.Allow(context.Background(), "key", step.tokens)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if allowed != step.allowed || retryAfter != step.retryAfter {
+					t.Fatalf("step %d: got allowed %v, retry after %d, want %v, %d", i, allowed, retryAfter, step.allowed, step.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitersIsolateKeys(t *testing.T) {
+	for _, algorithm := range []string{TokenBucketAlgorithm, SlidingWindowAlgorithm, GCRAAlgorithm} {
+		limiter, _ := newTestLimiter(t, config.RateLimitPolicy{Algorithm: algorithm, Rate: 1, Capacity: 1})
+		for _, key := range []string{"a", "b"} {
+			if allowed, _, err := limiter.Allow(context.Background(), key, 1); err != nil || !allowed {
+				t.Fatalf("%s: key %s denied: %v", algorithm, key, err)
+			}
+		}
+		if allowed, _, _ := limiter.Allow(context.Background(), "a", 1); allowed {
+			t.Fatalf("%s: key a allowed twice", algorithm)
+		}
+	}
+}
+
+func TestNewLimiterRejectsInvalidPolicies(t *testing.T) {
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer redisClient.Close()
+	for _, policy := range []config.RateLimitPolicy{
+		{Algorithm: TokenBucketAlgorithm, Rate: 0, Capacity: 1},
+		{Algorithm: GCRAAlgorithm, Rate: 1, Capacity: 0},
+		{Algorithm: "leaky_bucket", Rate: 1, Capacity: 1},
+	} {
+		if _, err := NewLimiter(redisClient, policy); err == nil {
+			t.Errorf("policy %+v was accepted", policy)
+		}
+	}
+}
+
+// limiterModel is the in-memory reference of an algorithm, it returns the decision and the retry
+// delay in milliseconds like the scripts.
+type limiterModel interface {
+	allow(nowMillis float64, tokens int) (bool, float64)
+}
+
+type tokenBucketModel struct {
+	rate, capacity float64
+	tokens, ts     float64
+	initialized    bool
+}
+
+func (model *tokenBucketModel) allow(now float64, tokens int) (bool, float64) {
+	if !model.initialized {
+		model.tokens, model.ts, model.initialized = model.capacity, now, true
+	}
+	refilled := math.Min(model.capacity, model.tokens+math.Max(0, now-model.ts)/1000*model.rate)
+	if refilled >= float64(tokens) {
+		model.tokens, model.ts = refilled-float64(tokens), now
+		return true, 0
+	}
+	return false, math.Ceil((float64(tokens) - refilled) / model.rate * 1000)
+}
+
+type slidingWindowModel struct {
+	limit  int
+	window float64
+	log    []float64
+}
+
+func (model *slidingWindowModel) allow(now float64, tokens int) (bool, float64) {
+	live := model.log[:0]
+	for _, ts := range model.log {
+		if ts > now-model.window {
+			live = append(live, ts)
+		}
+	}
+	model.log = live
+	if len(model.log)+tokens <= model.limit {
+		for i := 0; i < tokens; i++ {
+			model.log = append(model.log, now)
+		}
+		return true, 0
+	}
+	if tokens > model.limit {
+		return false, model.window
+	}
+	sort.Float64s(model.log)
+	oldest := model.log[len(model.log)+tokens-model.limit-1]
+	return false, math.Max(1, oldest+model.window-now)
+}
+
+type gcraModel struct {
+	emissionInterval, burst float64
+	tat                     float64
+}
+
+func (model *gcraModel) allow(now float64, tokens int) (bool, float64) {
+	tat := math.Max(model.tat, now)
+	newTat := tat + model.emissionInterval*float64(tokens)
+	allowAt := newTat - model.emissionInterval*model.burst
+	if allowAt <= now {
+		model.tat = newTat
+		return true, 0
+	}
+	return false, math.Ceil(allowAt - now)
+}
+
+// TestLimitersMatchModel replays random traffic under simulated time against every algorithm and
+// its reference model. Time advances in steps of 125ms, so the refilled amounts are exact floats.
+func TestLimitersMatchModel(t *testing.T) {
+	const rate, capacity = 4, 5
+	models := map[string]func() limiterModel{
+		TokenBucketAlgorithm: func() limiterModel {
+			return &tokenBucketModel{rate: rate, capacity: capacity}
+		},
+		SlidingWindowAlgorithm: func() limiterModel {
+			return &slidingWindowModel{limit: capacity, window: capacity * 1000 / rate}
+		},
+		GCRAAlgorithm: func() limiterModel {
+			return &gcraModel{emissionInterval: 1000 / rate, burst: capacity}
+		},
+	}
+	for algorithm, newModel := range models {
+		t.Run(algorithm, func(t *testing.T) {
+			limiter, clock := newTestLimiter(t, config.RateLimitPolicy{Algorithm: algorithm, Rate: rate, Capacity: capacity})
+			model := newModel()
+			random := rand.New(rand.NewPCG(1, 2))
+			for i := 0; i < 2000; i++ {
+				clock.Advance(time.Duration(random.IntN(4)) * 125 * time.Millisecond)
+				tokens := 1 + random.IntN(3)
+				allowed, retryAfter, err := limiter.Allow(context.Background(), "key", tokens)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantAllowed, wantRetryMillis := model.allow(float64(clock.now.UnixMilli()), tokens)
+				wantRetryAfter := int(math.Ceil(wantRetryMillis / 1000))
+				if allowed != wantAllowed || retryAfter != wantRetryAfter {
+					t.Fatalf("request %d of %d tokens: got allowed %v, retry after %d, model %v, %d", i, tokens, allowed, retryAfter, wantAllowed, wantRetryAfter)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"errors"
+	"time"
 
 	"github.com/sony/sonyflake"
 )
@@ -11,6 +12,9 @@ type IDGenerator interface {
 	NextID() (uint64, error)
 }
 
+// snowFlakeStartTime is the sonyflake default start time, IDs are generated with the default settings.
+var snowFlakeStartTime = time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC)
+
 func NewSonyFlake() (IDGenerator, error) {
 	var settings sonyflake.Settings
 	snowFlake := sonyflake.NewSonyflake(settings)
@@ -19,3 +23,19 @@ func NewSonyFlake() (IDGenerator, error) {
 	}
 	return snowFlake, nil
 }
+
+// MinIDAt returns the smallest ID that can be generated at t, so IDs can be used as a time range.
+func MinIDAt(t time.Time) uint64 {
+	if t.Before(snowFlakeStartTime) {
+		return 0
+	}
+	// sonyflake time unit is 10 msec
+	elapsed := uint64(t.Sub(snowFlakeStartTime) / (10 * time.Millisecond))
+	return elapsed << (sonyflake.BitLenSequence + sonyflake.BitLenMachineID)
+}
+
+// IDTime returns the time an ID was generated at, to the sonyflake time unit.
+func IDTime(id uint64) time.Time {
+	elapsed := id >> (sonyflake.BitLenSequence + sonyflake.BitLenMachineID)
+	return snowFlakeStartTime.Add(time.Duration(elapsed) * 10 * time.Millisecond)
+}
@@ -10,6 +10,7 @@ import (
 type Config struct {
 	Room          *RoomConfig          `mapstructure:"room"`
 	Subscriber    *SubscriberConfig    `mapstructure:"subscriber"`
+	Storage       *StorageConfig       `mapstructure:"storage"`
 	Cassandra     *CassandraConfig     `mapstructure:"cassandra"`
 	Redis         *RedisConfig         `mapstructure:"redis"`
 	Kafka         *KafkaConfig         `mapstructure:"kafka"`
@@ -26,13 +27,112 @@ type RoomConfig struct {
 	MessageSubscriber struct {
 		Topic string
 	}
+	// DirectFanout is used by the direct mode, room messages are published to Partitions room partition topics
+	DirectFanout struct {
+		Partitions int
+	}
 	Grpc struct {
+		// Server serves the RoomService API next to the HTTP server
+		Server struct {
+			Port string
+		}
 		Client struct {
 			Subscriber struct {
 				Endpoint string
 			}
 		}
 	}
+	RateLimit struct {
+		CreateRoom RateLimitPolicy
+		// JoinRequest limits the unauthenticated join requests to private rooms
+		JoinRequest RateLimitPolicy
+	}
+	// SendQueue bounds the outbound messages of a session, OverflowPolicy is one of
+	// drop_oldest, drop_typing (typing events first, then the oldest) or disconnect.
+	SendQueue struct {
+		Capacity       int
+		OverflowPolicy string
+	}
+	// Compression negotiates permessage-deflate with the websocket clients offering it, messages
+	// of at least ThresholdBytes are compressed at Level (1 fastest to 9 smallest, -2 huffman only)
+	Compression struct {
+		Enabled        bool
+		ThresholdBytes int
+		Level          int
+	}
+	// Fallback configures the SSE and long polling transports for clients that cannot open a
+	// websocket. Long polling sessions not polled for SessionIdleSecond are closed.
+	Fallback struct {
+		PollTimeoutSecond int64
+		SessionIdleSecond int64
+		KeepAliveSecond   int64
+	}
+	// Dedup drops text messages resent with the same client_msg_id within WindowSecond,
+	// and messages redelivered to a session among its last SessionWindow messages
+	Dedup struct {
+		WindowSecond  int64
+		SessionWindow int
+	}
+	// Outbox relays stored messages older than GraceSecond whose publish did not complete,
+	// records older than LookbackHour are no longer relayed and deleted. A round holds a lock for
+	// LockSecond, renewed while it runs.
+	Outbox struct {
+		IntervalSecond int64
+		GraceSecond    int64
+		LookbackHour   int64
+		LockSecond     int64
+	}
+	// Webhook configures the outgoing webhook deliveries, consumed in ConsumerGroup and retried
+	// Retries times, and the slash command handlers. Room webhooks are cached for CacheSecond.
+	// Every outgoing webhook queues at most QueueSize messages, the next ones are dropped. Webhooks
+	// resolving to private, loopback or link-local addresses are refused unless AllowPrivateNetworks.
+	// The /giphy command searches with GiphyAPIKey, without it it replies with a search link.
+	Webhook struct {
+		ConsumerGroup             string
+		TimeoutMilliSecond        int64
+		Retries                   int
+		CommandTimeoutMilliSecond int64
+		CacheSecond               int64
+		QueueSize                 int
+		AllowPrivateNetworks      bool
+		GiphyAPIKey               string
+	}
+	// Scheduler fires the scheduled messages every IntervalSecond on the instance holding the leader
+	// lease for LeaseSecond. A message failing MaxAttempts times is dropped, messages due more than
+	// LookbackHour ago are no longer fired and deleted, and messages are scheduled at most
+	// MaxDelayDay ahead.
+	Scheduler struct {
+		IntervalSecond int64
+		LeaseSecond    int64
+		LookbackHour   int64
+		MaxDelayDay    int64
+		MaxAttempts    int
+	}
+	// Invite signs the room invite tokens with Secret, which is shared by all room instances and
+	// enables the invites. Invites expire after DefaultTTLHour unless created with another lifetime of at
+	// most MaxTTLHour.
+	Invite struct {
+		Secret         string
+		DefaultTTLHour int64
+		MaxTTLHour     int64
+	}
+	// Retention runs every IntervalMinute on a single instance, holding a lock for LockSecond
+	// renewed while the round runs.
+	Retention struct {
+		IntervalMinute int64
+		LockSecond     int64
+		// rooms without messages or joins for this long are deleted, 0 disables the expiry
+		InactiveRoomExpirationHour int64
+	}
+}
+
+// RateLimitPolicy allows bursts of Capacity tokens refilled at Rate tokens per second,
+// a request costs Cost tokens. Algorithm is one of token_bucket, sliding_window or gcra.
+type RateLimitPolicy struct {
+	Algorithm string
+	Rate      float64
+	Capacity  int
+	Cost      int
 }
 
 type SubscriberConfig struct {
@@ -41,6 +141,25 @@ type SubscriberConfig struct {
 			Port string
 		}
 	}
+	// Publish controls the fan-out to the room instance topics, messages waiting for the same
+	// topic are sent as one batch of at most MaxBatchSize. A topic still failing after Retries is
+	// sent the message through RetryTopic, whose handler retries it like the other handlers.
+	Publish struct {
+		Parallelism             int
+		MaxBatchSize            int
+		Retries                 int
+		RetryBackoffMilliSecond int64
+		RetryTopic              string
+	}
+}
+
+// StorageConfig selects where rooms and messages are persisted,
+// Driver is one of cassandra, sqlite or postgres.
+type StorageConfig struct {
+	Driver string
+	SQL    struct {
+		DSN string
+	}
 }
 
 type CassandraConfig struct {
@@ -49,6 +168,8 @@ type CassandraConfig struct {
 	User     string
 	Password string
 	Keyspace string
+	// ReplicationFactor is used when the migrate command creates the keyspace
+	ReplicationFactor int
 }
 
 type RedisConfig struct {
@@ -69,6 +190,19 @@ type KafkaConfig struct {
 		NumPartitions     int32
 		ReplicationFactor int16
 	}
+	// PayloadFormat encodes the published messages as protobuf or json, both formats are decoded
+	PayloadFormat string
+	// Retry retries failing message handlers with exponential backoff before the message is
+	// moved to the PoisonQueue topic
+	Retry struct {
+		MaxRetries                 int
+		InitialIntervalMilliSecond int64
+		MaxIntervalMilliSecond     int64
+	}
+	PoisonQueue struct {
+		Topic         string
+		ConsumerGroup string
+	}
 }
 
 type ObservabilityConfig struct {
@@ -84,15 +218,67 @@ func applyDefaultValues() {
 	viper.SetDefault("room.http.server.port", "3000")
 	viper.SetDefault("room.http.server.maxConn", 20000)
 	viper.SetDefault("room.messageSubscriber.topic", "room.msg.subscriber."+os.Getenv("HOSTNAME"))
+	viper.SetDefault("room.directFanout.partitions", 16)
+	viper.SetDefault("room.grpc.server.port", "4000")
 	viper.SetDefault("room.grpc.client.subscriber.endpoint", "localhost:5000")
+	viper.SetDefault("room.rateLimit.createRoom.algorithm", "token_bucket")
+	viper.SetDefault("room.rateLimit.createRoom.rate", 1)
+	viper.SetDefault("room.rateLimit.createRoom.capacity", 30)
+	viper.SetDefault("room.rateLimit.createRoom.cost", 10)
+	viper.SetDefault("room.rateLimit.joinRequest.algorithm", "token_bucket")
+	viper.SetDefault("room.rateLimit.joinRequest.rate", 1)
+	viper.SetDefault("room.rateLimit.joinRequest.capacity", 30)
+	viper.SetDefault("room.rateLimit.joinRequest.cost", 10)
+	viper.SetDefault("room.sendQueue.capacity", 256)
+	viper.SetDefault("room.sendQueue.overflowPolicy", "drop_typing")
+	viper.SetDefault("room.compression.enabled", true)
+	viper.SetDefault("room.compression.thresholdBytes", 512)
+	viper.SetDefault("room.compression.level", 1)
+	viper.SetDefault("room.fallback.pollTimeoutSecond", 25)
+	viper.SetDefault("room.fallback.sessionIdleSecond", 60)
+	viper.SetDefault("room.fallback.keepAliveSecond", 15)
+	viper.SetDefault("room.dedup.windowSecond", 300)
+	viper.SetDefault("room.dedup.sessionWindow", 256)
+	viper.SetDefault("room.outbox.intervalSecond", 5)
+	viper.SetDefault("room.outbox.graceSecond", 10)
+	viper.SetDefault("room.outbox.lookbackHour", 24)
+	viper.SetDefault("room.outbox.lockSecond", 60)
+	viper.SetDefault("room.webhook.consumerGroup", "chat.msg.webhook")
+	viper.SetDefault("room.webhook.timeoutMilliSecond", 5000)
+	viper.SetDefault("room.webhook.retries", 2)
+	viper.SetDefault("room.webhook.commandTimeoutMilliSecond", 3000)
+	viper.SetDefault("room.webhook.cacheSecond", 30)
+	viper.SetDefault("room.webhook.queueSize", 256)
+	viper.SetDefault("room.webhook.allowPrivateNetworks", false)
+	viper.SetDefault("room.webhook.giphyAPIKey", "")
+	viper.SetDefault("room.scheduler.intervalSecond", 1)
+	viper.SetDefault("room.scheduler.leaseSecond", 15)
+	viper.SetDefault("room.scheduler.lookbackHour", 24)
+	viper.SetDefault("room.scheduler.maxDelayDay", 30)
+	viper.SetDefault("room.scheduler.maxAttempts", 5)
+	viper.SetDefault("room.invite.secret", "")
+	viper.SetDefault("room.invite.defaultTTLHour", 24)
+	viper.SetDefault("room.invite.maxTTLHour", 720)
+	viper.SetDefault("room.retention.intervalMinute", 10)
+	viper.SetDefault("room.retention.lockSecond", 60)
+	viper.SetDefault("room.retention.inactiveRoomExpirationHour", 0)
 
 	viper.SetDefault("subscriber.grpc.server.port", "5000")
+	viper.SetDefault("subscriber.publish.parallelism", 16)
+	viper.SetDefault("subscriber.publish.maxBatchSize", 100)
+	viper.SetDefault("subscriber.publish.retries", 3)
+	viper.SetDefault("subscriber.publish.retryBackoffMilliSecond", 100)
+	viper.SetDefault("subscriber.publish.retryTopic", "chat.msg.subscriber.retry")
+
+	viper.SetDefault("storage.driver", "cassandra")
+	viper.SetDefault("storage.sql.dsn", "chatroom.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
 
 	viper.SetDefault("cassandra.hosts", "localhost")
 	viper.SetDefault("cassandra.port", 9042)
 	viper.SetDefault("cassandra.user", "billy")
 	viper.SetDefault("cassandra.password", "p@ssword")
 	viper.SetDefault("cassandra.keyspace", "chatroom")
+	viper.SetDefault("cassandra.replicationFactor", 1)
 
 	viper.SetDefault("redis.password", "redis_cluster_password")
 	viper.SetDefault("redis.addrs", "localhost:6379,localhost:6380,localhost:6381,localhost:6382,localhost:6383")
@@ -104,9 +290,15 @@ func applyDefaultValues() {
 
 	viper.SetDefault("kafka.addrs", "localhost:9092")
 	viper.SetDefault("kafka.version", "1.0.0")
+	viper.SetDefault("kafka.payloadFormat", "protobuf")
 	viper.SetDefault("kafka.subscriber.consumerGroup", watermill.NewUUID())
 	viper.SetDefault("kafka.subscriber.numPartitions", 1)
 	viper.SetDefault("kafka.subscriber.replicationFactor", 2)
+	viper.SetDefault("kafka.retry.maxRetries", 5)
+	viper.SetDefault("kafka.retry.initialIntervalMilliSecond", 100)
+	viper.SetDefault("kafka.retry.maxIntervalMilliSecond", 10000)
+	viper.SetDefault("kafka.poisonQueue.topic", "chat.msg.poison")
+	viper.SetDefault("kafka.poisonQueue.consumerGroup", "chat.msg.poison.cli")
 
 	viper.SetDefault("observability.prometheus.port", "")
 	viper.SetDefault("observability.Tracing.URL", "localhost:4318")
@@ -9,9 +9,21 @@ import (
 var CassandraSession *gocql.Session
 
 func NewCassandraSession(config *config.Config) (*gocql.Session, error) {
+	cluster := newCassandraCluster(config)
+	cluster.Keyspace = config.Cassandra.Keyspace
+	CassandraSession, err := cluster.CreateSession()
+	return CassandraSession, err
+}
+
+// NewCassandraAdminSession creates a session that is not bound to the keyspace,
+// so it can be used before the keyspace exists.
+func NewCassandraAdminSession(config *config.Config) (*gocql.Session, error) {
+	return newCassandraCluster(config).CreateSession()
+}
+
+func newCassandraCluster(config *config.Config) *gocql.ClusterConfig {
 	cluster := gocql.NewCluster(common.GetServerAddrs(config.Cassandra.Hosts)...)
 	cluster.Port = config.Cassandra.Port
-	cluster.Keyspace = config.Cassandra.Keyspace
 	cluster.Consistency = gocql.Quorum
 	cluster.RetryPolicy = &gocql.SimpleRetryPolicy{
 		NumRetries: 3,
@@ -23,6 +35,5 @@ func NewCassandraSession(config *config.Config) (*gocql.Session, error) {
 	cluster.DefaultIdempotence = false
 	// number of connections per host
 	cluster.NumConns = 3
-	CassandraSession, err := cluster.CreateSession()
-	return CassandraSession, err
+	return cluster
 }
@@ -0,0 +1,221 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+const schemaVersionTable = "schema_version"
+
+// CassandraMigration is one versioned CQL file, e.g. 0001_create_rooms.cql.
+type CassandraMigration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// CassandraMigrator applies embedded CQL migrations to a keyspace and records them in schema_version.
+// Listing the applied and pending migrations works with a session that is not bound to the keyspace,
+// even before the keyspace exists, applying them needs a session bound to it.
+type CassandraMigrator struct {
+	session    *gocql.Session
+	keyspace   string
+	migrations []CassandraMigration
+}
+
+// LoadCassandraMigrations reads the *.cql files of migrations ordered by version.
+func LoadCassandraMigrations(migrations fs.FS) ([]CassandraMigration, error) {
+	files, err := fs.Glob(migrations, "*.cql")
+	if err != nil {
+		return nil, err
+	}
+	var result []CassandraMigration
+	versions := map[int]string{}
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".cql")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %s: %w", file, err)
+		}
+		if other, exists := versions[version]; exists {
+			return nil, fmt.Errorf("duplicate migration version %d: %s and %s", version, other, name)
+		}
+		versions[version] = name
+
+		script, err := fs.ReadFile(migrations, file)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, CassandraMigration{version, name, splitCQLStatements(string(script))})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+	return result, nil
+}
+
+// splitCQLStatements splits a script on the semicolons ending its statements, after removing the
+// comment lines. Semicolons inside string literals are not supported.
+func splitCQLStatements(script string) []string {
+	var code strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			code.WriteString(line + "\n")
+		}
+	}
+	var statements []string
+	for _, stmt := range strings.Split(code.String(), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
+
+func NewCassandraMigrator(session *gocql.Session, keyspace string, migrations []CassandraMigration) *CassandraMigrator {
+	return &CassandraMigrator{session, keyspace, migrations}
+}
+
+// CreateKeyspace creates the keyspace if it does not exist, the session must not be bound to a keyspace.
+func CreateKeyspace(ctx context.Context, session *gocql.Session, keyspace string, replicationFactor int) error {
+	query := fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': 'SimpleStrategy', 'replication_factor': %d}", keyspace, replicationFactor)
+	return session.Query(query).WithContext(ctx).Exec()
+}
+
+// Applied returns the applied migration versions with their apply time.
+func (migrator *CassandraMigrator) Applied(ctx context.Context) (map[int]time.Time, error) {
+	applied := map[int]time.Time{}
+	exists, err := migrator.schemaVersionExists(ctx)
+	if err != nil || !exists {
+		return applied, err
+	}
+	var (
+		version   int
+		appliedAt time.Time
+	)
+	iter := migrator.session.Query("SELECT version, applied_at FROM " + migrator.schemaVersionTable()).WithContext(ctx).Idempotent(true).Iter()
+	for iter.Scan(&version, &appliedAt) {
+		applied[version] = appliedAt
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func (migrator *CassandraMigrator) Pending(ctx context.Context) ([]CassandraMigration, error) {
+	applied, err := migrator.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pendingMigrations(migrator.migrations, applied), nil
+}
+
+func pendingMigrations(migrations []CassandraMigration, applied map[int]time.Time) []CassandraMigration {
+	var pending []CassandraMigration
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+// Status writes every migration with its state to out.
+func (migrator *CassandraMigrator) Status(ctx context.Context, out io.Writer) error {
+	applied, err := migrator.Applied(ctx)
+	if err != nil {
+		return err
+	}
+	writeStatus(out, migrator.migrations, applied)
+	return nil
+}
+
+func writeStatus(out io.Writer, migrations []CassandraMigration, applied map[int]time.Time) {
+	for _, migration := range migrations {
+		state := "pending"
+		if appliedAt, ok := applied[migration.Version]; ok {
+			state = "applied at " + appliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "%04d %-40s %s\n", migration.Version, migration.Name, state)
+	}
+}
+
+// Up applies the pending migrations in order. With dryRun the statements are only written to out.
+func (migrator *CassandraMigrator) Up(ctx context.Context, dryRun bool, out io.Writer) error {
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintln(out, "schema is up to date")
+		return nil
+	}
+	if dryRun {
+		writeMigrations(out, pending)
+		return nil
+	}
+	if err := migrator.createSchemaVersionTable(ctx); err != nil {
+		return err
+	}
+	for _, migration := range pending {
+		fmt.Fprintf(out, "-- %04d %s\n", migration.Version, migration.Name)
+		for _, stmt := range migration.Statements {
+			// cassandra DDL is not transactional, migrations should be written with IF [NOT] EXISTS to be re-runnable
+			if err := migrator.session.Query(stmt).WithContext(ctx).Exec(); err != nil {
+				return fmt.Errorf("error applying migration %04d %s: %w", migration.Version, migration.Name, err)
+			}
+		}
+		insert := "INSERT INTO " + migrator.schemaVersionTable() + " (version, name, applied_at) VALUES (?, ?, ?)"
+		if err := migrator.session.Query(insert, migration.Version, migration.Name, time.Now()).WithContext(ctx).Exec(); err != nil {
+			return fmt.Errorf("error recording migration %04d %s: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// writeMigrations writes the statements of the migrations as the dry run of Up.
+func writeMigrations(out io.Writer, migrations []CassandraMigration) {
+	for _, migration := range migrations {
+		fmt.Fprintf(out, "-- %04d %s\n", migration.Version, migration.Name)
+		for _, stmt := range migration.Statements {
+			fmt.Fprintln(out, stmt+";")
+		}
+	}
+}
+
+func (migrator *CassandraMigrator) createSchemaVersionTable(ctx context.Context) error {
+	query := "CREATE TABLE IF NOT EXISTS " + migrator.schemaVersionTable() + " (version int, name text, applied_at timestamp, PRIMARY KEY (version))"
+	return migrator.session.Query(query).WithContext(ctx).Exec()
+}
+
+// schemaVersionTable is qualified by the keyspace, the session may not be bound to it.
+func (migrator *CassandraMigrator) schemaVersionTable() string {
+	return migrator.keyspace + "." + schemaVersionTable
+}
+
+// schemaVersionExists is false on a fresh keyspace, or before the keyspace is created, where nothing is applied.
+func (migrator *CassandraMigrator) schemaVersionExists(ctx context.Context) (bool, error) {
+	var tableName string
+	err := migrator.session.Query(
+		"SELECT table_name FROM system_schema.tables WHERE keyspace_name = ? AND table_name = ?",
+		strings.ToLower(migrator.keyspace), schemaVersionTable,
+	).WithContext(ctx).Idempotent(true).Scan(&tableName)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,82 @@
+package infrastructure
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestLoadCassandraMigrations(t *testing.T) {
+	migrations, err := LoadCassandraMigrations(fstest.MapFS{
+		"0010_add_column.cql":    {Data: []byte("ALTER TABLE rooms ADD name text;")},
+		"0002_create_tables.cql": {Data: []byte("-- the tables; with a comment\nCREATE TABLE a (id int PRIMARY KEY);\n\nCREATE TABLE b (id int PRIMARY KEY);\n")},
+		"0001_init.cql":          {Data: []byte("CREATE TABLE rooms (id int PRIMARY KEY)")},
+		"README.md":              {Data: []byte("not a migration;")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, migration := range migrations {
+		names = append(names, migration.Name)
+	}
+	if want := []string{"0001_init", "0002_create_tables", "0010_add_column"}; !slices.Equal(names, want) {
+		t.Fatalf("migrations %v, want %v ordered by version", names, want)
+	}
+	if versions := []int{migrations[0].Version, migrations[1].Version, migrations[2].Version}; !slices.Equal(versions, []int{1, 2, 10}) {
+		t.Fatalf("versions %v", versions)
+	}
+	want := []string{"CREATE TABLE a (id int PRIMARY KEY)", "CREATE TABLE b (id int PRIMARY KEY)"}
+	if !slices.Equal(migrations[1].Statements, want) {
+		t.Fatalf("statements %q, want %q", migrations[1].Statements, want)
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"invalid name":      {"init.cql": {Data: []byte("CREATE TABLE a (id int PRIMARY KEY);")}},
+		"duplicate version": {"0001_a.cql": {}, "0001_b.cql": {}},
+	} {
+		if _, err := LoadCassandraMigrations(fsys); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	migrations := []CassandraMigration{{Version: 1, Name: "0001_init"}, {Version: 2, Name: "0002_tables"}, {Version: 3, Name: "0003_column"}}
+	appliedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	applied := map[int]time.Time{1: appliedAt, 3: appliedAt}
+	pending := pendingMigrations(migrations, applied)
+	if len(pending) != 1 || pending[0].Version != 2 {
+		t.Fatalf("pending %v, want the unapplied version 2", pending)
+	}
+	if pending := pendingMigrations(migrations, map[int]time.Time{}); len(pending) != 3 {
+		t.Fatalf("%d pending on a fresh keyspace", len(pending))
+	}
+
+	var status bytes.Buffer
+	writeStatus(&status, migrations, applied)
+	lines := strings.Split(strings.TrimSpace(status.String()), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], "applied at 2024-01-02T03:04:05Z") || !strings.HasSuffix(lines[1], "pending") {
+		t.Fatalf("status:\n%s", status.String())
+	}
+}
+
+func TestDryRunOutput(t *testing.T) {
+	var out bytes.Buffer
+	writeMigrations(&out, []CassandraMigration{
+		{Version: 2, Name: "0002_tables", Statements: []string{"CREATE TABLE a (id int PRIMARY KEY)", "CREATE TABLE b (id int PRIMARY KEY)"}},
+		{Version: 3, Name: "0003_column", Statements: []string{"ALTER TABLE a ADD name text"}},
+	})
+	want := `-- 0002 0002_tables
+CREATE TABLE a (id int PRIMARY KEY);
+CREATE TABLE b (id int PRIMARY KEY);
+-- 0003 0003_column
+ALTER TABLE a ADD name text;
+`
+	if out.String() != want {
+		t.Fatalf("dry run:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
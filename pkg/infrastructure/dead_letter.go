@@ -0,0 +1,153 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+)
+
+// DeadLetter is a message moved to the poison queue, its metadata carries the failure.
+type DeadLetter struct {
+	Partition int32
+	Offset    int64
+	Message   *message.Message
+}
+
+// DeadLetterQueue reads the poison queue topic. The consumer group offsets mark the dead letters
+// that were replayed or purged, inspecting does not move them.
+type DeadLetterQueue struct {
+	client sarama.Client
+	topic  string
+	group  string
+}
+
+func NewDeadLetterQueue(config *config.Config) (*DeadLetterQueue, error) {
+	saramaConfig := sarama.NewConfig()
+	saramaVersion, err := sarama.ParseKafkaVersion(config.Kafka.Version)
+	if err != nil {
+		return nil, err
+	}
+	saramaConfig.Version = saramaVersion
+	saramaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	saramaConfig.Consumer.Offsets.AutoCommit.Enable = false
+
+	client, err := sarama.NewClient(common.GetServerAddrs(config.Kafka.Addrs), saramaConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterQueue{client, config.Kafka.PoisonQueue.Topic, config.Kafka.PoisonQueue.ConsumerGroup}, nil
+}
+
+func (dlq *DeadLetterQueue) Close() error {
+	return dlq.client.Close()
+}
+
+// Process calls fn for at most limit pending dead letters, all of them when limit is 0.
+// With commit the dead letters handled without error are marked done.
+func (dlq *DeadLetterQueue) Process(ctx context.Context, limit int, commit bool, fn func(DeadLetter) error) error {
+	processed := 0
+	return dlq.forEachPartition(func(pom sarama.PartitionOffsetManager, partition int32, next, end int64) error {
+		if next >= end {
+			return nil
+		}
+		consumer, err := sarama.NewConsumerFromClient(dlq.client)
+		if err != nil {
+			return err
+		}
+		defer consumer.Close()
+		partitionConsumer, err := consumer.ConsumePartition(dlq.topic, partition, next)
+		if err != nil {
+			return err
+		}
+		defer partitionConsumer.Close()
+
+		for next < end && (limit == 0 || processed < limit) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case err := <-partitionConsumer.Errors():
+				return err
+			case kafkaMsg := <-partitionConsumer.Messages():
+				msg, err := kafka.DefaultMarshaler{}.Unmarshal(kafkaMsg)
+				if err != nil {
+					return err
+				}
+				if err := fn(DeadLetter{partition, kafkaMsg.Offset, msg}); err != nil {
+					return err
+				}
+				processed++
+				next = kafkaMsg.Offset + 1
+				if commit {
+					pom.MarkOffset(next, "")
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Purge marks every pending dead letter done without reading it.
+func (dlq *DeadLetterQueue) Purge(ctx context.Context) (int64, error) {
+	var purged int64
+	err := dlq.forEachPartition(func(pom sarama.PartitionOffsetManager, partition int32, next, end int64) error {
+		if next < end {
+			purged += end - next
+			pom.MarkOffset(end, "")
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// forEachPartition calls fn with the next pending offset and the end offset of each partition,
+// then commits the offsets marked by fn, also when fn failed on a later partition.
+func (dlq *DeadLetterQueue) forEachPartition(fn func(pom sarama.PartitionOffsetManager, partition int32, next, end int64) error) error {
+	partitions, err := dlq.client.Partitions(dlq.topic)
+	if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	offsetManager, err := sarama.NewOffsetManagerFromClient(dlq.group, dlq.client)
+	if err != nil {
+		return err
+	}
+	defer offsetManager.Close()
+
+	var poms []sarama.PartitionOffsetManager
+	defer func() {
+		for _, pom := range poms {
+			pom.Close()
+		}
+	}()
+	// the marked offsets are flushed while their partition offset managers are still open
+	defer offsetManager.Commit()
+
+	for _, partition := range partitions {
+		pom, err := offsetManager.ManagePartition(dlq.topic, partition)
+		if err != nil {
+			return err
+		}
+		poms = append(poms, pom)
+		next, _ := pom.NextOffset()
+		if next < 0 {
+			if next, err = dlq.client.GetOffset(dlq.topic, partition, sarama.OffsetOldest); err != nil {
+				return err
+			}
+		}
+		end, err := dlq.client.GetOffset(dlq.topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+		if err := fn(pom, partition, next, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
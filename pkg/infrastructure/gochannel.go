@@ -0,0 +1,13 @@
+package infrastructure
+
+import (
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+)
+
+// NewGoChannel creates an in-process Pub/Sub used in place of Kafka by the standalone mode.
+// Messages are not persisted, so subscribers must be registered before anything is published.
+func NewGoChannel() *gochannel.GoChannel {
+	return gochannel.NewGoChannel(gochannel.Config{
+		OutputChannelBuffer: 1024,
+	}, logger)
+}
@@ -51,7 +51,9 @@ func interceptorLogger(l common.GrpcLog) logging.Logger {
 	})
 }
 
-func InitializeGrpcServer(name string, logger common.GrpcLog) *grpc.Server {
+// InitializeGrpcServer creates a server with the shared interceptors, extraOpts are applied last
+// and override the default options.
+func InitializeGrpcServer(name string, logger common.GrpcLog, extraOpts ...grpc.ServerOption) *grpc.Server {
 	opts := []grpc.ServerOption{
 		grpc.MaxRecvMsgSize(1024 * 1024 * 8), // increase to 8 MB (default: 4 MB)
 		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
@@ -124,7 +126,7 @@ func InitializeGrpcServer(name string, logger common.GrpcLog) *grpc.Server {
 			recovery.UnaryServerInterceptor(recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
 		),
 	)
-	grpcSrv := grpc.NewServer(opts...)
+	grpcSrv := grpc.NewServer(append(opts, extraOpts...)...)
 	srvMetrics.InitializeMetrics(grpcSrv)
 	return grpcSrv
 }
@@ -1,6 +1,8 @@
 package infrastructure
 
 import (
+	"context"
+	"strconv"
 	"time"
 
 	"github.com/IBM/sarama"
@@ -54,6 +56,11 @@ func NewKafkaPublisherWithPartitioning(config *config.Config) (message.Publisher
 }
 
 func NewKafkaSubscriber(config *config.Config) (message.Subscriber, error) {
+	return NewKafkaGroupSubscriber(config, config.Kafka.Subscriber.ConsumerGroup)
+}
+
+// NewKafkaGroupSubscriber consumes in consumerGroup, each message is handled by one of its members.
+func NewKafkaGroupSubscriber(config *config.Config, consumerGroup string) (message.Subscriber, error) {
 	saramaConfig := sarama.NewConfig()
 	saramaVersion, err := sarama.ParseKafkaVersion(config.Kafka.Version)
 	if err != nil {
@@ -68,7 +75,7 @@ func NewKafkaSubscriber(config *config.Config) (message.Subscriber, error) {
 		kafka.SubscriberConfig{
 			Brokers:       common.GetServerAddrs(config.Kafka.Addrs),
 			Unmarshaler:   kafka.DefaultMarshaler{},
-			ConsumerGroup: config.Kafka.Subscriber.ConsumerGroup,
+			ConsumerGroup: consumerGroup,
 			InitializeTopicDetails: &sarama.TopicDetail{
 				NumPartitions:     config.Kafka.Subscriber.NumPartitions,
 				ReplicationFactor: config.Kafka.Subscriber.ReplicationFactor,
@@ -85,7 +92,41 @@ func NewKafkaSubscriber(config *config.Config) (message.Subscriber, error) {
 	return kafkaSubscriber, nil
 }
 
-func NewBrokerRouter(name string) (*message.Router, error) {
+// NewKafkaFanoutSubscriber consumes every partition of a topic without a consumer group,
+// starting from the newest offset, so each instance receives all messages published after it subscribed.
+func NewKafkaFanoutSubscriber(config *config.Config) (message.Subscriber, error) {
+	saramaConfig := sarama.NewConfig()
+	saramaVersion, err := sarama.ParseKafkaVersion(config.Kafka.Version)
+	if err != nil {
+		return nil, err
+	}
+	saramaConfig.Version = saramaVersion
+	saramaConfig.Consumer.Fetch.Default = 1024 * 1024
+	saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+
+	kafkaSubscriber, err := kafka.NewSubscriber(
+		kafka.SubscriberConfig{
+			Brokers:     common.GetServerAddrs(config.Kafka.Addrs),
+			Unmarshaler: kafka.DefaultMarshaler{},
+			InitializeTopicDetails: &sarama.TopicDetail{
+				NumPartitions:     config.Kafka.Subscriber.NumPartitions,
+				ReplicationFactor: config.Kafka.Subscriber.ReplicationFactor,
+			},
+			OverwriteSaramaConfig: saramaConfig,
+			OTELEnabled:           true,
+		},
+		logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return kafkaSubscriber, nil
+}
+
+// NewBrokerRouter retries failing handlers with exponential backoff, then moves the message to
+// the poison queue topic with the failure metadata, so a poison message does not block its partition.
+func NewBrokerRouter(name string, config *config.Config, publisher message.Publisher) (*message.Router, error) {
 	router, err := message.NewRouter(message.RouterConfig{}, logger)
 	if err != nil {
 		return nil, err
@@ -94,10 +135,63 @@ func NewBrokerRouter(name string) (*message.Router, error) {
 	metricsBuilder := metrics.NewPrometheusMetricsBuilder(prom.DefaultRegisterer, name, "pubsub")
 	metricsBuilder.AddPrometheusRouterMetrics(router)
 
+	poisonQueue, err := middleware.PoisonQueue(publisher, config.Kafka.PoisonQueue.Topic)
+	if err != nil {
+		return nil, err
+	}
+	retry := middleware.Retry{
+		MaxRetries:      config.Kafka.Retry.MaxRetries,
+		InitialInterval: time.Duration(config.Kafka.Retry.InitialIntervalMilliSecond) * time.Millisecond,
+		MaxInterval:     time.Duration(config.Kafka.Retry.MaxIntervalMilliSecond) * time.Millisecond,
+		Multiplier:      2,
+		Logger:          logger,
+	}
+
+	// the first middleware is the outermost, panics are recovered into errors before they are retried
 	router.AddMiddleware(
 		middleware.CorrelationID,
-		middleware.Timeout(time.Second*15),
+		poisonQueue,
+		poisonedAt(config.Kafka.Retry.MaxRetries),
+		retry.Middleware,
+		attemptTimeout(time.Second*15),
 		middleware.Recoverer,
 	)
 	return router, nil
 }
+
+// attemptTimeout cancels the message context of each handler attempt after timeout. Unlike
+// middleware.Timeout it restores the message context once the attempt returned, the retry
+// middleware waits on it between the attempts and would stop after the first one.
+func attemptTimeout(timeout time.Duration) message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			parent := msg.Context()
+			ctx, cancel := context.WithTimeout(parent, timeout)
+			defer func() {
+				cancel()
+				msg.SetContext(parent)
+			}()
+			msg.SetContext(ctx)
+			return h(msg)
+		}
+	}
+}
+
+const (
+	PoisonedAtKey      = "poisoned_at"
+	PoisonedRetriesKey = "retries_poisoned"
+)
+
+// poisonedAt adds when and after how many retries the message failed to the poison queue metadata.
+func poisonedAt(retries int) message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			msgs, err := h(msg)
+			if err != nil {
+				msg.Metadata.Set(PoisonedAtKey, time.Now().UTC().Format(time.RFC3339))
+				msg.Metadata.Set(PoisonedRetriesKey, strconv.Itoa(retries))
+			}
+			return msgs, err
+		}
+	}
+}
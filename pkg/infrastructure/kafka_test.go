@@ -0,0 +1,75 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/omran95/chatroom/pkg/config"
+)
+
+func TestBrokerRouterMovesFailingMessagesToThePoisonQueue(t *testing.T) {
+	cfg, err := config.NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Kafka.Retry.MaxRetries = 2
+	cfg.Kafka.Retry.InitialIntervalMilliSecond = 1
+	cfg.Kafka.Retry.MaxIntervalMilliSecond = 1
+	pubSub := NewGoChannel()
+	defer pubSub.Close()
+	router, err := NewBrokerRouter("poisontest", cfg, pubSub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attempts atomic.Int32
+	router.AddNoPublisherHandler("failing_handler", "test.topic", pubSub, func(msg *message.Message) error {
+		attempts.Add(1)
+		return errors.New("handler failed")
+	})
+	poisoned, err := pubSub.Subscribe(context.Background(), cfg.Kafka.PoisonQueue.Topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go router.Run(context.Background())
+	defer router.Close()
+	<-router.Running()
+
+	if err := pubSub.Publish("test.topic", message.NewMessage(watermill.NewUUID(), []byte("payload"))); err != nil {
+		t.Fatal(err)
+	}
+	var deadLetter *message.Message
+	select {
+	case deadLetter = <-poisoned:
+		deadLetter.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message on the poison topic")
+	}
+	if attempts.Load() != 3 {
+		t.Fatalf("handler ran %d times, want the first attempt and 2 retries", attempts.Load())
+	}
+	metadata := deadLetter.Metadata
+	if string(deadLetter.Payload) != "payload" || metadata.Get(middleware.PoisonedTopicKey) != "test.topic" || metadata.Get(middleware.PoisonedHandlerKey) != "failing_handler" {
+		t.Fatalf("dead letter %s with metadata %v", deadLetter.Payload, metadata)
+	}
+	if reason := metadata.Get(middleware.ReasonForPoisonedKey); !strings.Contains(reason, "handler failed") {
+		t.Fatalf("poisoned reason %q", reason)
+	}
+	if retries := metadata.Get(PoisonedRetriesKey); retries != "2" {
+		t.Fatalf("poisoned after %q retries, want 2", retries)
+	}
+	if _, err := time.Parse(time.RFC3339, metadata.Get(PoisonedAtKey)); err != nil {
+		t.Fatalf("poisoned at: %v", err)
+	}
+	select {
+	case msg := <-poisoned:
+		t.Fatalf("a second dead letter %v", msg.Metadata)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,68 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MemoryCacheImpl is an in-process RedisCache for single-node deployments.
+type MemoryCacheImpl struct {
+	mu     sync.RWMutex
+	hashes map[string]map[string]string
+}
+
+func NewMemoryCache() *MemoryCacheImpl {
+	return &MemoryCacheImpl{hashes: make(map[string]map[string]string)}
+}
+
+func (mc *MemoryCacheImpl) HGet(ctx context.Context, key, field string) (string, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	value, ok := mc.hashes[key][field]
+	if !ok {
+		return "", redis.Nil
+	}
+	return value, nil
+}
+
+func (mc *MemoryCacheImpl) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	values := make(map[string]string, len(mc.hashes[key]))
+	for field, value := range mc.hashes[key] {
+		values[field] = value
+	}
+	return values, nil
+}
+
+// HSet accepts field/value pairs like redis HSET.
+func (mc *MemoryCacheImpl) HSet(ctx context.Context, key string, values ...interface{}) error {
+	if len(values)%2 != 0 {
+		return errors.New("HSet expects field/value pairs")
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	hash, ok := mc.hashes[key]
+	if !ok {
+		hash = make(map[string]string)
+		mc.hashes[key] = hash
+	}
+	for i := 0; i < len(values); i += 2 {
+		hash[fmt.Sprint(values[i])] = fmt.Sprint(values[i+1])
+	}
+	return nil
+}
+
+func (mc *MemoryCacheImpl) HDel(ctx context.Context, key, field string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.hashes[key], field)
+	if len(mc.hashes[key]) == 0 {
+		delete(mc.hashes, key)
+	}
+	return nil
+}
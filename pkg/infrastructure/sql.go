@@ -0,0 +1,98 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/omran95/chatroom/pkg/config"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	CassandraDriver = "cassandra"
+	SQLiteDriver    = "sqlite"
+	PostgresDriver  = "postgres"
+)
+
+var sqlDriverNames = map[string]string{
+	SQLiteDriver:   "sqlite",
+	PostgresDriver: "pgx",
+}
+
+func NewSQLDB(config *config.Config) (*sql.DB, error) {
+	driverName, ok := sqlDriverNames[config.Storage.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sql driver: %s", config.Storage.Driver)
+	}
+	db, err := sql.Open(driverName, config.Storage.SQL.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if config.Storage.Driver == SQLiteDriver {
+		// sqlite allows a single writer, serialize connections instead of failing with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// MigrateSQL applies the *.sql files of migrations that are not recorded in schema_migrations yet,
+// in lexical order and each in its own transaction.
+func MigrateSQL(ctx context.Context, db *sql.DB, migrations fs.FS) error {
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version TEXT PRIMARY KEY)"); err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+	files, err := fs.Glob(migrations, "*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		version := strings.TrimSuffix(file, ".sql")
+		var applied int
+		if err := db.QueryRowContext(ctx, "SELECT count(*) FROM schema_migrations WHERE version = $1", version).Scan(&applied); err != nil {
+			return err
+		}
+		if applied > 0 {
+			continue
+		}
+		script, err := fs.ReadFile(migrations, file)
+		if err != nil {
+			return err
+		}
+		if err := applySQLMigration(ctx, db, version, string(script)); err != nil {
+			return fmt.Errorf("error applying migration %s: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func applySQLMigration(ctx context.Context, db *sql.DB, version, script string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range strings.Split(script, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
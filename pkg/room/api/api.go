@@ -0,0 +1,14 @@
+// Package api holds the contracts of the room service, served by the room HTTP server.
+package api
+
+import _ "embed"
+
+// OpenAPI is the OpenAPI 3 document of the REST API.
+//
+//go:embed openapi.yaml
+var OpenAPI []byte
+
+// AsyncAPI is the AsyncAPI document of the room websocket.
+//
+//go:embed asyncapi.yaml
+var AsyncAPI []byte
@@ -0,0 +1,339 @@
+package room
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ArchiveRoomRecord    = "room"
+	ArchiveMessageRecord = "message"
+	ArchivePollRecord    = "poll"
+	ArchiveMemberRecord  = "member"
+)
+
+// ArchiveRecord is one line of a JSONL room archive, a room record precedes the messages, the
+// polls and the members of the room.
+type ArchiveRecord struct {
+	Type    string         `json:"type"`
+	Room    *ArchiveRoom   `json:"room,omitempty"`
+	Message *Message       `json:"message,omitempty"`
+	Poll    *ArchivePoll   `json:"poll,omitempty"`
+	Member  *ArchiveMember `json:"member,omitempty"`
+}
+
+// ArchiveRoom carries the hashed secrets of the room so a restored room keeps its password and owner.
+type ArchiveRoom struct {
+	Room
+	OwnerTokenHash string `json:"owner_token_hash"`
+}
+
+// ArchivePoll carries the votes of the poll by voter, the votes of each option are counted from them.
+type ArchivePoll struct {
+	Poll
+	RoomID    RoomID         `json:"room_id"`
+	CreatedAt int64          `json:"created_at"`
+	Voters    map[string]int `json:"voters"`
+}
+
+// ArchiveMember carries the hashed member token so a restored member joins with their token.
+type ArchiveMember struct {
+	RoomID    RoomID `json:"room_id"`
+	UserName  string `json:"username"`
+	Status    string `json:"status"`
+	TokenHash string `json:"token_hash"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+func (record *ArchiveRecord) validate() error {
+	switch record.Type {
+	case ArchiveRoomRecord:
+		if record.Room == nil || record.Room.ID == 0 || record.Room.Name == "" {
+			return errors.New("room record without id or name")
+		}
+		if record.Room.Protected && record.Room.Password == "" {
+			return errors.New("protected room without password")
+		}
+	case ArchiveMessageRecord:
+		if record.Message == nil || record.Message.ID == 0 || record.Message.RoomID == 0 || record.Message.Time == 0 {
+			return errors.New("message record without id, room_id or time")
+		}
+	case ArchivePollRecord:
+		if record.Poll == nil || record.Poll.ID == 0 || record.Poll.RoomID == 0 || record.Poll.Creator == "" || len(record.Poll.Options) < 2 {
+			return errors.New("poll record without id, room_id, creator or options")
+		}
+		for userName, choice := range record.Poll.Voters {
+			if choice < 0 || choice >= len(record.Poll.Options) {
+				return fmt.Errorf("vote of %s for unknown option %d", userName, choice)
+			}
+		}
+	case ArchiveMemberRecord:
+		if record.Member == nil || record.Member.RoomID == 0 || record.Member.UserName == "" || record.Member.TokenHash == "" {
+			return errors.New("member record without room_id, username or token_hash")
+		}
+		if record.Member.Status != MemberActive && record.Member.Status != MemberPending {
+			return fmt.Errorf("member %s with unknown status %q", record.Member.UserName, record.Member.Status)
+		}
+	default:
+		return fmt.Errorf("unknown record type %q", record.Type)
+	}
+	return nil
+}
+
+// ExportArchive writes the room with all its messages, polls and members as a JSONL archive that can be read by the Importer.
+func ExportArchive(ctx context.Context, roomRepo RoomRepo, messageRepo MessageRepo, pollRepo PollRepo, memberRepo MemberRepo, roomID RoomID, w io.Writer) error {
+	room, err := roomRepo.GetRoom(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("error exporting room %d: %w", roomID, err)
+	}
+	encoder := json.NewEncoder(w)
+	roomRecord := ArchiveRecord{Type: ArchiveRoomRecord, Room: &ArchiveRoom{room, room.OwnerTokenHash}}
+	if err := encoder.Encode(roomRecord); err != nil {
+		return err
+	}
+	err = messageRepo.ScanMessages(ctx, roomID, 0, math.MaxInt64, func(msg Message) error {
+		return encoder.Encode(ArchiveRecord{Type: ArchiveMessageRecord, Message: &msg})
+	})
+	if err != nil {
+		return err
+	}
+	polls, err := pollRepo.ListPolls(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("error exporting the polls of room %d: %w", roomID, err)
+	}
+	for _, poll := range polls {
+		voters, err := pollRepo.ListVotes(ctx, poll.ID)
+		if err != nil {
+			return fmt.Errorf("error exporting the votes of poll %d: %w", poll.ID, err)
+		}
+		if err := encoder.Encode(ArchiveRecord{Type: ArchivePollRecord, Poll: &ArchivePoll{poll, poll.RoomID, poll.CreatedAt, voters}}); err != nil {
+			return err
+		}
+	}
+	members, err := memberRepo.ListMembers(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("error exporting the members of room %d: %w", roomID, err)
+	}
+	for _, member := range members {
+		archived := ArchiveMember{member.RoomID, member.UserName, member.Status, member.TokenHash, member.CreatedAt, member.ExpiresAt}
+		if err := encoder.Encode(ArchiveRecord{Type: ArchiveMemberRecord, Member: &archived}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportOptions configures the Importer. Checkpoint is the file recording the last imported line,
+// an existing checkpoint resumes the import after that line.
+type ImportOptions struct {
+	BatchSize  int
+	Checkpoint string
+	DryRun     bool
+}
+
+type ImportSummary struct {
+	Rooms    int
+	Messages int
+	Polls    int
+	Members  int
+	Skipped  int
+}
+
+// Importer writes a JSONL archive through the repos. Rooms, messages, polls and members keep their
+// IDs and times and are upserted, so an import can be re-run or resumed safely. Join requests that
+// expired since the export are skipped.
+type Importer struct {
+	roomRepo    RoomRepo
+	messageRepo MessageRepo
+	pollRepo    PollRepo
+	memberRepo  MemberRepo
+	options     ImportOptions
+	retentions  map[RoomID]Retention
+	batch       []Message
+	batchRoomID RoomID
+	summary     ImportSummary
+}
+
+func NewImporter(roomRepo RoomRepo, messageRepo MessageRepo, pollRepo PollRepo, memberRepo MemberRepo, options ImportOptions) *Importer {
+	if options.BatchSize <= 0 {
+		options.BatchSize = 500
+	}
+	return &Importer{
+		roomRepo:    roomRepo,
+		messageRepo: messageRepo,
+		pollRepo:    pollRepo,
+		memberRepo:  memberRepo,
+		options:     options,
+		retentions:  map[RoomID]Retention{},
+	}
+}
+
+func (importer *Importer) Import(ctx context.Context, archive io.Reader) (ImportSummary, error) {
+	resumeAfter, err := importer.readCheckpoint()
+	if err != nil {
+		return importer.summary, err
+	}
+
+	scanner := bufio.NewScanner(archive)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record ArchiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return importer.summary, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := record.validate(); err != nil {
+			return importer.summary, fmt.Errorf("line %d: %w", line, err)
+		}
+		// rooms before the checkpoint are still read for the retention of their messages
+		if line <= resumeAfter {
+			if record.Type == ArchiveRoomRecord {
+				importer.retentions[record.Room.ID] = record.Room.Retention
+			}
+			importer.summary.Skipped++
+			continue
+		}
+		if err := importer.importRecord(ctx, record, line); err != nil {
+			return importer.summary, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return importer.summary, err
+	}
+	return importer.summary, importer.flush(ctx, line)
+}
+
+func (importer *Importer) importRecord(ctx context.Context, record ArchiveRecord, line int) error {
+	if record.Type == ArchiveRoomRecord {
+		// keep the archive order, messages of the previous room are written before the next room
+		if err := importer.flush(ctx, line-1); err != nil {
+			return err
+		}
+		room := record.Room.Room
+		room.OwnerTokenHash = record.Room.OwnerTokenHash
+		// archives written before the room visibility hold unlisted rooms
+		if room.Visibility == "" {
+			room.Visibility = VisibilityUnlisted
+		}
+		importer.retentions[room.ID] = room.Retention
+		importer.summary.Rooms++
+		if importer.options.DryRun {
+			return nil
+		}
+		if err := importer.roomRepo.UpsertRoom(ctx, room); err != nil {
+			return err
+		}
+		return importer.saveCheckpoint(line)
+	}
+	if record.Type == ArchivePollRecord {
+		if err := importer.flush(ctx, line-1); err != nil {
+			return err
+		}
+		poll := record.Poll.Poll
+		poll.RoomID, poll.CreatedAt = record.Poll.RoomID, record.Poll.CreatedAt
+		importer.summary.Polls++
+		if importer.options.DryRun {
+			return nil
+		}
+		if err := importer.pollRepo.UpsertPoll(ctx, poll, record.Poll.Voters); err != nil {
+			return err
+		}
+		return importer.saveCheckpoint(line)
+	}
+	if record.Type == ArchiveMemberRecord {
+		if err := importer.flush(ctx, line-1); err != nil {
+			return err
+		}
+		archived := record.Member
+		member := Member{archived.RoomID, archived.UserName, archived.Status, archived.TokenHash, archived.CreatedAt, archived.ExpiresAt}
+		if member.ExpiresAt > 0 && member.ttl(time.Now()) <= 0 {
+			return nil
+		}
+		importer.summary.Members++
+		if importer.options.DryRun {
+			return nil
+		}
+		if err := importer.memberRepo.AddMember(ctx, member); err != nil {
+			return err
+		}
+		return importer.saveCheckpoint(line)
+	}
+
+	msg := *record.Message
+	if _, ok := importer.retentions[msg.RoomID]; !ok {
+		retention, err := importer.roomRepo.GetRetention(ctx, msg.RoomID)
+		if err != nil {
+			return fmt.Errorf("message %d of unknown room %d: %w", msg.ID, msg.RoomID, err)
+		}
+		importer.retentions[msg.RoomID] = retention
+	}
+	if len(importer.batch) > 0 && importer.batchRoomID != msg.RoomID {
+		if err := importer.flush(ctx, line-1); err != nil {
+			return err
+		}
+	}
+	importer.batch = append(importer.batch, msg)
+	importer.batchRoomID = msg.RoomID
+	importer.summary.Messages++
+	if len(importer.batch) >= importer.options.BatchSize {
+		return importer.flush(ctx, line)
+	}
+	return nil
+}
+
+// flush writes the buffered messages and records line as the last imported line.
+func (importer *Importer) flush(ctx context.Context, line int) error {
+	if len(importer.batch) == 0 {
+		return nil
+	}
+	batch := importer.batch
+	importer.batch = importer.batch[:0]
+	if importer.options.DryRun {
+		return nil
+	}
+	ttl := importer.retentions[importer.batchRoomID].TTL()
+	if err := importer.messageRepo.UpsertMessages(ctx, batch, ttl); err != nil {
+		return err
+	}
+	return importer.saveCheckpoint(line)
+}
+
+func (importer *Importer) readCheckpoint() (int, error) {
+	if importer.options.Checkpoint == "" {
+		return 0, nil
+	}
+	data, err := os.ReadFile(importer.options.Checkpoint)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (importer *Importer) saveCheckpoint(line int) error {
+	if importer.options.Checkpoint == "" {
+		return nil
+	}
+	// write then rename, so a crash never leaves a truncated checkpoint
+	tmp := importer.options.Checkpoint + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(line)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, importer.options.Checkpoint)
+}
@@ -0,0 +1,134 @@
+package room
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/common"
+)
+
+// failingMessageRepo counts the upserted messages and fails the upserts after failAfter of them.
+type failingMessageRepo struct {
+	MessageRepo
+	failAfter int
+	upserted  []MessageID
+}
+
+var errUpsertFailed = errors.New("upsert failed")
+
+func (repo *failingMessageRepo) UpsertMessages(ctx context.Context, msgs []Message, ttl time.Duration) error {
+	if repo.failAfter >= 0 && len(repo.upserted)+len(msgs) > repo.failAfter {
+		return errUpsertFailed
+	}
+	for _, msg := range msgs {
+		repo.upserted = append(repo.upserted, msg.ID)
+	}
+	return repo.MessageRepo.UpsertMessages(ctx, msgs, ttl)
+}
+
+// newTestArchive exports a room keeping messages for two days, with a message older than that,
+// one sent a day ago and recent ones.
+func newTestArchive(t *testing.T) (*bytes.Buffer, Room, []MessageID) {
+	t.Helper()
+	source := newTestStorage(t)
+	ctx := context.Background()
+	now := time.Now()
+	room := Room{ID: common.MinIDAt(now.Add(-7 * 24 * time.Hour)), Name: "archived", Visibility: VisibilityUnlisted, Retention: Retention{RetentionDays: 2}}
+	if err := source.RoomRepo.CreateRoom(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+	var ids []MessageID
+	for _, sentAt := range []time.Time{
+		now.Add(-3 * 24 * time.Hour), now.Add(-24 * time.Hour),
+		now.Add(-4 * time.Minute), now.Add(-3 * time.Minute), now.Add(-2 * time.Minute), now.Add(-time.Minute),
+	} {
+		msg := Message{ID: common.MinIDAt(sentAt), RoomID: room.ID, UserName: "alice", Payload: "message", Time: sentAt.UnixMilli()}
+		if err := source.MessageRepo.InesrtMessage(ctx, msg, 0); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	var archive bytes.Buffer
+	if err := ExportArchive(ctx, source.RoomRepo, source.MessageRepo, source.PollRepo, source.MemberRepo, room.ID, &archive); err != nil {
+		t.Fatal(err)
+	}
+	return &archive, room, ids
+}
+
+func TestImportResumesFromTheCheckpoint(t *testing.T) {
+	archive, room, ids := newTestArchive(t)
+	target := newTestStorage(t)
+	ctx := context.Background()
+	options := ImportOptions{BatchSize: 2, Checkpoint: filepath.Join(t.TempDir(), "import.checkpoint")}
+
+	// the second batch fails, the first one and the room are recorded in the checkpoint
+	interrupted := &failingMessageRepo{MessageRepo: target.MessageRepo, failAfter: 2}
+	archiveData := archive.Bytes()
+	if _, err := NewImporter(target.RoomRepo, interrupted, target.PollRepo, target.MemberRepo, options).Import(ctx, bytes.NewReader(archiveData)); !errors.Is(err, errUpsertFailed) {
+		t.Fatalf("interrupted import: %v", err)
+	}
+	if _, err := os.Stat(options.Checkpoint); err != nil {
+		t.Fatalf("no checkpoint after the interrupted import: %v", err)
+	}
+
+	resumed := &failingMessageRepo{MessageRepo: target.MessageRepo, failAfter: -1}
+	summary, err := NewImporter(target.RoomRepo, resumed, target.PollRepo, target.MemberRepo, options).Import(ctx, bytes.NewReader(archiveData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the room and the first batch are skipped, only the remaining messages are written again
+	if summary.Rooms != 0 || summary.Messages != 4 || summary.Skipped != 3 {
+		t.Fatalf("resumed import %+v", summary)
+	}
+	if upserted := append(slices.Clone(interrupted.upserted), resumed.upserted...); !slices.Equal(upserted, ids) {
+		t.Fatalf("upserted %v, want every message once %v", upserted, ids)
+	}
+
+	// the message past its retention is skipped, the others expire two days after they were sent
+	stored, err := target.MessageRepo.LatestMessages(ctx, room.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var storedIDs []MessageID
+	for _, msg := range stored {
+		storedIDs = append(storedIDs, msg.ID)
+	}
+	if !slices.Equal(storedIDs, ids[1:]) {
+		t.Fatalf("stored %v, want %v", storedIDs, ids[1:])
+	}
+	if err := target.MessageRepo.DeleteExpiredMessages(ctx, time.Now().Add(36*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := target.MessageRepo.LatestMessages(ctx, room.ID, 10); err != nil || len(stored) != 4 || stored[0].ID != ids[2] {
+		t.Fatalf("messages left after a day and a half %v, want the recent ones: %v", stored, err)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	archive, room, _ := newTestArchive(t)
+	target := newTestStorage(t)
+	ctx := context.Background()
+	checkpoint := filepath.Join(t.TempDir(), "import.checkpoint")
+	summary, err := NewImporter(target.RoomRepo, target.MessageRepo, target.PollRepo, target.MemberRepo, ImportOptions{BatchSize: 2, Checkpoint: checkpoint, DryRun: true}).Import(ctx, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Rooms != 1 || summary.Messages != 6 {
+		t.Fatalf("dry run %+v", summary)
+	}
+	if exist, err := target.RoomRepo.RoomExist(ctx, room.ID); err != nil || exist {
+		t.Fatalf("dry run created the room: %v", err)
+	}
+	if msgs, err := target.MessageRepo.LatestMessages(ctx, room.ID, 10); err != nil || len(msgs) != 0 {
+		t.Fatalf("dry run stored %v: %v", msgs, err)
+	}
+	if _, err := os.Stat(checkpoint); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("dry run wrote a checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,4 @@
+// Package client is the Go client of the room REST API, generated from the OpenAPI document.
+package client
+
+//go:generate oapi-codegen --config=oapi-codegen.yaml ../api/openapi.yaml
@@ -0,0 +1,178 @@
+package room
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/gorilla/websocket"
+	roompb "github.com/omran95/chatroom/pkg/room/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// ContentTypeMetadataKey carries the payload format of a broker message,
+// messages published before protobuf was introduced have none and are JSON.
+var ContentTypeMetadataKey = "content_type"
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// PayloadContentType maps the kafka.payloadFormat setting to the content type of the published messages.
+func PayloadContentType(format string) (string, error) {
+	switch format {
+	case "protobuf":
+		return ContentTypeProtobuf, nil
+	case "json":
+		return ContentTypeJSON, nil
+	default:
+		return "", fmt.Errorf("unknown kafka payload format: %s", format)
+	}
+}
+
+// Websocket clients pick the protobuf format through the Sec-WebSocket-Protocol header,
+// sessions that ask for no subprotocol or an unknown one use JSON text frames.
+const (
+	ProtobufSubprotocol = "chat.v1.protobuf"
+	JSONSubprotocol     = "chat.v1.json"
+)
+
+// wsSubprotocols is in server preference order, like the websocket upgrader negotiates it.
+var wsSubprotocols = []string{ProtobufSubprotocol, JSONSubprotocol}
+
+func sessionContentType(r *http.Request) string {
+	for _, clientProtocol := range websocket.Subprotocols(r) {
+		if clientProtocol == ProtobufSubprotocol {
+			return ContentTypeProtobuf
+		}
+	}
+	return ContentTypeJSON
+}
+
+func (m *Message) toProto() *roompb.Message {
+	return &roompb.Message{
+		MessageId:   m.ID,
+		Event:       int32(m.Event),
+		RoomId:      m.RoomID,
+		Username:    m.UserName,
+		Payload:     m.Payload,
+		Seen:        m.Seen,
+		Time:        m.Time,
+		ClientMsgId: m.ClientMsgID,
+	}
+}
+
+func messageFromProto(pb *roompb.Message) Message {
+	return Message{
+		ID:          pb.GetMessageId(),
+		Event:       int(pb.GetEvent()),
+		RoomID:      pb.GetRoomId(),
+		UserName:    pb.GetUsername(),
+		Payload:     pb.GetPayload(),
+		Seen:        pb.GetSeen(),
+		Time:        pb.GetTime(),
+		ClientMsgID: pb.GetClientMsgId(),
+	}
+}
+
+func (m *Message) EncodeProto() []byte {
+	result, _ := proto.Marshal(m.toProto())
+	return result
+}
+
+// EncodeAs encodes the message in the given content type.
+func (m *Message) EncodeAs(contentType string) []byte {
+	if contentType == ContentTypeProtobuf {
+		return m.EncodeProto()
+	}
+	return m.Encode()
+}
+
+// DecodeMessage decodes a message in the given content type, JSON when it is empty.
+func DecodeMessage(contentType string, data []byte) (*Message, error) {
+	if contentType != ContentTypeProtobuf {
+		return decodeToMessage(data)
+	}
+	var pb roompb.Message
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return nil, err
+	}
+	msg := messageFromProto(&pb)
+	return &msg, nil
+}
+
+func encodeBatchProto(msgs []Message) []byte {
+	batch := &roompb.MessageBatch{Messages: make([]*roompb.Message, len(msgs))}
+	for i := range msgs {
+		batch.Messages[i] = msgs[i].toProto()
+	}
+	result, _ := proto.Marshal(batch)
+	return result
+}
+
+func decodeBatchProto(data []byte) ([]Message, error) {
+	var batch roompb.MessageBatch
+	if err := proto.Unmarshal(data, &batch); err != nil {
+		return nil, err
+	}
+	msgs := make([]Message, len(batch.Messages))
+	for i, pb := range batch.Messages {
+		msgs[i] = messageFromProto(pb)
+	}
+	return msgs, nil
+}
+
+// NewBrokerMessage encodes msgs as one broker message in the content type, several messages as a batch.
+func NewBrokerMessage(uuid string, contentType string, msgs ...Message) *message.Message {
+	var payload []byte
+	switch {
+	case len(msgs) == 1:
+		payload = msgs[0].EncodeAs(contentType)
+	case contentType == ContentTypeProtobuf:
+		payload = encodeBatchProto(msgs)
+	default:
+		payload = EncodeBatch(msgs)
+	}
+	brokerMsg := message.NewMessage(uuid, payload)
+	brokerMsg.Metadata.Set(ContentTypeMetadataKey, contentType)
+	if len(msgs) > 1 {
+		brokerMsg.Metadata.Set(BatchMetadataKey, "true")
+	}
+	return brokerMsg
+}
+
+// DecodeBrokerMessage decodes the messages carried by a broker message of any content type.
+func DecodeBrokerMessage(brokerMsg *message.Message) ([]Message, error) {
+	contentType := brokerContentType(brokerMsg)
+	if brokerMsg.Metadata.Get(BatchMetadataKey) == "true" {
+		if contentType == ContentTypeProtobuf {
+			return decodeBatchProto(brokerMsg.Payload)
+		}
+		return decodeBatch(brokerMsg.Payload)
+	}
+	msg, err := DecodeMessage(contentType, brokerMsg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return []Message{*msg}, nil
+}
+
+// brokerContentType is the content type of a broker message, JSON when it has none.
+func brokerContentType(brokerMsg *message.Message) string {
+	if contentType := brokerMsg.Metadata.Get(ContentTypeMetadataKey); contentType != "" {
+		return contentType
+	}
+	return ContentTypeJSON
+}
+
+func decodeRoomAuth(contentType string, data []byte) (*RoomAuth, error) {
+	if contentType != ContentTypeProtobuf {
+		return decodeToRoomAuth(data)
+	}
+	var pb roompb.RoomAuth
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return nil, err
+	}
+	return &RoomAuth{Password: pb.GetPassword()}, nil
+}
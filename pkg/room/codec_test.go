@@ -0,0 +1,108 @@
+package room
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var codecContentTypes = []struct {
+	name        string
+	contentType string
+}{
+	{"json", ContentTypeJSON},
+	{"protobuf", ContentTypeProtobuf},
+}
+
+// codecMessages returns n text messages shaped like chat traffic, with snowflake IDs and a client message ID.
+func codecMessages(n int) []Message {
+	msgs := make([]Message, n)
+	for i := range msgs {
+		msgs[i] = Message{
+			ID:          uint64(532875391836127745 + i),
+			Event:       EventText,
+			RoomID:      532875391836127232,
+			UserName:    "alice",
+			Payload:     "are we still meeting at the station at six tonight?",
+			Time:        1_700_000_000_000 + int64(i),
+			ClientMsgID: "0b7c1c2e-94d2-4c7d-a4f5-7d1c0c3f9e21",
+		}
+	}
+	return msgs
+}
+
+func TestBrokerMessageRoundTrip(t *testing.T) {
+	for _, format := range codecContentTypes {
+		for _, n := range []int{1, 3} {
+			msgs := codecMessages(n)
+			decoded, err := DecodeBrokerMessage(NewBrokerMessage("uuid", format.contentType, msgs...))
+			if err != nil {
+				t.Fatalf("%s batch of %d: %v", format.name, n, err)
+			}
+			if !reflect.DeepEqual(decoded, msgs) {
+				t.Fatalf("%s batch of %d: got %+v, want %+v", format.name, n, decoded, msgs)
+			}
+		}
+	}
+}
+
+// BenchmarkKafkaPayload encodes and decodes the broker messages of the kafka topics, single
+// messages and the batches of the subscriber service.
+func BenchmarkKafkaPayload(b *testing.B) {
+	for _, format := range codecContentTypes {
+		for _, n := range []int{1, 16} {
+			msgs := codecMessages(n)
+			brokerMsg := NewBrokerMessage("uuid", format.contentType, msgs...)
+			perMsg := float64(len(brokerMsg.Payload)) / float64(n)
+			b.Run(fmt.Sprintf("%s/batch=%d/encode", format.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					NewBrokerMessage("uuid", format.contentType, msgs...)
+				}
+				b.ReportMetric(perMsg, "bytes/msg")
+			})
+			b.Run(fmt.Sprintf("%s/batch=%d/decode", format.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := DecodeBrokerMessage(brokerMsg); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(perMsg, "bytes/msg")
+			})
+		}
+	}
+}
+
+// BenchmarkWebsocketFrame encodes the frames a broadcast writes to the sessions of a format and
+// decodes the frames clients send. The deflated size is what a session with permessage-deflate sends.
+func BenchmarkWebsocketFrame(b *testing.B) {
+	msg := codecMessages(1)[0]
+	for _, format := range codecContentTypes {
+		frame := msg.EncodeAs(format.contentType)
+		var deflated bytes.Buffer
+		writer, _ := flate.NewWriter(&deflated, 1)
+		writer.Write(frame)
+		writer.Close()
+		b.Run(format.name+"/encode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encoded := &encodedMessage{msg: &msg, encodings: make(map[string][]byte, 2)}
+				encoded.as(format.contentType)
+			}
+			b.ReportMetric(float64(len(frame)), "bytes/frame")
+			b.ReportMetric(float64(deflated.Len()), "deflated-bytes/frame")
+		})
+		b.Run(format.name+"/decode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeMessage(format.contentType, frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(frame)), "bytes/frame")
+		})
+	}
+}
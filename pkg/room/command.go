@@ -0,0 +1,185 @@
+package room
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/config"
+)
+
+// Command is a slash command sent as a text message, e.g. "/giphy cats".
+type Command struct {
+	RoomID   RoomID `json:"room_id"`
+	UserName string `json:"username"`
+	Name     string `json:"command"`
+	Text     string `json:"text"`
+}
+
+// CommandReply is posted to the room as UserName, nothing is posted for an empty Text.
+type CommandReply struct {
+	UserName string `json:"-"`
+	Text     string `json:"text"`
+}
+
+// CommandHandler answers the slash commands of one name.
+type CommandHandler interface {
+	HandleCommand(ctx context.Context, cmd Command) (CommandReply, error)
+}
+
+// SlashCommands routes the slash commands to the command webhooks of the room, then to the
+// handlers registered in process. Handlers must answer within the command timeout.
+type SlashCommands struct {
+	webhooks *WebhookCache
+	client   *http.Client
+	timeout  time.Duration
+
+	mu       sync.RWMutex
+	handlers map[string]CommandHandler
+}
+
+func NewSlashCommands(config *config.Config, webhooks *WebhookCache) *SlashCommands {
+	commands := &SlashCommands{
+		webhooks: webhooks,
+		// the requests are bounded by the command timeout
+		client:   newWebhookClient(0, config.Room.Webhook.AllowPrivateNetworks),
+		timeout:  time.Duration(config.Room.Webhook.CommandTimeoutMilliSecond) * time.Millisecond,
+		handlers: make(map[string]CommandHandler),
+	}
+	commands.Register("giphy", &giphyCommand{apiKey: config.Room.Webhook.GiphyAPIKey, client: &http.Client{}})
+	return commands
+}
+
+// Register makes handler answer the name commands of every room without a command webhook of that name.
+func (commands *SlashCommands) Register(name string, handler CommandHandler) {
+	commands.mu.Lock()
+	defer commands.mu.Unlock()
+	commands.handlers[name] = handler
+}
+
+// Run answers cmd, handled is false when neither a webhook nor a registered handler knows the command.
+func (commands *SlashCommands) Run(ctx context.Context, cmd Command) (reply CommandReply, handled bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, commands.timeout)
+	defer cancel()
+	handler, err := commands.handler(ctx, cmd.RoomID, cmd.Name)
+	if err != nil || handler == nil {
+		return CommandReply{}, false, err
+	}
+	reply, err = handler.HandleCommand(ctx, cmd)
+	if err != nil {
+		return CommandReply{}, true, fmt.Errorf("error running command /%s: %w", cmd.Name, err)
+	}
+	if reply.UserName == "" {
+		reply.UserName = cmd.Name
+	}
+	return reply, true, nil
+}
+
+func (commands *SlashCommands) handler(ctx context.Context, roomID RoomID, name string) (CommandHandler, error) {
+	webhooks, err := commands.webhooks.get(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, webhook := range webhooks {
+		if webhook.Kind == WebhookCommand && webhook.Name == name {
+			return &webhookCommandHandler{webhook, commands.client}, nil
+		}
+	}
+	commands.mu.RLock()
+	defer commands.mu.RUnlock()
+	return commands.handlers[name], nil
+}
+
+// parseCommand splits "/name text" into the command name and its text, ok is false for other payloads.
+func parseCommand(payload string) (name, text string, ok bool) {
+	rest, found := strings.CutPrefix(payload, "/")
+	if !found {
+		return "", "", false
+	}
+	name, text, _ = strings.Cut(rest, " ")
+	if !commandNamePattern.MatchString(name) {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(text), true
+}
+
+// webhookCommandHandler posts the command to a command webhook, the reply is posted as the command name.
+type webhookCommandHandler struct {
+	webhook Webhook
+	client  *http.Client
+}
+
+func (handler *webhookCommandHandler) HandleCommand(ctx context.Context, cmd Command) (CommandReply, error) {
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return CommandReply{}, err
+	}
+	respBody, err := postWebhook(ctx, handler.client, handler.webhook, body, maxWebhookResponseBytes)
+	if err != nil {
+		return CommandReply{}, err
+	}
+	var reply CommandReply
+	if len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, &reply); err != nil {
+			return CommandReply{}, fmt.Errorf("invalid reply of webhook %d: %w", handler.webhook.ID, err)
+		}
+	}
+	reply.UserName = handler.webhook.Name
+	return reply, nil
+}
+
+const giphySearchURL = "https://api.giphy.com/v1/gifs/search"
+
+// giphyCommand answers "/giphy <search>" with the first matching GIF. Without an API key, and when
+// nothing matches, it replies with the link of the search on giphy.com.
+type giphyCommand struct {
+	apiKey string
+	client *http.Client
+	// searchURL is the search API endpoint, giphySearchURL when empty
+	searchURL string
+}
+
+func (command *giphyCommand) HandleCommand(ctx context.Context, cmd Command) (CommandReply, error) {
+	if cmd.Text == "" {
+		return CommandReply{Text: "usage: /giphy <search>"}, nil
+	}
+	searchLink := "https://giphy.com/search/" + url.PathEscape(strings.ReplaceAll(cmd.Text, " ", "-"))
+	if command.apiKey == "" {
+		return CommandReply{Text: searchLink}, nil
+	}
+	searchURL := command.searchURL
+	if searchURL == "" {
+		searchURL = giphySearchURL
+	}
+	query := url.Values{"api_key": {command.apiKey}, "q": {cmd.Text}, "limit": {"1"}, "rating": {"g"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, searchURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return CommandReply{}, err
+	}
+	resp, err := command.client.Do(req)
+	if err != nil {
+		return CommandReply{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return CommandReply{}, fmt.Errorf("giphy search responded %d", resp.StatusCode)
+	}
+	var result struct {
+		Data []struct {
+			URL string `json:"url"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponseBytes)).Decode(&result); err != nil {
+		return CommandReply{}, fmt.Errorf("invalid giphy search response: %w", err)
+	}
+	if len(result.Data) == 0 || result.Data[0].URL == "" {
+		return CommandReply{Text: searchLink}, nil
+	}
+	return CommandReply{Text: result.Data[0].URL}, nil
+}
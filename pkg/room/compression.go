@@ -0,0 +1,118 @@
+package room
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/olahol/melody"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// WsCompression negotiates permessage-deflate with the websocket clients offering it. Messages
+// below the threshold are sent uncompressed, deflating typing and seen events costs more than it saves.
+type WsCompression struct {
+	enabled      bool
+	threshold    int
+	level        int
+	payloadBytes *prometheus.CounterVec
+	writtenBytes prometheus.Counter
+}
+
+func NewWsCompression(name string, config *config.Config) (*WsCompression, error) {
+	compression := config.Room.Compression
+	if compression.Level < flate.HuffmanOnly || compression.Level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid websocket compression level: %d", compression.Level)
+	}
+	return &WsCompression{
+		enabled:   compression.Enabled,
+		threshold: compression.ThresholdBytes,
+		level:     compression.Level,
+		payloadBytes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: name,
+			Name:      "websocket_payload_bytes_total",
+			Help:      "Raw bytes of the messages sent to the websocket sessions, by whether they were compressed.",
+		}, []string{"compressed"}),
+		writtenBytes: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: name,
+			Name:      "websocket_written_bytes_total",
+			Help:      "Bytes written to the websocket connections, after compression and framing.",
+		}),
+	}, nil
+}
+
+// negotiated reports whether the connection upgraded from r uses permessage-deflate,
+// the upgrader accepts the extension whenever the client offers it.
+func (compression *WsCompression) negotiated(r *http.Request) bool {
+	if !compression.enabled {
+		return false
+	}
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// initSession runs before the session write pump starts, the messages stay uncompressed
+// until the send queue of the session decides otherwise.
+func (compression *WsCompression) initSession(sess *melody.Session) {
+	if !compression.negotiated(sess.Request) {
+		return
+	}
+	conn := sess.WebsocketConnection()
+	conn.SetCompressionLevel(compression.level)
+	conn.EnableWriteCompression(false)
+}
+
+func (compression *WsCompression) compresses(size int) bool {
+	return size >= compression.threshold
+}
+
+func (compression *WsCompression) sent(size int, compressed bool) {
+	compression.payloadBytes.WithLabelValues(strconv.FormatBool(compressed)).Add(float64(size))
+}
+
+// countWritten counts the bytes written to the connection hijacked from w by the websocket upgrade.
+func (compression *WsCompression) countWritten(w http.ResponseWriter) http.ResponseWriter {
+	return &countingResponseWriter{w, compression.writtenBytes}
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written prometheus.Counter
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{conn, w.written}, rw, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written prometheus.Counter
+}
+
+func (conn *countingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.written.Add(float64(n))
+	return n, err
+}
@@ -1,18 +1,19 @@
 package room
 
 import (
-	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/olahol/melody"
 	"github.com/omran95/chatroom/pkg/common"
-	"gopkg.in/olahol/melody.v1"
+	"github.com/omran95/chatroom/pkg/room/api"
 )
 
-var sessRidKey = "sessRid"
-
 func (server *HttpServer) CreateRoom(c *gin.Context) {
 	var dto CreateRoomDTO
 	if err := c.ShouldBindBodyWithJSON(&dto); err != nil {
@@ -34,6 +35,35 @@ func (server *HttpServer) CreateRoom(c *gin.Context) {
 	c.JSON(http.StatusCreated, room)
 }
 
+// ListPublicRooms lists the public rooms newest first, the next page starts before the last room ID.
+func (server *HttpServer) ListPublicRooms(c *gin.Context) {
+	var (
+		beforeID uint64
+		limit    int
+		err      error
+	)
+	if before := c.Query("before"); before != "" {
+		if beforeID, err = strconv.ParseUint(before, 10, 64); err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+	}
+	if limitParam := c.Query("limit"); limitParam != "" {
+		if limit, err = strconv.Atoi(limitParam); err != nil || limit < 0 {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+	}
+
+	rooms, err := server.roomService.ListPublicRooms(c, beforeID, limit)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, rooms)
+}
+
 func (server *HttpServer) RequestToJoinRoom(c *gin.Context) {
 	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	userName := c.Query("userName")
@@ -62,124 +92,672 @@ func (server *HttpServer) RequestToJoinRoom(c *gin.Context) {
 	}
 }
 
-func (server *HttpServer) HandleRoomOnJoin(wsSession *melody.Session) {
-	ctx := context.Background()
-	roomID, userName := extractWsParams(wsSession)
-	isProtectedRoom, err := server.roomService.IsRoomProtected(ctx, roomID)
+func (server *HttpServer) ExportTranscript(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	options, err := extractExportOptions(c)
+	if err != nil || !options.isValid() {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
+	}
+
+	c.Header("Content-Type", options.ContentType())
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="room-%d.%s"`, roomID, options.Format))
+	c.Status(http.StatusOK)
+	// the status is already sent while streaming, errors can only be logged
+	if err := server.roomService.ExportTranscript(c, roomID, options, c.Writer); err != nil {
+		server.logger.Error(err.Error())
+	}
+}
+
+func (server *HttpServer) CreateWebhook(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
-		wsSession.CloseWithMsg(melody.FormatCloseMessage(500, "Error checking if the room is protected: "+err.Error()))
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
 		return
 	}
-	if !isProtectedRoom {
-		server.joinRoom(wsSession, roomID, userName)
+	var dto CreateWebhookDTO
+	if err := c.ShouldBindBodyWithJSON(&dto); err != nil {
+		response(c, http.StatusBadRequest, err)
 		return
 	}
-	err = server.sendAuthRequiredMessage(wsSession)
+	if !dto.isValid() {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
+	}
+
+	webhook, err := server.roomService.CreateWebhook(c, roomID, dto)
 	if err != nil {
-		wsSession.CloseWithMsg(melody.FormatCloseMessage(500, "Error: "+err.Error()))
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
+	c.JSON(http.StatusCreated, webhook)
 }
 
-func (server *HttpServer) HandleRoomOnLeave(wsSession *melody.Session, n int, s string) error {
-	roomID, userName := extractWsParams(wsSession)
-	err := server.roomService.RemoveRoomSubscriber(context.Background(), roomID, userName)
+func (server *HttpServer) ListWebhooks(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
+	}
+
+	webhooks, err := server.roomService.ListWebhooks(c, roomID)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, webhooks)
+}
+
+func (server *HttpServer) DeleteWebhook(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	webhookID, err := strconv.ParseUint(c.Param("webhook"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
+	}
+
+	deleted, err := server.roomService.DeleteWebhook(c, roomID, webhookID)
 	if err != nil {
 		server.logger.Error(err.Error())
-		return err
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !deleted {
+		response(c, http.StatusNotFound, common.ErrNoWebhook)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// PostIncomingMessage posts a message to the room as the bot of the incoming webhook, the token in the path authorizes it.
+func (server *HttpServer) PostIncomingMessage(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxFallbackMessageBytes)
+	var dto IncomingMessageDTO
+	if err := c.ShouldBindBodyWithJSON(&dto); err != nil {
+		response(c, http.StatusBadRequest, err)
+		return
 	}
-	if err := server.roomService.BroadcastLeaveMessage(context.Background(), roomID, userName); err != nil {
+	if len(dto.ClientMsgID) > maxClientMsgIDLength {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+
+	posted, err := server.roomService.PostIncomingMessage(c, roomID, c.Param("token"), dto)
+	if err != nil {
 		server.logger.Error(err.Error())
-		return err
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !posted {
+		response(c, http.StatusNotFound, common.ErrNoWebhook)
+		return
 	}
-	return nil
+	c.Status(http.StatusAccepted)
 }
 
-func (server *HttpServer) HandleOnMessage(wsSession *melody.Session, msg []byte) {
-	roomID, userName := extractWsParams(wsSession)
-	if authRequired := server.roomAuthRequired(wsSession); authRequired {
-		server.AuthenticateRoom(wsSession, roomID, userName, msg)
+// ListPins lists the pinned messages, protected rooms require their password in the X-Room-Password header or the owner token.
+func (server *HttpServer) ListPins(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomMember(c, roomID, "") {
+		return
+	}
+
+	pins, err := server.roomService.ListPins(c, roomID)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, pins)
+}
+
+func (server *HttpServer) PinMessage(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var dto PinMessageDTO
+	if err := c.ShouldBindBodyWithJSON(&dto); err != nil {
+		response(c, http.StatusBadRequest, err)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
+	}
+
+	pinned, err := server.roomService.PinMessage(c, roomID, dto.MessageID)
+	if errors.Is(err, common.ErrTooManyPins) {
+		response(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if pinned == nil {
+		response(c, http.StatusNotFound, common.ErrNoMessage)
+		return
+	}
+	c.JSON(http.StatusCreated, pinned)
+}
+
+func (server *HttpServer) UnpinMessage(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	messageID, err := strconv.ParseUint(c.Param("message"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
+	}
+
+	unpinned, err := server.roomService.UnpinMessage(c, roomID, messageID)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !unpinned {
+		response(c, http.StatusNotFound, common.ErrNoPin)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// CreateInvite creates an invite token joining the protected room without its password.
+func (server *HttpServer) CreateInvite(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var dto CreateInviteDTO
+	if err := c.ShouldBindBodyWithJSON(&dto); err != nil {
+		response(c, http.StatusBadRequest, err)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
+	}
+
+	invite, err := server.roomService.CreateInvite(c, roomID, dto)
+	if errors.Is(err, common.ErrInvalidParam) {
+		response(c, http.StatusBadRequest, err)
+		return
+	}
+	if errors.Is(err, common.ErrNoInvites) {
+		response(c, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusCreated, invite)
+}
+
+func (server *HttpServer) ListInvites(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
+	}
+
+	invites, err := server.roomService.ListInvites(c, roomID)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, invites)
+}
+
+func (server *HttpServer) RevokeInvite(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	inviteID, err := strconv.ParseUint(c.Param("invite"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
 		return
 	}
-	decodedMsg, err := decodeToMessage(msg)
+
+	revoked, err := server.roomService.RevokeInvite(c, roomID, inviteID)
 	if err != nil {
-		wsSession.CloseWithMsg(melody.FormatCloseMessage(400, "Invalid message"))
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !revoked {
+		response(c, http.StatusNotFound, common.ErrNoInvite)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RequestToJoin stores a join request to a private room, its member token joins the room once the owner approved it.
+func (server *HttpServer) RequestToJoin(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var dto MemberDTO
+	if err := c.ShouldBindBodyWithJSON(&dto); err != nil {
+		response(c, http.StatusBadRequest, err)
+		return
+	}
+	if !dto.isValid() {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	exist, err := server.roomService.RoomExist(c, roomID)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !exist {
+		response(c, http.StatusNotFound, common.ErrRoomNotFound)
 		return
 	}
-	decodedMsg.RoomID = roomID
-	decodedMsg.UserName = userName
-	err = server.roomService.HandleNewMessage(context.Background(), *decodedMsg)
 
+	request, err := server.roomService.RequestToJoin(c, roomID, dto.UserName)
+	if errors.Is(err, common.ErrNotPrivate) || errors.Is(err, common.ErrMemberExists) {
+		response(c, http.StatusConflict, err)
+		return
+	}
 	if err != nil {
 		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
 	}
+	c.JSON(http.StatusCreated, request)
 }
 
-func (server *HttpServer) roomAuthRequired(wsSession *melody.Session) bool {
-	_, exists := wsSession.Get(sessRidKey)
-	return !exists
+func (server *HttpServer) ListJoinRequests(c *gin.Context) {
+	server.listMembers(c, MemberPending)
 }
 
-func (server *HttpServer) AuthenticateRoom(wsSession *melody.Session, roomID RoomID, userName string, msg []byte) {
-	password, err := extractPassword(msg)
+func (server *HttpServer) ListMembers(c *gin.Context) {
+	server.listMembers(c, MemberActive)
+}
 
-	if err != nil || password == "" {
-		wsSession.CloseWithMsg(melody.FormatCloseMessage(400, "Invalid password"))
+func (server *HttpServer) listMembers(c *gin.Context, status string) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
 		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
+	}
+
+	members, err := server.roomService.ListMembers(c, roomID, status)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, members)
+}
 
+func (server *HttpServer) ApproveJoinRequest(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
 	}
-	validPassword, err := server.roomService.IsValidPassword(context.Background(), roomID, password)
+
+	approved, err := server.roomService.ApproveJoinRequest(c, roomID, c.Param("username"))
 	if err != nil {
-		wsSession.CloseWithMsg(melody.FormatCloseMessage(500, "Error: "+err.Error()))
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
-	if !validPassword {
-		wsSession.CloseWithMsg(melody.FormatCloseMessage(400, "Invalid password"))
+	if !approved {
+		response(c, http.StatusNotFound, common.ErrNoJoinRequest)
 		return
 	}
-	server.joinRoom(wsSession, roomID, userName)
+	c.Status(http.StatusNoContent)
 }
 
-func (server *HttpServer) sendAuthRequiredMessage(wsSession *melody.Session) error {
-	return wsSession.Write([]byte("This room is protected, please enter the password"))
+func (server *HttpServer) RejectJoinRequest(c *gin.Context) {
+	server.removeMember(c, MemberPending, common.ErrNoJoinRequest)
 }
 
-func (server *HttpServer) joinRoom(wsSession *melody.Session, roomID RoomID, userName string) {
-	err := server.initializeChatSession(wsSession, roomID, userName)
+// AddMember adds a member to a private room without a join request.
+func (server *HttpServer) AddMember(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
-		wsSession.CloseWithMsg(melody.FormatCloseMessage(500, "Error: "+err.Error()))
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var dto MemberDTO
+	if err := c.ShouldBindBodyWithJSON(&dto); err != nil {
+		response(c, http.StatusBadRequest, err)
+		return
+	}
+	if !dto.isValid() {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
 		return
 	}
 
-	if err := server.roomService.BroadcastConnectMessage(context.Background(), roomID, userName); err != nil {
-		wsSession.CloseWithMsg(melody.FormatCloseMessage(500, "Error: "+err.Error()))
+	member, err := server.roomService.AddMember(c, roomID, dto.UserName)
+	if errors.Is(err, common.ErrNotPrivate) {
+		response(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
+	c.JSON(http.StatusCreated, member)
 }
 
-func (server *HttpServer) initializeChatSession(wsSession *melody.Session, roomID RoomID, userName string) error {
-	ctx := context.Background()
-	if err := server.roomService.AddRoomSubscriber(ctx, roomID, userName, server.msgSubscriber.topic); err != nil {
-		return err
+func (server *HttpServer) RemoveMember(c *gin.Context) {
+	server.removeMember(c, MemberActive, common.ErrNoMember)
+}
+
+func (server *HttpServer) removeMember(c *gin.Context, status string, errNotFound error) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomOwner(c, roomID) {
+		return
+	}
+
+	removed, err := server.roomService.RemoveMember(c, roomID, c.Param("username"), status)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !removed {
+		response(c, http.StatusNotFound, errNotFound)
+		return
 	}
-	wsSession.Set(sessRidKey, roomID)
-	return nil
+	c.Status(http.StatusNoContent)
 }
 
-func extractPassword(msg []byte) (string, error) {
-	auth, err := decodeToRoomAuth(msg)
+// ScheduleMessage schedules a text message, protected rooms require their password in the X-Room-Password
+// header or the owner token. A bearer token is the author token of the message, one is created when missing.
+func (server *HttpServer) ScheduleMessage(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
-		return "", err
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var dto ScheduleMessageDTO
+	if err := c.ShouldBindBodyWithJSON(&dto); err != nil {
+		response(c, http.StatusBadRequest, err)
+		return
+	}
+	if !dto.isValid(time.Now(), server.scheduleMaxDelay) {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if !server.authorizeRoomMember(c, roomID, dto.UserName) {
+		return
 	}
-	return auth.Password, nil
+
+	scheduled, err := server.roomService.ScheduleMessage(c, roomID, extractBearerToken(c), dto)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusCreated, scheduled)
+}
+
+// ListScheduledMessages lists the pending messages scheduled with the author token in the bearer token.
+func (server *HttpServer) ListScheduledMessages(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	authorToken := extractBearerToken(c)
+	if err != nil || authorToken == "" {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+
+	scheduled, err := server.roomService.ListScheduledMessages(c, roomID, authorToken)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, scheduled)
+}
+
+func (server *HttpServer) CancelScheduledMessage(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	scheduledID, err := strconv.ParseUint(c.Param("scheduled"), 10, 64)
+	authorToken := extractBearerToken(c)
+	if err != nil || authorToken == "" {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+
+	canceled, err := server.roomService.CancelScheduledMessage(c, roomID, scheduledID, authorToken)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !canceled {
+		response(c, http.StatusNotFound, common.ErrNoScheduled)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// authorizeRoomMember writes the error response and returns false unless the room exists and the
+// request carries the owner token, or the member token of a private room in the X-Room-Member-Token
+// header, which must be the one of userName when it is set, and the password of a protected room in
+// the X-Room-Password header.
+func (server *HttpServer) authorizeRoomMember(c *gin.Context, roomID RoomID, userName string) bool {
+	exist, err := server.roomService.RoomExist(c, roomID)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	if !exist {
+		response(c, http.StatusNotFound, common.ErrRoomNotFound)
+		return false
+	}
+	isOwner, err := server.roomService.IsRoomOwner(c, roomID, extractBearerToken(c))
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	if isOwner {
+		return true
+	}
+	visibility, err := server.roomService.RoomVisibility(c, roomID)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	if visibility == VisibilityPrivate {
+		member, err := server.roomService.RoomMember(c, roomID, c.GetHeader("X-Room-Member-Token"))
+		if err != nil {
+			server.logger.Error(err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return false
+		}
+		if member == nil || (userName != "" && member.UserName != userName) {
+			response(c, http.StatusForbidden, common.ErrNotMember)
+			return false
+		}
+	}
+	protected, err := server.roomService.IsRoomProtected(c, roomID)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	if !protected {
+		return true
+	}
+	if password := c.GetHeader("X-Room-Password"); password != "" {
+		valid, err := server.roomService.IsValidPassword(c, roomID, password)
+		if err != nil {
+			server.logger.Error(err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return false
+		}
+		if valid {
+			return true
+		}
+	}
+	response(c, http.StatusForbidden, common.ErrBadPassword)
+	return false
+}
+
+// authorizeRoomOwner writes the error response and returns false unless the request carries the room owner token.
+func (server *HttpServer) authorizeRoomOwner(c *gin.Context, roomID RoomID) bool {
+	exist, err := server.roomService.RoomExist(c, roomID)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	if !exist {
+		response(c, http.StatusNotFound, common.ErrRoomNotFound)
+		return false
+	}
+	isOwner, err := server.roomService.IsRoomOwner(c, roomID, extractBearerToken(c))
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	if !isOwner {
+		response(c, http.StatusForbidden, common.ErrNotRoomOwner)
+		return false
+	}
+	return true
+}
+
+func (server *HttpServer) HandleRoomOnJoin(wsSession *melody.Session) {
+	sess := newWsSession(wsSession)
+	wsSession.Set(wsSessionKey, sess)
+	server.sessionHandler.openSession(sess, joinCredentialsOf(wsSession.Request.URL.Query()))
+}
+
+func (server *HttpServer) HandleRoomOnLeave(wsSession *melody.Session, n int, s string) error {
+	return server.sessionHandler.leaveRoom(wsSessionOf(wsSession))
+}
+
+// HandleOnMessage handles the JSON text frames, sessions that negotiated protobuf may send them too.
+func (server *HttpServer) HandleOnMessage(wsSession *melody.Session, msg []byte) {
+	server.sessionHandler.handleMessage(wsSessionOf(wsSession), ContentTypeJSON, msg)
+}
+
+// HandleOnBinaryMessage handles the protobuf binary frames.
+func (server *HttpServer) HandleOnBinaryMessage(wsSession *melody.Session, msg []byte) {
+	server.sessionHandler.handleMessage(wsSessionOf(wsSession), ContentTypeProtobuf, msg)
+}
+
+// HandleSentMessage is called by melody once a text or binary message was written to the socket.
+func (server *HttpServer) HandleSentMessage(wsSession *melody.Session, msg []byte) {
+	server.sendQueues.Sent(wsSessionOf(wsSession))
+}
+
+func extractExportOptions(c *gin.Context) (ExportOptions, error) {
+	options := ExportOptions{Format: c.DefaultQuery("format", ExportJSON)}
+	var err error
+	if from := c.Query("from"); from != "" {
+		if options.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return options, err
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if options.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return options, err
+		}
+	}
+	return options, nil
+}
+
+func extractBearerToken(c *gin.Context) string {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// OpenAPI serves the OpenAPI document of the REST API.
+func (server *HttpServer) OpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/yaml", api.OpenAPI)
 }
 
-func extractWsParams(wsSession *melody.Session) (roomID RoomID, userName string) {
-	userName = wsSession.Request.URL.Query().Get("userName")
-	// path e.g. /api/rooms/:roomID
-	pathParts := strings.Split(wsSession.Request.URL.Path, "/")
-	roomID, _ = strconv.ParseUint(pathParts[len(pathParts)-1], 10, 64)
-	return
+// AsyncAPI serves the AsyncAPI document of the room websocket.
+func (server *HttpServer) AsyncAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/yaml", api.AsyncAPI)
 }
 
 func response(c *gin.Context, httpCode int, err error) {
@@ -0,0 +1,73 @@
+package room
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+var dedupRedisKeyPrefix = "chat:dedup"
+
+// maxClientMsgIDLength bounds the client chosen IDs kept in redis.
+const maxClientMsgIDLength = 64
+
+// MessageDeduplicator remembers the client_msg_id of the sent text messages for a window,
+// so a message resent by the client is stored and broadcast once.
+type MessageDeduplicator struct {
+	redisClient redis.UniversalClient
+	window      time.Duration
+}
+
+func NewMessageDeduplicator(config *config.Config, redisClient redis.UniversalClient) *MessageDeduplicator {
+	return &MessageDeduplicator{redisClient, time.Duration(config.Room.Dedup.WindowSecond) * time.Second}
+}
+
+// Claim reports whether the message was not sent before within the window. Messages without
+// a client message ID are always claimed.
+func (dedup *MessageDeduplicator) Claim(ctx context.Context, msg Message) (bool, error) {
+	if msg.ClientMsgID == "" {
+		return true, nil
+	}
+	return dedup.redisClient.SetNX(ctx, dedup.key(msg), 1, dedup.window).Result()
+}
+
+// Release forgets a claimed message that could not be sent, so the client can retry it.
+func (dedup *MessageDeduplicator) Release(ctx context.Context, msg Message) error {
+	if msg.ClientMsgID == "" {
+		return nil
+	}
+	return dedup.redisClient.Del(ctx, dedup.key(msg)).Err()
+}
+
+func (dedup *MessageDeduplicator) key(msg Message) string {
+	return dedupRedisKeyPrefix + ":" + strconv.FormatUint(msg.RoomID, 10) + ":" + msg.UserName + ":" + msg.ClientMsgID
+}
+
+// deliveredIDs keeps the last delivered message IDs of a session, to drop messages redelivered by the broker.
+type deliveredIDs struct {
+	ring []MessageID
+	next int
+	ids  map[MessageID]struct{}
+}
+
+func newDeliveredIDs(size int) *deliveredIDs {
+	return &deliveredIDs{ring: make([]MessageID, size), ids: make(map[MessageID]struct{}, size)}
+}
+
+// add reports whether id was not delivered before.
+func (delivered *deliveredIDs) add(id MessageID) bool {
+	if len(delivered.ring) == 0 {
+		return true
+	}
+	if _, ok := delivered.ids[id]; ok {
+		return false
+	}
+	delete(delivered.ids, delivered.ring[delivered.next])
+	delivered.ring[delivered.next] = id
+	delivered.ids[id] = struct{}{}
+	delivered.next = (delivered.next + 1) % len(delivered.ring)
+	return true
+}
@@ -0,0 +1,105 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingSaveRepo fails storing messages.
+type failingSaveRepo struct {
+	MessageRepo
+}
+
+var errSaveFailed = errors.New("save failed")
+
+func (repo *failingSaveRepo) InsertMessageWithOutbox(ctx context.Context, msg Message, ttl time.Duration) error {
+	return errSaveFailed
+}
+
+func TestMessageDeduplicator(t *testing.T) {
+	server := newTestRoomServer(t)
+	service, ctx := server.service, context.Background()
+	room, err := service.CreateRoom(ctx, CreateRoomDTO{Name: "dedup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := func() int {
+		t.Helper()
+		msgs, err := server.storage.MessageRepo.LatestMessages(ctx, room.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(msgs)
+	}
+
+	// a resend within the window is stored once, messages without a client ID are never deduplicated
+	for i := 0; i < 2; i++ {
+		if err := service.BroadcastTextMessage(ctx, room.ID, "alice", "hello", "msg-1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := service.BroadcastTextMessage(ctx, room.ID, "alice", "hello", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := stored(); count != 3 {
+		t.Fatalf("stored %d messages, want 3", count)
+	}
+	// the client ID is scoped to the user
+	if err := service.BroadcastTextMessage(ctx, room.ID, "bob", "hello", "msg-1"); err != nil {
+		t.Fatal(err)
+	}
+	if count := stored(); count != 4 {
+		t.Fatalf("stored %d messages, want the message of another user with the same client ID", count)
+	}
+
+	// a failed save releases the claim, so the client can retry
+	service.messageRepo = &failingSaveRepo{server.storage.MessageRepo}
+	if err := service.BroadcastTextMessage(ctx, room.ID, "alice", "retried", "msg-2"); !errors.Is(err, errSaveFailed) {
+		t.Fatalf("got %v, want the save error", err)
+	}
+	service.messageRepo = server.storage.MessageRepo
+	if err := service.BroadcastTextMessage(ctx, room.ID, "alice", "retried", "msg-2"); err != nil {
+		t.Fatal(err)
+	}
+	if count := stored(); count != 5 {
+		t.Fatalf("stored %d messages, want the retried message", count)
+	}
+
+	// once the window passed the client ID is accepted again
+	server.redis.FastForward(time.Duration(server.config.Room.Dedup.WindowSecond)*time.Second + time.Second)
+	if err := service.BroadcastTextMessage(ctx, room.ID, "alice", "hello", "msg-1"); err != nil {
+		t.Fatal(err)
+	}
+	if count := stored(); count != 6 {
+		t.Fatalf("stored %d messages, want the resend after the window", count)
+	}
+}
+
+func TestDeliveredIDs(t *testing.T) {
+	delivered := newDeliveredIDs(3)
+	for _, step := range []struct {
+		id  MessageID
+		new bool
+	}{
+		{1, true}, {2, true}, {3, true},
+		{2, false},
+		// 4 evicts 1, which is admitted again and evicts 2
+		{4, true}, {1, true}, {2, true},
+		{4, false}, {3, true},
+	} {
+		if added := delivered.add(step.id); added != step.new {
+			t.Fatalf("adding %d reported %v, want %v", step.id, added, step.new)
+		}
+	}
+	if len(delivered.ids) != len(delivered.ring) {
+		t.Fatalf("%d IDs kept, want %d", len(delivered.ids), len(delivered.ring))
+	}
+
+	// a session without a window delivers every message
+	disabled := newDeliveredIDs(0)
+	if !disabled.add(1) || !disabled.add(1) {
+		t.Fatal("a disabled window dropped a message")
+	}
+}
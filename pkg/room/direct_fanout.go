@@ -0,0 +1,165 @@
+package room
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+	subscriberpb "github.com/omran95/chatroom/pkg/subscriber/proto"
+)
+
+// Direct fan-out skips the subscriber service: a room message is published to the topic of its room
+// partition, and every room instance consumes all the partition topics, writing the messages of the
+// rooms it has sessions in. A message costs one publish plus one consume per instance, instead of
+// one publish and consume to the subscriber service, a redis lookup and one publish and consume per
+// instance hosting the room.
+
+var RoomPartitionTopicPrefix = "chat.msg.room."
+
+// RoomPartitionTopic hashes the room ID to one of the partitions.
+func RoomPartitionTopic(roomID RoomID, partitions int) string {
+	return RoomPartitionTopicPrefix + strconv.Itoa(int(roomHash(roomID)%uint32(partitions)))
+}
+
+// roomHash spreads the room IDs, snowflake IDs end with the machine ID and would put every room
+// created by the same instance in the same partition or shard.
+func roomHash(roomID RoomID) uint32 {
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], roomID)
+	hash := fnv.New32a()
+	hash.Write(id[:])
+	return hash.Sum32()
+}
+
+type RoomPartitionPublisher struct {
+	publisher   message.Publisher
+	partitions  int
+	contentType string
+}
+
+func NewRoomPartitionPublisher(publisher message.Publisher, config *config.Config) (*RoomPartitionPublisher, error) {
+	contentType, err := PayloadContentType(config.Kafka.PayloadFormat)
+	if err != nil {
+		return nil, err
+	}
+	return &RoomPartitionPublisher{publisher, config.Room.DirectFanout.Partitions, contentType}, nil
+}
+
+func (msgPub *RoomPartitionPublisher) PublishMessage(ctx context.Context, msg Message) error {
+	kafkaMessage := NewBrokerMessage(watermill.NewUUID(), msgPub.contentType, msg)
+	kafkaMessage.Metadata.Set("partition_key", strconv.FormatUint(msg.RoomID, 10))
+	return msgPub.publisher.Publish(RoomPartitionTopic(msg.RoomID, msgPub.partitions), kafkaMessage)
+}
+
+// NewDirectSubscriberEndpoints replaces the subscriber service calls, room subscribers are only
+// tracked in the local session index with direct fan-out.
+func NewDirectSubscriberEndpoints() SubscriberEndpoints {
+	return SubscriberEndpoints{
+		AddRoomSubscriber: func(ctx context.Context, request interface{}) (interface{}, error) {
+			return &subscriberpb.AddRoomSubscriberResponse{}, nil
+		},
+		RemoveRoomSubscriber: func(ctx context.Context, request interface{}) (interface{}, error) {
+			return &subscriberpb.RemoveRoomSubscriberResponse{}, nil
+		},
+	}
+}
+
+// DirectMessageSubscriber consumes every room partition topic from its creation on, so a session
+// joining a room gets the room messages published after its join without waiting for a partition
+// subscription. The subscriber must not use a consumer group, every instance reads the whole
+// partition topics from the newest offset.
+type DirectMessageSubscriber struct {
+	subscriber message.Subscriber
+	sessions   *RoomSessions
+	logger     common.HttpLog
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	closed     chan struct{}
+}
+
+func NewDirectMessageSubscriber(config *config.Config, subscriber message.Subscriber, sessions *RoomSessions, logger common.HttpLog) (*DirectMessageSubscriber, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	directSubscriber := &DirectMessageSubscriber{
+		subscriber: subscriber,
+		sessions:   sessions,
+		logger:     logger,
+		cancel:     cancel,
+		closed:     make(chan struct{}),
+	}
+	for partition := 0; partition < config.Room.DirectFanout.Partitions; partition++ {
+		topic := RoomPartitionTopicPrefix + strconv.Itoa(partition)
+		if err := directSubscriber.consume(ctx, topic); err != nil {
+			cancel()
+			directSubscriber.wg.Wait()
+			return nil, fmt.Errorf("error subscribing to %s: %w", topic, err)
+		}
+	}
+	return directSubscriber, nil
+}
+
+func (subscriber *DirectMessageSubscriber) RegisterHandler() {}
+
+func (subscriber *DirectMessageSubscriber) Run() error {
+	<-subscriber.closed
+	return nil
+}
+
+func (subscriber *DirectMessageSubscriber) GracefulStop() error {
+	subscriber.cancel()
+	subscriber.wg.Wait()
+	close(subscriber.closed)
+	return subscriber.subscriber.Close()
+}
+
+func (subscriber *DirectMessageSubscriber) Topic() string {
+	return RoomPartitionTopicPrefix + "*"
+}
+
+func (subscriber *DirectMessageSubscriber) JoinRoom(roomID RoomID, sess Session) error {
+	subscriber.sessions.Add(roomID, sess)
+	return nil
+}
+
+func (subscriber *DirectMessageSubscriber) LeaveRoom(roomID RoomID, sess Session) {
+	subscriber.sessions.Remove(roomID, sess)
+}
+
+func (subscriber *DirectMessageSubscriber) consume(ctx context.Context, topic string) error {
+	// the partition topics are subscribed before anything was published to them
+	if initializer, ok := subscriber.subscriber.(message.SubscribeInitializer); ok {
+		if err := initializer.SubscribeInitialize(topic); err != nil {
+			return err
+		}
+	}
+	messages, err := subscriber.subscriber.Subscribe(ctx, topic)
+	if err != nil {
+		return err
+	}
+	subscriber.wg.Add(1)
+	go func() {
+		defer subscriber.wg.Done()
+		// the channel is closed once the context is canceled
+		for msg := range messages {
+			// the partition key is the room ID, the messages of rooms without local sessions are not decoded
+			if roomID, err := strconv.ParseUint(msg.Metadata.Get("partition_key"), 10, 64); err == nil && !subscriber.sessions.HasRoom(roomID) {
+				msg.Ack()
+				continue
+			}
+			message, err := DecodeMessage(brokerContentType(msg), msg.Payload)
+			if err != nil {
+				subscriber.logger.Error("direct fan-out: " + err.Error())
+			} else {
+				subscriber.sessions.Broadcast(message, brokerContentType(msg), msg.Payload)
+			}
+			msg.Ack()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,307 @@
+package room
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+)
+
+// testSession records the messages written to it and reports them sent right away, like a
+// transport with an instant client.
+type testSession struct {
+	sessionState
+	contentType string
+	queues      *SendQueues
+	out         chan []byte
+	received    chan []byte
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newTestSession(roomID RoomID, userName string, queues *SendQueues) *testSession {
+	sess := &testSession{
+		sessionState: sessionState{roomID: roomID, userName: userName},
+		contentType:  ContentTypeJSON,
+		queues:       queues,
+		out:          make(chan []byte, sendWindow),
+		received:     make(chan []byte, 1024),
+		closed:       make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case data := <-sess.out:
+				sess.received <- data
+				queues.Sent(sess)
+			case <-sess.closed:
+				return
+			}
+		}
+	}()
+	return sess
+}
+
+func (sess *testSession) ContentType() string {
+	return sess.contentType
+}
+
+// Write never blocks, SendQueues hands at most sendWindow messages to a session at once.
+func (sess *testSession) Write(data []byte) error {
+	sess.out <- data
+	return nil
+}
+
+func (sess *testSession) Close(code int, reason string) error {
+	sess.closeOnce.Do(func() { close(sess.closed) })
+	return nil
+}
+
+var testInstanceSeq atomic.Int64
+
+var testLogger = common.HttpLog{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+// newTestConfig returns the default configuration.
+func newTestConfig(tb testing.TB) *config.Config {
+	tb.Helper()
+	cfg, err := config.NewConfig()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cfg
+}
+
+// newTestSendQueues creates send queues with their own metric names, metrics are registered globally.
+func newTestSendQueues(tb testing.TB, cfg *config.Config) *SendQueues {
+	tb.Helper()
+	name := "test" + strconv.FormatInt(testInstanceSeq.Add(1), 10)
+	compression, err := NewWsCompression(name, cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	queues, err := NewSendQueues(name, cfg, compression)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return queues
+}
+
+// countingPublisher counts the broker messages and bytes published, every publish to a topic is
+// consumed once per subscribed instance.
+type countingPublisher struct {
+	message.Publisher
+	publishes atomic.Int64
+	bytes     atomic.Int64
+}
+
+func (publisher *countingPublisher) Publish(topic string, msgs ...*message.Message) error {
+	for _, msg := range msgs {
+		publisher.publishes.Add(1)
+		publisher.bytes.Add(int64(len(msg.Payload)))
+	}
+	return publisher.Publisher.Publish(topic, msgs...)
+}
+
+// fanoutBench runs the fan-out of one path: instances room instances, the room of the messages has a
+// session on hosting of them.
+type fanoutBench struct {
+	publisher MessagePublisher
+	broker    *countingPublisher
+	consumes  atomic.Int64
+	sessions  []*testSession
+}
+
+const (
+	benchInstances = 4
+	benchHosting   = 2
+	benchRoomID    = RoomID(42)
+)
+
+func newBrokerForBench(tb testing.TB) *gochannel.GoChannel {
+	pubSub := gochannel.NewGoChannel(gochannel.Config{OutputChannelBuffer: 1024}, watermill.NopLogger{})
+	tb.Cleanup(func() { pubSub.Close() })
+	return pubSub
+}
+
+// newDirectFanoutBench publishes to the room partition topics, every instance consumes all of them.
+func newDirectFanoutBench(tb testing.TB) *fanoutBench {
+	cfg := newTestConfig(tb)
+	pubSub := newBrokerForBench(tb)
+	bench := &fanoutBench{broker: &countingPublisher{Publisher: pubSub}}
+	publisher, err := NewRoomPartitionPublisher(bench.broker, cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	bench.publisher = publisher
+	for i := 0; i < benchInstances; i++ {
+		sessions := NewRoomSessions(newTestSendQueues(tb, cfg))
+		subscriber, err := NewDirectMessageSubscriber(cfg, &countingSubscriber{pubSub, &bench.consumes}, sessions, testLogger)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { subscriber.cancel(); subscriber.wg.Wait() })
+		if i < benchHosting {
+			sess := newTestSession(benchRoomID, "user"+strconv.Itoa(i), sessions.sendQueues)
+			subscriber.JoinRoom(benchRoomID, sess)
+			bench.sessions = append(bench.sessions, sess)
+		}
+	}
+	return bench
+}
+
+// newSubscriberFanoutBench publishes to chat.msg.pub, a subscriber service hop looks up the hosting
+// instances, as the subscriber service does in redis, and publishes to each of their topics.
+func newSubscriberFanoutBench(tb testing.TB) *fanoutBench {
+	cfg := newTestConfig(tb)
+	pubSub := newBrokerForBench(tb)
+	bench := &fanoutBench{broker: &countingPublisher{Publisher: pubSub}}
+	publisher, err := NewMessagePublisher(bench.broker, cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	bench.publisher = publisher
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	consumer := &countingSubscriber{pubSub, &bench.consumes}
+
+	roomTopics := map[RoomID][]string{}
+	for i := 0; i < benchInstances; i++ {
+		sessions := NewRoomSessions(newTestSendQueues(tb, cfg))
+		topic := "room.msg.subscriber.host" + strconv.Itoa(i)
+		subscriber := &MessageSubscriber{topic: topic, sessions: sessions}
+		messages, err := consumer.Subscribe(ctx, topic)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		go func() {
+			for msg := range messages {
+				if err := subscriber.HandleIncomingMessage(msg); err != nil {
+					tb.Error(err)
+				}
+				msg.Ack()
+			}
+		}()
+		if i < benchHosting {
+			sess := newTestSession(benchRoomID, "user"+strconv.Itoa(i), sessions.sendQueues)
+			subscriber.JoinRoom(benchRoomID, sess)
+			bench.sessions = append(bench.sessions, sess)
+			roomTopics[benchRoomID] = append(roomTopics[benchRoomID], topic)
+		}
+	}
+
+	messages, err := consumer.Subscribe(ctx, MessagePubTopic)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		for msg := range messages {
+			messages, err := DecodeBrokerMessage(msg)
+			if err != nil {
+				tb.Error(err)
+				continue
+			}
+			for _, topic := range roomTopics[messages[0].RoomID] {
+				if err := bench.broker.Publish(topic, NewBrokerMessage(watermill.NewUUID(), brokerContentType(msg), messages[0])); err != nil {
+					tb.Error(err)
+				}
+			}
+			msg.Ack()
+		}
+	}()
+	return bench
+}
+
+type countingSubscriber struct {
+	message.Subscriber
+	consumes *atomic.Int64
+}
+
+func (subscriber *countingSubscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	messages, err := subscriber.Subscriber.Subscribe(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	counted := make(chan *message.Message)
+	go func() {
+		defer close(counted)
+		for msg := range messages {
+			subscriber.consumes.Add(1)
+			counted <- msg
+		}
+	}()
+	return counted, nil
+}
+
+// run publishes b.N messages one by one and waits until every hosting session received each of
+// them, so ns/op is the end-to-end latency of a message.
+func (bench *fanoutBench) run(b *testing.B) {
+	msg := Message{RoomID: benchRoomID, Event: EventText, UserName: "bench", Payload: "hello, room", Time: time.Now().UnixMilli()}
+	bench.broker.publishes.Store(0)
+	bench.broker.bytes.Store(0)
+	bench.consumes.Store(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg.ID = uint64(i + 1)
+		if err := bench.publisher.PublishMessage(context.Background(), msg); err != nil {
+			b.Fatal(err)
+		}
+		for _, sess := range bench.sessions {
+			select {
+			case <-sess.received:
+			case <-time.After(5 * time.Second):
+				b.Fatalf("message %d not received", i)
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(bench.broker.publishes.Load())/float64(b.N), "publishes/msg")
+	b.ReportMetric(float64(bench.consumes.Load())/float64(b.N), "consumes/msg")
+	b.ReportMetric(float64(bench.broker.bytes.Load())/float64(b.N), "published-bytes/msg")
+}
+
+// BenchmarkFanout compares the end-to-end latency and the broker traffic of a message sent to a
+// room hosted by 2 of 4 instances, through the subscriber service and with direct fan-out.
+func BenchmarkFanout(b *testing.B) {
+	paths := []struct {
+		name  string
+		setup func(testing.TB) *fanoutBench
+	}{
+		{"subscriber", newSubscriberFanoutBench},
+		{"direct", newDirectFanoutBench},
+	}
+	for _, path := range paths {
+		b.Run(fmt.Sprintf("%s/instances=%d/hosting=%d", path.name, benchInstances, benchHosting), func(b *testing.B) {
+			path.setup(b).run(b)
+		})
+	}
+}
+
+func TestDirectFanoutDeliversToJoinedSessions(t *testing.T) {
+	bench := newDirectFanoutBench(t)
+	msg := Message{ID: 1, RoomID: benchRoomID, Event: EventText, UserName: "bench", Payload: "hello"}
+	if err := bench.publisher.PublishMessage(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	for _, sess := range bench.sessions {
+		select {
+		case data := <-sess.received:
+			decoded, err := DecodeMessage(ContentTypeJSON, data)
+			if err != nil || decoded.Payload != "hello" {
+				t.Fatalf("got %q: %v", data, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not received")
+		}
+	}
+}
@@ -1,26 +1,67 @@
 package room
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
+
+// A public room is listed in the room directory, an unlisted one is joined with its ID and a
+// private one only admits its members.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
 
 type CreateRoomDTO struct {
 	Name      string `json:"name" binding:"required"`
 	Protected bool   `json:"protected"`
 	Password  string `json:"password"`
+	// Visibility is unlisted when empty
+	Visibility string `json:"visibility"`
+	Retention
 }
 
 func (dto *CreateRoomDTO) isValid() bool {
 	if dto.Protected && dto.Password == "" {
 		return false
 	}
+	switch dto.Visibility {
+	case "", VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+	default:
+		return false
+	}
+	if dto.RetentionDays < 0 || dto.RetentionDays > maxRetentionDays || dto.RetentionMessages < 0 {
+		return false
+	}
 	return true
 }
 
+// maxRetentionDays keeps the message TTL within the 20 years Cassandra accepts.
+const maxRetentionDays = 7300
+
+// Retention limits how long messages of a room are kept, zero values keep messages forever.
+type Retention struct {
+	// RetentionDays expires messages after N days through the message TTL
+	RetentionDays int `json:"retention_days"`
+	// RetentionMessages keeps the last N messages, older ones are deleted by the retention worker
+	RetentionMessages int `json:"retention_messages"`
+}
+
+func (retention Retention) TTL() time.Duration {
+	return time.Duration(retention.RetentionDays) * 24 * time.Hour
+}
+
 type RoomID = uint64
 
 type RoomPresenter struct {
-	ID        RoomID `json:"room_id"`
-	Name      string `json:"name"`
-	Protected bool   `json:"protected"`
+	ID         RoomID `json:"room_id"`
+	Name       string `json:"name"`
+	Protected  bool   `json:"protected"`
+	Visibility string `json:"visibility"`
+	Retention
+	// OwnerToken is only returned to the room creator, it authorizes the owner operations
+	OwnerToken string `json:"owner_token,omitempty"`
 }
 
 type Room struct {
@@ -28,19 +69,32 @@ type Room struct {
 	Name      string `json:"name"`
 	Protected bool   `json:"protected"`
 	Password  string `json:"password"`
+	// Visibility is one of VisibilityPublic, VisibilityUnlisted or VisibilityPrivate
+	Visibility string `json:"visibility"`
+	Retention
+	// LastActivityAt is the unix time in milliseconds of the last message or join
+	LastActivityAt int64  `json:"last_activity_at"`
+	OwnerTokenHash string `json:"-"`
 }
 
 func (room *Room) FromDTO(dto CreateRoomDTO) {
 	room.Name = dto.Name
 	room.Protected = dto.Protected
 	room.Password = dto.Password
+	room.Visibility = dto.Visibility
+	if room.Visibility == "" {
+		room.Visibility = VisibilityUnlisted
+	}
+	room.Retention = dto.Retention
 }
 
 func (room *Room) ToPresenter() *RoomPresenter {
 	return &RoomPresenter{
-		ID:        room.ID,
-		Name:      room.Name,
-		Protected: room.Protected,
+		ID:         room.ID,
+		Name:       room.Name,
+		Protected:  room.Protected,
+		Visibility: room.Visibility,
+		Retention:  room.Retention,
 	}
 }
 
@@ -60,6 +114,13 @@ const (
 	EventAction
 	EventSeen
 	EventFile
+	EventPoll
+	EventPollVote
+	EventPollClose
+	EventPollResult
+	EventPin
+	EventUnpin
+	EventRoomState
 )
 
 type Message struct {
@@ -70,6 +131,12 @@ type Message struct {
 	Payload  string    `json:"payload"`
 	Seen     bool      `json:"seen"`
 	Time     int64     `json:"time"`
+	// ClientMsgID is chosen by the sending client to recognize resends, it is not stored
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+}
+
+func (m *Message) isTyping() bool {
+	return m.Event == EventAction && (m.Payload == string(IsTypingMessage) || m.Payload == string(EndTypingMessage))
 }
 
 func (m *Message) Encode() []byte {
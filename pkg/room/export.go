@@ -0,0 +1,176 @@
+package room
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/common"
+)
+
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+	ExportHTML = "html"
+)
+
+// ExportOptions selects the transcript format and the [From, To) time range, zero times are unbounded.
+type ExportOptions struct {
+	Format string
+	From   time.Time
+	To     time.Time
+}
+
+func (options ExportOptions) isValid() bool {
+	switch options.Format {
+	case ExportJSON, ExportCSV, ExportHTML:
+	default:
+		return false
+	}
+	return options.From.IsZero() || options.To.IsZero() || options.From.Before(options.To)
+}
+
+func (options ExportOptions) ContentType() string {
+	switch options.Format {
+	case ExportCSV:
+		return "text/csv; charset=utf-8"
+	case ExportHTML:
+		return "text/html; charset=utf-8"
+	}
+	return "application/json; charset=utf-8"
+}
+
+// idRange converts the time range to message IDs, snowflake IDs are ordered by creation time.
+func (options ExportOptions) idRange() (fromID, toID MessageID) {
+	toID = math.MaxInt64
+	if !options.From.IsZero() {
+		fromID = common.MinIDAt(options.From)
+	}
+	if !options.To.IsZero() {
+		toID = common.MinIDAt(options.To)
+	}
+	return fromID, toID
+}
+
+type transcriptWriter interface {
+	begin(roomID RoomID) error
+	write(msg Message) error
+	end() error
+}
+
+// ExportTranscript writes the room messages in chronological order to w while they are read from
+// the message repo, so the transcript is never held in memory.
+func ExportTranscript(ctx context.Context, messageRepo MessageRepo, roomID RoomID, options ExportOptions, w io.Writer) error {
+	if !options.isValid() {
+		return common.ErrInvalidParam
+	}
+	var writer transcriptWriter
+	switch options.Format {
+	case ExportJSON:
+		writer = &jsonTranscriptWriter{w: w}
+	case ExportCSV:
+		writer = &csvTranscriptWriter{w: csv.NewWriter(w)}
+	case ExportHTML:
+		writer = &htmlTranscriptWriter{w: w}
+	}
+
+	if err := writer.begin(roomID); err != nil {
+		return err
+	}
+	fromID, toID := options.idRange()
+	err := messageRepo.ScanMessages(ctx, roomID, fromID, toID, writer.write)
+	if err != nil {
+		return fmt.Errorf("error exporting room %d: %w", roomID, err)
+	}
+	return writer.end()
+}
+
+type jsonTranscriptWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (writer *jsonTranscriptWriter) begin(roomID RoomID) error {
+	_, err := io.WriteString(writer.w, "[")
+	return err
+}
+
+func (writer *jsonTranscriptWriter) write(msg Message) error {
+	if writer.count > 0 {
+		if _, err := io.WriteString(writer.w, ","); err != nil {
+			return err
+		}
+	}
+	writer.count++
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = writer.w.Write(data)
+	return err
+}
+
+func (writer *jsonTranscriptWriter) end() error {
+	_, err := io.WriteString(writer.w, "]\n")
+	return err
+}
+
+type csvTranscriptWriter struct {
+	w *csv.Writer
+}
+
+func (writer *csvTranscriptWriter) begin(roomID RoomID) error {
+	return writer.w.Write([]string{"message_id", "time", "username", "event", "payload", "seen"})
+}
+
+func (writer *csvTranscriptWriter) write(msg Message) error {
+	return writer.w.Write([]string{
+		strconv.FormatUint(msg.ID, 10),
+		time.UnixMilli(msg.Time).UTC().Format(time.RFC3339Nano),
+		msg.UserName,
+		strconv.Itoa(msg.Event),
+		msg.Payload,
+		strconv.FormatBool(msg.Seen),
+	})
+}
+
+func (writer *csvTranscriptWriter) end() error {
+	writer.w.Flush()
+	return writer.w.Error()
+}
+
+type htmlTranscriptWriter struct {
+	w io.Writer
+}
+
+func (writer *htmlTranscriptWriter) begin(roomID RoomID) error {
+	_, err := fmt.Fprintf(writer.w, `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Room %d transcript</title></head>
+<body>
+<h1>Room %d transcript</h1>
+<table>
+<tr><th>Time</th><th>User</th><th>Message</th></tr>
+`, roomID, roomID)
+	return err
+}
+
+func (writer *htmlTranscriptWriter) write(msg Message) error {
+	_, err := fmt.Fprintf(writer.w, "<tr><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+		time.UnixMilli(msg.Time).UTC().Format(time.RFC3339),
+		html.EscapeString(msg.UserName),
+		html.EscapeString(msg.Payload),
+	)
+	return err
+}
+
+func (writer *htmlTranscriptWriter) end() error {
+	_, err := io.WriteString(writer.w, "</table>\n</body>\n</html>\n")
+	return err
+}
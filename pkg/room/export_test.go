@@ -0,0 +1,126 @@
+package room
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/room/client"
+)
+
+func TestExportTranscript(t *testing.T) {
+	server := newTestRoomServer(t)
+	roomClient := server.httpClient(t)
+	ctx := context.Background()
+	room, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: "exported"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := withHeader("Authorization", "Bearer "+room.OwnerToken)
+
+	// one message per second, stored newest first to check the transcript order
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var sent []MessageID
+	for i := 3; i >= 0; i-- {
+		at := start.Add(time.Duration(i) * time.Second)
+		msg := Message{ID: common.MinIDAt(at), RoomID: room.ID, UserName: "alice", Payload: "<b>message</b>, " + at.Format(time.RFC3339), Time: at.UnixMilli()}
+		if err := server.storage.MessageRepo.InesrtMessage(ctx, msg, 0); err != nil {
+			t.Fatal(err)
+		}
+		sent = slices.Insert(sent, 0, msg.ID)
+	}
+	export := func(params client.ExportTranscriptParams, editors ...client.RequestEditorFn) *client.ExportTranscriptResponse {
+		t.Helper()
+		resp, err := roomClient.ExportTranscriptWithResponse(ctx, room.ID, &params, editors...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	format := func(format client.ExportTranscriptParamsFormat) *client.ExportTranscriptParamsFormat { return &format }
+
+	t.Run("json", func(t *testing.T) {
+		resp := export(client.ExportTranscriptParams{}, owner)
+		var msgs []Message
+		if resp.StatusCode() != http.StatusOK || json.Unmarshal(resp.Body, &msgs) != nil {
+			t.Fatalf("export: %s %s", resp.Status(), resp.Body)
+		}
+		var ids []MessageID
+		for _, msg := range msgs {
+			ids = append(ids, msg.ID)
+		}
+		if !slices.Equal(ids, sent) {
+			t.Fatalf("exported %v, want %v in chronological order", ids, sent)
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		resp := export(client.ExportTranscriptParams{Format: format(client.Csv)}, owner)
+		if resp.StatusCode() != http.StatusOK || !strings.HasPrefix(resp.HTTPResponse.Header.Get("Content-Type"), "text/csv") {
+			t.Fatalf("export: %s %s", resp.Status(), resp.HTTPResponse.Header.Get("Content-Type"))
+		}
+		records, err := csv.NewReader(strings.NewReader(string(resp.Body))).ReadAll()
+		if err != nil || len(records) != len(sent)+1 {
+			t.Fatalf("csv transcript %v: %v", records, err)
+		}
+		if records[0][0] != "message_id" || records[1][4] != "<b>message</b>, "+start.Format(time.RFC3339) {
+			t.Fatalf("csv transcript %v", records)
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		resp := export(client.ExportTranscriptParams{Format: format(client.Html)}, owner)
+		body := string(resp.Body)
+		if resp.StatusCode() != http.StatusOK || !strings.Contains(body, "&lt;b&gt;message&lt;/b&gt;") || strings.Contains(body, "<b>message") {
+			t.Fatalf("html transcript: %s %s", resp.Status(), body)
+		}
+		if strings.Count(body, "<tr><td>") != len(sent) {
+			t.Fatalf("html transcript has %d messages, want %d", strings.Count(body, "<tr><td>"), len(sent))
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		// from is inclusive and to exclusive, the IDs of the messages are the first IDs of their second
+		from, to := start.Add(time.Second), start.Add(3*time.Second)
+		resp := export(client.ExportTranscriptParams{From: &from, To: &to}, owner)
+		var msgs []Message
+		if resp.StatusCode() != http.StatusOK || json.Unmarshal(resp.Body, &msgs) != nil {
+			t.Fatalf("export: %s %s", resp.Status(), resp.Body)
+		}
+		if len(msgs) != 2 || msgs[0].ID != sent[1] || msgs[1].ID != sent[2] {
+			t.Fatalf("exported %+v, want the messages %v", msgs, sent[1:3])
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		from := start.Add(time.Second)
+		for name, params := range map[string]client.ExportTranscriptParams{
+			"from equal to":  {From: &from, To: &from},
+			"from after to":  {From: &from, To: &start},
+			"unknown format": {Format: format("xml")},
+		} {
+			if resp := export(params, owner); resp.StatusCode() != http.StatusBadRequest {
+				t.Errorf("%s: %s", name, resp.Status())
+			}
+		}
+	})
+
+	t.Run("authorization", func(t *testing.T) {
+		if resp := export(client.ExportTranscriptParams{}); resp.StatusCode() != http.StatusForbidden {
+			t.Fatalf("export without the owner token: %s", resp.Status())
+		}
+		if resp := export(client.ExportTranscriptParams{}, withHeader("Authorization", "Bearer wrong")); resp.StatusCode() != http.StatusForbidden {
+			t.Fatalf("export with another token: %s", resp.Status())
+		}
+		resp, err := roomClient.ExportTranscriptWithResponse(ctx, room.ID+1, &client.ExportTranscriptParams{}, owner)
+		if err != nil || resp.StatusCode() != http.StatusNotFound {
+			t.Fatalf("export of an unknown room: %v %v", resp.Status(), err)
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/omran95/chatroom/pkg/infrastructure"
+	roompb "github.com/omran95/chatroom/pkg/room/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// GrpcServer serves the RoomService API for the clients that are not browsers. Chat streams are
+// sessions like the websocket ones and get the same events.
+type GrpcServer struct {
+	port           string
+	logger         common.GrpcLog
+	server         *grpc.Server
+	roomService    RoomService
+	sessionHandler *SessionHandler
+	sendQueues     *SendQueues
+	rateLimiter    *RateLimiterMiddleware
+	// chatSessions holds the open Chat streams, they are closed on shutdown for the graceful stop to complete
+	chatSessions sync.Map
+	stopping     atomic.Bool
+	roompb.UnimplementedRoomServiceServer
+}
+
+func NewGrpcServer(name string, logger common.GrpcLog, config *config.Config, roomService RoomService, sessionHandler *SessionHandler, sendQueues *SendQueues, rateLimiter *RateLimiterMiddleware) *GrpcServer {
+	server := &GrpcServer{
+		port:           config.Room.Grpc.Server.Port,
+		logger:         logger,
+		roomService:    roomService,
+		sessionHandler: sessionHandler,
+		sendQueues:     sendQueues,
+		rateLimiter:    rateLimiter,
+	}
+	// Chat streams last as long as the client stays in the room, their connections are not recycled
+	server.server = infrastructure.InitializeGrpcServer(name, logger, grpc.KeepaliveParams(keepalive.ServerParameters{
+		MaxConnectionIdle: 15 * time.Second,
+		Time:              5 * time.Second,
+		Timeout:           1 * time.Second,
+	}))
+	return server
+}
+
+func (server *GrpcServer) Register() {
+	roompb.RegisterRoomServiceServer(server.server, server)
+}
+
+func (server *GrpcServer) Run() {
+	go func() {
+		addr := "0.0.0.0:" + server.port
+		server.logger.Info("grpc server listening", slog.String("addr", addr))
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			server.logger.Error(err.Error())
+			os.Exit(1)
+		}
+		if err := server.Serve(lis); err != nil {
+			server.logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}()
+}
+
+// Serve serves the registered API on lis, e.g. a bufconn listener.
+func (server *GrpcServer) Serve(lis net.Listener) error {
+	return server.server.Serve(lis)
+}
+
+func (server *GrpcServer) GracefulStop() error {
+	server.stopping.Store(true)
+	server.chatSessions.Range(func(key, value any) bool {
+		key.(*grpcSession).Close(1001, "server shutting down")
+		return true
+	})
+	server.server.GracefulStop()
+	return nil
+}
+
+func (server *GrpcServer) CreateRoom(ctx context.Context, req *roompb.CreateRoomRequest) (*roompb.CreateRoomResponse, error) {
+	allowed, retryAfter, err := server.rateLimiter.AllowCreateRoom(ctx, peerIP(ctx))
+	if err != nil {
+		return nil, server.internalError(err)
+	}
+	if !allowed {
+		return nil, status.Errorf(codes.ResourceExhausted, "retry after %d seconds", retryAfter)
+	}
+	dto := CreateRoomDTO{
+		Name:       req.GetName(),
+		Protected:  req.GetProtected(),
+		Password:   req.GetPassword(),
+		Visibility: req.GetVisibility(),
+		Retention: Retention{
+			RetentionDays:     int(req.GetRetentionDays()),
+			RetentionMessages: int(req.GetRetentionMessages()),
+		},
+	}
+	if dto.Name == "" || !dto.isValid() {
+		return nil, status.Error(codes.InvalidArgument, common.ErrInvalidParam.Error())
+	}
+	room, err := server.roomService.CreateRoom(ctx, dto)
+	if err != nil {
+		return nil, server.internalError(err)
+	}
+	return &roompb.CreateRoomResponse{
+		RoomId:            room.ID,
+		Name:              room.Name,
+		Protected:         room.Protected,
+		RetentionDays:     int32(room.RetentionDays),
+		RetentionMessages: int32(room.RetentionMessages),
+		OwnerToken:        room.OwnerToken,
+		Visibility:        room.Visibility,
+	}, nil
+}
+
+func (server *GrpcServer) GetHistory(ctx context.Context, req *roompb.GetHistoryRequest) (*roompb.GetHistoryResponse, error) {
+	if err := server.authorizeRoom(ctx, req.GetRoomId(), "", req.GetPassword(), req.GetMemberToken(), ""); err != nil {
+		return nil, err
+	}
+	msgs, err := server.roomService.GetHistory(ctx, req.GetRoomId(), req.GetAfterMessageId(), int(req.GetLimit()))
+	if err != nil {
+		return nil, server.internalError(err)
+	}
+	resp := &roompb.GetHistoryResponse{Messages: make([]*roompb.Message, len(msgs))}
+	for i := range msgs {
+		resp.Messages[i] = msgs[i].toProto()
+	}
+	return resp, nil
+}
+
+// Chat joins the room of the first request, which must be a join, then publishes the messages
+// of the next requests and streams the room messages until either side ends the stream.
+func (server *GrpcServer) Chat(stream roompb.RoomService_ChatServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	join := req.GetJoin()
+	if join == nil || join.GetUsername() == "" {
+		return status.Error(codes.InvalidArgument, "the first request must join a room")
+	}
+	if err := server.authorizeRoom(stream.Context(), join.GetRoomId(), join.GetUsername(), join.GetPassword(), join.GetMemberToken(), join.GetInviteToken()); err != nil {
+		return err
+	}
+
+	sess := newGrpcSession(join.GetRoomId(), join.GetUsername())
+	server.chatSessions.Store(sess, struct{}{})
+	defer server.chatSessions.Delete(sess)
+	if server.stopping.Load() {
+		return status.Error(codes.Unavailable, "server shutting down")
+	}
+	server.sessionHandler.joinRoom(sess)
+	defer server.sessionHandler.leaveRoom(sess)
+	if !sess.Joined() {
+		return sess.status()
+	}
+
+	go server.receiveMessages(stream, sess)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-sess.done:
+			return sess.status()
+		case <-sess.ready:
+			for _, msg := range sess.take() {
+				if err := stream.Send(msg); err != nil {
+					return err
+				}
+				server.sendQueues.Sent(sess)
+			}
+		}
+	}
+}
+
+// receiveMessages publishes the messages of the stream, a client that closed its send side keeps receiving.
+func (server *GrpcServer) receiveMessages(stream roompb.RoomService_ChatServer, sess *grpcSession) {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return
+		}
+		msg := req.GetMessage()
+		if msg == nil {
+			sess.Close(400, "Invalid message")
+			return
+		}
+		server.sessionHandler.sendMessage(sess, messageFromProto(msg))
+	}
+}
+
+// authorizeRoom checks that the room exists, the member token of a private room, which must be the
+// one of userName when it is set, and the password or an invite token of a protected room.
+func (server *GrpcServer) authorizeRoom(ctx context.Context, roomID RoomID, userName, password, memberToken, inviteToken string) error {
+	exist, err := server.roomService.RoomExist(ctx, roomID)
+	if err != nil {
+		return server.internalError(err)
+	}
+	if !exist {
+		return status.Error(codes.NotFound, common.ErrRoomNotFound.Error())
+	}
+	visibility, err := server.roomService.RoomVisibility(ctx, roomID)
+	if err != nil {
+		return server.internalError(err)
+	}
+	if visibility == VisibilityPrivate {
+		member, err := server.roomService.RoomMember(ctx, roomID, memberToken)
+		if err != nil {
+			return server.internalError(err)
+		}
+		if member == nil || (userName != "" && member.UserName != userName) {
+			return status.Error(codes.PermissionDenied, common.ErrNotMember.Error())
+		}
+	}
+	protected, err := server.roomService.IsRoomProtected(ctx, roomID)
+	if err != nil {
+		return server.internalError(err)
+	}
+	if !protected {
+		return nil
+	}
+	if password == "" && inviteToken != "" {
+		validInvite, err := server.roomService.RedeemInvite(ctx, roomID, inviteToken)
+		if errors.Is(err, common.ErrNoInvites) {
+			return status.Error(codes.Unimplemented, err.Error())
+		}
+		if err != nil {
+			return server.internalError(err)
+		}
+		if !validInvite {
+			return status.Error(codes.PermissionDenied, "invalid invite")
+		}
+		return nil
+	}
+	if password == "" {
+		return status.Error(codes.PermissionDenied, "invalid password")
+	}
+	valid, err := server.roomService.IsValidPassword(ctx, roomID, password)
+	if err != nil {
+		return server.internalError(err)
+	}
+	if !valid {
+		return status.Error(codes.PermissionDenied, "invalid password")
+	}
+	return nil
+}
+
+func (server *GrpcServer) internalError(err error) error {
+	server.logger.Error(err.Error())
+	return status.Error(codes.Internal, common.ErrServer.Error())
+}
+
+// peerIP returns the client IP the room creation rate limit applies to.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
@@ -0,0 +1,198 @@
+package room
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+	roompb "github.com/omran95/chatroom/pkg/room/proto"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testIDGenerator returns increasing IDs of the current time, like the sonyflake of a single instance.
+type testIDGenerator struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+func (generator *testIDGenerator) NextID() (uint64, error) {
+	generator.mu.Lock()
+	defer generator.mu.Unlock()
+	generator.last = max(generator.last+1, common.MinIDAt(time.Now()))
+	return generator.last, nil
+}
+
+// testRoomServer is a room instance with direct fan-out on an in-memory broker, sqlite storage and
+// miniredis, the transports are started by the tests that use them.
+type testRoomServer struct {
+	name           string
+	config         *config.Config
+	redis          *miniredis.Miniredis
+	storage        *Storage
+	service        *RoomServiceImpl
+	subscriber     *DirectMessageSubscriber
+	sessionHandler *SessionHandler
+	sendQueues     *SendQueues
+	rateLimiter    *RateLimiterMiddleware
+}
+
+func newTestRoomServer(t *testing.T) *testRoomServer {
+	t.Helper()
+	cfg := newTestConfig(t)
+	cfg.Room.Invite.Secret = "test-secret"
+	server := &testRoomServer{
+		name:    "test" + strconv.FormatInt(testInstanceSeq.Add(1), 10),
+		config:  cfg,
+		redis:   miniredis.RunT(t),
+		storage: newTestStorage(t),
+	}
+	redisClient := redis.NewClient(&redis.Options{Addr: server.redis.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{OutputChannelBuffer: 1024}, watermill.NopLogger{})
+	publisher, err := NewRoomPartitionPublisher(pubSub, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.sendQueues = newTestSendQueues(t, cfg)
+	sessions := NewRoomSessions(server.sendQueues)
+	server.subscriber, err = NewDirectMessageSubscriber(cfg, pubSub, sessions, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.subscriber.GracefulStop() })
+
+	webhooks := NewWebhookCache(cfg, server.storage.WebhookRepo)
+	inviteSigner := NewInviteSigner(cfg)
+	server.service = NewRoomService(&testIDGenerator{}, server.storage.RoomRepo, publisher, NewDirectSubscriberEndpoints(),
+		server.storage.MessageRepo, NewMessageDeduplicator(cfg, redisClient), webhooks, NewSlashCommands(cfg, webhooks),
+		server.storage.PollRepo, server.storage.PinRepo, server.storage.ScheduledMessageRepo, server.storage.InviteRepo,
+		inviteSigner, server.storage.MemberRepo)
+	server.sessionHandler = NewSessionHandler(testLogger, server.service, server.subscriber, sessions)
+	server.rateLimiter, err = NewRateLimiterMiddleware(cfg, redisClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// grpcClient serves the gRPC API of the instance on a bufconn listener and returns a client of it.
+func (server *testRoomServer) grpcClient(t *testing.T) roompb.RoomServiceClient {
+	t.Helper()
+	grpcServer := NewGrpcServer(server.name, common.GrpcLog{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))},
+		server.config, server.service, server.sessionHandler, server.sendQueues, server.rateLimiter)
+	grpcServer.Register()
+	lis := bufconn.Listen(1024 * 1024)
+	go grpcServer.Serve(lis)
+	t.Cleanup(func() { grpcServer.GracefulStop() })
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return roompb.NewRoomServiceClient(conn)
+}
+
+// recvText returns the next text message of the stream, skipping the room events.
+func recvText(t *testing.T, stream roompb.RoomService_ChatClient) *roompb.Message {
+	t.Helper()
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.GetEvent() == int32(EventText) {
+			return msg
+		}
+	}
+}
+
+func TestGrpcChatAndHistory(t *testing.T) {
+	client := newTestRoomServer(t).grpcClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	room, err := client.CreateRoom(ctx, &roompb.CreateRoomRequest{Name: "general"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.Chat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&roompb.ChatRequest{Request: &roompb.ChatRequest_Join{Join: &roompb.JoinRequest{RoomId: room.GetRoomId(), Username: "alice"}}}); err != nil {
+		t.Fatal(err)
+	}
+	const sent = 5
+	for i := 0; i < sent; i++ {
+		msg := &roompb.Message{Event: int32(EventText), Payload: "message " + strconv.Itoa(i)}
+		if err := stream.Send(&roompb.ChatRequest{Request: &roompb.ChatRequest_Message{Message: msg}}); err != nil {
+			t.Fatal(err)
+		}
+		if got := recvText(t, stream); got.GetPayload() != msg.GetPayload() || got.GetUsername() != "alice" {
+			t.Fatalf("got %s from %s, want %s", got.GetPayload(), got.GetUsername(), msg.GetPayload())
+		}
+	}
+	stream.CloseSend()
+
+	history, err := client.GetHistory(ctx, &roompb.GetHistoryRequest{RoomId: room.GetRoomId(), Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payloads []string
+	for _, msg := range history.GetMessages() {
+		if msg.GetEvent() == int32(EventText) {
+			payloads = append(payloads, msg.GetPayload())
+		}
+	}
+	if want := []string{"message 2", "message 3", "message 4"}; !slices.Equal(payloads, want) {
+		t.Fatalf("latest history %v, want %v", payloads, want)
+	}
+
+	after, err := client.GetHistory(ctx, &roompb.GetHistoryRequest{RoomId: room.GetRoomId(), AfterMessageId: history.GetMessages()[0].GetMessageId(), Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads = payloads[:0]
+	for _, msg := range after.GetMessages() {
+		if msg.GetEvent() == int32(EventText) {
+			payloads = append(payloads, msg.GetPayload())
+		}
+	}
+	if want := []string{"message 3", "message 4"}; !slices.Equal(payloads, want) {
+		t.Fatalf("history after message 2 %v, want %v", payloads, want)
+	}
+}
+
+func TestGrpcChatRejectsUnknownRoom(t *testing.T) {
+	client := newTestRoomServer(t).grpcClient(t)
+	stream, err := client.Chat(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&roompb.ChatRequest{Request: &roompb.ChatRequest_Join{Join: &roompb.JoinRequest{RoomId: 1, Username: "alice"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want NotFound", err)
+	}
+}
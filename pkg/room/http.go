@@ -2,17 +2,16 @@ package room
 
 import (
 	"context"
-	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/olahol/melody"
 	"github.com/omran95/chatroom/pkg/common"
 	"github.com/omran95/chatroom/pkg/config"
-	"github.com/redis/go-redis/v9"
-	"gopkg.in/olahol/melody.v1"
 
 	metrics "github.com/slok/go-http-metrics/metrics/prometheus"
 	prommiddleware "github.com/slok/go-http-metrics/middleware"
@@ -23,14 +22,28 @@ var WsConn MelodyConn
 
 type MelodyConn struct {
 	*melody.Melody
+	compression *WsCompression
 }
 
-func NewWebSocketConnection() MelodyConn {
+func NewWebSocketConnection(compression *WsCompression) MelodyConn {
 	melody := melody.New()
-	WsConn = MelodyConn{melody}
+	melody.Upgrader.Subprotocols = wsSubprotocols
+	melody.Upgrader.EnableCompression = compression.enabled
+	WsConn = MelodyConn{melody, compression}
 	return WsConn
 }
 
+func (conn MelodyConn) HandleRequest(w http.ResponseWriter, r *http.Request) error {
+	return conn.Melody.HandleRequest(conn.compression.countWritten(w), r)
+}
+
+func (conn MelodyConn) HandleConnect(fn func(*melody.Session)) {
+	conn.Melody.HandleConnect(func(sess *melody.Session) {
+		conn.compression.initSession(sess)
+		fn(sess)
+	})
+}
+
 type HttpServer struct {
 	port                  string
 	name                  string
@@ -39,8 +52,20 @@ type HttpServer struct {
 	engine                *gin.Engine
 	logger                common.HttpLog
 	roomService           RoomService
-	msgSubscriber         *MessageSubscriber
+	msgSubscriber         RoomMessageSubscriber
+	sessionHandler        *SessionHandler
 	rateLimiterMiddleware *RateLimiterMiddleware
+	retentionWorker       *RetentionWorker
+	sendQueues            *SendQueues
+	outboxRelay           *OutboxRelay
+	webhookDispatcher     *WebhookDispatcher
+	messageScheduler      *MessageScheduler
+	scheduleMaxDelay      time.Duration
+	// fallbackSessions holds the SSE and long polling sessions by session ID
+	fallbackSessions    sync.Map
+	fallbackPollTimeout time.Duration
+	fallbackSessionIdle time.Duration
+	fallbackKeepAlive   time.Duration
 }
 
 func NewGinEngine(name string, logger common.HttpLog, config *config.Config) *gin.Engine {
@@ -58,13 +83,7 @@ func NewGinEngine(name string, logger common.HttpLog, config *config.Config) *gi
 	return engine
 }
 
-func NewHttpServer(name string, logger common.HttpLog, engine *gin.Engine, ws MelodyConn, config *config.Config, roomService RoomService, msgSubscriber *MessageSubscriber, redisClient redis.UniversalClient) (*HttpServer, error) {
-	// FillingRatePerSecond (RPS), bucketSize, expiration
-	createRoomsrateLimiter, err := common.NewRateLimiter(redisClient, 1, 30, 24*time.Hour)
-	if err != nil {
-		return nil, fmt.Errorf("error creating room rate limiter: %w", err)
-	}
-	rateLimiterMiddleware := NewRateLimiterMiddleware(*createRoomsrateLimiter)
+func NewHttpServer(name string, logger common.HttpLog, engine *gin.Engine, ws MelodyConn, config *config.Config, roomService RoomService, msgSubscriber RoomMessageSubscriber, sessionHandler *SessionHandler, rateLimiterMiddleware *RateLimiterMiddleware, retentionWorker *RetentionWorker, sendQueues *SendQueues, outboxRelay *OutboxRelay, webhookDispatcher *WebhookDispatcher, messageScheduler *MessageScheduler) *HttpServer {
 	return &HttpServer{
 		name:                  name,
 		logger:                logger,
@@ -73,8 +92,18 @@ func NewHttpServer(name string, logger common.HttpLog, engine *gin.Engine, ws Me
 		port:                  config.Room.Http.Server.Port,
 		roomService:           roomService,
 		msgSubscriber:         msgSubscriber,
+		sessionHandler:        sessionHandler,
 		rateLimiterMiddleware: rateLimiterMiddleware,
-	}, nil
+		retentionWorker:       retentionWorker,
+		sendQueues:            sendQueues,
+		outboxRelay:           outboxRelay,
+		webhookDispatcher:     webhookDispatcher,
+		messageScheduler:      messageScheduler,
+		scheduleMaxDelay:      time.Duration(config.Room.Scheduler.MaxDelayDay) * 24 * time.Hour,
+		fallbackPollTimeout:   time.Duration(config.Room.Fallback.PollTimeoutSecond) * time.Second,
+		fallbackSessionIdle:   time.Duration(config.Room.Fallback.SessionIdleSecond) * time.Second,
+		fallbackKeepAlive:     time.Duration(config.Room.Fallback.KeepAliveSecond) * time.Second,
+	}
 }
 
 func (server *HttpServer) RegisterRoutes() {
@@ -82,11 +111,43 @@ func (server *HttpServer) RegisterRoutes() {
 	roomGroup := server.engine.Group("/api/rooms")
 	{
 		roomGroup.POST("", server.rateLimiterMiddleware.LimitCreateRooms, server.CreateRoom)
+		roomGroup.GET("", server.ListPublicRooms)
+		roomGroup.GET("/openapi.yaml", server.OpenAPI)
+		roomGroup.GET("/asyncapi.yaml", server.AsyncAPI)
 		roomGroup.GET("/:id", server.RequestToJoinRoom)
+		roomGroup.GET("/:id/export", server.ExportTranscript)
+		roomGroup.GET("/:id/events", server.StreamRoomEvents)
+		roomGroup.POST("/:id/sessions", server.CreatePollSession)
+		roomGroup.GET("/:id/sessions/:session/messages", server.PollMessages)
+		roomGroup.POST("/:id/sessions/:session/messages", server.SendSessionMessage)
+		roomGroup.DELETE("/:id/sessions/:session", server.LeaveSession)
+		roomGroup.POST("/:id/webhooks", server.CreateWebhook)
+		roomGroup.GET("/:id/webhooks", server.ListWebhooks)
+		roomGroup.DELETE("/:id/webhooks/:webhook", server.DeleteWebhook)
+		roomGroup.POST("/:id/incoming/:token", server.PostIncomingMessage)
+		roomGroup.GET("/:id/pins", server.ListPins)
+		roomGroup.POST("/:id/pins", server.PinMessage)
+		roomGroup.DELETE("/:id/pins/:message", server.UnpinMessage)
+		roomGroup.POST("/:id/scheduled", server.ScheduleMessage)
+		roomGroup.GET("/:id/scheduled", server.ListScheduledMessages)
+		roomGroup.DELETE("/:id/scheduled/:scheduled", server.CancelScheduledMessage)
+		roomGroup.POST("/:id/invites", server.CreateInvite)
+		roomGroup.GET("/:id/invites", server.ListInvites)
+		roomGroup.DELETE("/:id/invites/:invite", server.RevokeInvite)
+		roomGroup.POST("/:id/join-requests", server.rateLimiterMiddleware.LimitJoinRequests, server.RequestToJoin)
+		roomGroup.GET("/:id/join-requests", server.ListJoinRequests)
+		roomGroup.POST("/:id/join-requests/:username/approve", server.ApproveJoinRequest)
+		roomGroup.DELETE("/:id/join-requests/:username", server.RejectJoinRequest)
+		roomGroup.POST("/:id/members", server.AddMember)
+		roomGroup.GET("/:id/members", server.ListMembers)
+		roomGroup.DELETE("/:id/members/:username", server.RemoveMember)
 	}
 	server.wsCon.HandleConnect(server.HandleRoomOnJoin)
 	server.wsCon.HandleClose(server.HandleRoomOnLeave)
 	server.wsCon.HandleMessage(server.HandleOnMessage)
+	server.wsCon.HandleMessageBinary(server.HandleOnBinaryMessage)
+	server.wsCon.HandleSentMessage(server.HandleSentMessage)
+	server.wsCon.HandleSentMessageBinary(server.HandleSentMessage)
 }
 
 func (server *HttpServer) Run() {
@@ -110,6 +171,13 @@ func (server *HttpServer) Run() {
 			os.Exit(1)
 		}
 	}()
+	server.retentionWorker.Run()
+	server.outboxRelay.Run()
+	server.messageScheduler.Run()
+	if err := server.webhookDispatcher.Run(); err != nil {
+		server.logger.Error(err.Error())
+		os.Exit(1)
+	}
 }
 
 func (server *HttpServer) GracefulStop(ctx context.Context) error {
@@ -117,6 +185,7 @@ func (server *HttpServer) GracefulStop(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	server.closeFallbackSessions()
 	err = server.httpServer.Shutdown(ctx)
 	if err != nil {
 		return err
@@ -125,5 +194,8 @@ func (server *HttpServer) GracefulStop(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	server.retentionWorker.GracefulStop()
+	server.outboxRelay.GracefulStop()
+	server.messageScheduler.GracefulStop()
+	return server.webhookDispatcher.GracefulStop()
 }
@@ -0,0 +1,156 @@
+package room
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/omran95/chatroom/pkg/room/client"
+)
+
+// httpClient serves the HTTP API of the instance and returns the generated client of it.
+func (server *testRoomServer) httpClient(t *testing.T) *client.ClientWithResponses {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	compression, err := NewWsCompression(server.name, server.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := NewHttpServer(server.name, testLogger, NewGinEngine(server.name, testLogger, server.config), NewWebSocketConnection(compression),
+		server.config, server.service, server.subscriber, server.sessionHandler, server.rateLimiter, nil, server.sendQueues, nil, nil, nil)
+	httpServer.RegisterRoutes()
+	ts := httptest.NewServer(httpServer.engine)
+	t.Cleanup(func() {
+		httpServer.closeFallbackSessions()
+		ts.Close()
+	})
+
+	roomClient, err := client.NewClientWithResponses(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return roomClient
+}
+
+// pollText polls the session until it gets a text message and returns its payload with the offset to acknowledge.
+func pollText(t *testing.T, roomClient *client.ClientWithResponses, roomID RoomID, sessionID string, ack uint64) (string, uint64) {
+	t.Helper()
+	for {
+		resp, err := roomClient.PollMessagesWithResponse(context.Background(), roomID, sessionID, &client.PollMessagesParams{Ack: &ack})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode() != http.StatusOK {
+			t.Fatalf("poll: %s %s", resp.Status(), resp.Body)
+		}
+		ack, err = strconv.ParseUint(resp.HTTPResponse.Header.Get("X-Poll-Offset"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := bufio.NewScanner(bytes.NewReader(resp.Body))
+		for lines.Scan() {
+			msg, err := DecodeMessage(ContentTypeJSON, lines.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Event == EventText {
+				return msg.Payload, ack
+			}
+		}
+	}
+}
+
+func TestHttpAPI(t *testing.T) {
+	server := newTestRoomServer(t)
+	server.config.Room.Fallback.PollTimeoutSecond = 1
+	roomClient := server.httpClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	spec, err := roomClient.GetOpenAPIWithResponse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.StatusCode() != http.StatusOK || !bytes.HasPrefix(spec.Body, []byte("openapi:")) {
+		t.Fatalf("openapi.yaml: %s %.40s", spec.Status(), spec.Body)
+	}
+
+	visibility := client.Visibility(VisibilityPublic)
+	created, err := roomClient.CreateRoomWithResponse(ctx, client.CreateRoomRequest{Name: "general", Visibility: &visibility})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.JSON201 == nil || created.JSON201.OwnerToken == nil {
+		t.Fatalf("create room: %s %s", created.Status(), created.Body)
+	}
+	room := created.JSON201
+	if invalid, err := roomClient.CreateRoomWithResponse(ctx, client.CreateRoomRequest{}); err != nil || invalid.JSON400 == nil {
+		t.Fatalf("room without name: %v %v", invalid.Status(), err)
+	}
+
+	public, err := roomClient.ListPublicRoomsWithResponse(ctx, &client.ListPublicRoomsParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public.JSON200 == nil || len(*public.JSON200) != 1 || (*public.JSON200)[0].RoomId != room.RoomId || (*public.JSON200)[0].OwnerToken != nil {
+		t.Fatalf("public rooms: %s %s", public.Status(), public.Body)
+	}
+
+	session, err := roomClient.CreatePollSessionWithResponse(ctx, room.RoomId, &client.CreatePollSessionParams{UserName: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.JSON201 == nil {
+		t.Fatalf("create session: %s %s", session.Status(), session.Body)
+	}
+	sessionID := session.JSON201.SessionId
+	sent, err := roomClient.SendSessionMessageWithBodyWithResponse(ctx, room.RoomId, sessionID, "application/json",
+		strings.NewReader(`{"event":0,"payload":"hello over http"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.StatusCode() != http.StatusAccepted {
+		t.Fatalf("send: %s %s", sent.Status(), sent.Body)
+	}
+	payload, offset := pollText(t, roomClient, room.RoomId, sessionID, 0)
+	if payload != "hello over http" {
+		t.Fatalf("polled %q", payload)
+	}
+	empty, err := roomClient.PollMessagesWithResponse(ctx, room.RoomId, sessionID, &client.PollMessagesParams{Ack: &offset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.StatusCode() != http.StatusNoContent {
+		t.Fatalf("poll after acknowledging: %s %s", empty.Status(), empty.Body)
+	}
+
+	left, err := roomClient.LeaveSessionWithResponse(ctx, room.RoomId, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left.StatusCode() != http.StatusNoContent {
+		t.Fatalf("leave: %s", left.Status())
+	}
+	gone, err := roomClient.PollMessagesWithResponse(ctx, room.RoomId, sessionID, &client.PollMessagesParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gone.JSON404 == nil {
+		t.Fatalf("poll after leaving: %s %s", gone.Status(), gone.Body)
+	}
+
+	unknown, err := roomClient.CreatePollSessionWithResponse(ctx, room.RoomId+1, &client.CreatePollSessionParams{UserName: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unknown.JSON404 == nil {
+		t.Fatalf("session of an unknown room: %s %s", unknown.Status(), unknown.Body)
+	}
+}
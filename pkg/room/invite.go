@@ -0,0 +1,118 @@
+package room
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/config"
+)
+
+// Invites let the room owner grant access to a protected room without sharing its password. The
+// invite token carries the invite ID and expiry signed by the server, the stored invite is only
+// read for revocation and single use.
+
+type InviteID = uint64
+
+type Invite struct {
+	ID        InviteID
+	RoomID    RoomID
+	SingleUse bool
+	Used      bool
+	// ExpiresAt is the unix time in milliseconds the invite expires at
+	ExpiresAt int64
+	CreatedAt int64
+}
+
+type CreateInviteDTO struct {
+	// TTLSecond is the lifetime of the invite, zero uses the default one
+	TTLSecond int64 `json:"ttl_seconds"`
+	SingleUse bool  `json:"single_use"`
+}
+
+type InvitePresenter struct {
+	ID        InviteID `json:"invite_id"`
+	SingleUse bool     `json:"single_use"`
+	Used      bool     `json:"used"`
+	ExpiresAt int64    `json:"expires_at"`
+	CreatedAt int64    `json:"created_at"`
+	// Token is passed as the invite query parameter when joining, it is only returned on creation
+	Token string `json:"token,omitempty"`
+}
+
+func (invite *Invite) ToPresenter() *InvitePresenter {
+	return &InvitePresenter{
+		ID:        invite.ID,
+		SingleUse: invite.SingleUse,
+		Used:      invite.Used,
+		ExpiresAt: invite.ExpiresAt,
+		CreatedAt: invite.CreatedAt,
+	}
+}
+
+// InviteSigner signs the invite tokens "<invite ID>.<expires at>.<signature>", the signature is an
+// HMAC-SHA256 of the room ID, invite ID and expiry with the invite secret shared by the instances.
+type InviteSigner struct {
+	secret     []byte
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+}
+
+func NewInviteSigner(config *config.Config) *InviteSigner {
+	return &InviteSigner{
+		secret:     []byte(config.Room.Invite.Secret),
+		defaultTTL: time.Duration(config.Room.Invite.DefaultTTLHour) * time.Hour,
+		maxTTL:     time.Duration(config.Room.Invite.MaxTTLHour) * time.Hour,
+	}
+}
+
+// enabled reports whether the invite secret is set. A secret generated per instance would make the
+// invites fail on the other instances and after a restart, so without the shared one the invites
+// are disabled.
+func (signer *InviteSigner) enabled() bool {
+	return len(signer.secret) > 0
+}
+
+// ttl returns the lifetime of an invite created with dto, false when it exceeds the maximum.
+func (signer *InviteSigner) ttl(dto CreateInviteDTO) (time.Duration, bool) {
+	if dto.TTLSecond == 0 {
+		return signer.defaultTTL, true
+	}
+	ttl := time.Duration(dto.TTLSecond) * time.Second
+	return ttl, dto.TTLSecond > 0 && ttl <= signer.maxTTL
+}
+
+func (signer *InviteSigner) sign(invite Invite) string {
+	claims := fmt.Sprintf("%d.%d", invite.ID, invite.ExpiresAt)
+	return claims + "." + signer.signature(invite.RoomID, claims)
+}
+
+// verify returns the invite ID of a token of the room that is correctly signed and not expired.
+func (signer *InviteSigner) verify(roomID RoomID, token string, now time.Time) (InviteID, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signer.signature(roomID, parts[0]+"."+parts[1]))) {
+		return 0, false
+	}
+	inviteID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.UnixMilli() >= expiresAt {
+		return 0, false
+	}
+	return inviteID, true
+}
+
+func (signer *InviteSigner) signature(roomID RoomID, claims string) string {
+	mac := hmac.New(sha256.New, signer.secret)
+	fmt.Fprintf(mac, "%d.%s", roomID, claims)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,92 @@
+package room
+
+import (
+	"context"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+type InviteRepo interface {
+	CreateInvite(ctx context.Context, invite Invite) error
+	ListInvites(ctx context.Context, roomID RoomID) ([]Invite, error)
+	// GetInvite returns nil when the room has no such invite, e.g. once it was revoked
+	GetInvite(ctx context.Context, roomID RoomID, inviteID InviteID) (*Invite, error)
+	// UseInvite marks a single use invite used, it reports false when it already was
+	UseInvite(ctx context.Context, invite Invite) (bool, error)
+	// DeleteInvite reports whether the invite existed
+	DeleteInvite(ctx context.Context, roomID RoomID, inviteID InviteID) (bool, error)
+	DeleteRoomInvites(ctx context.Context, roomID RoomID) error
+	// DeleteExpiredInvites deletes the expired invites, for stores without native TTL
+	DeleteExpiredInvites(ctx context.Context, now time.Time) error
+}
+
+type InviteRepoImpl struct {
+	cassandraSession *gocql.Session
+}
+
+func NewInviteRepo(cassandraSession *gocql.Session) *InviteRepoImpl {
+	return &InviteRepoImpl{cassandraSession}
+}
+
+// inviteTTL is the remaining lifetime of the invite in seconds, at least one as a zero TTL never expires.
+func inviteTTL(invite Invite) int64 {
+	return max(time.Until(time.UnixMilli(invite.ExpiresAt)).Milliseconds()/1000, 1)
+}
+
+func (repo *InviteRepoImpl) CreateInvite(ctx context.Context, invite Invite) error {
+	query := "insert into room_invites (room_id, id, single_use, used, expires_at, created_at) values (?, ?, ?, ?, ?, ?) using ttl ?"
+	return repo.cassandraSession.Query(query, invite.RoomID, invite.ID, invite.SingleUse, invite.Used, invite.ExpiresAt, invite.CreatedAt, inviteTTL(invite)).WithContext(ctx).Exec()
+}
+
+func (repo *InviteRepoImpl) ListInvites(ctx context.Context, roomID RoomID) ([]Invite, error) {
+	query := "select room_id, id, single_use, used, expires_at, created_at from room_invites where room_id = ?"
+	iter := repo.cassandraSession.Query(query, roomID).WithContext(ctx).Idempotent(true).Iter()
+	var invites []Invite
+	var invite Invite
+	for iter.Scan(&invite.RoomID, &invite.ID, &invite.SingleUse, &invite.Used, &invite.ExpiresAt, &invite.CreatedAt) {
+		invites = append(invites, invite)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (repo *InviteRepoImpl) GetInvite(ctx context.Context, roomID RoomID, inviteID InviteID) (*Invite, error) {
+	invite := Invite{RoomID: roomID, ID: inviteID}
+	query := "select single_use, used, expires_at, created_at from room_invites where room_id = ? and id = ?"
+	err := repo.cassandraSession.Query(query, roomID, inviteID).WithContext(ctx).Idempotent(true).
+		Scan(&invite.SingleUse, &invite.Used, &invite.ExpiresAt, &invite.CreatedAt)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (repo *InviteRepoImpl) UseInvite(ctx context.Context, invite Invite) (bool, error) {
+	// the update keeps the TTL of the row, otherwise the used column would outlive the invite
+	return repo.cassandraSession.Query("update room_invites using ttl ? set used = true where room_id = ? and id = ? if used = false", inviteTTL(invite), invite.RoomID, invite.ID).
+		WithContext(ctx).MapScanCAS(map[string]interface{}{})
+}
+
+func (repo *InviteRepoImpl) DeleteInvite(ctx context.Context, roomID RoomID, inviteID InviteID) (bool, error) {
+	invite, err := repo.GetInvite(ctx, roomID, inviteID)
+	if err != nil || invite == nil {
+		return false, err
+	}
+	err = repo.cassandraSession.Query("delete from room_invites where room_id = ? and id = ?", roomID, inviteID).WithContext(ctx).Idempotent(true).Exec()
+	return err == nil, err
+}
+
+func (repo *InviteRepoImpl) DeleteRoomInvites(ctx context.Context, roomID RoomID) error {
+	return repo.cassandraSession.Query("delete from room_invites where room_id = ?", roomID).WithContext(ctx).Idempotent(true).Exec()
+}
+
+func (repo *InviteRepoImpl) DeleteExpiredInvites(ctx context.Context, now time.Time) error {
+	// expired invites are removed by the cassandra TTL
+	return nil
+}
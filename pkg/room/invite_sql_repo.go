@@ -0,0 +1,80 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type SQLInviteRepoImpl struct {
+	db *sql.DB
+}
+
+func NewSQLInviteRepo(db *sql.DB) *SQLInviteRepoImpl {
+	return &SQLInviteRepoImpl{db}
+}
+
+func (repo *SQLInviteRepoImpl) CreateInvite(ctx context.Context, invite Invite) error {
+	query := "INSERT INTO room_invites (room_id, id, single_use, used, expires_at, created_at) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, err := repo.db.ExecContext(ctx, query, invite.RoomID, invite.ID, invite.SingleUse, invite.Used, invite.ExpiresAt, invite.CreatedAt)
+	return err
+}
+
+func (repo *SQLInviteRepoImpl) ListInvites(ctx context.Context, roomID RoomID) ([]Invite, error) {
+	query := "SELECT room_id, id, single_use, used, expires_at, created_at FROM room_invites WHERE room_id = $1 ORDER BY id"
+	rows, err := repo.db.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var invites []Invite
+	for rows.Next() {
+		var invite Invite
+		if err := rows.Scan(&invite.RoomID, &invite.ID, &invite.SingleUse, &invite.Used, &invite.ExpiresAt, &invite.CreatedAt); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+func (repo *SQLInviteRepoImpl) GetInvite(ctx context.Context, roomID RoomID, inviteID InviteID) (*Invite, error) {
+	invite := Invite{RoomID: roomID, ID: inviteID}
+	query := "SELECT single_use, used, expires_at, created_at FROM room_invites WHERE room_id = $1 AND id = $2"
+	err := repo.db.QueryRowContext(ctx, query, roomID, inviteID).Scan(&invite.SingleUse, &invite.Used, &invite.ExpiresAt, &invite.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (repo *SQLInviteRepoImpl) UseInvite(ctx context.Context, invite Invite) (bool, error) {
+	result, err := repo.db.ExecContext(ctx, "UPDATE room_invites SET used = $1 WHERE room_id = $2 AND id = $3 AND used = $4", true, invite.RoomID, invite.ID, false)
+	if err != nil {
+		return false, err
+	}
+	used, err := result.RowsAffected()
+	return used > 0, err
+}
+
+func (repo *SQLInviteRepoImpl) DeleteInvite(ctx context.Context, roomID RoomID, inviteID InviteID) (bool, error) {
+	result, err := repo.db.ExecContext(ctx, "DELETE FROM room_invites WHERE room_id = $1 AND id = $2", roomID, inviteID)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (repo *SQLInviteRepoImpl) DeleteRoomInvites(ctx context.Context, roomID RoomID) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM room_invites WHERE room_id = $1", roomID)
+	return err
+}
+
+func (repo *SQLInviteRepoImpl) DeleteExpiredInvites(ctx context.Context, now time.Time) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM room_invites WHERE expires_at <= $1", now.UnixMilli())
+	return err
+}
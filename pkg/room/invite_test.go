@@ -0,0 +1,169 @@
+package room
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/room/client"
+	roompb "github.com/omran95/chatroom/pkg/room/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInvitesWithoutSecret(t *testing.T) {
+	server := newTestRoomServer(t)
+	cfg := newTestConfig(t)
+	cfg.Room.Invite.Secret = ""
+	server.service.inviteSigner = NewInviteSigner(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	room, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: "protected", Protected: true, Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := withHeader("Authorization", "Bearer "+room.OwnerToken)
+	resp, err := server.httpClient(t).CreateInviteWithResponse(ctx, room.ID, client.CreateInviteJSONRequestBody{}, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusNotImplemented || resp.JSON501 == nil || resp.JSON501.Msg != common.ErrNoInvites.Error() {
+		t.Fatalf("create invite: %d %s", resp.StatusCode(), resp.Body)
+	}
+
+	stream, err := server.grpcClient(t).Chat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.CloseSend()
+	join := &roompb.JoinRequest{RoomId: room.ID, Username: "alice", InviteToken: "1.2.signature"}
+	if err := stream.Send(&roompb.ChatRequest{Request: &roompb.ChatRequest_Join{Join: join}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("join with an invite: %v", err)
+	}
+}
+
+func TestInviteSignerVerify(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Room.Invite.Secret = "test-secret"
+	signer := NewInviteSigner(cfg)
+	now := time.Now()
+	invite := Invite{ID: 7, RoomID: 1, ExpiresAt: now.Add(time.Hour).UnixMilli()}
+	token := signer.sign(invite)
+	if inviteID, ok := signer.verify(1, token, now); !ok || inviteID != 7 {
+		t.Fatalf("valid token got %d, %v", inviteID, ok)
+	}
+
+	parts := strings.Split(token, ".")
+	otherSecret := *cfg
+	otherSecret.Room.Invite.Secret = "other-secret"
+	otherSigner := NewInviteSigner(&otherSecret)
+	for name, test := range map[string]struct {
+		roomID RoomID
+		token  string
+		now    time.Time
+	}{
+		"other invite ID":   {1, "8." + parts[1] + "." + parts[2], now},
+		"extended expiry":   {1, parts[0] + "." + strconv.FormatInt(invite.ExpiresAt+time.Hour.Milliseconds(), 10) + "." + parts[2], now},
+		"tampered mac":      {1, parts[0] + "." + parts[1] + "." + strings.ToUpper(parts[2]), now},
+		"missing signature": {1, parts[0] + "." + parts[1], now},
+		"expired":           {1, token, time.UnixMilli(invite.ExpiresAt)},
+		"wrong room":        {2, token, now},
+		"other secret":      {1, otherSigner.sign(invite), now},
+	} {
+		if _, ok := signer.verify(test.roomID, test.token, test.now); ok {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestRedeemSingleUseInvite(t *testing.T) {
+	server := newTestRoomServer(t)
+	ctx := context.Background()
+	room, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: "protected", Protected: true, Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite, err := server.service.CreateInvite(ctx, room.ID, CreateInviteDTO{SingleUse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := server.service.RedeemInvite(ctx, room.ID, invite.Token); err != nil || !valid {
+		t.Fatalf("first use: %v, %v", valid, err)
+	}
+	if valid, err := server.service.RedeemInvite(ctx, room.ID, invite.Token); err != nil || valid {
+		t.Fatalf("replayed single use invite: %v, %v", valid, err)
+	}
+
+	reusable, err := server.service.CreateInvite(ctx, room.ID, CreateInviteDTO{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if valid, err := server.service.RedeemInvite(ctx, room.ID, reusable.Token); err != nil || !valid {
+			t.Fatalf("use %d of a reusable invite: %v, %v", i, valid, err)
+		}
+	}
+	if revoked, err := server.service.RevokeInvite(ctx, room.ID, reusable.ID); err != nil || !revoked {
+		t.Fatalf("revoke: %v, %v", revoked, err)
+	}
+	if valid, err := server.service.RedeemInvite(ctx, room.ID, reusable.Token); err != nil || valid {
+		t.Fatalf("revoked invite: %v, %v", valid, err)
+	}
+}
+
+func TestGrpcJoinWithInvite(t *testing.T) {
+	server := newTestRoomServer(t)
+	client := server.grpcClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	room, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: "protected", Protected: true, Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite, err := server.service.CreateInvite(ctx, room.ID, CreateInviteDTO{SingleUse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	join := func(inviteToken string) error {
+		stream, err := client.Chat(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.CloseSend()
+		join := &roompb.JoinRequest{RoomId: room.ID, Username: "alice", InviteToken: inviteToken}
+		if err := stream.Send(&roompb.ChatRequest{Request: &roompb.ChatRequest_Join{Join: join}}); err != nil {
+			t.Fatal(err)
+		}
+		msg := &roompb.Message{Event: int32(EventText), Payload: "hello"}
+		if err := stream.Send(&roompb.ChatRequest{Request: &roompb.ChatRequest_Message{Message: msg}}); err != nil {
+			return err
+		}
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			if msg.GetEvent() == int32(EventText) {
+				return nil
+			}
+		}
+	}
+	if err := join(invite.Token); err != nil {
+		t.Fatalf("join with the invite: %v", err)
+	}
+	if err := join(invite.Token); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("join with the used invite: %v", err)
+	}
+	if err := join(""); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("join without password or invite: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package room
+
+import "time"
+
+// Members are the users admitted to a private room, added by the owner or through an approved
+// join request. Each member joins with the member token returned when it was added or requested,
+// so another user taking the same user name is not admitted. Membership is stored with the room,
+// unlike the presence of the online users kept in redis by the subscriber service. Join requests
+// need no credentials, so they are rate limited and expire unless the owner approves them.
+
+const (
+	MemberActive  = "member"
+	MemberPending = "pending"
+)
+
+const (
+	maxMemberNameLength = 64
+	joinRequestTTL      = 24 * time.Hour
+)
+
+type Member struct {
+	RoomID    RoomID
+	UserName  string
+	Status    string
+	TokenHash string
+	CreatedAt int64
+	// ExpiresAt is the unix time in milliseconds a pending join request expires at, 0 for members
+	ExpiresAt int64
+}
+
+// ttl returns the time until the join request expires, 0 when it does not expire.
+func (member *Member) ttl(now time.Time) time.Duration {
+	if member.ExpiresAt == 0 {
+		return 0
+	}
+	return time.UnixMilli(member.ExpiresAt).Sub(now)
+}
+
+// setTTL sets the expiry of a join request from the TTL in seconds left to its row.
+func (member *Member) setTTL(ttl int64, now time.Time) {
+	if ttl > 0 {
+		member.ExpiresAt = now.Add(time.Duration(ttl) * time.Second).UnixMilli()
+	}
+}
+
+type MemberDTO struct {
+	UserName string `json:"username" binding:"required"`
+}
+
+func (dto *MemberDTO) isValid() bool {
+	return len(dto.UserName) <= maxMemberNameLength
+}
+
+type MemberPresenter struct {
+	UserName  string `json:"username"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+	// MemberToken is only returned when the member is added or requests to join
+	MemberToken string `json:"member_token,omitempty"`
+}
+
+func (member *Member) ToPresenter() *MemberPresenter {
+	return &MemberPresenter{
+		UserName:  member.UserName,
+		Status:    member.Status,
+		CreatedAt: member.CreatedAt,
+	}
+}
@@ -0,0 +1,170 @@
+package room
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+type MemberRepo interface {
+	// AddMember creates or overwrites the member or join request, a join request expires at its ExpiresAt
+	AddMember(ctx context.Context, member Member) error
+	// RequestMembership stores a join request, it reports false when the user already is a member or
+	// has a join request that did not expire
+	RequestMembership(ctx context.Context, member Member) (bool, error)
+	// GetMemberByToken returns the member of the room with the token hash, nil when there is none
+	GetMemberByToken(ctx context.Context, roomID RoomID, tokenHash string) (*Member, error)
+	// ListMembers returns the members and the join requests that did not expire
+	ListMembers(ctx context.Context, roomID RoomID) ([]Member, error)
+	// ApproveMember makes a pending join request a member, it reports false when there was no such request
+	ApproveMember(ctx context.Context, roomID RoomID, userName string) (bool, error)
+	// DeleteMember deletes the member or join request with the status, it reports whether it existed
+	DeleteMember(ctx context.Context, roomID RoomID, userName string, status string) (bool, error)
+	DeleteRoomMembers(ctx context.Context, roomID RoomID) error
+	// DeleteExpiredJoinRequests deletes the expired join requests, for stores without native TTL
+	DeleteExpiredJoinRequests(ctx context.Context, now time.Time) error
+}
+
+// MemberRepoImpl stores the members by room and user name, and the user name of each member by
+// token hash in room_member_tokens. A token row is checked against the member, so a token row left
+// by a replaced or removed member admits nobody.
+type MemberRepoImpl struct {
+	cassandraSession *gocql.Session
+}
+
+func NewMemberRepo(cassandraSession *gocql.Session) *MemberRepoImpl {
+	return &MemberRepoImpl{cassandraSession}
+}
+
+// cassandraTTL returns the TTL in seconds of a row expiring after ttl, 0 for no expiry.
+func cassandraTTL(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(ttl.Seconds()))
+}
+
+func (repo *MemberRepoImpl) AddMember(ctx context.Context, member Member) error {
+	ttl := member.ttl(time.Now())
+	if member.ExpiresAt > 0 && ttl <= 0 {
+		return nil
+	}
+	previous, err := repo.getMember(ctx, member.RoomID, member.UserName)
+	if err != nil {
+		return err
+	}
+	batch := repo.cassandraSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("insert into room_members (room_id, username, status, token_hash, created_at) values (?, ?, ?, ?, ?) using ttl ?",
+		member.RoomID, member.UserName, member.Status, member.TokenHash, member.CreatedAt, cassandraTTL(ttl))
+	if member.Status == MemberActive {
+		batch.Query("insert into room_member_tokens (room_id, token_hash, username) values (?, ?, ?)", member.RoomID, member.TokenHash, member.UserName)
+	}
+	if previous != nil && previous.TokenHash != member.TokenHash {
+		batch.Query("delete from room_member_tokens where room_id = ? and token_hash = ?", member.RoomID, previous.TokenHash)
+	}
+	return repo.cassandraSession.ExecuteBatch(batch)
+}
+
+func (repo *MemberRepoImpl) RequestMembership(ctx context.Context, member Member) (bool, error) {
+	// the join request has no token row until it is approved
+	query := "insert into room_members (room_id, username, status, token_hash, created_at) values (?, ?, ?, ?, ?) if not exists using ttl ?"
+	return repo.cassandraSession.Query(query, member.RoomID, member.UserName, member.Status, member.TokenHash, member.CreatedAt, cassandraTTL(member.ttl(time.Now()))).
+		WithContext(ctx).MapScanCAS(map[string]interface{}{})
+}
+
+func (repo *MemberRepoImpl) GetMemberByToken(ctx context.Context, roomID RoomID, tokenHash string) (*Member, error) {
+	var userName string
+	err := repo.cassandraSession.Query("select username from room_member_tokens where room_id = ? and token_hash = ?", roomID, tokenHash).
+		WithContext(ctx).Idempotent(true).Scan(&userName)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	member, err := repo.getMember(ctx, roomID, userName)
+	if err != nil || member == nil || member.TokenHash != tokenHash {
+		return nil, err
+	}
+	return member, nil
+}
+
+func (repo *MemberRepoImpl) getMember(ctx context.Context, roomID RoomID, userName string) (*Member, error) {
+	query := "select room_id, username, status, token_hash, created_at, ttl(status) from room_members where room_id = ? and username = ?"
+	var member Member
+	var ttl int64
+	err := repo.cassandraSession.Query(query, roomID, userName).WithContext(ctx).Idempotent(true).
+		Scan(&member.RoomID, &member.UserName, &member.Status, &member.TokenHash, &member.CreatedAt, &ttl)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	member.setTTL(ttl, time.Now())
+	return &member, nil
+}
+
+func (repo *MemberRepoImpl) ListMembers(ctx context.Context, roomID RoomID) ([]Member, error) {
+	query := "select room_id, username, status, token_hash, created_at, ttl(status) from room_members where room_id = ?"
+	iter := repo.cassandraSession.Query(query, roomID).WithContext(ctx).Idempotent(true).Iter()
+	var members []Member
+	var member Member
+	var ttl int64
+	now := time.Now()
+	for iter.Scan(&member.RoomID, &member.UserName, &member.Status, &member.TokenHash, &member.CreatedAt, &ttl) {
+		member.ExpiresAt = 0
+		member.setTTL(ttl, now)
+		members = append(members, member)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (repo *MemberRepoImpl) ApproveMember(ctx context.Context, roomID RoomID, userName string) (bool, error) {
+	member, err := repo.getMember(ctx, roomID, userName)
+	if err != nil || member == nil || member.Status != MemberPending {
+		return false, err
+	}
+	// every column is written without TTL, the row stays once the TTL of the request passed
+	query := "update room_members using ttl 0 set status = ?, token_hash = ?, created_at = ? where room_id = ? and username = ? if status = ? and token_hash = ?"
+	approved, err := repo.cassandraSession.Query(query, MemberActive, member.TokenHash, member.CreatedAt, roomID, userName, MemberPending, member.TokenHash).
+		WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil || !approved {
+		return false, err
+	}
+	err = repo.cassandraSession.Query("insert into room_member_tokens (room_id, token_hash, username) values (?, ?, ?)", roomID, member.TokenHash, userName).
+		WithContext(ctx).Idempotent(true).Exec()
+	return err == nil, err
+}
+
+func (repo *MemberRepoImpl) DeleteMember(ctx context.Context, roomID RoomID, userName string, status string) (bool, error) {
+	member, err := repo.getMember(ctx, roomID, userName)
+	if err != nil || member == nil {
+		return false, err
+	}
+	deleted, err := repo.cassandraSession.Query("delete from room_members where room_id = ? and username = ? if status = ?", roomID, userName, status).
+		WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil || !deleted {
+		return false, err
+	}
+	err = repo.cassandraSession.Query("delete from room_member_tokens where room_id = ? and token_hash = ?", roomID, member.TokenHash).
+		WithContext(ctx).Idempotent(true).Exec()
+	return err == nil, err
+}
+
+func (repo *MemberRepoImpl) DeleteRoomMembers(ctx context.Context, roomID RoomID) error {
+	if err := repo.cassandraSession.Query("delete from room_member_tokens where room_id = ?", roomID).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return repo.cassandraSession.Query("delete from room_members where room_id = ?", roomID).WithContext(ctx).Idempotent(true).Exec()
+}
+
+func (repo *MemberRepoImpl) DeleteExpiredJoinRequests(ctx context.Context, now time.Time) error {
+	// expired join requests are removed by the cassandra TTL
+	return nil
+}
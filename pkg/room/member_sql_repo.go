@@ -0,0 +1,99 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type SQLMemberRepoImpl struct {
+	db *sql.DB
+}
+
+func NewSQLMemberRepo(db *sql.DB) *SQLMemberRepoImpl {
+	return &SQLMemberRepoImpl{db}
+}
+
+func (repo *SQLMemberRepoImpl) AddMember(ctx context.Context, member Member) error {
+	query := `INSERT INTO room_members (room_id, username, status, token_hash, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (room_id, username) DO UPDATE SET status = excluded.status, token_hash = excluded.token_hash, created_at = excluded.created_at, expires_at = excluded.expires_at`
+	_, err := repo.db.ExecContext(ctx, query, member.RoomID, member.UserName, member.Status, member.TokenHash, member.CreatedAt, member.ExpiresAt)
+	return err
+}
+
+func (repo *SQLMemberRepoImpl) RequestMembership(ctx context.Context, member Member) (bool, error) {
+	// an expired join request is replaced, a member or a live request is kept
+	query := `INSERT INTO room_members (room_id, username, status, token_hash, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (room_id, username) DO UPDATE SET status = excluded.status, token_hash = excluded.token_hash, created_at = excluded.created_at, expires_at = excluded.expires_at
+	WHERE room_members.expires_at > 0 AND room_members.expires_at <= $7`
+	result, err := repo.db.ExecContext(ctx, query, member.RoomID, member.UserName, member.Status, member.TokenHash, member.CreatedAt, member.ExpiresAt, time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	return inserted > 0, err
+}
+
+func (repo *SQLMemberRepoImpl) GetMemberByToken(ctx context.Context, roomID RoomID, tokenHash string) (*Member, error) {
+	query := `SELECT room_id, username, status, token_hash, created_at, expires_at FROM room_members
+	WHERE room_id = $1 AND token_hash = $2 AND (expires_at = 0 OR expires_at > $3)`
+	var member Member
+	err := repo.db.QueryRowContext(ctx, query, roomID, tokenHash, time.Now().UnixMilli()).
+		Scan(&member.RoomID, &member.UserName, &member.Status, &member.TokenHash, &member.CreatedAt, &member.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (repo *SQLMemberRepoImpl) ListMembers(ctx context.Context, roomID RoomID) ([]Member, error) {
+	query := `SELECT room_id, username, status, token_hash, created_at, expires_at FROM room_members
+	WHERE room_id = $1 AND (expires_at = 0 OR expires_at > $2) ORDER BY username`
+	rows, err := repo.db.QueryContext(ctx, query, roomID, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []Member
+	for rows.Next() {
+		var member Member
+		if err := rows.Scan(&member.RoomID, &member.UserName, &member.Status, &member.TokenHash, &member.CreatedAt, &member.ExpiresAt); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (repo *SQLMemberRepoImpl) ApproveMember(ctx context.Context, roomID RoomID, userName string) (bool, error) {
+	query := `UPDATE room_members SET status = $1, expires_at = 0
+	WHERE room_id = $2 AND username = $3 AND status = $4 AND (expires_at = 0 OR expires_at > $5)`
+	result, err := repo.db.ExecContext(ctx, query, MemberActive, roomID, userName, MemberPending, time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	approved, err := result.RowsAffected()
+	return approved > 0, err
+}
+
+func (repo *SQLMemberRepoImpl) DeleteMember(ctx context.Context, roomID RoomID, userName string, status string) (bool, error) {
+	result, err := repo.db.ExecContext(ctx, "DELETE FROM room_members WHERE room_id = $1 AND username = $2 AND status = $3", roomID, userName, status)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (repo *SQLMemberRepoImpl) DeleteRoomMembers(ctx context.Context, roomID RoomID) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM room_members WHERE room_id = $1", roomID)
+	return err
+}
+
+func (repo *SQLMemberRepoImpl) DeleteExpiredJoinRequests(ctx context.Context, now time.Time) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM room_members WHERE expires_at > 0 AND expires_at <= $1", now.UnixMilli())
+	return err
+}
@@ -0,0 +1,237 @@
+package room
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/room/client"
+)
+
+func TestPublicRoomsMonth(t *testing.T) {
+	created := time.Date(2024, time.March, 31, 23, 59, 0, 0, time.UTC)
+	if month := publicRoomsMonth(common.MinIDAt(created)); month != 202403 {
+		t.Fatalf("month %d, want 202403", month)
+	}
+	if got := common.IDTime(common.MinIDAt(created)); !got.Equal(created) {
+		t.Fatalf("ID time %v, want %v", got, created)
+	}
+}
+
+func TestListPublicRoomsByVisibility(t *testing.T) {
+	server := newTestRoomServer(t)
+	roomClient := server.httpClient(t)
+	ctx := context.Background()
+	var public []RoomID
+	for i, visibility := range []string{VisibilityPublic, VisibilityUnlisted, VisibilityPublic, VisibilityPrivate, VisibilityPublic} {
+		room, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: "room " + strconv.Itoa(i), Visibility: visibility})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if visibility == VisibilityPublic {
+			public = append(public, room.ID)
+		}
+	}
+	slices.Reverse(public)
+
+	limit := 2
+	var listed []RoomID
+	params := &client.ListPublicRoomsParams{Limit: &limit}
+	for {
+		resp, err := roomClient.ListPublicRoomsWithResponse(ctx, params)
+		if err != nil || resp.JSON200 == nil {
+			t.Fatalf("list public rooms: %v %v", resp.Status(), err)
+		}
+		for _, room := range *resp.JSON200 {
+			if room.Visibility != client.Public {
+				t.Fatalf("listed %s room %d", room.Visibility, room.RoomId)
+			}
+			listed = append(listed, room.RoomId)
+		}
+		if len(*resp.JSON200) < limit {
+			break
+		}
+		before := listed[len(listed)-1]
+		params = &client.ListPublicRoomsParams{Before: &before, Limit: &limit}
+	}
+	if !slices.Equal(listed, public) {
+		t.Fatalf("listed %v, want the public rooms newest first %v", listed, public)
+	}
+}
+
+func TestJoinRequestFlow(t *testing.T) {
+	server := newTestRoomServer(t)
+	roomClient := server.httpClient(t)
+	ctx := context.Background()
+	room, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: "private", Visibility: VisibilityPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := withHeader("Authorization", "Bearer "+room.OwnerToken)
+	pinsStatus := func(editors ...client.RequestEditorFn) int {
+		t.Helper()
+		resp, err := roomClient.ListPinsWithResponse(ctx, room.ID, editors...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode()
+	}
+	if status := pinsStatus(); status != http.StatusForbidden {
+		t.Fatalf("private room read without a member token: %d", status)
+	}
+	if status := pinsStatus(owner); status != http.StatusOK {
+		t.Fatalf("private room read by the owner: %d", status)
+	}
+
+	requested, err := roomClient.RequestToJoinWithResponse(ctx, room.ID, client.MemberRequest{Username: "bob"})
+	if err != nil || requested.JSON201 == nil || *requested.JSON201.Status != client.MemberStatus(MemberPending) {
+		t.Fatalf("request to join: %v %v", requested.Status(), err)
+	}
+	bob := withHeader("X-Room-Member-Token", *requested.JSON201.MemberToken)
+	again, err := roomClient.RequestToJoinWithResponse(ctx, room.ID, client.MemberRequest{Username: "bob"})
+	if err != nil || again.StatusCode() != http.StatusConflict {
+		t.Fatalf("second request for the user name: %v %v", again.Status(), err)
+	}
+	if status := pinsStatus(bob); status != http.StatusForbidden {
+		t.Fatalf("private room read with a pending request: %d", status)
+	}
+
+	requests, err := roomClient.ListJoinRequestsWithResponse(ctx, room.ID, owner)
+	if err != nil || requests.JSON200 == nil || len(*requests.JSON200) != 1 || *(*requests.JSON200)[0].Username != "bob" {
+		t.Fatalf("join requests: %v %v", requests.Status(), err)
+	}
+	if approved, err := roomClient.ApproveJoinRequestWithResponse(ctx, room.ID, "bob"); err != nil || approved.StatusCode() != http.StatusForbidden {
+		t.Fatalf("approve without the owner token: %v %v", approved.Status(), err)
+	}
+	if approved, err := roomClient.ApproveJoinRequestWithResponse(ctx, room.ID, "bob", owner); err != nil || approved.StatusCode() != http.StatusNoContent {
+		t.Fatalf("approve: %v %v", approved.Status(), err)
+	}
+	if status := pinsStatus(bob); status != http.StatusOK {
+		t.Fatalf("private room read by the member: %d", status)
+	}
+	members, err := roomClient.ListMembersWithResponse(ctx, room.ID, owner)
+	if err != nil || members.JSON200 == nil || len(*members.JSON200) != 1 || *(*members.JSON200)[0].Status != client.MemberStatus(MemberActive) {
+		t.Fatalf("members: %v %v", members.Status(), err)
+	}
+
+	if removed, err := roomClient.RemoveMemberWithResponse(ctx, room.ID, "bob", owner); err != nil || removed.StatusCode() != http.StatusNoContent {
+		t.Fatalf("remove member: %v %v", removed.Status(), err)
+	}
+	if status := pinsStatus(bob); status != http.StatusForbidden {
+		t.Fatalf("private room read by a removed member: %d", status)
+	}
+
+	unlisted, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: "unlisted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := roomClient.RequestToJoinWithResponse(ctx, unlisted.ID, client.MemberRequest{Username: "bob"}); err != nil || resp.StatusCode() != http.StatusConflict {
+		t.Fatalf("request to join an unlisted room: %v %v", resp.Status(), err)
+	}
+}
+
+func TestExpiredJoinRequest(t *testing.T) {
+	server := newTestRoomServer(t)
+	repo, ctx := server.storage.MemberRepo, context.Background()
+	room, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: "private", Visibility: VisibilityPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := Member{RoomID: room.ID, UserName: "bob", Status: MemberPending, TokenHash: hashToken("squatter"), CreatedAt: 1, ExpiresAt: time.Now().Add(-time.Minute).UnixMilli()}
+	if err := repo.AddMember(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	if members, err := repo.ListMembers(ctx, room.ID); err != nil || len(members) != 0 {
+		t.Fatalf("expired request listed: %v %v", members, err)
+	}
+	if approved, err := repo.ApproveMember(ctx, room.ID, "bob"); err != nil || approved {
+		t.Fatalf("expired request approved: %v", err)
+	}
+
+	// the user name is free again once the request expired
+	request, err := server.service.RequestToJoin(ctx, room.ID, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := repo.GetMemberByToken(ctx, room.ID, hashToken(request.MemberToken))
+	if err != nil || member == nil || member.Status != MemberPending || member.ExpiresAt <= time.Now().UnixMilli() {
+		t.Fatalf("join request %+v: %v", member, err)
+	}
+	if member, err := server.service.RoomMember(ctx, room.ID, request.MemberToken); err != nil || member != nil {
+		t.Fatalf("pending request admitted as %+v: %v", member, err)
+	}
+
+	if err := repo.DeleteExpiredJoinRequests(ctx, time.Now().Add(2*joinRequestTTL)); err != nil {
+		t.Fatal(err)
+	}
+	if members, err := repo.ListMembers(ctx, room.ID); err != nil || len(members) != 0 {
+		t.Fatalf("expired requests kept: %v %v", members, err)
+	}
+}
+
+func TestJoinRequestRateLimit(t *testing.T) {
+	server := newTestRoomServer(t)
+	roomClient := server.httpClient(t)
+	ctx := context.Background()
+	room, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: "private", Visibility: VisibilityPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := server.config.Room.RateLimit.JoinRequest
+	allowed := policy.Capacity / policy.Cost
+	for i := 0; i <= allowed; i++ {
+		resp, err := roomClient.RequestToJoinWithResponse(ctx, room.ID, client.MemberRequest{Username: "user" + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < allowed && resp.StatusCode() != http.StatusCreated {
+			t.Fatalf("request %d: %s", i, resp.Status())
+		}
+		if i == allowed && (resp.StatusCode() != http.StatusTooManyRequests || resp.HTTPResponse.Header.Get("Retry-After") == "") {
+			t.Fatalf("request over the limit: %s", resp.Status())
+		}
+	}
+}
+
+func TestArchiveRoundTripWithMembers(t *testing.T) {
+	server := newTestRoomServer(t)
+	service, ctx := server.service, context.Background()
+	room, err := service.CreateRoom(ctx, CreateRoomDTO{Name: "private", Visibility: VisibilityPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := service.AddMember(ctx, room.ID, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.RequestToJoin(ctx, room.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	source := server.storage
+	if err := ExportArchive(ctx, source.RoomRepo, source.MessageRepo, source.PollRepo, source.MemberRepo, room.ID, &archive); err != nil {
+		t.Fatal(err)
+	}
+	target := newTestStorage(t)
+	summary, err := NewImporter(target.RoomRepo, target.MessageRepo, target.PollRepo, target.MemberRepo, ImportOptions{}).Import(ctx, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Rooms != 1 || summary.Members != 2 {
+		t.Fatalf("imported %+v", summary)
+	}
+	member, err := target.MemberRepo.GetMemberByToken(ctx, room.ID, hashToken(alice.MemberToken))
+	if err != nil || member == nil || member.UserName != "alice" || member.Status != MemberActive {
+		t.Fatalf("imported member %+v: %v", member, err)
+	}
+	members, err := target.MemberRepo.ListMembers(ctx, room.ID)
+	if err != nil || len(members) != 2 || members[1].UserName != "bob" || members[1].Status != MemberPending || members[1].ExpiresAt == 0 {
+		t.Fatalf("imported members %+v: %v", members, err)
+	}
+}
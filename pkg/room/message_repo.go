@@ -1,34 +1,68 @@
 package room
 
 import (
+	"cmp"
 	"context"
+	"slices"
+	"time"
 
 	"github.com/gocql/gocql"
+	"github.com/omran95/chatroom/pkg/common"
 )
 
 type MessageRepo interface {
-	InesrtMessage(ctx context.Context, msg Message) error
+	// InesrtMessage saves msg, a non zero ttl expires the message after that duration
+	InesrtMessage(ctx context.Context, msg Message, ttl time.Duration) error
 	MarkSeen(ctx context.Context, RoomID RoomID, messageID MessageID) error
+	// TrimMessages deletes all but the last keep messages of the room
+	TrimMessages(ctx context.Context, roomID RoomID, keep int) error
+	DeleteRoomMessages(ctx context.Context, roomID RoomID) error
+	// DeleteExpiredMessages deletes messages whose ttl passed, for stores without native TTL
+	DeleteExpiredMessages(ctx context.Context, now time.Time) error
+	// ScanMessages calls fn for the room messages with fromID <= id < toID in chronological order
+	ScanMessages(ctx context.Context, roomID RoomID, fromID, toID MessageID, fn func(msg Message) error) error
+	// LatestMessages returns the last limit messages of the room in chronological order
+	LatestMessages(ctx context.Context, roomID RoomID, limit int) ([]Message, error)
+	// GetMessages returns the stored messages of the room with the given IDs in chronological order
+	GetMessages(ctx context.Context, roomID RoomID, messageIDs []MessageID) ([]Message, error)
+	// UpsertMessages writes msgs with their original IDs, a non zero ttl expires each message
+	// ttl after its original time and messages that already expired are skipped
+	UpsertMessages(ctx context.Context, msgs []Message, ttl time.Duration) error
+	// InsertMessageWithOutbox saves msg together with its pending publish record
+	InsertMessageWithOutbox(ctx context.Context, msg Message, ttl time.Duration) error
+	// ScanOutbox calls fn for the pending publishes of messages sent within [from, to), in ID order
+	// within each room
+	ScanOutbox(ctx context.Context, from, to time.Time, fn func(msg Message) error) error
+	DeleteOutbox(ctx context.Context, msg Message) error
+	// DeleteExpiredOutbox deletes the pending publishes of messages sent before the given time, for
+	// stores without native TTL
+	DeleteExpiredOutbox(ctx context.Context, before time.Time) error
 }
 
+// cassandra fails batches over 50KB by default, keep batches of small messages well below
+var cassandraBatchSize = 50
+
 type MessageRepoImpl struct {
 	cassandraSession *gocql.Session
 	insertStmt       *gocql.Query
 	markSeenStmt     *gocql.Query
+	// outboxTTL expires pending publishes the relay no longer looks at
+	outboxTTL time.Duration
 }
 
-func NewMessageRepo(cassandraSession *gocql.Session) *MessageRepoImpl {
-	insertQuery := "insert into messages (id, event, room_id, username, payload, seen, timestamp) values (?, ?, ?, ?, ?, ?, ?)"
+func NewMessageRepo(cassandraSession *gocql.Session, outboxTTL time.Duration) *MessageRepoImpl {
+	// a ttl of 0 means the message never expires
+	insertQuery := "insert into messages (id, event, room_id, username, payload, seen, timestamp) values (?, ?, ?, ?, ?, ?, ?) using ttl ?"
 	preparedInsrtStmt := cassandraSession.Query(insertQuery)
 
 	markSeenQuery := "UPDATE messages SET seen = ? WHERE room_id = ? AND id = ?"
 	preparedmarkSeenStmt := cassandraSession.Query(markSeenQuery)
 
-	return &MessageRepoImpl{cassandraSession, preparedInsrtStmt, preparedmarkSeenStmt}
+	return &MessageRepoImpl{cassandraSession, preparedInsrtStmt, preparedmarkSeenStmt, outboxTTL}
 }
 
-func (msgRepo *MessageRepoImpl) InesrtMessage(ctx context.Context, msg Message) error {
-	stmt := msgRepo.insertStmt.Bind(msg.ID, msg.Event, msg.RoomID, msg.UserName, msg.Payload, msg.Seen, msg.Time).WithContext(ctx)
+func (msgRepo *MessageRepoImpl) InesrtMessage(ctx context.Context, msg Message, ttl time.Duration) error {
+	stmt := msgRepo.insertStmt.Bind(msg.ID, msg.Event, msg.RoomID, msg.UserName, msg.Payload, msg.Seen, msg.Time, int(ttl.Seconds())).WithContext(ctx)
 
 	if err := stmt.Exec(); err != nil {
 		return err
@@ -43,3 +77,179 @@ func (msgRepo *MessageRepoImpl) MarkSeen(ctx context.Context, RoomID RoomID, mes
 	}
 	return nil
 }
+
+func (msgRepo *MessageRepoImpl) TrimMessages(ctx context.Context, roomID RoomID, keep int) error {
+	var (
+		id     MessageID
+		count  int
+		lastID MessageID
+	)
+	// messages are clustered by id desc, the keep-th row is the oldest message to keep
+	iter := msgRepo.cassandraSession.Query("select id from messages where room_id = ? limit ?", roomID, keep).WithContext(ctx).Idempotent(true).Iter()
+	for iter.Scan(&id) {
+		count++
+		lastID = id
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if count < keep {
+		return nil
+	}
+	return msgRepo.cassandraSession.Query("delete from messages where room_id = ? and id < ?", roomID, lastID).WithContext(ctx).Idempotent(true).Exec()
+}
+
+func (msgRepo *MessageRepoImpl) DeleteRoomMessages(ctx context.Context, roomID RoomID) error {
+	return msgRepo.cassandraSession.Query("delete from messages where room_id = ?", roomID).WithContext(ctx).Idempotent(true).Exec()
+}
+
+func (msgRepo *MessageRepoImpl) DeleteExpiredMessages(ctx context.Context, now time.Time) error {
+	// expired messages are removed by the cassandra TTL
+	return nil
+}
+
+func (msgRepo *MessageRepoImpl) ScanMessages(ctx context.Context, roomID RoomID, fromID, toID MessageID, fn func(msg Message) error) error {
+	query := "select id, event, room_id, username, payload, seen, timestamp from messages where room_id = ? and id >= ? and id < ? order by id asc"
+	iter := msgRepo.cassandraSession.Query(query, roomID, fromID, toID).WithContext(ctx).Idempotent(true).PageSize(1000).Iter()
+	var msg Message
+	for iter.Scan(&msg.ID, &msg.Event, &msg.RoomID, &msg.UserName, &msg.Payload, &msg.Seen, &msg.Time) {
+		if err := fn(msg); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func (msgRepo *MessageRepoImpl) GetMessages(ctx context.Context, roomID RoomID, messageIDs []MessageID) ([]Message, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	query := "select id, event, room_id, username, payload, seen, timestamp from messages where room_id = ? and id in ?"
+	iter := msgRepo.cassandraSession.Query(query, roomID, messageIDs).WithContext(ctx).Idempotent(true).Iter()
+	msgs := make([]Message, 0, len(messageIDs))
+	var msg Message
+	for iter.Scan(&msg.ID, &msg.Event, &msg.RoomID, &msg.UserName, &msg.Payload, &msg.Seen, &msg.Time) {
+		msgs = append(msgs, msg)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(msgs, func(a, b Message) int { return cmp.Compare(a.ID, b.ID) })
+	return msgs, nil
+}
+
+func (msgRepo *MessageRepoImpl) LatestMessages(ctx context.Context, roomID RoomID, limit int) ([]Message, error) {
+	// messages are clustered by id desc, the first rows are the latest
+	query := "select id, event, room_id, username, payload, seen, timestamp from messages where room_id = ? limit ?"
+	iter := msgRepo.cassandraSession.Query(query, roomID, limit).WithContext(ctx).Idempotent(true).Iter()
+	msgs := make([]Message, 0, limit)
+	var msg Message
+	for iter.Scan(&msg.ID, &msg.Event, &msg.RoomID, &msg.UserName, &msg.Payload, &msg.Seen, &msg.Time) {
+		msgs = append(msgs, msg)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(msgs)
+	return msgs, nil
+}
+
+func (msgRepo *MessageRepoImpl) UpsertMessages(ctx context.Context, msgs []Message, ttl time.Duration) error {
+	query := "insert into messages (id, event, room_id, username, payload, seen, timestamp) values (?, ?, ?, ?, ?, ?, ?) using ttl ?"
+	now := time.Now()
+	// unlogged batches are only efficient within a partition, group the messages by room
+	byRoom := map[RoomID][]Message{}
+	for _, msg := range msgs {
+		byRoom[msg.RoomID] = append(byRoom[msg.RoomID], msg)
+	}
+	for _, roomMsgs := range byRoom {
+		batch := msgRepo.cassandraSession.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+		for _, msg := range roomMsgs {
+			ttlSeconds := 0
+			if ttl > 0 {
+				remaining := time.UnixMilli(msg.Time).Add(ttl).Sub(now)
+				if remaining <= 0 {
+					continue
+				}
+				ttlSeconds = max(1, int(remaining.Seconds()))
+			}
+			batch.Query(query, msg.ID, msg.Event, msg.RoomID, msg.UserName, msg.Payload, msg.Seen, msg.Time, ttlSeconds)
+			if batch.Size() >= cassandraBatchSize {
+				if err := msgRepo.cassandraSession.ExecuteBatch(batch); err != nil {
+					return err
+				}
+				batch = msgRepo.cassandraSession.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+			}
+		}
+		if batch.Size() > 0 {
+			if err := msgRepo.cassandraSession.ExecuteBatch(batch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// outboxShards is the number of outbox partitions per hour. Changing it orphans the pending
+// records of the current lookback, they expire with their ttl without being relayed.
+const outboxShards = 16
+
+// outboxBucket partitions the outbox by the hour the message was sent, so a relay round reads
+// outboxShards partitions per hour it scans.
+func outboxBucket(msgTime int64) int64 {
+	return msgTime / time.Hour.Milliseconds()
+}
+
+// outboxShard spreads the outbox records of an hour by room, the records of a room stay in ID order.
+func outboxShard(roomID RoomID) int {
+	return int(roomHash(roomID) % outboxShards)
+}
+
+func (msgRepo *MessageRepoImpl) InsertMessageWithOutbox(ctx context.Context, msg Message, ttl time.Duration) error {
+	// a logged batch applies both inserts or none, even across partitions
+	batch := msgRepo.cassandraSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("insert into messages (id, event, room_id, username, payload, seen, timestamp) values (?, ?, ?, ?, ?, ?, ?) using ttl ?",
+		msg.ID, msg.Event, msg.RoomID, msg.UserName, msg.Payload, msg.Seen, msg.Time, int(ttl.Seconds()))
+	batch.Query("insert into outbox (bucket, shard, id, payload) values (?, ?, ?, ?) using ttl ?",
+		outboxBucket(msg.Time), outboxShard(msg.RoomID), msg.ID, string(msg.Encode()), int(msgRepo.outboxTTL.Seconds()))
+	return msgRepo.cassandraSession.ExecuteBatch(batch)
+}
+
+func (msgRepo *MessageRepoImpl) ScanOutbox(ctx context.Context, from, to time.Time, fn func(msg Message) error) error {
+	toID := common.MinIDAt(to)
+	for bucket := outboxBucket(from.UnixMilli()); bucket <= outboxBucket(to.UnixMilli()); bucket++ {
+		for shard := 0; shard < outboxShards; shard++ {
+			if err := msgRepo.scanOutboxPartition(ctx, bucket, shard, toID, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (msgRepo *MessageRepoImpl) scanOutboxPartition(ctx context.Context, bucket int64, shard int, toID MessageID, fn func(msg Message) error) error {
+	iter := msgRepo.cassandraSession.Query("select payload from outbox where bucket = ? and shard = ? and id < ?", bucket, shard, toID).WithContext(ctx).Idempotent(true).Iter()
+	var payload string
+	for iter.Scan(&payload) {
+		msg, err := decodeToMessage([]byte(payload))
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		if err := fn(*msg); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func (msgRepo *MessageRepoImpl) DeleteOutbox(ctx context.Context, msg Message) error {
+	return msgRepo.cassandraSession.Query("delete from outbox where bucket = ? and shard = ? and id = ?", outboxBucket(msg.Time), outboxShard(msg.RoomID), msg.ID).WithContext(ctx).Idempotent(true).Exec()
+}
+
+// DeleteExpiredOutbox is a no-op, the outbox records expire with their ttl.
+func (msgRepo *MessageRepoImpl) DeleteExpiredOutbox(ctx context.Context, before time.Time) error {
+	return nil
+}
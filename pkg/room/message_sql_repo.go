@@ -0,0 +1,226 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SQLMessageRepoImpl struct {
+	db *sql.DB
+}
+
+func NewSQLMessageRepo(db *sql.DB) *SQLMessageRepoImpl {
+	return &SQLMessageRepoImpl{db}
+}
+
+func (msgRepo *SQLMessageRepoImpl) InesrtMessage(ctx context.Context, msg Message, ttl time.Duration) error {
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = msg.Time + ttl.Milliseconds()
+	}
+	query := "INSERT INTO messages (id, event, room_id, username, payload, seen, timestamp, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+	if _, err := msgRepo.db.ExecContext(ctx, query, msg.ID, msg.Event, msg.RoomID, msg.UserName, msg.Payload, msg.Seen, msg.Time, expiresAt); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (msgRepo *SQLMessageRepoImpl) MarkSeen(ctx context.Context, roomID RoomID, messageID MessageID) error {
+	query := "UPDATE messages SET seen = $1 WHERE room_id = $2 AND id = $3"
+	if _, err := msgRepo.db.ExecContext(ctx, query, true, roomID, messageID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (msgRepo *SQLMessageRepoImpl) TrimMessages(ctx context.Context, roomID RoomID, keep int) error {
+	var oldestKeptID MessageID
+	query := "SELECT id FROM messages WHERE room_id = $1 ORDER BY id DESC LIMIT 1 OFFSET $2"
+	err := msgRepo.db.QueryRowContext(ctx, query, roomID, keep-1).Scan(&oldestKeptID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = msgRepo.db.ExecContext(ctx, "DELETE FROM messages WHERE room_id = $1 AND id < $2", roomID, oldestKeptID)
+	return err
+}
+
+func (msgRepo *SQLMessageRepoImpl) DeleteRoomMessages(ctx context.Context, roomID RoomID) error {
+	_, err := msgRepo.db.ExecContext(ctx, "DELETE FROM messages WHERE room_id = $1", roomID)
+	return err
+}
+
+func (msgRepo *SQLMessageRepoImpl) DeleteExpiredMessages(ctx context.Context, now time.Time) error {
+	_, err := msgRepo.db.ExecContext(ctx, "DELETE FROM messages WHERE expires_at > 0 AND expires_at <= $1", now.UnixMilli())
+	return err
+}
+
+func (msgRepo *SQLMessageRepoImpl) ScanMessages(ctx context.Context, roomID RoomID, fromID, toID MessageID, fn func(msg Message) error) error {
+	query := "SELECT id, event, room_id, username, payload, seen, timestamp FROM messages WHERE room_id = $1 AND id >= $2 AND id < $3 ORDER BY id ASC"
+	rows, err := msgRepo.db.QueryContext(ctx, query, roomID, fromID, toID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.Event, &msg.RoomID, &msg.UserName, &msg.Payload, &msg.Seen, &msg.Time); err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (msgRepo *SQLMessageRepoImpl) GetMessages(ctx context.Context, roomID RoomID, messageIDs []MessageID) ([]Message, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	placeholders := make([]string, len(messageIDs))
+	args := make([]any, 0, len(messageIDs)+1)
+	args = append(args, roomID)
+	for i, id := range messageIDs {
+		placeholders[i] = "$" + strconv.Itoa(i+2)
+		args = append(args, id)
+	}
+	query := "SELECT id, event, room_id, username, payload, seen, timestamp FROM messages WHERE room_id = $1 AND id IN (" + strings.Join(placeholders, ", ") + ") ORDER BY id ASC"
+	rows, err := msgRepo.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	msgs := make([]Message, 0, len(messageIDs))
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.Event, &msg.RoomID, &msg.UserName, &msg.Payload, &msg.Seen, &msg.Time); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (msgRepo *SQLMessageRepoImpl) LatestMessages(ctx context.Context, roomID RoomID, limit int) ([]Message, error) {
+	query := "SELECT id, event, room_id, username, payload, seen, timestamp FROM messages WHERE room_id = $1 ORDER BY id DESC LIMIT $2"
+	rows, err := msgRepo.db.QueryContext(ctx, query, roomID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	msgs := make([]Message, 0, limit)
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.Event, &msg.RoomID, &msg.UserName, &msg.Payload, &msg.Seen, &msg.Time); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(msgs)
+	return msgs, nil
+}
+
+func (msgRepo *SQLMessageRepoImpl) UpsertMessages(ctx context.Context, msgs []Message, ttl time.Duration) error {
+	tx, err := msgRepo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO messages (id, event, room_id, username, payload, seen, timestamp, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (room_id, id) DO UPDATE SET event = excluded.event, username = excluded.username, payload = excluded.payload,
+	seen = excluded.seen, timestamp = excluded.timestamp, expires_at = excluded.expires_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().UnixMilli()
+	for _, msg := range msgs {
+		var expiresAt int64
+		if ttl > 0 {
+			expiresAt = msg.Time + ttl.Milliseconds()
+			if expiresAt <= now {
+				continue
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, msg.ID, msg.Event, msg.RoomID, msg.UserName, msg.Payload, msg.Seen, msg.Time, expiresAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (msgRepo *SQLMessageRepoImpl) InsertMessageWithOutbox(ctx context.Context, msg Message, ttl time.Duration) error {
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = msg.Time + ttl.Milliseconds()
+	}
+	tx, err := msgRepo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO messages (id, event, room_id, username, payload, seen, timestamp, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+	if _, err := tx.ExecContext(ctx, query, msg.ID, msg.Event, msg.RoomID, msg.UserName, msg.Payload, msg.Seen, msg.Time, expiresAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO outbox (id, payload, created_at) VALUES ($1, $2, $3)", msg.ID, string(msg.Encode()), msg.Time); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (msgRepo *SQLMessageRepoImpl) ScanOutbox(ctx context.Context, from, to time.Time, fn func(msg Message) error) error {
+	query := "SELECT payload FROM outbox WHERE created_at >= $1 AND created_at < $2 ORDER BY id ASC"
+	rows, err := msgRepo.db.QueryContext(ctx, query, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var payloads []string
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return err
+		}
+		payloads = append(payloads, payload)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// the rows are closed before fn runs, sqlite allows a single connection to write
+	rows.Close()
+	for _, payload := range payloads {
+		msg, err := decodeToMessage([]byte(payload))
+		if err != nil {
+			return err
+		}
+		if err := fn(*msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (msgRepo *SQLMessageRepoImpl) DeleteOutbox(ctx context.Context, msg Message) error {
+	_, err := msgRepo.db.ExecContext(ctx, "DELETE FROM outbox WHERE id = $1", msg.ID)
+	return err
+}
+
+func (msgRepo *SQLMessageRepoImpl) DeleteExpiredOutbox(ctx context.Context, before time.Time) error {
+	_, err := msgRepo.db.ExecContext(ctx, "DELETE FROM outbox WHERE created_at < $1", before.UnixMilli())
+	return err
+}
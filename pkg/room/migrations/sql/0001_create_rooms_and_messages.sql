@@ -0,0 +1,17 @@
+CREATE TABLE rooms (
+    id BIGINT PRIMARY KEY,
+    name TEXT NOT NULL,
+    protected BOOLEAN NOT NULL,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE messages (
+    id BIGINT NOT NULL,
+    event INTEGER NOT NULL,
+    room_id BIGINT NOT NULL,
+    username TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    seen BOOLEAN NOT NULL,
+    timestamp BIGINT NOT NULL,
+    PRIMARY KEY (room_id, id)
+);
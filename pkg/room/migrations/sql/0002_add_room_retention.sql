@@ -0,0 +1,6 @@
+ALTER TABLE rooms ADD COLUMN retention_days INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rooms ADD COLUMN retention_messages INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rooms ADD COLUMN last_activity_at BIGINT NOT NULL DEFAULT 0;
+
+-- sql has no TTL, expired messages (expires_at > 0) are deleted by the retention worker
+ALTER TABLE messages ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0;
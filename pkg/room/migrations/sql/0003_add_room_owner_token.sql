@@ -0,0 +1 @@
+ALTER TABLE rooms ADD COLUMN owner_token_hash TEXT NOT NULL DEFAULT '';
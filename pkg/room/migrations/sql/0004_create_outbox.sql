@@ -0,0 +1,8 @@
+-- pending publishes of stored messages
+CREATE TABLE outbox (
+    id BIGINT PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at BIGINT NOT NULL
+);
+
+CREATE INDEX outbox_created_at ON outbox (created_at);
@@ -0,0 +1,11 @@
+-- outgoing and incoming webhooks and slash commands registered by the room owners
+CREATE TABLE webhooks (
+    room_id BIGINT NOT NULL,
+    id BIGINT NOT NULL,
+    kind TEXT NOT NULL,
+    name TEXT NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    created_at BIGINT NOT NULL,
+    PRIMARY KEY (room_id, id)
+);
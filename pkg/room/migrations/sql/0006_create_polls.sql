@@ -0,0 +1,27 @@
+-- polls are keyed by their poll message ID, a user has one vote per poll
+CREATE TABLE polls (
+    room_id BIGINT NOT NULL,
+    id BIGINT NOT NULL,
+    creator TEXT NOT NULL,
+    question TEXT NOT NULL,
+    options TEXT NOT NULL,
+    allow_change BOOLEAN NOT NULL,
+    closed BOOLEAN NOT NULL,
+    created_at BIGINT NOT NULL,
+    PRIMARY KEY (room_id, id)
+);
+
+CREATE TABLE poll_votes (
+    poll_id BIGINT NOT NULL,
+    username TEXT NOT NULL,
+    choice INTEGER NOT NULL,
+    PRIMARY KEY (poll_id, username)
+);
+
+-- the votes of each option, updated with the votes in the same transaction
+CREATE TABLE poll_tallies (
+    poll_id BIGINT NOT NULL,
+    choice INTEGER NOT NULL,
+    votes BIGINT NOT NULL,
+    PRIMARY KEY (poll_id, choice)
+);
@@ -0,0 +1,7 @@
+-- pinned messages, the messages are read from the messages table so pins of expired messages vanish with them
+CREATE TABLE pins (
+    room_id BIGINT NOT NULL,
+    message_id BIGINT NOT NULL,
+    pinned_at BIGINT NOT NULL,
+    PRIMARY KEY (room_id, message_id)
+);
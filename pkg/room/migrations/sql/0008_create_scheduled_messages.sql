@@ -0,0 +1,12 @@
+-- pending scheduled messages
+CREATE TABLE scheduled_messages (
+    id BIGINT PRIMARY KEY,
+    room_id BIGINT NOT NULL,
+    username TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    due_at BIGINT NOT NULL,
+    author_token_hash TEXT NOT NULL
+);
+
+CREATE INDEX scheduled_messages_room_id ON scheduled_messages (room_id);
+CREATE INDEX scheduled_messages_due_at ON scheduled_messages (due_at);
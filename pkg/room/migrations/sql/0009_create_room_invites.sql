@@ -0,0 +1,12 @@
+-- invites of the room owner
+CREATE TABLE room_invites (
+    room_id BIGINT NOT NULL,
+    id BIGINT NOT NULL,
+    single_use BOOLEAN NOT NULL,
+    used BOOLEAN NOT NULL,
+    expires_at BIGINT NOT NULL,
+    created_at BIGINT NOT NULL,
+    PRIMARY KEY (room_id, id)
+);
+
+CREATE INDEX room_invites_expires_at ON room_invites (expires_at);
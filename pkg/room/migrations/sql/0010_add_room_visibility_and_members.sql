@@ -0,0 +1,17 @@
+ALTER TABLE rooms ADD COLUMN visibility TEXT NOT NULL DEFAULT 'unlisted';
+
+CREATE INDEX rooms_visibility ON rooms (visibility, id);
+
+-- members and pending join requests of the private rooms, pending join requests expire and
+-- members have no expiry
+CREATE TABLE room_members (
+    room_id BIGINT NOT NULL,
+    username TEXT NOT NULL,
+    status TEXT NOT NULL,
+    token_hash TEXT NOT NULL,
+    created_at BIGINT NOT NULL,
+    expires_at BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (room_id, username)
+);
+
+CREATE INDEX room_members_token_hash ON room_members (room_id, token_hash);
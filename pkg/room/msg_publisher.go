@@ -6,6 +6,7 @@ import (
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/omran95/chatroom/pkg/config"
 )
 
 var MessagePubTopic = "chat.msg.pub"
@@ -15,18 +16,20 @@ type MessagePublisher interface {
 }
 
 type MessagePublisherImpl struct {
-	publisher message.Publisher
+	publisher   message.Publisher
+	contentType string
 }
 
-func NewMessagePublisher(publisher message.Publisher) *MessagePublisherImpl {
-	return &MessagePublisherImpl{publisher}
+func NewMessagePublisher(publisher message.Publisher, config *config.Config) (*MessagePublisherImpl, error) {
+	contentType, err := PayloadContentType(config.Kafka.PayloadFormat)
+	if err != nil {
+		return nil, err
+	}
+	return &MessagePublisherImpl{publisher, contentType}, nil
 }
 
 func (msgPub *MessagePublisherImpl) PublishMessage(ctx context.Context, msg Message) error {
-	kafkaMessage := message.NewMessage(
-		watermill.NewUUID(),
-		msg.Encode(),
-	)
+	kafkaMessage := NewBrokerMessage(watermill.NewUUID(), msgPub.contentType, msg)
 	//partition kafka topic based on roomID
 	kafkaMessage.Metadata.Set("partition_key", strconv.FormatUint(msg.RoomID, 10))
 	return msgPub.publisher.Publish(MessagePubTopic, kafkaMessage)
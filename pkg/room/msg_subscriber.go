@@ -5,32 +5,50 @@ import (
 
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/omran95/chatroom/pkg/config"
-
-	"gopkg.in/olahol/melody.v1"
 )
 
+// RoomMessageSubscriber delivers the published room messages to the websocket sessions of this instance.
+type RoomMessageSubscriber interface {
+	RegisterHandler()
+	Run() error
+	GracefulStop() error
+	// Topic is the topic the subscriber service publishes the messages of joined rooms to.
+	Topic() string
+	JoinRoom(roomID RoomID, sess Session) error
+	LeaveRoom(roomID RoomID, sess Session)
+}
+
+// MessageSubscriber consumes the per-host topic the subscriber service publishes to.
 type MessageSubscriber struct {
 	topic      string
 	router     *message.Router
 	subscriber message.Subscriber
-	ws         MelodyConn
+	sessions   *RoomSessions
 }
 
-func NewMessageSubscriber(router *message.Router, config *config.Config, subscriber message.Subscriber, ws MelodyConn) (*MessageSubscriber, error) {
+func NewMessageSubscriber(router *message.Router, config *config.Config, subscriber message.Subscriber, sessions *RoomSessions) (*MessageSubscriber, error) {
 	return &MessageSubscriber{
 		topic:      config.Room.MessageSubscriber.Topic,
 		router:     router,
 		subscriber: subscriber,
-		ws:         ws,
+		sessions:   sessions,
 	}, nil
 }
 
 func (subscriber *MessageSubscriber) HandleIncomingMessage(msg *message.Message) error {
-	message, err := decodeToMessage([]byte(msg.Payload))
+	messages, err := DecodeBrokerMessage(msg)
 	if err != nil {
 		return err
 	}
-	return subscriber.broadcast(message)
+	if len(messages) == 1 && msg.Metadata.Get(BatchMetadataKey) != "true" {
+		// a single message payload is written to the sessions of the same format as is
+		subscriber.sessions.Broadcast(&messages[0], brokerContentType(msg), msg.Payload)
+		return nil
+	}
+	for i := range messages {
+		subscriber.sessions.Broadcast(&messages[i], "", nil)
+	}
+	return nil
 }
 
 func (subscriber *MessageSubscriber) RegisterHandler() {
@@ -50,12 +68,15 @@ func (subscriber *MessageSubscriber) GracefulStop() error {
 	return subscriber.router.Close()
 }
 
-func (subscriber *MessageSubscriber) broadcast(message *Message) error {
-	return subscriber.ws.BroadcastFilter(message.Encode(), func(sess *melody.Session) bool {
-		roomID, exist := sess.Get(sessRidKey)
-		if !exist {
-			return false
-		}
-		return message.RoomID == (roomID.(uint64))
-	})
+func (subscriber *MessageSubscriber) Topic() string {
+	return subscriber.topic
+}
+
+func (subscriber *MessageSubscriber) JoinRoom(roomID RoomID, sess Session) error {
+	subscriber.sessions.Add(roomID, sess)
+	return nil
+}
+
+func (subscriber *MessageSubscriber) LeaveRoom(roomID RoomID, sess Session) {
+	subscriber.sessions.Remove(roomID, sess)
 }
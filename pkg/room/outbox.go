@@ -0,0 +1,188 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+var outboxLockKey = "chat:outbox:lock"
+
+var errOutboxLockLost = errors.New("outbox lock lost")
+
+// outboxFullScanInterval is how often a relay rescans the whole lookback, for the records stored
+// after a round scanned past them, e.g. by an instance whose clock is behind.
+const outboxFullScanInterval = time.Hour
+
+// OutboxRelay publishes the stored messages whose publish failed or never happened, e.g. when
+// the broker was down or the instance crashed after saving. Records younger than the grace period
+// are left to the publish right after saving, records older than the lookback are deleted.
+// A redis lock makes a single instance relay each round, it is renewed while the round runs and
+// held until one interval after the round started. A round scans from where the previous round of
+// the instance completed, the whole lookback is scanned on the first round and every outboxFullScanInterval.
+type OutboxRelay struct {
+	messageRepo      MessageRepo
+	messagePublisher MessagePublisher
+	redisClient      redis.UniversalClient
+	logger           common.HttpLog
+	instanceID       string
+	interval         time.Duration
+	grace            time.Duration
+	lookback         time.Duration
+	lockTTL          time.Duration
+	// scannedUntil is the end of the last completed round, fullScanAt the start of the last
+	// completed round that scanned the whole lookback
+	scannedUntil time.Time
+	fullScanAt   time.Time
+	cancel       context.CancelFunc
+	done         chan struct{}
+}
+
+func NewOutboxRelay(config *config.Config, logger common.HttpLog, messageRepo MessageRepo, messagePublisher MessagePublisher, redisClient redis.UniversalClient) (*OutboxRelay, error) {
+	outbox := config.Room.Outbox
+	if outbox.IntervalSecond <= 0 {
+		return nil, fmt.Errorf("invalid outbox interval: %d seconds", outbox.IntervalSecond)
+	}
+	if outbox.LockSecond <= 0 {
+		return nil, fmt.Errorf("invalid outbox lock ttl: %d seconds", outbox.LockSecond)
+	}
+	hostname, _ := os.Hostname()
+	return &OutboxRelay{
+		messageRepo:      messageRepo,
+		messagePublisher: messagePublisher,
+		redisClient:      redisClient,
+		logger:           logger,
+		instanceID:       fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		interval:         time.Duration(outbox.IntervalSecond) * time.Second,
+		grace:            time.Duration(outbox.GraceSecond) * time.Second,
+		lookback:         time.Duration(outbox.LookbackHour) * time.Hour,
+		lockTTL:          time.Duration(outbox.LockSecond) * time.Second,
+		done:             make(chan struct{}),
+	}, nil
+}
+
+func (relay *OutboxRelay) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	relay.cancel = cancel
+	go func() {
+		defer close(relay.done)
+		ticker := time.NewTicker(relay.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := relay.runOnce(ctx); err != nil && !errors.Is(err, context.Canceled) {
+					relay.logger.Error("outbox relay: " + err.Error())
+				}
+			}
+		}
+	}()
+}
+
+func (relay *OutboxRelay) GracefulStop() {
+	if relay.cancel == nil {
+		return
+	}
+	relay.cancel()
+	<-relay.done
+}
+
+func (relay *OutboxRelay) runOnce(ctx context.Context) error {
+	start := time.Now()
+	acquired, err := relay.redisClient.SetNX(ctx, outboxLockKey, relay.instanceID, relay.lockTTL).Result()
+	if err != nil || !acquired {
+		return err
+	}
+	defer relay.unlock(context.WithoutCancel(ctx), start)
+
+	roundCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		relay.renewLock(roundCtx, cancel)
+	}()
+	defer func() {
+		cancel(nil)
+		<-renewed
+	}()
+
+	now := time.Now()
+	from, to := now.Add(-relay.lookback), now.Add(-relay.grace)
+	fullScan := now.Sub(relay.fullScanAt) >= outboxFullScanInterval || !relay.scannedUntil.After(from)
+	if !fullScan {
+		from = relay.scannedUntil
+	}
+	err = relay.messageRepo.ScanOutbox(roundCtx, from, to, func(msg Message) error {
+		// a failed publish stops the round, the remaining records keep their order for the next one
+		if err := relay.messagePublisher.PublishMessage(roundCtx, msg); err != nil {
+			return err
+		}
+		relay.logger.Info("relayed outbox message", slog.Uint64("message_id", msg.ID), slog.Uint64("room_id", msg.RoomID))
+		return relay.messageRepo.DeleteOutbox(roundCtx, msg)
+	})
+	if err == nil {
+		relay.scannedUntil = to
+		if fullScan {
+			relay.fullScanAt = now
+		}
+		err = relay.messageRepo.DeleteExpiredOutbox(roundCtx, now.Add(-relay.lookback))
+	}
+	if err != nil && errors.Is(context.Cause(roundCtx), errOutboxLockLost) {
+		return errOutboxLockLost
+	}
+	return err
+}
+
+// renewLock extends the lock every third of its ttl until ctx is done, and stops the round when
+// the lock was lost.
+func (relay *OutboxRelay) renewLock(ctx context.Context, stopRound context.CancelCauseFunc) {
+	renewLease(ctx, relay.redisClient, outboxLockKey, relay.instanceID, relay.lockTTL, func() { stopRound(errOutboxLockLost) })
+}
+
+// unlock keeps the lock until one interval after the round started, so the instances relay one
+// round per interval together.
+func (relay *OutboxRelay) unlock(ctx context.Context, start time.Time) {
+	if err := releaseLeaseAfter(ctx, relay.redisClient, outboxLockKey, relay.instanceID, relay.interval-time.Since(start)); err != nil {
+		relay.logger.Error("outbox relay: error releasing lock: " + err.Error())
+	}
+}
+
+// renewLease extends the lease every third of its ttl until ctx is done, and calls lost once
+// the lease is held by another instance or could not be renewed.
+func renewLease(ctx context.Context, redisClient redis.UniversalClient, key, instanceID string, ttl time.Duration, lost func()) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			renewed, err := renewLeaseScript.Run(ctx, redisClient, []string{key}, instanceID, ttl.Milliseconds()).Int()
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+			if err != nil || renewed != 1 {
+				lost()
+				return
+			}
+		}
+	}
+}
+
+// releaseLeaseAfter keeps the lease for the remaining duration, or releases it when none remains.
+func releaseLeaseAfter(ctx context.Context, redisClient redis.UniversalClient, key, instanceID string, remaining time.Duration) error {
+	if remaining >= time.Millisecond {
+		return renewLeaseScript.Run(ctx, redisClient, []string{key}, instanceID, remaining.Milliseconds()).Err()
+	}
+	return releaseLeaseScript.Run(ctx, redisClient, []string{key}, instanceID).Err()
+}
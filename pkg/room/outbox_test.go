@@ -0,0 +1,187 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/redis/go-redis/v9"
+)
+
+type recordingPublisher struct {
+	mu   sync.Mutex
+	ids  []MessageID
+	fail bool
+}
+
+func (publisher *recordingPublisher) PublishMessage(ctx context.Context, msg Message) error {
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	if publisher.fail {
+		return errors.New("broker down")
+	}
+	publisher.ids = append(publisher.ids, msg.ID)
+	return nil
+}
+
+func newTestOutboxRelay(t *testing.T, messageRepo MessageRepo, publisher MessagePublisher) (*OutboxRelay, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+	cfg := newTestConfig(t)
+	cfg.Room.Outbox.IntervalSecond = 5
+	cfg.Room.Outbox.GraceSecond = 10
+	cfg.Room.Outbox.LookbackHour = 1
+	cfg.Room.Outbox.LockSecond = 60
+	relay, err := NewOutboxRelay(cfg, testLogger, messageRepo, publisher, redisClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return relay, server
+}
+
+func TestOutboxRelay(t *testing.T) {
+	storage := newTestStorage(t)
+	publisher := &recordingPublisher{}
+	relay, server := newTestOutboxRelay(t, storage.MessageRepo, publisher)
+	ctx := context.Background()
+	now := time.Now()
+	for _, msg := range []Message{
+		{ID: 1, RoomID: 1, Payload: "expired", Time: now.Add(-2 * time.Hour).UnixMilli()},
+		{ID: 2, RoomID: 1, Payload: "pending", Time: now.Add(-time.Minute).UnixMilli()},
+		{ID: 3, RoomID: 1, Payload: "in grace", Time: now.UnixMilli()},
+	} {
+		if err := storage.MessageRepo.InsertMessageWithOutbox(ctx, msg, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := relay.runOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(publisher.ids) != 1 || publisher.ids[0] != 2 {
+		t.Fatalf("relayed %v, want [2]", publisher.ids)
+	}
+	var pending []MessageID
+	err := storage.MessageRepo.ScanOutbox(ctx, time.UnixMilli(0), now.Add(time.Hour), func(msg Message) error {
+		pending = append(pending, msg.ID)
+		return nil
+	})
+	if err != nil || len(pending) != 1 || pending[0] != 3 {
+		t.Fatalf("outbox holds %v, want [3]: %v", pending, err)
+	}
+
+	// the lock is held until one interval after the round started
+	ttl := server.TTL(outboxLockKey)
+	if ttl <= 0 || ttl > relay.interval {
+		t.Fatalf("lock ttl %s after the round, want at most %s", ttl, relay.interval)
+	}
+	if err := relay.runOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(publisher.ids) != 1 {
+		t.Fatalf("a second round ran while the lock was held")
+	}
+}
+
+func TestOutboxRelayStopsWhenTheLockIsLost(t *testing.T) {
+	storage := newTestStorage(t)
+	publisher := &recordingPublisher{}
+	relay, server := newTestOutboxRelay(t, storage.MessageRepo, publisher)
+	relay.lockTTL = 30 * time.Millisecond
+	ctx := context.Background()
+	if err := storage.MessageRepo.InsertMessageWithOutbox(ctx, Message{ID: 1, RoomID: 1, Time: time.Now().Add(-time.Minute).UnixMilli()}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := &blockingPublisher{started: make(chan struct{})}
+	relay.messagePublisher = blocked
+	result := make(chan error)
+	go func() { result <- relay.runOnce(ctx) }()
+	<-blocked.started
+	server.Set(outboxLockKey, "other instance")
+	select {
+	case err := <-result:
+		if !errors.Is(err, errOutboxLockLost) {
+			t.Fatalf("got %v, want %v", err, errOutboxLockLost)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("round kept running without the lock")
+	}
+	if value, _ := server.Get(outboxLockKey); value != "other instance" {
+		t.Fatalf("the lock of the other instance was changed to %q", value)
+	}
+}
+
+// blockingPublisher blocks until the round is stopped.
+type blockingPublisher struct {
+	started chan struct{}
+}
+
+func (publisher *blockingPublisher) PublishMessage(ctx context.Context, msg Message) error {
+	close(publisher.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestOutboxRelayScansFromThePreviousRound(t *testing.T) {
+	storage := newTestStorage(t)
+	publisher := &recordingPublisher{}
+	relay, server := newTestOutboxRelay(t, storage.MessageRepo, publisher)
+	ctx := context.Background()
+	if err := relay.runOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if relay.scannedUntil.IsZero() || relay.fullScanAt.IsZero() {
+		t.Fatal("the first round did not record the scanned range")
+	}
+
+	now := time.Now()
+	relay.scannedUntil = now.Add(-5 * time.Minute)
+	for _, msg := range []Message{
+		{ID: 1, RoomID: 1, Payload: "stored late", Time: now.Add(-10 * time.Minute).UnixMilli()},
+		{ID: 2, RoomID: 1, Payload: "pending", Time: now.Add(-time.Minute).UnixMilli()},
+	} {
+		if err := storage.MessageRepo.InsertMessageWithOutbox(ctx, msg, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Del(outboxLockKey)
+	if err := relay.runOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(publisher.ids) != 1 || publisher.ids[0] != 2 {
+		t.Fatalf("relayed %v, want only the record after the previous round [2]", publisher.ids)
+	}
+
+	// the whole lookback is scanned again once the full scan interval passed
+	relay.fullScanAt = now.Add(-outboxFullScanInterval)
+	server.Del(outboxLockKey)
+	if err := relay.runOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(publisher.ids) != 2 || publisher.ids[1] != 1 {
+		t.Fatalf("relayed %v, want the late record on the full scan", publisher.ids)
+	}
+}
+
+func TestOutboxShard(t *testing.T) {
+	// the IDs of one instance share their low bits, they are still spread over every shard
+	used := map[int]bool{}
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		shard := outboxShard(common.MinIDAt(start.Add(time.Duration(i) * time.Second)))
+		if shard < 0 || shard >= outboxShards {
+			t.Fatalf("shard %d out of range", shard)
+		}
+		used[shard] = true
+	}
+	if len(used) != outboxShards {
+		t.Fatalf("rooms spread over %d of %d shards", len(used), outboxShards)
+	}
+}
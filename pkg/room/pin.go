@@ -0,0 +1,28 @@
+package room
+
+// Pins are made by the room owner with the owner token, rooms have no moderator role so pinning is
+// not delegated. Only the pinned message IDs are stored, the messages are read from the room
+// messages, so a pin goes away with its message once the room retention deletes it.
+
+const maxPinsPerRoom = 50
+
+type Pin struct {
+	RoomID    RoomID
+	MessageID MessageID
+	PinnedAt  int64
+}
+
+type PinMessageDTO struct {
+	MessageID MessageID `json:"message_id" binding:"required"`
+}
+
+// PinnedMessage is listed by the pins endpoint and is the payload of the EventPin messages.
+type PinnedMessage struct {
+	Message
+	PinnedAt int64 `json:"pinned_at"`
+}
+
+// RoomState is the payload of the EventRoomState message a session gets once it joined the room.
+type RoomState struct {
+	Pins []PinnedMessage `json:"pins"`
+}
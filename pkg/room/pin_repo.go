@@ -0,0 +1,59 @@
+package room
+
+import (
+	"context"
+
+	"github.com/gocql/gocql"
+)
+
+type PinRepo interface {
+	PinMessage(ctx context.Context, pin Pin) error
+	// UnpinMessage reports whether the message was pinned
+	UnpinMessage(ctx context.Context, roomID RoomID, messageID MessageID) (bool, error)
+	// ListPins returns the pins of the room in message order
+	ListPins(ctx context.Context, roomID RoomID) ([]Pin, error)
+	DeleteRoomPins(ctx context.Context, roomID RoomID) error
+}
+
+type PinRepoImpl struct {
+	cassandraSession *gocql.Session
+}
+
+func NewPinRepo(cassandraSession *gocql.Session) *PinRepoImpl {
+	return &PinRepoImpl{cassandraSession}
+}
+
+func (repo *PinRepoImpl) PinMessage(ctx context.Context, pin Pin) error {
+	query := "insert into pins (room_id, message_id, pinned_at) values (?, ?, ?)"
+	return repo.cassandraSession.Query(query, pin.RoomID, pin.MessageID, pin.PinnedAt).WithContext(ctx).Exec()
+}
+
+func (repo *PinRepoImpl) UnpinMessage(ctx context.Context, roomID RoomID, messageID MessageID) (bool, error) {
+	var id MessageID
+	err := repo.cassandraSession.Query("select message_id from pins where room_id = ? and message_id = ?", roomID, messageID).WithContext(ctx).Idempotent(true).Scan(&id)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = repo.cassandraSession.Query("delete from pins where room_id = ? and message_id = ?", roomID, messageID).WithContext(ctx).Idempotent(true).Exec()
+	return err == nil, err
+}
+
+func (repo *PinRepoImpl) ListPins(ctx context.Context, roomID RoomID) ([]Pin, error) {
+	iter := repo.cassandraSession.Query("select room_id, message_id, pinned_at from pins where room_id = ?", roomID).WithContext(ctx).Idempotent(true).Iter()
+	var pins []Pin
+	var pin Pin
+	for iter.Scan(&pin.RoomID, &pin.MessageID, &pin.PinnedAt) {
+		pins = append(pins, pin)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+func (repo *PinRepoImpl) DeleteRoomPins(ctx context.Context, roomID RoomID) error {
+	return repo.cassandraSession.Query("delete from pins where room_id = ?", roomID).WithContext(ctx).Idempotent(true).Exec()
+}
@@ -0,0 +1,51 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+)
+
+type SQLPinRepoImpl struct {
+	db *sql.DB
+}
+
+func NewSQLPinRepo(db *sql.DB) *SQLPinRepoImpl {
+	return &SQLPinRepoImpl{db}
+}
+
+func (repo *SQLPinRepoImpl) PinMessage(ctx context.Context, pin Pin) error {
+	query := "INSERT INTO pins (room_id, message_id, pinned_at) VALUES ($1, $2, $3) ON CONFLICT (room_id, message_id) DO UPDATE SET pinned_at = excluded.pinned_at"
+	_, err := repo.db.ExecContext(ctx, query, pin.RoomID, pin.MessageID, pin.PinnedAt)
+	return err
+}
+
+func (repo *SQLPinRepoImpl) UnpinMessage(ctx context.Context, roomID RoomID, messageID MessageID) (bool, error) {
+	result, err := repo.db.ExecContext(ctx, "DELETE FROM pins WHERE room_id = $1 AND message_id = $2", roomID, messageID)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (repo *SQLPinRepoImpl) ListPins(ctx context.Context, roomID RoomID) ([]Pin, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT room_id, message_id, pinned_at FROM pins WHERE room_id = $1 ORDER BY message_id", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pins []Pin
+	for rows.Next() {
+		var pin Pin
+		if err := rows.Scan(&pin.RoomID, &pin.MessageID, &pin.PinnedAt); err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	return pins, rows.Err()
+}
+
+func (repo *SQLPinRepoImpl) DeleteRoomPins(ctx context.Context, roomID RoomID) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM pins WHERE room_id = $1", roomID)
+	return err
+}
@@ -0,0 +1,104 @@
+package room
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/omran95/chatroom/pkg/common"
+)
+
+// newPinTestRoom creates a room with count stored text messages and returns it with the messages.
+func newPinTestRoom(t *testing.T, server *testRoomServer, count int) (RoomID, []Message) {
+	t.Helper()
+	ctx := context.Background()
+	room, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: "general"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		if err := server.service.BroadcastTextMessage(ctx, room.ID, "alice", "message "+strconv.Itoa(i), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, err := server.storage.MessageRepo.LatestMessages(ctx, room.ID, count)
+	if err != nil || len(msgs) != count {
+		t.Fatalf("messages %d: %v", len(msgs), err)
+	}
+	return room.ID, msgs
+}
+
+func TestPinLimitCountsLivePins(t *testing.T) {
+	server := newTestRoomServer(t)
+	service, ctx := server.service, context.Background()
+	roomID, msgs := newPinTestRoom(t, server, maxPinsPerRoom+1)
+
+	// a pin of a message the retention deleted does not count and is deleted
+	if err := server.storage.PinRepo.PinMessage(ctx, Pin{RoomID: roomID, MessageID: 1, PinnedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs[:maxPinsPerRoom] {
+		if pinned, err := service.PinMessage(ctx, roomID, msg.ID); err != nil || pinned == nil {
+			t.Fatalf("pin %d: %v", msg.ID, err)
+		}
+	}
+	pins, err := server.storage.PinRepo.ListPins(ctx, roomID)
+	if err != nil || len(pins) != maxPinsPerRoom {
+		t.Fatalf("%d stored pins, want %d: %v", len(pins), maxPinsPerRoom, err)
+	}
+
+	first, err := service.PinMessage(ctx, roomID, msgs[0].ID)
+	if err != nil || first == nil || first.Payload != msgs[0].Payload {
+		t.Fatalf("pinning a pinned message got %v: %v", first, err)
+	}
+	if _, err := service.PinMessage(ctx, roomID, msgs[maxPinsPerRoom].ID); !errors.Is(err, common.ErrTooManyPins) {
+		t.Fatalf("pin over the limit: %v", err)
+	}
+	if unpinned, err := service.UnpinMessage(ctx, roomID, msgs[0].ID); err != nil || !unpinned {
+		t.Fatalf("unpin: %v", err)
+	}
+	if _, err := service.PinMessage(ctx, roomID, msgs[maxPinsPerRoom].ID); err != nil {
+		t.Fatalf("pin after an unpin: %v", err)
+	}
+
+	state, err := service.RoomState(ctx, roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roomState RoomState
+	if err := json.Unmarshal([]byte(state.Payload), &roomState); err != nil {
+		t.Fatal(err)
+	}
+	if len(roomState.Pins) != maxPinsPerRoom || roomState.Pins[0].ID != msgs[1].ID || roomState.Pins[maxPinsPerRoom-1].ID != msgs[maxPinsPerRoom].ID {
+		t.Fatalf("room state has %d pins from %d to %d", len(roomState.Pins), roomState.Pins[0].ID, roomState.Pins[len(roomState.Pins)-1].ID)
+	}
+}
+
+func TestConcurrentPinsStayWithinLimit(t *testing.T) {
+	server := newTestRoomServer(t)
+	ctx := context.Background()
+	const extra = 10
+	roomID, msgs := newPinTestRoom(t, server, maxPinsPerRoom+extra)
+
+	var wg sync.WaitGroup
+	for _, msg := range msgs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := server.service.PinMessage(ctx, roomID, msg.ID); err != nil && !errors.Is(err, common.ErrTooManyPins) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	pins, err := server.storage.PinRepo.ListPins(ctx, roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) > maxPinsPerRoom {
+		t.Fatalf("%d pins, the limit is %d", len(pins), maxPinsPerRoom)
+	}
+}
@@ -0,0 +1,106 @@
+package room
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// A poll is started by an EventPoll message carrying a PollDTO, it is stored as a room message
+// whose ID is the poll ID. Votes and closes are EventPollVote and EventPollClose messages, each
+// accepted one broadcasts the current votes in an EventPollResult message.
+
+type PollID = MessageID
+
+const (
+	maxPollOptions        = 10
+	maxPollQuestionLength = 300
+	maxPollOptionLength   = 100
+)
+
+type PollDTO struct {
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+	// AllowChange lets the voters move their vote to another option until the poll is closed
+	AllowChange bool `json:"allow_change"`
+}
+
+func (dto *PollDTO) isValid() bool {
+	if dto.Question == "" || len(dto.Question) > maxPollQuestionLength {
+		return false
+	}
+	if len(dto.Options) < 2 || len(dto.Options) > maxPollOptions {
+		return false
+	}
+	for _, option := range dto.Options {
+		if option == "" || len(option) > maxPollOptionLength {
+			return false
+		}
+	}
+	return true
+}
+
+type Poll struct {
+	ID          PollID   `json:"poll_id"`
+	RoomID      RoomID   `json:"-"`
+	Creator     string   `json:"creator"`
+	Question    string   `json:"question"`
+	Options     []string `json:"options"`
+	AllowChange bool     `json:"allow_change"`
+	Closed      bool     `json:"closed"`
+	// Votes counts the votes of each option
+	Votes []int64 `json:"votes"`
+	// CreatedAt is the time of the poll message
+	CreatedAt int64 `json:"-"`
+}
+
+func (poll *Poll) FromDTO(dto PollDTO) {
+	poll.Question = dto.Question
+	poll.Options = dto.Options
+	poll.AllowChange = dto.AllowChange
+	poll.Votes = make([]int64, len(dto.Options))
+}
+
+// countVotes sets the votes of each option from the option chosen by each voter.
+func (poll *Poll) countVotes(voters map[string]int) {
+	poll.Votes = make([]int64, len(poll.Options))
+	for _, choice := range voters {
+		if choice >= 0 && choice < len(poll.Votes) {
+			poll.Votes[choice]++
+		}
+	}
+}
+
+// Encode is the payload of the EventPoll and EventPollResult messages.
+func (poll *Poll) Encode() string {
+	result, _ := json.Marshal(poll)
+	return string(result)
+}
+
+// PollVote is the payload of the EventPollVote messages, Option is the index of the chosen option.
+type PollVote struct {
+	PollID PollID `json:"poll_id"`
+	Option int    `json:"option"`
+}
+
+// PollClose is the payload of the EventPollClose messages, only the poll creator may send it.
+type PollClose struct {
+	PollID PollID `json:"poll_id"`
+}
+
+// pollCommand starts a poll from "/poll question | option | option", the poll message is the reply.
+type pollCommand struct {
+	service *RoomServiceImpl
+}
+
+func (command *pollCommand) HandleCommand(ctx context.Context, cmd Command) (CommandReply, error) {
+	parts := strings.Split(cmd.Text, "|")
+	dto := PollDTO{Question: strings.TrimSpace(parts[0])}
+	for _, option := range parts[1:] {
+		dto.Options = append(dto.Options, strings.TrimSpace(option))
+	}
+	if !dto.isValid() {
+		return CommandReply{Text: "usage: /poll question | option | option"}, nil
+	}
+	return CommandReply{}, command.service.StartPoll(ctx, cmd.RoomID, cmd.UserName, dto, "")
+}
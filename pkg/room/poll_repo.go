@@ -0,0 +1,207 @@
+package room
+
+import (
+	"context"
+
+	"github.com/gocql/gocql"
+)
+
+type PollRepo interface {
+	CreatePoll(ctx context.Context, poll Poll) error
+	// GetPoll returns the poll without its votes, nil when the room has no such poll
+	GetPoll(ctx context.Context, roomID RoomID, pollID PollID) (*Poll, error)
+	// CountVotes returns the votes of each option of the poll from its tally, which is updated
+	// whenever a vote is recorded or moved
+	CountVotes(ctx context.Context, poll Poll) ([]int64, error)
+	// ListPolls returns the polls of the room without their votes
+	ListPolls(ctx context.Context, roomID RoomID) ([]Poll, error)
+	// ListVotes returns the option chosen by each voter of the poll
+	ListVotes(ctx context.Context, pollID PollID) (map[string]int, error)
+	// CastVote records the vote of userName, a voter of another option moves their vote when the
+	// poll allows changes. It reports whether the votes changed.
+	CastVote(ctx context.Context, poll Poll, userName string, option int) (bool, error)
+	// ClosePoll reports false when the poll was already closed
+	ClosePoll(ctx context.Context, roomID RoomID, pollID PollID) (bool, error)
+	// UpsertPoll writes the poll with the votes of voters, it is used by the archive import. Votes
+	// already recorded are kept.
+	UpsertPoll(ctx context.Context, poll Poll, voters map[string]int) error
+	DeleteRoomPolls(ctx context.Context, roomID RoomID) error
+}
+
+// PollRepoImpl counts the votes of the open polls in the poll_tallies counters, incremented once
+// the lightweight transaction recording a vote applied. A counter update that failed is not
+// retried, so the live tally may be off by a vote; the votes are recounted from poll_votes when the
+// poll is closed and the final votes are stored in the poll.
+type PollRepoImpl struct {
+	cassandraSession *gocql.Session
+}
+
+func NewPollRepo(cassandraSession *gocql.Session) *PollRepoImpl {
+	return &PollRepoImpl{cassandraSession}
+}
+
+func (repo *PollRepoImpl) CreatePoll(ctx context.Context, poll Poll) error {
+	query := "insert into polls (room_id, id, creator, question, options, allow_change, closed, created_at) values (?, ?, ?, ?, ?, ?, ?, ?)"
+	return repo.cassandraSession.Query(query, poll.RoomID, poll.ID, poll.Creator, poll.Question, poll.Options, poll.AllowChange, poll.Closed, poll.CreatedAt).WithContext(ctx).Exec()
+}
+
+func (repo *PollRepoImpl) GetPoll(ctx context.Context, roomID RoomID, pollID PollID) (*Poll, error) {
+	poll := Poll{RoomID: roomID, ID: pollID}
+	query := "select creator, question, options, allow_change, closed, created_at from polls where room_id = ? and id = ?"
+	err := repo.cassandraSession.Query(query, roomID, pollID).WithContext(ctx).Idempotent(true).
+		Scan(&poll.Creator, &poll.Question, &poll.Options, &poll.AllowChange, &poll.Closed, &poll.CreatedAt)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &poll, nil
+}
+
+func (repo *PollRepoImpl) CountVotes(ctx context.Context, poll Poll) ([]int64, error) {
+	if poll.Closed {
+		var final []int64
+		err := repo.cassandraSession.Query("select votes from polls where room_id = ? and id = ?", poll.RoomID, poll.ID).WithContext(ctx).Idempotent(true).Scan(&final)
+		if err != nil && err != gocql.ErrNotFound {
+			return nil, err
+		}
+		// a poll whose recount failed when it was closed keeps its live tally
+		if len(final) == len(poll.Options) {
+			return final, nil
+		}
+	}
+	votes := make([]int64, len(poll.Options))
+	iter := repo.cassandraSession.Query("select choice, votes from poll_tallies where poll_id = ?", poll.ID).WithContext(ctx).Idempotent(true).Iter()
+	var (
+		choice int
+		count  int64
+	)
+	for iter.Scan(&choice, &count) {
+		if choice >= 0 && choice < len(votes) {
+			votes[choice] = count
+		}
+	}
+	return votes, iter.Close()
+}
+
+func (repo *PollRepoImpl) ListPolls(ctx context.Context, roomID RoomID) ([]Poll, error) {
+	iter := repo.cassandraSession.Query("select id, creator, question, options, allow_change, closed, created_at from polls where room_id = ?", roomID).
+		WithContext(ctx).Idempotent(true).Iter()
+	var polls []Poll
+	poll := Poll{RoomID: roomID}
+	for iter.Scan(&poll.ID, &poll.Creator, &poll.Question, &poll.Options, &poll.AllowChange, &poll.Closed, &poll.CreatedAt) {
+		polls = append(polls, poll)
+		poll = Poll{RoomID: roomID}
+	}
+	return polls, iter.Close()
+}
+
+func (repo *PollRepoImpl) ListVotes(ctx context.Context, pollID PollID) (map[string]int, error) {
+	iter := repo.cassandraSession.Query("select username, choice from poll_votes where poll_id = ?", pollID).WithContext(ctx).Idempotent(true).Iter()
+	voters := map[string]int{}
+	var (
+		userName string
+		choice   int
+	)
+	for iter.Scan(&userName, &choice) {
+		voters[userName] = choice
+	}
+	return voters, iter.Close()
+}
+
+func (repo *PollRepoImpl) CastVote(ctx context.Context, poll Poll, userName string, option int) (bool, error) {
+	// the lightweight transactions make a user vote once even when their sessions vote concurrently
+	previous := map[string]interface{}{}
+	applied, err := repo.cassandraSession.Query("insert into poll_votes (poll_id, username, choice) values (?, ?, ?) if not exists", poll.ID, userName, option).
+		WithContext(ctx).MapScanCAS(previous)
+	if err != nil {
+		return false, err
+	}
+	if applied {
+		return true, repo.cassandraSession.Query("update poll_tallies set votes = votes + 1 where poll_id = ? and choice = ?", poll.ID, option).WithContext(ctx).Exec()
+	}
+	previousOption, _ := previous["choice"].(int)
+	if !poll.AllowChange || previousOption == option {
+		return false, nil
+	}
+	moved, err := repo.cassandraSession.Query("update poll_votes set choice = ? where poll_id = ? and username = ? if choice = ?", option, poll.ID, userName, previousOption).
+		WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil || !moved {
+		return false, err
+	}
+	batch := repo.cassandraSession.NewBatch(gocql.CounterBatch).WithContext(ctx)
+	batch.Query("update poll_tallies set votes = votes - 1 where poll_id = ? and choice = ?", poll.ID, previousOption)
+	batch.Query("update poll_tallies set votes = votes + 1 where poll_id = ? and choice = ?", poll.ID, option)
+	return true, repo.cassandraSession.ExecuteBatch(batch)
+}
+
+func (repo *PollRepoImpl) ClosePoll(ctx context.Context, roomID RoomID, pollID PollID) (bool, error) {
+	closed, err := repo.cassandraSession.Query("update polls set closed = true where room_id = ? and id = ? if closed = false", roomID, pollID).
+		WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil || !closed {
+		return false, err
+	}
+	poll, err := repo.GetPoll(ctx, roomID, pollID)
+	if err != nil || poll == nil {
+		return true, err
+	}
+	return true, repo.saveFinalVotes(ctx, *poll)
+}
+
+// saveFinalVotes recounts the votes of the closed poll from poll_votes and stores them in the poll.
+func (repo *PollRepoImpl) saveFinalVotes(ctx context.Context, poll Poll) error {
+	voters, err := repo.ListVotes(ctx, poll.ID)
+	if err != nil {
+		return err
+	}
+	poll.countVotes(voters)
+	return repo.cassandraSession.Query("update polls set votes = ? where room_id = ? and id = ?", poll.Votes, poll.RoomID, poll.ID).WithContext(ctx).Idempotent(true).Exec()
+}
+
+func (repo *PollRepoImpl) UpsertPoll(ctx context.Context, poll Poll, voters map[string]int) error {
+	if err := repo.CreatePoll(ctx, poll); err != nil {
+		return err
+	}
+	// only the inserted votes are counted, so importing the poll again does not count them twice
+	for userName, choice := range voters {
+		applied, err := repo.cassandraSession.Query("insert into poll_votes (poll_id, username, choice) values (?, ?, ?) if not exists", poll.ID, userName, choice).
+			WithContext(ctx).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		if !applied {
+			continue
+		}
+		if err := repo.cassandraSession.Query("update poll_tallies set votes = votes + 1 where poll_id = ? and choice = ?", poll.ID, choice).WithContext(ctx).Exec(); err != nil {
+			return err
+		}
+	}
+	if poll.Closed {
+		return repo.saveFinalVotes(ctx, poll)
+	}
+	return nil
+}
+
+func (repo *PollRepoImpl) DeleteRoomPolls(ctx context.Context, roomID RoomID) error {
+	iter := repo.cassandraSession.Query("select id from polls where room_id = ?", roomID).WithContext(ctx).Idempotent(true).Iter()
+	var (
+		pollID  PollID
+		pollIDs []PollID
+	)
+	for iter.Scan(&pollID) {
+		pollIDs = append(pollIDs, pollID)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	for _, pollID := range pollIDs {
+		if err := repo.cassandraSession.Query("delete from poll_votes where poll_id = ?", pollID).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+			return err
+		}
+		if err := repo.cassandraSession.Query("delete from poll_tallies where poll_id = ?", pollID).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+			return err
+		}
+	}
+	return repo.cassandraSession.Query("delete from polls where room_id = ?", roomID).WithContext(ctx).Idempotent(true).Exec()
+}
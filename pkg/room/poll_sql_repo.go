@@ -0,0 +1,224 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+type SQLPollRepoImpl struct {
+	db *sql.DB
+}
+
+func NewSQLPollRepo(db *sql.DB) *SQLPollRepoImpl {
+	return &SQLPollRepoImpl{db}
+}
+
+func (repo *SQLPollRepoImpl) CreatePoll(ctx context.Context, poll Poll) error {
+	options, err := json.Marshal(poll.Options)
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO polls (room_id, id, creator, question, options, allow_change, closed, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+	_, err = repo.db.ExecContext(ctx, query, poll.RoomID, poll.ID, poll.Creator, poll.Question, string(options), poll.AllowChange, poll.Closed, poll.CreatedAt)
+	return err
+}
+
+func (repo *SQLPollRepoImpl) GetPoll(ctx context.Context, roomID RoomID, pollID PollID) (*Poll, error) {
+	poll := Poll{RoomID: roomID, ID: pollID}
+	var options string
+	query := "SELECT creator, question, options, allow_change, closed, created_at FROM polls WHERE room_id = $1 AND id = $2"
+	err := repo.db.QueryRowContext(ctx, query, roomID, pollID).Scan(&poll.Creator, &poll.Question, &options, &poll.AllowChange, &poll.Closed, &poll.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(options), &poll.Options); err != nil {
+		return nil, err
+	}
+	return &poll, nil
+}
+
+func (repo *SQLPollRepoImpl) CountVotes(ctx context.Context, poll Poll) ([]int64, error) {
+	votes := make([]int64, len(poll.Options))
+	rows, err := repo.db.QueryContext(ctx, "SELECT choice, votes FROM poll_tallies WHERE poll_id = $1", poll.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			choice int
+			count  int64
+		)
+		if err := rows.Scan(&choice, &count); err != nil {
+			return nil, err
+		}
+		if choice >= 0 && choice < len(votes) {
+			votes[choice] = count
+		}
+	}
+	return votes, rows.Err()
+}
+
+func (repo *SQLPollRepoImpl) ListPolls(ctx context.Context, roomID RoomID) ([]Poll, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT id, creator, question, options, allow_change, closed, created_at FROM polls WHERE room_id = $1 ORDER BY id", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var polls []Poll
+	for rows.Next() {
+		poll := Poll{RoomID: roomID}
+		var options string
+		if err := rows.Scan(&poll.ID, &poll.Creator, &poll.Question, &options, &poll.AllowChange, &poll.Closed, &poll.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(options), &poll.Options); err != nil {
+			return nil, err
+		}
+		polls = append(polls, poll)
+	}
+	return polls, rows.Err()
+}
+
+func (repo *SQLPollRepoImpl) ListVotes(ctx context.Context, pollID PollID) (map[string]int, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT username, choice FROM poll_votes WHERE poll_id = $1", pollID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	voters := map[string]int{}
+	for rows.Next() {
+		var (
+			userName string
+			choice   int
+		)
+		if err := rows.Scan(&userName, &choice); err != nil {
+			return nil, err
+		}
+		voters[userName] = choice
+	}
+	return voters, rows.Err()
+}
+
+// CastVote updates the tally in the transaction recording the vote, so it always matches the votes.
+func (repo *SQLPollRepoImpl) CastVote(ctx context.Context, poll Poll, userName string, option int) (bool, error) {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO poll_votes (poll_id, username, choice) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", poll.ID, userName, option)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if inserted > 0 {
+		if err := addPollVotes(ctx, tx, poll.ID, option, 1); err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+	if !poll.AllowChange {
+		return false, nil
+	}
+	var previous int
+	if err := tx.QueryRowContext(ctx, "SELECT choice FROM poll_votes WHERE poll_id = $1 AND username = $2", poll.ID, userName).Scan(&previous); err != nil {
+		return false, err
+	}
+	if previous == option {
+		return false, nil
+	}
+	// the vote only moves from the option read, a concurrent move of the voter changes nothing
+	result, err = tx.ExecContext(ctx, "UPDATE poll_votes SET choice = $1 WHERE poll_id = $2 AND username = $3 AND choice = $4", option, poll.ID, userName, previous)
+	if err != nil {
+		return false, err
+	}
+	if moved, err := result.RowsAffected(); err != nil || moved == 0 {
+		return false, err
+	}
+	if err := addPollVotes(ctx, tx, poll.ID, previous, -1); err != nil {
+		return false, err
+	}
+	if err := addPollVotes(ctx, tx, poll.ID, option, 1); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func addPollVotes(ctx context.Context, tx *sql.Tx, pollID PollID, choice int, votes int64) error {
+	query := `INSERT INTO poll_tallies (poll_id, choice, votes) VALUES ($1, $2, $3)
+	ON CONFLICT (poll_id, choice) DO UPDATE SET votes = poll_tallies.votes + excluded.votes`
+	_, err := tx.ExecContext(ctx, query, pollID, choice, votes)
+	return err
+}
+
+func (repo *SQLPollRepoImpl) ClosePoll(ctx context.Context, roomID RoomID, pollID PollID) (bool, error) {
+	result, err := repo.db.ExecContext(ctx, "UPDATE polls SET closed = $1 WHERE room_id = $2 AND id = $3 AND closed = $4", true, roomID, pollID, false)
+	if err != nil {
+		return false, err
+	}
+	closed, err := result.RowsAffected()
+	return closed > 0, err
+}
+
+func (repo *SQLPollRepoImpl) UpsertPoll(ctx context.Context, poll Poll, voters map[string]int) error {
+	options, err := json.Marshal(poll.Options)
+	if err != nil {
+		return err
+	}
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO polls (room_id, id, creator, question, options, allow_change, closed, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (room_id, id) DO UPDATE SET creator = excluded.creator, question = excluded.question, options = excluded.options,
+	allow_change = excluded.allow_change, closed = excluded.closed, created_at = excluded.created_at`
+	if _, err := tx.ExecContext(ctx, query, poll.RoomID, poll.ID, poll.Creator, poll.Question, string(options), poll.AllowChange, poll.Closed, poll.CreatedAt); err != nil {
+		return err
+	}
+	for userName, choice := range voters {
+		query := "INSERT INTO poll_votes (poll_id, username, choice) VALUES ($1, $2, $3) ON CONFLICT (poll_id, username) DO UPDATE SET choice = excluded.choice"
+		if _, err := tx.ExecContext(ctx, query, poll.ID, userName, choice); err != nil {
+			return err
+		}
+	}
+	// the tally is recounted from the votes, which may have been imported before
+	if _, err := tx.ExecContext(ctx, "DELETE FROM poll_tallies WHERE poll_id = $1", poll.ID); err != nil {
+		return err
+	}
+	recount := "INSERT INTO poll_tallies (poll_id, choice, votes) SELECT poll_id, choice, COUNT(*) FROM poll_votes WHERE poll_id = $1 GROUP BY poll_id, choice"
+	if _, err := tx.ExecContext(ctx, recount, poll.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *SQLPollRepoImpl) DeleteRoomPolls(ctx context.Context, roomID RoomID) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	pollIDs := "SELECT id FROM polls WHERE room_id = $1"
+	if _, err := tx.ExecContext(ctx, "DELETE FROM poll_votes WHERE poll_id IN ("+pollIDs+")", roomID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM poll_tallies WHERE poll_id IN ("+pollIDs+")", roomID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM polls WHERE room_id = $1", roomID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,134 @@
+package room
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestPollVotesAndClose(t *testing.T) {
+	server := newTestRoomServer(t)
+	service, ctx := server.service, context.Background()
+	room, err := service.CreateRoom(ctx, CreateRoomDTO{Name: "general"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dto := PollDTO{Question: "lunch?", Options: []string{"pizza", "sushi"}, AllowChange: true}
+	if err := service.StartPoll(ctx, room.ID, "alice", dto, "client-1"); err != nil {
+		t.Fatal(err)
+	}
+	polls, err := server.storage.PollRepo.ListPolls(ctx, room.ID)
+	if err != nil || len(polls) != 1 {
+		t.Fatalf("polls %v: %v", polls, err)
+	}
+	pollID := polls[0].ID
+	if err := service.MarkSeen(ctx, room.ID, "bob", pollID); err != nil {
+		t.Fatal(err)
+	}
+
+	votes := []struct {
+		userName string
+		option   int
+	}{{"bob", 0}, {"carol", 0}, {"bob", 0}, {"bob", 1}, {"dave", 5}}
+	for _, vote := range votes {
+		if err := service.VotePoll(ctx, room.ID, vote.userName, PollVote{PollID: pollID, Option: vote.option}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	poll, err := server.storage.PollRepo.GetPoll(ctx, room.ID, pollID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bob's moved vote leaves the first option and counts for the second
+	if counted, err := server.storage.PollRepo.CountVotes(ctx, *poll); err != nil || !slices.Equal(counted, []int64{1, 1}) {
+		t.Fatalf("votes %v, want [1 1]: %v", counted, err)
+	}
+
+	// only the creator closes the poll, votes after the close are ignored
+	if err := service.ClosePoll(ctx, room.ID, "bob", PollClose{PollID: pollID}); err != nil {
+		t.Fatal(err)
+	}
+	if poll, _ := server.storage.PollRepo.GetPoll(ctx, room.ID, pollID); poll.Closed {
+		t.Fatal("poll closed by another user")
+	}
+	if err := service.ClosePoll(ctx, room.ID, "alice", PollClose{PollID: pollID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.VotePoll(ctx, room.ID, "erin", PollVote{PollID: pollID, Option: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := service.getMessage(ctx, room.ID, pollID)
+	if err != nil || msg == nil {
+		t.Fatalf("poll message %v: %v", msg, err)
+	}
+	var stored Poll
+	if err := json.Unmarshal([]byte(msg.Payload), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Closed || !slices.Equal(stored.Votes, []int64{1, 1}) {
+		t.Fatalf("stored poll %+v, want closed with votes [1 1]", stored)
+	}
+	if !msg.Seen || msg.Event != EventPoll || msg.UserName != "alice" {
+		t.Fatalf("poll message %+v lost its fields on close", msg)
+	}
+}
+
+func TestArchiveRoundTripWithPolls(t *testing.T) {
+	server := newTestRoomServer(t)
+	service, ctx := server.service, context.Background()
+	room, err := service.CreateRoom(ctx, CreateRoomDTO{Name: "general"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.BroadcastTextMessage(ctx, room.ID, "alice", "hello", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.StartPoll(ctx, room.ID, "alice", PollDTO{Question: "lunch?", Options: []string{"pizza", "sushi"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	polls, err := server.storage.PollRepo.ListPolls(ctx, room.ID)
+	if err != nil || len(polls) != 1 {
+		t.Fatalf("polls %v: %v", polls, err)
+	}
+	for userName, option := range map[string]int{"bob": 1, "carol": 1, "dave": 0} {
+		if err := service.VotePoll(ctx, room.ID, userName, PollVote{PollID: polls[0].ID, Option: option}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	source := server.storage
+	if err := ExportArchive(ctx, source.RoomRepo, source.MessageRepo, source.PollRepo, source.MemberRepo, room.ID, &archive); err != nil {
+		t.Fatal(err)
+	}
+	target := newTestStorage(t)
+	summary, err := NewImporter(target.RoomRepo, target.MessageRepo, target.PollRepo, target.MemberRepo, ImportOptions{BatchSize: 10}).Import(ctx, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Rooms != 1 || summary.Messages != 2 || summary.Polls != 1 {
+		t.Fatalf("imported %+v", summary)
+	}
+
+	imported, err := target.PollRepo.GetPoll(ctx, room.ID, polls[0].ID)
+	if err != nil || imported == nil {
+		t.Fatalf("imported poll %v: %v", imported, err)
+	}
+	if imported.Question != "lunch?" || imported.CreatedAt != polls[0].CreatedAt {
+		t.Fatalf("imported poll %+v", imported)
+	}
+	if counted, err := target.PollRepo.CountVotes(ctx, *imported); err != nil || !slices.Equal(counted, []int64{1, 2}) {
+		t.Fatalf("imported votes %v, want [1 2]: %v", counted, err)
+	}
+	voters, err := target.PollRepo.ListVotes(ctx, polls[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"bob": 1, "carol": 1, "dave": 0}; !maps.Equal(voters, want) {
+		t.Fatalf("imported votes %v, want %v", voters, want)
+	}
+}
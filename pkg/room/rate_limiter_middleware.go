@@ -1,26 +1,53 @@
 package room
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/redis/go-redis/v9"
 )
 
-func NewRateLimiterMiddleware(createRoomsrateLimiter common.RateLimiter) *RateLimiterMiddleware {
-	return &RateLimiterMiddleware{createRoomsrateLimiter: createRoomsrateLimiter}
+func NewRateLimiterMiddleware(config *config.Config, redisClient redis.UniversalClient) (*RateLimiterMiddleware, error) {
+	createRoomPolicy := config.Room.RateLimit.CreateRoom
+	createRoomsRateLimiter, err := common.NewLimiter(redisClient, createRoomPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("error creating room rate limiter: %w", err)
+	}
+	joinRequestPolicy := config.Room.RateLimit.JoinRequest
+	joinRequestsRateLimiter, err := common.NewLimiter(redisClient, joinRequestPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("error creating join request rate limiter: %w", err)
+	}
+	return &RateLimiterMiddleware{
+		createRoomsRateLimiter:  createRoomsRateLimiter,
+		createRoomCost:          createRoomPolicy.Cost,
+		joinRequestsRateLimiter: joinRequestsRateLimiter,
+		joinRequestCost:         joinRequestPolicy.Cost,
+	}, nil
 }
 
 type RateLimiterMiddleware struct {
-	createRoomsrateLimiter common.RateLimiter
+	createRoomsRateLimiter  common.Limiter
+	createRoomCost          int
+	joinRequestsRateLimiter common.Limiter
+	joinRequestCost         int
 }
 
 func (rl *RateLimiterMiddleware) LimitCreateRooms(c *gin.Context) {
-	hostIP := c.ClientIP()
-	key := hostIP + ":create_room"
-	tokensPerRequest := 10
-	allowed, retryAfter, err := rl.createRoomsrateLimiter.Allow(c.Request.Context(), key, tokensPerRequest)
+	rl.limit(c, rl.AllowCreateRoom)
+}
+
+func (rl *RateLimiterMiddleware) LimitJoinRequests(c *gin.Context) {
+	rl.limit(c, rl.AllowJoinRequest)
+}
+
+func (rl *RateLimiterMiddleware) limit(c *gin.Context, allow func(ctx context.Context, hostIP string) (bool, int, error)) {
+	allowed, retryAfter, err := allow(c.Request.Context(), c.ClientIP())
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -32,3 +59,15 @@ func (rl *RateLimiterMiddleware) LimitCreateRooms(c *gin.Context) {
 	}
 	c.Next()
 }
+
+// AllowCreateRoom takes the tokens of a room creation from the bucket of hostIP, shared by the HTTP and gRPC APIs.
+func (rl *RateLimiterMiddleware) AllowCreateRoom(ctx context.Context, hostIP string) (bool, int, error) {
+	key := hostIP + ":create_room"
+	return rl.createRoomsRateLimiter.Allow(ctx, key, rl.createRoomCost)
+}
+
+// AllowJoinRequest takes the tokens of a join request from the bucket of hostIP.
+func (rl *RateLimiterMiddleware) AllowJoinRequest(ctx context.Context, hostIP string) (bool, int, error) {
+	key := hostIP + ":join_request"
+	return rl.joinRequestsRateLimiter.Allow(ctx, key, rl.joinRequestCost)
+}
@@ -0,0 +1,248 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+var retentionLockKey = "chat:retention:lock"
+
+var errRetentionLockLost = errors.New("retention lock lost")
+
+// roomCache keeps the room retention settings and the last recorded activity in memory,
+// so sending a message does not read the room and update its activity every time.
+type roomCache struct {
+	mu          sync.Mutex
+	expiry      time.Duration
+	entries     map[RoomID]*roomCacheEntry
+	lastEvicted time.Time
+}
+
+type roomCacheEntry struct {
+	retention  Retention
+	fetchedAt  time.Time
+	recordedAt time.Time
+}
+
+func newRoomCache(expiry time.Duration) *roomCache {
+	return &roomCache{expiry: expiry, entries: make(map[RoomID]*roomCacheEntry)}
+}
+
+func (cache *roomCache) retention(roomID RoomID, now time.Time) (Retention, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.entries[roomID]
+	if !ok || now.Sub(entry.fetchedAt) > cache.expiry {
+		return Retention{}, false
+	}
+	return entry.retention, true
+}
+
+func (cache *roomCache) setRetention(roomID RoomID, retention Retention, now time.Time) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.entries[roomID]
+	if !ok {
+		entry = &roomCacheEntry{}
+		cache.entries[roomID] = entry
+	}
+	entry.retention = retention
+	entry.fetchedAt = now
+	cache.evictExpired(now)
+}
+
+// shouldRecordActivity reports whether the room activity was not recorded within the cache expiry.
+func (cache *roomCache) shouldRecordActivity(roomID RoomID, now time.Time) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.entries[roomID]
+	if !ok {
+		entry = &roomCacheEntry{}
+		cache.entries[roomID] = entry
+	}
+	if now.Sub(entry.recordedAt) < cache.expiry {
+		return false
+	}
+	entry.recordedAt = now
+	return true
+}
+
+func (cache *roomCache) evictExpired(now time.Time) {
+	if now.Sub(cache.lastEvicted) < cache.expiry {
+		return
+	}
+	cache.lastEvicted = now
+	for roomID, entry := range cache.entries {
+		if now.Sub(entry.fetchedAt) > cache.expiry && now.Sub(entry.recordedAt) > cache.expiry {
+			delete(cache.entries, roomID)
+		}
+	}
+}
+
+// RetentionWorker periodically trims rooms to their message count limit, deletes expired messages,
+// invites, scheduled messages and join requests on stores without TTL and expires inactive rooms. A redis lock makes a single instance run each round,
+// it is renewed while the round runs and held until one interval after the round started.
+type RetentionWorker struct {
+	roomRepo        RoomRepo
+	messageRepo     MessageRepo
+	webhookRepo     WebhookRepo
+	pollRepo        PollRepo
+	pinRepo         PinRepo
+	scheduleRepo    ScheduledMessageRepo
+	inviteRepo      InviteRepo
+	memberRepo      MemberRepo
+	redisClient     redis.UniversalClient
+	logger          common.HttpLog
+	instanceID      string
+	interval        time.Duration
+	lockTTL         time.Duration
+	inactiveRoomTTL time.Duration
+	// scheduleLookback is how long after they are due scheduled messages may still be fired
+	scheduleLookback time.Duration
+	cancel           context.CancelFunc
+	done             chan struct{}
+}
+
+func NewRetentionWorker(config *config.Config, logger common.HttpLog, roomRepo RoomRepo, messageRepo MessageRepo, webhookRepo WebhookRepo, pollRepo PollRepo, pinRepo PinRepo, scheduleRepo ScheduledMessageRepo, inviteRepo InviteRepo, memberRepo MemberRepo, redisClient redis.UniversalClient) (*RetentionWorker, error) {
+	if config.Room.Retention.IntervalMinute <= 0 {
+		return nil, fmt.Errorf("invalid room.retention.intervalMinute: %d", config.Room.Retention.IntervalMinute)
+	}
+	if config.Room.Retention.LockSecond <= 0 {
+		return nil, fmt.Errorf("invalid room.retention.lockSecond: %d", config.Room.Retention.LockSecond)
+	}
+	hostname, _ := os.Hostname()
+	return &RetentionWorker{
+		roomRepo:         roomRepo,
+		messageRepo:      messageRepo,
+		webhookRepo:      webhookRepo,
+		pollRepo:         pollRepo,
+		pinRepo:          pinRepo,
+		scheduleRepo:     scheduleRepo,
+		inviteRepo:       inviteRepo,
+		memberRepo:       memberRepo,
+		redisClient:      redisClient,
+		logger:           logger,
+		instanceID:       fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		interval:         time.Duration(config.Room.Retention.IntervalMinute) * time.Minute,
+		lockTTL:          time.Duration(config.Room.Retention.LockSecond) * time.Second,
+		inactiveRoomTTL:  time.Duration(config.Room.Retention.InactiveRoomExpirationHour) * time.Hour,
+		scheduleLookback: time.Duration(config.Room.Scheduler.LookbackHour) * time.Hour,
+		done:             make(chan struct{}),
+	}, nil
+}
+
+func (worker *RetentionWorker) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	worker.cancel = cancel
+	go func() {
+		defer close(worker.done)
+		ticker := time.NewTicker(worker.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := worker.runOnce(ctx); err != nil && !errors.Is(err, context.Canceled) {
+					worker.logger.Error("retention worker: " + err.Error())
+				}
+			}
+		}
+	}()
+}
+
+func (worker *RetentionWorker) GracefulStop() {
+	if worker.cancel == nil {
+		return
+	}
+	worker.cancel()
+	<-worker.done
+}
+
+func (worker *RetentionWorker) runOnce(ctx context.Context) error {
+	start := time.Now()
+	acquired, err := worker.redisClient.SetNX(ctx, retentionLockKey, worker.instanceID, worker.lockTTL).Result()
+	if err != nil || !acquired {
+		return err
+	}
+	defer func() {
+		// the lock is kept until one interval after the round started, so the next round can run on any instance
+		if err := releaseLeaseAfter(context.WithoutCancel(ctx), worker.redisClient, retentionLockKey, worker.instanceID, worker.interval-time.Since(start)); err != nil {
+			worker.logger.Error("retention worker: error releasing lock: " + err.Error())
+		}
+	}()
+
+	roundCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		renewLease(roundCtx, worker.redisClient, retentionLockKey, worker.instanceID, worker.lockTTL, func() { cancel(errRetentionLockLost) })
+	}()
+	defer func() {
+		cancel(nil)
+		<-renewed
+	}()
+
+	err = worker.runRound(roundCtx, start)
+	if err != nil && errors.Is(context.Cause(roundCtx), errRetentionLockLost) {
+		return errRetentionLockLost
+	}
+	return err
+}
+
+func (worker *RetentionWorker) runRound(ctx context.Context, now time.Time) error {
+	if err := worker.messageRepo.DeleteExpiredMessages(ctx, now); err != nil {
+		return err
+	}
+	if err := worker.inviteRepo.DeleteExpiredInvites(ctx, now); err != nil {
+		return err
+	}
+	if err := worker.scheduleRepo.DeleteExpiredScheduledMessages(ctx, now.Add(-worker.scheduleLookback)); err != nil {
+		return err
+	}
+	if err := worker.memberRepo.DeleteExpiredJoinRequests(ctx, now); err != nil {
+		return err
+	}
+	return worker.roomRepo.ScanRooms(ctx, func(room Room) error {
+		// rooms created before activity tracking have no last activity and are never expired
+		if worker.inactiveRoomTTL > 0 && room.LastActivityAt > 0 && now.Sub(time.UnixMilli(room.LastActivityAt)) > worker.inactiveRoomTTL {
+			worker.logger.Info("expiring inactive room", slog.Uint64("room_id", room.ID))
+			if err := worker.messageRepo.DeleteRoomMessages(ctx, room.ID); err != nil {
+				return err
+			}
+			if err := worker.webhookRepo.DeleteRoomWebhooks(ctx, room.ID); err != nil {
+				return err
+			}
+			if err := worker.pollRepo.DeleteRoomPolls(ctx, room.ID); err != nil {
+				return err
+			}
+			if err := worker.pinRepo.DeleteRoomPins(ctx, room.ID); err != nil {
+				return err
+			}
+			if err := worker.scheduleRepo.DeleteRoomScheduledMessages(ctx, room.ID); err != nil {
+				return err
+			}
+			if err := worker.inviteRepo.DeleteRoomInvites(ctx, room.ID); err != nil {
+				return err
+			}
+			if err := worker.memberRepo.DeleteRoomMembers(ctx, room.ID); err != nil {
+				return err
+			}
+			return worker.roomRepo.DeleteRoom(ctx, room.ID)
+		}
+		if room.RetentionMessages > 0 {
+			return worker.messageRepo.TrimMessages(ctx, room.ID, room.RetentionMessages)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,150 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRetentionWorker(t *testing.T, storage *Storage) (*RetentionWorker, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+	cfg := newTestConfig(t)
+	cfg.Room.Retention.IntervalMinute = 10
+	cfg.Room.Retention.LockSecond = 60
+	cfg.Room.Retention.InactiveRoomExpirationHour = 24
+	worker, err := NewRetentionWorker(cfg, testLogger, storage.RoomRepo, storage.MessageRepo, storage.WebhookRepo, storage.PollRepo,
+		storage.PinRepo, storage.ScheduledMessageRepo, storage.InviteRepo, storage.MemberRepo, redisClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return worker, server
+}
+
+func TestRetentionDaysLimit(t *testing.T) {
+	for days, valid := range map[int]bool{-1: false, 0: true, maxRetentionDays: true, maxRetentionDays + 1: false} {
+		dto := CreateRoomDTO{Name: "room", Retention: Retention{RetentionDays: days}}
+		if dto.isValid() != valid {
+			t.Errorf("retention of %d days valid: %v, want %v", days, !valid, valid)
+		}
+	}
+}
+
+func TestRetentionWorker(t *testing.T) {
+	storage := newTestStorage(t)
+	worker, server := newTestRetentionWorker(t, storage)
+	ctx := context.Background()
+	now := time.Now()
+	trimmed := Room{ID: 1, Name: "trimmed", Visibility: VisibilityUnlisted, Retention: Retention{RetentionMessages: 2}, LastActivityAt: now.UnixMilli()}
+	inactive := Room{ID: 2, Name: "inactive", Visibility: VisibilityPrivate, LastActivityAt: now.Add(-48 * time.Hour).UnixMilli()}
+	untracked := Room{ID: 3, Name: "untracked", Visibility: VisibilityUnlisted}
+	for _, room := range []Room{trimmed, inactive, untracked} {
+		if err := storage.RoomRepo.CreateRoom(ctx, room); err != nil {
+			t.Fatal(err)
+		}
+		for id := MessageID(1); id <= 4; id++ {
+			msg := Message{ID: room.ID*100 + id, RoomID: room.ID, Payload: "message", Time: now.UnixMilli()}
+			if err := storage.MessageRepo.InesrtMessage(ctx, msg, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	inactiveID := inactive.ID
+	if err := storage.WebhookRepo.CreateWebhook(ctx, Webhook{ID: 1, RoomID: inactiveID, Kind: "incoming", Name: "hook", CreatedAt: now.UnixMilli()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PollRepo.CreatePoll(ctx, Poll{ID: 1, RoomID: inactiveID, Creator: "alice", Question: "?", Options: []string{"yes", "no"}, Votes: []int64{0, 0}, CreatedAt: now.UnixMilli()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PinRepo.PinMessage(ctx, Pin{RoomID: inactiveID, MessageID: 201, PinnedAt: now.UnixMilli()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.InviteRepo.CreateInvite(ctx, Invite{ID: 1, RoomID: inactiveID, ExpiresAt: now.Add(time.Hour).UnixMilli(), CreatedAt: now.UnixMilli()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.MemberRepo.AddMember(ctx, Member{RoomID: inactiveID, UserName: "bob", Status: MemberActive, TokenHash: hashToken("bob"), CreatedAt: now.UnixMilli()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := worker.runOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs, err := storage.MessageRepo.LatestMessages(ctx, trimmed.ID, 10); err != nil || len(msgs) != 2 || msgs[0].ID != 103 || msgs[1].ID != 104 {
+		t.Fatalf("trimmed room keeps %v, want the last 2 messages: %v", msgs, err)
+	}
+	if exist, err := storage.RoomRepo.RoomExist(ctx, inactiveID); err != nil || exist {
+		t.Fatalf("inactive room exists: %v %v", exist, err)
+	}
+	if msgs, err := storage.MessageRepo.LatestMessages(ctx, inactiveID, 10); err != nil || len(msgs) != 0 {
+		t.Fatalf("inactive room keeps messages %v: %v", msgs, err)
+	}
+	if webhooks, err := storage.WebhookRepo.ListWebhooks(ctx, inactiveID); err != nil || len(webhooks) != 0 {
+		t.Fatalf("inactive room keeps webhooks %v: %v", webhooks, err)
+	}
+	if polls, err := storage.PollRepo.ListPolls(ctx, inactiveID); err != nil || len(polls) != 0 {
+		t.Fatalf("inactive room keeps polls %v: %v", polls, err)
+	}
+	if pins, err := storage.PinRepo.ListPins(ctx, inactiveID); err != nil || len(pins) != 0 {
+		t.Fatalf("inactive room keeps pins %v: %v", pins, err)
+	}
+	if invites, err := storage.InviteRepo.ListInvites(ctx, inactiveID); err != nil || len(invites) != 0 {
+		t.Fatalf("inactive room keeps invites %v: %v", invites, err)
+	}
+	if members, err := storage.MemberRepo.ListMembers(ctx, inactiveID); err != nil || len(members) != 0 {
+		t.Fatalf("inactive room keeps members %v: %v", members, err)
+	}
+	// rooms without a recorded activity are never expired
+	if exist, err := storage.RoomRepo.RoomExist(ctx, untracked.ID); err != nil || !exist {
+		t.Fatalf("room without activity deleted: %v", err)
+	}
+	if msgs, err := storage.MessageRepo.LatestMessages(ctx, untracked.ID, 10); err != nil || len(msgs) != 4 {
+		t.Fatalf("room without retention keeps %v: %v", msgs, err)
+	}
+
+	// the lock is held until one interval after the round started
+	if ttl := server.TTL(retentionLockKey); ttl <= worker.lockTTL || ttl > worker.interval {
+		t.Fatalf("lock ttl %s after the round, want the rest of the %s interval", ttl, worker.interval)
+	}
+}
+
+func TestRetentionWorkerStopsWhenTheLockIsLost(t *testing.T) {
+	storage := newTestStorage(t)
+	worker, server := newTestRetentionWorker(t, storage)
+	worker.lockTTL = 30 * time.Millisecond
+	blocked := &blockingRoomRepo{RoomRepo: storage.RoomRepo, started: make(chan struct{})}
+	worker.roomRepo = blocked
+	result := make(chan error)
+	go func() { result <- worker.runOnce(context.Background()) }()
+	<-blocked.started
+	server.Set(retentionLockKey, "other instance")
+	select {
+	case err := <-result:
+		if !errors.Is(err, errRetentionLockLost) {
+			t.Fatalf("got %v, want %v", err, errRetentionLockLost)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("round kept running without the lock")
+	}
+	if value, _ := server.Get(retentionLockKey); value != "other instance" {
+		t.Fatalf("the lock of the other instance was changed to %q", value)
+	}
+}
+
+// blockingRoomRepo blocks the room scan until the round is stopped.
+type blockingRoomRepo struct {
+	RoomRepo
+	started chan struct{}
+}
+
+func (repo *blockingRoomRepo) ScanRooms(ctx context.Context, fn func(room Room) error) error {
+	close(repo.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
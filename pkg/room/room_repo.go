@@ -2,9 +2,10 @@ package room
 
 import (
 	"context"
-	"database/sql"
+	"time"
 
 	"github.com/gocql/gocql"
+	"github.com/omran95/chatroom/pkg/common"
 )
 
 type RoomRepo interface {
@@ -12,6 +13,20 @@ type RoomRepo interface {
 	RoomExist(ctx context.Context, roomID RoomID) (bool, error)
 	IsProtected(ctx context.Context, roomID RoomID) (bool, error)
 	GetRoomPassword(ctx context.Context, roomID RoomID) (string, error)
+	GetRetention(ctx context.Context, roomID RoomID) (Retention, error)
+	// TouchRoom updates the last activity of an existing room, a deleted room is not recreated
+	TouchRoom(ctx context.Context, roomID RoomID, activityAt int64) error
+	// ScanRooms calls fn for every room with its ID, retention and last activity
+	ScanRooms(ctx context.Context, fn func(room Room) error) error
+	DeleteRoom(ctx context.Context, roomID RoomID) error
+	GetOwnerTokenHash(ctx context.Context, roomID RoomID) (string, error)
+	GetRoom(ctx context.Context, roomID RoomID) (Room, error)
+	// UpsertRoom creates or overwrites the room with its original ID
+	UpsertRoom(ctx context.Context, room Room) error
+	GetVisibility(ctx context.Context, roomID RoomID) (string, error)
+	// ListPublicRooms returns up to limit public rooms with an ID below beforeID, newest first,
+	// from the newest one when beforeID is 0
+	ListPublicRooms(ctx context.Context, beforeID RoomID, limit int) ([]Room, error)
 }
 
 type RoomRepoImpl struct {
@@ -22,13 +37,29 @@ func NewRoomRepo(cassandraSession *gocql.Session) *RoomRepoImpl {
 	return &RoomRepoImpl{cassandraSession}
 }
 
+// publicRoomsDirectory is the single partition of the public room months table.
+const publicRoomsDirectory = "public"
+
+// publicRoomsMonth is the partition of the public rooms table of the room, the year and month the
+// room ID was generated in as YYYYMM.
+func publicRoomsMonth(roomID RoomID) int {
+	created := common.IDTime(roomID).UTC()
+	return created.Year()*100 + int(created.Month())
+}
+
 func (repo *RoomRepoImpl) CreateRoom(ctx context.Context, room Room) error {
-	query := "insert into rooms (id, name, protected, password) values (?, ?, ?, ?)"
-	stmt := repo.cassandraSession.Query(query, room.ID, room.Name, room.Protected, room.Password).WithContext(ctx)
-	if err := stmt.Exec(); err != nil {
-		return err
+	batch := repo.cassandraSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("insert into rooms (id, name, protected, password, retention_days, retention_messages, last_activity_at, owner_token_hash, visibility) values (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		room.ID, room.Name, room.Protected, room.Password, room.RetentionDays, room.RetentionMessages, room.LastActivityAt, room.OwnerTokenHash, room.Visibility)
+	// an upserted room may no longer be public
+	month := publicRoomsMonth(room.ID)
+	if room.Visibility == VisibilityPublic {
+		batch.Query("insert into public_rooms_by_month (month, id, name, protected) values (?, ?, ?, ?)", month, room.ID, room.Name, room.Protected)
+		batch.Query("insert into public_room_months (directory, month) values (?, ?)", publicRoomsDirectory, month)
+	} else {
+		batch.Query("delete from public_rooms_by_month where month = ? and id = ?", month, room.ID)
 	}
-	return nil
+	return repo.cassandraSession.ExecuteBatch(batch)
 }
 
 func (repo *RoomRepoImpl) RoomExist(ctx context.Context, roomID RoomID) (bool, error) {
@@ -36,7 +67,7 @@ func (repo *RoomRepoImpl) RoomExist(ctx context.Context, roomID RoomID) (bool, e
 	err := repo.cassandraSession.Query("select id from rooms where id = ?", roomID).WithContext(ctx).Idempotent(true).Scan(&id)
 
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == gocql.ErrNotFound {
 			// Room does not exist
 			return false, nil
 		}
@@ -64,3 +95,113 @@ func (repo *RoomRepoImpl) GetRoomPassword(ctx context.Context, roomID RoomID) (s
 	}
 	return roomPassword, nil
 }
+
+func (repo *RoomRepoImpl) GetRetention(ctx context.Context, roomID RoomID) (Retention, error) {
+	var retention Retention
+	err := repo.cassandraSession.Query("select retention_days, retention_messages from rooms where id = ?", roomID).WithContext(ctx).Idempotent(true).Scan(&retention.RetentionDays, &retention.RetentionMessages)
+	if err != nil {
+		return Retention{}, err
+	}
+	return retention, nil
+}
+
+func (repo *RoomRepoImpl) TouchRoom(ctx context.Context, roomID RoomID, activityAt int64) error {
+	// a plain update is an upsert, it would recreate a room expired while a message was sent to it
+	_, err := repo.cassandraSession.Query("update rooms set last_activity_at = ? where id = ? if exists", activityAt, roomID).
+		WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	return err
+}
+
+func (repo *RoomRepoImpl) ScanRooms(ctx context.Context, fn func(room Room) error) error {
+	var room Room
+	iter := repo.cassandraSession.Query("select id, retention_days, retention_messages, last_activity_at from rooms").WithContext(ctx).Idempotent(true).PageSize(500).Iter()
+	for iter.Scan(&room.ID, &room.RetentionDays, &room.RetentionMessages, &room.LastActivityAt) {
+		if err := fn(room); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func (repo *RoomRepoImpl) DeleteRoom(ctx context.Context, roomID RoomID) error {
+	if err := repo.cassandraSession.Query("delete from public_rooms_by_month where month = ? and id = ?", publicRoomsMonth(roomID), roomID).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return repo.cassandraSession.Query("delete from rooms where id = ?", roomID).WithContext(ctx).Idempotent(true).Exec()
+}
+
+func (repo *RoomRepoImpl) GetOwnerTokenHash(ctx context.Context, roomID RoomID) (string, error) {
+	var ownerTokenHash string
+	err := repo.cassandraSession.Query("select owner_token_hash from rooms where id = ?", roomID).WithContext(ctx).Idempotent(true).Scan(&ownerTokenHash)
+	if err != nil {
+		return "", err
+	}
+	return ownerTokenHash, nil
+}
+
+func (repo *RoomRepoImpl) GetRoom(ctx context.Context, roomID RoomID) (Room, error) {
+	var room Room
+	query := "select id, name, protected, password, retention_days, retention_messages, last_activity_at, owner_token_hash, visibility from rooms where id = ?"
+	err := repo.cassandraSession.Query(query, roomID).WithContext(ctx).Idempotent(true).Scan(
+		&room.ID, &room.Name, &room.Protected, &room.Password, &room.RetentionDays, &room.RetentionMessages, &room.LastActivityAt, &room.OwnerTokenHash, &room.Visibility,
+	)
+	if err != nil {
+		return Room{}, err
+	}
+	if room.Visibility == "" {
+		room.Visibility = VisibilityUnlisted
+	}
+	return room, nil
+}
+
+func (repo *RoomRepoImpl) UpsertRoom(ctx context.Context, room Room) error {
+	// cassandra inserts are upserts
+	return repo.CreateRoom(ctx, room)
+}
+
+func (repo *RoomRepoImpl) GetVisibility(ctx context.Context, roomID RoomID) (string, error) {
+	var visibility string
+	err := repo.cassandraSession.Query("select visibility from rooms where id = ?", roomID).WithContext(ctx).Idempotent(true).Scan(&visibility)
+	if err != nil {
+		return "", err
+	}
+	// rooms created before the visibility were unlisted
+	if visibility == "" {
+		return VisibilityUnlisted, nil
+	}
+	return visibility, nil
+}
+
+func (repo *RoomRepoImpl) ListPublicRooms(ctx context.Context, beforeID RoomID, limit int) ([]Room, error) {
+	fromMonth := publicRoomsMonth(common.MinIDAt(time.Now()))
+	if beforeID > 0 {
+		fromMonth = publicRoomsMonth(beforeID)
+	}
+	// the months are read one page at a time, each month is read until the page is full
+	months := repo.cassandraSession.Query("select month from public_room_months where directory = ? and month <= ?", publicRoomsDirectory, fromMonth).
+		WithContext(ctx).Idempotent(true).PageSize(12).Iter()
+	rooms := []Room{}
+	var month int
+	for len(rooms) < limit && months.Scan(&month) {
+		query := "select id, name, protected from public_rooms_by_month where month = ? limit ?"
+		args := []interface{}{month, limit - len(rooms)}
+		if beforeID > 0 && month == fromMonth {
+			query = "select id, name, protected from public_rooms_by_month where month = ? and id < ? limit ?"
+			args = []interface{}{month, beforeID, limit - len(rooms)}
+		}
+		iter := repo.cassandraSession.Query(query, args...).WithContext(ctx).Idempotent(true).Iter()
+		room := Room{Visibility: VisibilityPublic}
+		for iter.Scan(&room.ID, &room.Name, &room.Protected) {
+			rooms = append(rooms, room)
+		}
+		if err := iter.Close(); err != nil {
+			months.Close()
+			return nil, err
+		}
+	}
+	if err := months.Close(); err != nil {
+		return nil, err
+	}
+	return rooms, nil
+}
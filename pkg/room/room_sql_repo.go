@@ -0,0 +1,161 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+)
+
+type SQLRoomRepoImpl struct {
+	db *sql.DB
+}
+
+func NewSQLRoomRepo(db *sql.DB) *SQLRoomRepoImpl {
+	return &SQLRoomRepoImpl{db}
+}
+
+func (repo *SQLRoomRepoImpl) CreateRoom(ctx context.Context, room Room) error {
+	query := "INSERT INTO rooms (id, name, protected, password, retention_days, retention_messages, last_activity_at, owner_token_hash, visibility) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	if _, err := repo.db.ExecContext(ctx, query, room.ID, room.Name, room.Protected, room.Password, room.RetentionDays, room.RetentionMessages, room.LastActivityAt, room.OwnerTokenHash, room.Visibility); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (repo *SQLRoomRepoImpl) RoomExist(ctx context.Context, roomID RoomID) (bool, error) {
+	var id RoomID
+	err := repo.db.QueryRowContext(ctx, "SELECT id FROM rooms WHERE id = $1", roomID).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (repo *SQLRoomRepoImpl) IsProtected(ctx context.Context, roomID RoomID) (bool, error) {
+	var isProtected bool
+	err := repo.db.QueryRowContext(ctx, "SELECT protected FROM rooms WHERE id = $1", roomID).Scan(&isProtected)
+	if err != nil {
+		return false, err
+	}
+	return isProtected, nil
+}
+
+func (repo *SQLRoomRepoImpl) GetRoomPassword(ctx context.Context, roomID RoomID) (string, error) {
+	var roomPassword string
+	err := repo.db.QueryRowContext(ctx, "SELECT password FROM rooms WHERE id = $1", roomID).Scan(&roomPassword)
+	if err != nil {
+		return "", err
+	}
+	return roomPassword, nil
+}
+
+func (repo *SQLRoomRepoImpl) GetRetention(ctx context.Context, roomID RoomID) (Retention, error) {
+	var retention Retention
+	err := repo.db.QueryRowContext(ctx, "SELECT retention_days, retention_messages FROM rooms WHERE id = $1", roomID).Scan(&retention.RetentionDays, &retention.RetentionMessages)
+	if err != nil {
+		return Retention{}, err
+	}
+	return retention, nil
+}
+
+func (repo *SQLRoomRepoImpl) TouchRoom(ctx context.Context, roomID RoomID, activityAt int64) error {
+	_, err := repo.db.ExecContext(ctx, "UPDATE rooms SET last_activity_at = $1 WHERE id = $2", activityAt, roomID)
+	return err
+}
+
+func (repo *SQLRoomRepoImpl) ScanRooms(ctx context.Context, fn func(room Room) error) error {
+	rows, err := repo.db.QueryContext(ctx, "SELECT id, retention_days, retention_messages, last_activity_at FROM rooms")
+	if err != nil {
+		return err
+	}
+	// collect the rooms first, fn may write to the database while rows hold the only sqlite connection
+	var rooms []Room
+	for rows.Next() {
+		var room Room
+		if err := rows.Scan(&room.ID, &room.RetentionDays, &room.RetentionMessages, &room.LastActivityAt); err != nil {
+			rows.Close()
+			return err
+		}
+		rooms = append(rooms, room)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, room := range rooms {
+		if err := fn(room); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *SQLRoomRepoImpl) DeleteRoom(ctx context.Context, roomID RoomID) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM rooms WHERE id = $1", roomID)
+	return err
+}
+
+func (repo *SQLRoomRepoImpl) GetOwnerTokenHash(ctx context.Context, roomID RoomID) (string, error) {
+	var ownerTokenHash string
+	err := repo.db.QueryRowContext(ctx, "SELECT owner_token_hash FROM rooms WHERE id = $1", roomID).Scan(&ownerTokenHash)
+	if err != nil {
+		return "", err
+	}
+	return ownerTokenHash, nil
+}
+
+func (repo *SQLRoomRepoImpl) GetRoom(ctx context.Context, roomID RoomID) (Room, error) {
+	var room Room
+	query := "SELECT id, name, protected, password, retention_days, retention_messages, last_activity_at, owner_token_hash, visibility FROM rooms WHERE id = $1"
+	err := repo.db.QueryRowContext(ctx, query, roomID).Scan(
+		&room.ID, &room.Name, &room.Protected, &room.Password, &room.RetentionDays, &room.RetentionMessages, &room.LastActivityAt, &room.OwnerTokenHash, &room.Visibility,
+	)
+	if err != nil {
+		return Room{}, err
+	}
+	return room, nil
+}
+
+func (repo *SQLRoomRepoImpl) UpsertRoom(ctx context.Context, room Room) error {
+	query := `INSERT INTO rooms (id, name, protected, password, retention_days, retention_messages, last_activity_at, owner_token_hash, visibility)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	ON CONFLICT (id) DO UPDATE SET name = excluded.name, protected = excluded.protected, password = excluded.password,
+	retention_days = excluded.retention_days, retention_messages = excluded.retention_messages,
+	last_activity_at = excluded.last_activity_at, owner_token_hash = excluded.owner_token_hash, visibility = excluded.visibility`
+	_, err := repo.db.ExecContext(ctx, query, room.ID, room.Name, room.Protected, room.Password, room.RetentionDays, room.RetentionMessages, room.LastActivityAt, room.OwnerTokenHash, room.Visibility)
+	return err
+}
+
+func (repo *SQLRoomRepoImpl) GetVisibility(ctx context.Context, roomID RoomID) (string, error) {
+	var visibility string
+	err := repo.db.QueryRowContext(ctx, "SELECT visibility FROM rooms WHERE id = $1", roomID).Scan(&visibility)
+	if err != nil {
+		return "", err
+	}
+	return visibility, nil
+}
+
+func (repo *SQLRoomRepoImpl) ListPublicRooms(ctx context.Context, beforeID RoomID, limit int) ([]Room, error) {
+	query := "SELECT id, name, protected FROM rooms WHERE visibility = $1 ORDER BY id DESC LIMIT $2"
+	args := []any{VisibilityPublic, limit}
+	if beforeID > 0 {
+		query = "SELECT id, name, protected FROM rooms WHERE visibility = $1 AND id < $2 ORDER BY id DESC LIMIT $3"
+		args = []any{VisibilityPublic, beforeID, limit}
+	}
+	rows, err := repo.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rooms := []Room{}
+	for rows.Next() {
+		room := Room{Visibility: VisibilityPublic}
+		if err := rows.Scan(&room.ID, &room.Name, &room.Protected); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
@@ -8,17 +8,25 @@ import (
 
 type Router struct {
 	httpServer common.HttpServer
+	grpcServer common.GrpcServer
 }
 
-func NewRouter(httpServer common.HttpServer) *Router {
-	return &Router{httpServer}
+func NewRouter(httpServer common.HttpServer, grpcServer common.GrpcServer) *Router {
+	return &Router{httpServer, grpcServer}
 }
 
 func (r *Router) Run() {
 	r.httpServer.RegisterRoutes()
+	r.grpcServer.Register()
 	r.httpServer.Run()
+	r.grpcServer.Run()
 
 }
+
+// GracefulStop ends the Chat streams first, their sessions leave the room through the HTTP server broker.
 func (r *Router) GracefulStop(ctx context.Context) error {
+	if err := r.grpcServer.GracefulStop(); err != nil {
+		return err
+	}
 	return r.httpServer.GracefulStop(ctx)
 }
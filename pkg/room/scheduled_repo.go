@@ -0,0 +1,113 @@
+package room
+
+import (
+	"context"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+type ScheduledMessageRepo interface {
+	CreateScheduledMessage(ctx context.Context, msg ScheduledMessage) error
+	// ListScheduledMessages returns the pending messages of the room in ID order
+	ListScheduledMessages(ctx context.Context, roomID RoomID) ([]ScheduledMessage, error)
+	// ScanDueMessages calls fn for the messages due within [from, to] in due order
+	ScanDueMessages(ctx context.Context, from, to time.Time, fn func(msg ScheduledMessage) error) error
+	// DeleteScheduledMessage reports whether the message was still pending
+	DeleteScheduledMessage(ctx context.Context, msg ScheduledMessage) (bool, error)
+	DeleteRoomScheduledMessages(ctx context.Context, roomID RoomID) error
+	// DeleteExpiredScheduledMessages deletes the messages due before the given time, for stores
+	// without native TTL
+	DeleteExpiredScheduledMessages(ctx context.Context, before time.Time) error
+}
+
+type ScheduledMessageRepoImpl struct {
+	cassandraSession *gocql.Session
+	// lookback expires the messages the scheduler no longer fires
+	lookback time.Duration
+}
+
+func NewScheduledMessageRepo(cassandraSession *gocql.Session, lookback time.Duration) *ScheduledMessageRepoImpl {
+	return &ScheduledMessageRepoImpl{cassandraSession, lookback}
+}
+
+// scheduledBucket partitions the due messages by the hour they are due.
+func scheduledBucket(dueAt int64) int64 {
+	return dueAt / time.Hour.Milliseconds()
+}
+
+func (repo *ScheduledMessageRepoImpl) CreateScheduledMessage(ctx context.Context, msg ScheduledMessage) error {
+	ttl := int64((time.Until(time.UnixMilli(msg.DueAt)) + repo.lookback).Seconds())
+	batch := repo.cassandraSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("insert into scheduled_messages (room_id, id, username, payload, due_at, author_token_hash) values (?, ?, ?, ?, ?, ?) using ttl ?",
+		msg.RoomID, msg.ID, msg.UserName, msg.Payload, msg.DueAt, msg.AuthorTokenHash, ttl)
+	batch.Query("insert into scheduled_messages_by_due (bucket, due_at, id, room_id, username, payload) values (?, ?, ?, ?, ?, ?) using ttl ?",
+		scheduledBucket(msg.DueAt), msg.DueAt, msg.ID, msg.RoomID, msg.UserName, msg.Payload, ttl)
+	return repo.cassandraSession.ExecuteBatch(batch)
+}
+
+func (repo *ScheduledMessageRepoImpl) ListScheduledMessages(ctx context.Context, roomID RoomID) ([]ScheduledMessage, error) {
+	query := "select room_id, id, username, payload, due_at, author_token_hash from scheduled_messages where room_id = ?"
+	iter := repo.cassandraSession.Query(query, roomID).WithContext(ctx).Idempotent(true).Iter()
+	var msgs []ScheduledMessage
+	var msg ScheduledMessage
+	for iter.Scan(&msg.RoomID, &msg.ID, &msg.UserName, &msg.Payload, &msg.DueAt, &msg.AuthorTokenHash) {
+		msgs = append(msgs, msg)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (repo *ScheduledMessageRepoImpl) ScanDueMessages(ctx context.Context, from, to time.Time, fn func(msg ScheduledMessage) error) error {
+	for bucket := scheduledBucket(from.UnixMilli()); bucket <= scheduledBucket(to.UnixMilli()); bucket++ {
+		query := "select room_id, id, username, payload, due_at from scheduled_messages_by_due where bucket = ? and due_at >= ? and due_at <= ?"
+		iter := repo.cassandraSession.Query(query, bucket, from.UnixMilli(), to.UnixMilli()).WithContext(ctx).Idempotent(true).Iter()
+		var msg ScheduledMessage
+		for iter.Scan(&msg.RoomID, &msg.ID, &msg.UserName, &msg.Payload, &msg.DueAt) {
+			if err := fn(msg); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *ScheduledMessageRepoImpl) DeleteScheduledMessage(ctx context.Context, msg ScheduledMessage) (bool, error) {
+	var id MessageID
+	err := repo.cassandraSession.Query("select id from scheduled_messages where room_id = ? and id = ?", msg.RoomID, msg.ID).WithContext(ctx).Idempotent(true).Scan(&id)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	batch := repo.cassandraSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("delete from scheduled_messages where room_id = ? and id = ?", msg.RoomID, msg.ID)
+	batch.Query("delete from scheduled_messages_by_due where bucket = ? and due_at = ? and id = ?", scheduledBucket(msg.DueAt), msg.DueAt, msg.ID)
+	err = repo.cassandraSession.ExecuteBatch(batch)
+	return err == nil, err
+}
+
+func (repo *ScheduledMessageRepoImpl) DeleteRoomScheduledMessages(ctx context.Context, roomID RoomID) error {
+	msgs, err := repo.ListScheduledMessages(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := repo.cassandraSession.Query("delete from scheduled_messages_by_due where bucket = ? and due_at = ? and id = ?", scheduledBucket(msg.DueAt), msg.DueAt, msg.ID).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+			return err
+		}
+	}
+	return repo.cassandraSession.Query("delete from scheduled_messages where room_id = ?", roomID).WithContext(ctx).Idempotent(true).Exec()
+}
+
+func (repo *ScheduledMessageRepoImpl) DeleteExpiredScheduledMessages(ctx context.Context, before time.Time) error {
+	// messages the scheduler no longer fires are removed by the cassandra TTL
+	return nil
+}
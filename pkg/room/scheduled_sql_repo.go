@@ -0,0 +1,77 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type SQLScheduledMessageRepoImpl struct {
+	db *sql.DB
+}
+
+func NewSQLScheduledMessageRepo(db *sql.DB) *SQLScheduledMessageRepoImpl {
+	return &SQLScheduledMessageRepoImpl{db}
+}
+
+func (repo *SQLScheduledMessageRepoImpl) CreateScheduledMessage(ctx context.Context, msg ScheduledMessage) error {
+	query := "INSERT INTO scheduled_messages (id, room_id, username, payload, due_at, author_token_hash) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, err := repo.db.ExecContext(ctx, query, msg.ID, msg.RoomID, msg.UserName, msg.Payload, msg.DueAt, msg.AuthorTokenHash)
+	return err
+}
+
+func (repo *SQLScheduledMessageRepoImpl) ListScheduledMessages(ctx context.Context, roomID RoomID) ([]ScheduledMessage, error) {
+	query := "SELECT room_id, id, username, payload, due_at, author_token_hash FROM scheduled_messages WHERE room_id = $1 ORDER BY id"
+	return repo.query(ctx, query, roomID)
+}
+
+func (repo *SQLScheduledMessageRepoImpl) ScanDueMessages(ctx context.Context, from, to time.Time, fn func(msg ScheduledMessage) error) error {
+	query := "SELECT room_id, id, username, payload, due_at, author_token_hash FROM scheduled_messages WHERE due_at >= $1 AND due_at <= $2 ORDER BY due_at, id"
+	// the rows are read before fn runs, sqlite allows a single connection to write
+	msgs, err := repo.query(ctx, query, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *SQLScheduledMessageRepoImpl) query(ctx context.Context, query string, args ...any) ([]ScheduledMessage, error) {
+	rows, err := repo.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []ScheduledMessage
+	for rows.Next() {
+		var msg ScheduledMessage
+		if err := rows.Scan(&msg.RoomID, &msg.ID, &msg.UserName, &msg.Payload, &msg.DueAt, &msg.AuthorTokenHash); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (repo *SQLScheduledMessageRepoImpl) DeleteScheduledMessage(ctx context.Context, msg ScheduledMessage) (bool, error) {
+	result, err := repo.db.ExecContext(ctx, "DELETE FROM scheduled_messages WHERE id = $1", msg.ID)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (repo *SQLScheduledMessageRepoImpl) DeleteRoomScheduledMessages(ctx context.Context, roomID RoomID) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM scheduled_messages WHERE room_id = $1", roomID)
+	return err
+}
+
+func (repo *SQLScheduledMessageRepoImpl) DeleteExpiredScheduledMessages(ctx context.Context, before time.Time) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM scheduled_messages WHERE due_at < $1", before.UnixMilli())
+	return err
+}
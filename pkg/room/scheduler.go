@@ -0,0 +1,251 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// Scheduled messages are stored with their due time and sent as text messages of their author by
+// the MessageScheduler. The author gets a token when scheduling, which lists and cancels them.
+
+const maxScheduledMessageLength = 4096
+
+var schedulerLeaderKey = "chat:scheduler:leader"
+
+type ScheduleMessageDTO struct {
+	UserName string    `json:"username" binding:"required"`
+	Text     string    `json:"text" binding:"required"`
+	SendAt   time.Time `json:"send_at" binding:"required"`
+}
+
+func (dto *ScheduleMessageDTO) isValid(now time.Time, maxDelay time.Duration) bool {
+	if len(dto.Text) > maxScheduledMessageLength {
+		return false
+	}
+	return dto.SendAt.After(now) && dto.SendAt.Sub(now) <= maxDelay
+}
+
+type ScheduledMessage struct {
+	ID       MessageID
+	RoomID   RoomID
+	UserName string
+	Payload  string
+	// DueAt is the unix time in milliseconds the message is sent at
+	DueAt           int64
+	AuthorTokenHash string
+}
+
+func (msg *ScheduledMessage) ToPresenter() *ScheduledMessagePresenter {
+	return &ScheduledMessagePresenter{
+		ID:       msg.ID,
+		UserName: msg.UserName,
+		Text:     msg.Payload,
+		SendAt:   time.UnixMilli(msg.DueAt).UTC(),
+	}
+}
+
+// clientMsgID makes a message fired twice, e.g. by a leader that lost its lease mid round, sent once.
+func (msg *ScheduledMessage) clientMsgID() string {
+	return "scheduled:" + strconv.FormatUint(msg.ID, 10)
+}
+
+type ScheduledMessagePresenter struct {
+	ID       MessageID `json:"scheduled_id"`
+	UserName string    `json:"username"`
+	Text     string    `json:"text"`
+	SendAt   time.Time `json:"send_at"`
+	// AuthorToken is only returned when scheduling without a token, it lists and cancels the messages
+	AuthorToken string `json:"author_token,omitempty"`
+}
+
+// renewLeaseScript extends the lease only when this instance still holds it.
+var renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// MessageScheduler sends the due scheduled messages. The instances compete for a leader lease in
+// redis, the leader renews it every round and is the only one firing messages until it stops or
+// fails to renew it for the lease duration.
+type MessageScheduler struct {
+	roomService  *RoomServiceImpl
+	roomRepo     RoomRepo
+	scheduleRepo ScheduledMessageRepo
+	redisClient  redis.UniversalClient
+	logger       common.HttpLog
+	instanceID   string
+	interval     time.Duration
+	lease        time.Duration
+	lookback     time.Duration
+	maxAttempts  int
+	// scannedUntil is the start of the oldest period that may still hold due messages, attempts
+	// counts the failed firings of the messages retried, they are only used while leading
+	scannedUntil time.Time
+	attempts     map[MessageID]int
+	cancel       context.CancelFunc
+	done         chan struct{}
+}
+
+func NewMessageScheduler(config *config.Config, logger common.HttpLog, roomService *RoomServiceImpl, roomRepo RoomRepo, scheduleRepo ScheduledMessageRepo, redisClient redis.UniversalClient) (*MessageScheduler, error) {
+	schedulerConfig := config.Room.Scheduler
+	if schedulerConfig.IntervalSecond <= 0 {
+		return nil, fmt.Errorf("invalid room.scheduler.intervalSecond: %d", schedulerConfig.IntervalSecond)
+	}
+	if schedulerConfig.LeaseSecond <= schedulerConfig.IntervalSecond {
+		return nil, fmt.Errorf("room.scheduler.leaseSecond %d must be longer than the interval", schedulerConfig.LeaseSecond)
+	}
+	if schedulerConfig.LookbackHour <= 0 {
+		return nil, fmt.Errorf("invalid room.scheduler.lookbackHour: %d", schedulerConfig.LookbackHour)
+	}
+	if schedulerConfig.MaxAttempts <= 0 {
+		return nil, fmt.Errorf("invalid room.scheduler.maxAttempts: %d", schedulerConfig.MaxAttempts)
+	}
+	hostname, _ := os.Hostname()
+	return &MessageScheduler{
+		roomService:  roomService,
+		roomRepo:     roomRepo,
+		scheduleRepo: scheduleRepo,
+		redisClient:  redisClient,
+		logger:       logger,
+		instanceID:   fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		interval:     time.Duration(schedulerConfig.IntervalSecond) * time.Second,
+		lease:        time.Duration(schedulerConfig.LeaseSecond) * time.Second,
+		lookback:     time.Duration(schedulerConfig.LookbackHour) * time.Hour,
+		maxAttempts:  schedulerConfig.MaxAttempts,
+		attempts:     make(map[MessageID]int),
+		done:         make(chan struct{}),
+	}, nil
+}
+
+func (scheduler *MessageScheduler) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	scheduler.cancel = cancel
+	go func() {
+		defer close(scheduler.done)
+		ticker := time.NewTicker(scheduler.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := scheduler.runOnce(ctx); err != nil && !errors.Is(err, context.Canceled) {
+					scheduler.logger.Error("message scheduler: " + err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// GracefulStop waits for the current round and hands the lease over to the other instances.
+func (scheduler *MessageScheduler) GracefulStop() {
+	if scheduler.cancel == nil {
+		return
+	}
+	scheduler.cancel()
+	<-scheduler.done
+	if err := releaseLeaseScript.Run(context.Background(), scheduler.redisClient, []string{schedulerLeaderKey}, scheduler.instanceID).Err(); err != nil {
+		scheduler.logger.Error("message scheduler: error releasing leader lease: " + err.Error())
+	}
+}
+
+func (scheduler *MessageScheduler) runOnce(ctx context.Context) error {
+	leading, err := scheduler.lead(ctx)
+	if err != nil || !leading {
+		scheduler.scannedUntil = time.Time{}
+		clear(scheduler.attempts)
+		return err
+	}
+
+	now := time.Now()
+	from := scheduler.scannedUntil
+	if from.IsZero() {
+		from = now.Add(-scheduler.lookback)
+	}
+	// messages are only scheduled in the future, the next rounds start from the current hour so
+	// messages created with a skewed clock are still found, or from the oldest message to retry
+	scannedUntil := now.Truncate(time.Hour)
+	err = scheduler.scheduleRepo.ScanDueMessages(ctx, from, now, func(msg ScheduledMessage) error {
+		err := scheduler.fire(ctx, msg)
+		if err == nil {
+			delete(scheduler.attempts, msg.ID)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// a failed message does not hold back the others of the round
+		if dueAt := time.UnixMilli(msg.DueAt); scheduler.retry(ctx, msg, err) && dueAt.Before(scannedUntil) {
+			scannedUntil = dueAt
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	scheduler.scannedUntil = scannedUntil
+	return nil
+}
+
+// retry logs the failed firing of msg and reports whether it is fired again by the next rounds,
+// a message failing maxAttempts times is deleted.
+func (scheduler *MessageScheduler) retry(ctx context.Context, msg ScheduledMessage, fireErr error) bool {
+	scheduler.attempts[msg.ID]++
+	attempts := scheduler.attempts[msg.ID]
+	if attempts < scheduler.maxAttempts {
+		scheduler.logger.Warn("message scheduler: error sending scheduled message, retrying: "+fireErr.Error(),
+			slog.Uint64("scheduled_id", msg.ID), slog.Int("attempts", attempts))
+		return true
+	}
+	scheduler.logger.Error("message scheduler: dropping scheduled message: "+fireErr.Error(),
+		slog.Uint64("scheduled_id", msg.ID), slog.Uint64("room_id", msg.RoomID), slog.Int("attempts", attempts))
+	if _, err := scheduler.scheduleRepo.DeleteScheduledMessage(ctx, msg); err != nil {
+		scheduler.logger.Error("message scheduler: error deleting dropped message: " + err.Error())
+		return true
+	}
+	delete(scheduler.attempts, msg.ID)
+	return false
+}
+
+// lead acquires the leader lease or renews the one this instance holds.
+func (scheduler *MessageScheduler) lead(ctx context.Context) (bool, error) {
+	acquired, err := scheduler.redisClient.SetNX(ctx, schedulerLeaderKey, scheduler.instanceID, scheduler.lease).Result()
+	if err != nil || acquired {
+		return acquired, err
+	}
+	renewed, err := renewLeaseScript.Run(ctx, scheduler.redisClient, []string{schedulerLeaderKey}, scheduler.instanceID, scheduler.lease.Milliseconds()).Int()
+	return renewed == 1, err
+}
+
+func (scheduler *MessageScheduler) fire(ctx context.Context, msg ScheduledMessage) error {
+	exist, err := scheduler.roomRepo.RoomExist(ctx, msg.RoomID)
+	if err != nil {
+		return err
+	}
+	if exist {
+		if err := scheduler.roomService.BroadcastTextMessage(ctx, msg.RoomID, msg.UserName, msg.Payload, msg.clientMsgID()); err != nil {
+			return err
+		}
+		scheduler.logger.Info("sent scheduled message", slog.Uint64("scheduled_id", msg.ID), slog.Uint64("room_id", msg.RoomID))
+	}
+	_, err = scheduler.scheduleRepo.DeleteScheduledMessage(ctx, msg)
+	return err
+}
@@ -0,0 +1,146 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/omran95/chatroom/pkg/room/client"
+	"github.com/redis/go-redis/v9"
+)
+
+// failingRoomRepo fails the room lookups of failRoom.
+type failingRoomRepo struct {
+	RoomRepo
+	failRoom RoomID
+}
+
+func (repo *failingRoomRepo) RoomExist(ctx context.Context, roomID RoomID) (bool, error) {
+	if roomID == repo.failRoom {
+		return false, errors.New("room lookup failed")
+	}
+	return repo.RoomRepo.RoomExist(ctx, roomID)
+}
+
+func newTestScheduler(t *testing.T, server *testRoomServer, roomRepo RoomRepo) *MessageScheduler {
+	t.Helper()
+	redisClient := redis.NewClient(&redis.Options{Addr: server.redis.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+	scheduler, err := NewMessageScheduler(server.config, testLogger, server.service, roomRepo, server.storage.ScheduledMessageRepo, redisClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scheduler
+}
+
+func TestNewMessageSchedulerValidatesConfig(t *testing.T) {
+	server := newTestRoomServer(t)
+	server.config.Room.Scheduler.IntervalSecond = 0
+	if _, err := NewMessageScheduler(server.config, testLogger, server.service, server.storage.RoomRepo, server.storage.ScheduledMessageRepo, nil); err == nil {
+		t.Fatal("scheduler created with a zero interval")
+	}
+}
+
+func TestSchedulerRetriesAndDropsFailingMessages(t *testing.T) {
+	server := newTestRoomServer(t)
+	ctx := context.Background()
+	var roomIDs []RoomID
+	for _, name := range []string{"failing", "working"} {
+		room, err := server.service.CreateRoom(ctx, CreateRoomDTO{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		roomIDs = append(roomIDs, room.ID)
+	}
+	failing, working := roomIDs[0], roomIDs[1]
+	scheduler := newTestScheduler(t, server, &failingRoomRepo{server.storage.RoomRepo, failing})
+
+	// the failing message is due first and the retries keep the scan window at its hour
+	dueAt := time.Now().Add(-2 * time.Hour).UnixMilli()
+	repo := server.storage.ScheduledMessageRepo
+	for i, roomID := range []RoomID{failing, working} {
+		msg := ScheduledMessage{ID: MessageID(i + 1), RoomID: roomID, UserName: "alice", Payload: "scheduled", DueAt: dueAt + int64(i)}
+		if err := repo.CreateScheduledMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for attempt := 1; attempt <= server.config.Room.Scheduler.MaxAttempts; attempt++ {
+		if err := scheduler.runOnce(ctx); err != nil {
+			t.Fatal(err)
+		}
+		pending, err := repo.ListScheduledMessages(ctx, failing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retried := attempt < server.config.Room.Scheduler.MaxAttempts; (len(pending) == 1) != retried {
+			t.Fatalf("after %d attempts %d messages pending", attempt, len(pending))
+		}
+		if attempt == 1 {
+			// the working message was sent by the first round and is gone
+			sent, err := server.storage.MessageRepo.LatestMessages(ctx, working, 10)
+			if err != nil || len(sent) != 1 || sent[0].Payload != "scheduled" {
+				t.Fatalf("working room messages %v: %v", sent, err)
+			}
+			if pending, _ := repo.ListScheduledMessages(ctx, working); len(pending) != 0 {
+				t.Fatalf("sent message still pending: %v", pending)
+			}
+		}
+	}
+	if len(scheduler.attempts) != 0 {
+		t.Fatalf("attempts kept for dropped messages: %v", scheduler.attempts)
+	}
+}
+
+func TestDeleteExpiredScheduledMessages(t *testing.T) {
+	repo, ctx := newTestStorage(t).ScheduledMessageRepo, context.Background()
+	now := time.Now()
+	for i, dueAt := range []time.Time{now.Add(-48 * time.Hour), now.Add(time.Hour)} {
+		if err := repo.CreateScheduledMessage(ctx, ScheduledMessage{ID: MessageID(i + 1), RoomID: 1, UserName: "alice", DueAt: dueAt.UnixMilli()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.DeleteExpiredScheduledMessages(ctx, now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := repo.ListScheduledMessages(ctx, 1)
+	if err != nil || len(pending) != 1 || pending[0].ID != 2 {
+		t.Fatalf("pending %v: %v", pending, err)
+	}
+}
+
+func TestScheduleMessageInPrivateRoomAsMember(t *testing.T) {
+	server := newTestRoomServer(t)
+	roomClient := server.httpClient(t)
+	ctx := context.Background()
+	visibility := client.Visibility(VisibilityPrivate)
+	created, err := roomClient.CreateRoomWithResponse(ctx, client.CreateRoomRequest{Name: "private", Visibility: &visibility})
+	if err != nil || created.JSON201 == nil {
+		t.Fatalf("create room: %v", err)
+	}
+	roomID, ownerToken := created.JSON201.RoomId, *created.JSON201.OwnerToken
+	added, err := roomClient.AddMemberWithResponse(ctx, roomID, client.MemberRequest{Username: "alice"}, withHeader("Authorization", "Bearer "+ownerToken))
+	if err != nil || added.JSON201 == nil {
+		t.Fatalf("add member: %v", err)
+	}
+	memberToken := withHeader("X-Room-Member-Token", *added.JSON201.MemberToken)
+
+	sendAt := time.Now().Add(time.Hour)
+	other, err := roomClient.ScheduleMessageWithResponse(ctx, roomID, client.ScheduleMessageRequest{Username: "mallory", Text: "hi", SendAt: sendAt}, memberToken)
+	if err != nil || other.StatusCode() != http.StatusForbidden {
+		t.Fatalf("scheduling as another user: %v %v", other.Status(), err)
+	}
+	own, err := roomClient.ScheduleMessageWithResponse(ctx, roomID, client.ScheduleMessageRequest{Username: "alice", Text: "hi", SendAt: sendAt}, memberToken)
+	if err != nil || own.JSON201 == nil {
+		t.Fatalf("scheduling as the member: %v %v", own.Status(), err)
+	}
+}
+
+func withHeader(name, value string) client.RequestEditorFn {
+	return func(ctx context.Context, req *http.Request) error {
+		req.Header.Set(name, value)
+		return nil
+	}
+}
@@ -0,0 +1,229 @@
+package room
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	DropOldest = "drop_oldest"
+	DropTyping = "drop_typing"
+	Disconnect = "disconnect"
+)
+
+// closeSlowConsumer is the websocket close code sent to sessions disconnected by the disconnect policy.
+const closeSlowConsumer = 4008
+
+// sendWindow is the number of messages handed to a transport at once, it stays below
+// the melody session buffer size so melody never drops messages on its own.
+const sendWindow = 16
+
+// SendQueues gives every joined session a bounded outbound queue. Messages wait in the queue
+// until the transport sent the previous ones, a full queue applies the overflow policy.
+type SendQueues struct {
+	queues      sync.Map
+	compression *WsCompression
+	capacity    int
+	policy      string
+	dedupWindow int
+	depth       prometheus.Gauge
+	dropped     *prometheus.CounterVec
+	disconnects prometheus.Counter
+}
+
+func NewSendQueues(name string, config *config.Config, compression *WsCompression) (*SendQueues, error) {
+	capacity, policy := config.Room.SendQueue.Capacity, config.Room.SendQueue.OverflowPolicy
+	if capacity <= 0 {
+		return nil, fmt.Errorf("invalid send queue capacity: %d", capacity)
+	}
+	switch policy {
+	case DropOldest, DropTyping, Disconnect:
+	default:
+		return nil, fmt.Errorf("unknown send queue overflow policy: %s", policy)
+	}
+	return &SendQueues{
+		compression: compression,
+		capacity:    capacity,
+		policy:      policy,
+		dedupWindow: config.Room.Dedup.SessionWindow,
+		depth: promauto.NewGauge(prometheus.GaugeOpts{
+			Namespace: name,
+			Name:      "session_send_queue_depth",
+			Help:      "Messages waiting in the session send queues of this instance.",
+		}),
+		dropped: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: name,
+			Name:      "session_send_queue_dropped_total",
+			Help:      "Messages dropped from full session send queues.",
+		}, []string{"reason"}),
+		disconnects: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: name,
+			Name:      "session_slow_consumer_disconnects_total",
+			Help:      "Sessions disconnected because their send queue was full.",
+		}),
+	}, nil
+}
+
+type queuedMessage struct {
+	data   []byte
+	typing bool
+}
+
+type sendQueue struct {
+	mu   sync.Mutex
+	sess Session
+	// deflate is the websocket session when its connection negotiated permessage-deflate,
+	// compressing tells whether compression is enabled for the next frame
+	deflate     *wsSession
+	compressing bool
+	pending     []queuedMessage
+	// inflight holds the sizes of the messages handed to melody, in the order they are written
+	inflight  []int
+	closed    bool
+	delivered *deliveredIDs
+}
+
+// open creates the send queue of sess, a session keeps its queue from connecting until it leaves.
+func (queues *SendQueues) open(sess Session) {
+	queue := &sendQueue{sess: sess, delivered: newDeliveredIDs(queues.dedupWindow)}
+	if ws, ok := sess.(*wsSession); ok && queues.compression.negotiated(ws.sess.Request) {
+		queue.deflate = ws
+	}
+	queues.queues.LoadOrStore(sess, queue)
+}
+
+func (queues *SendQueues) close(sess Session) {
+	value, ok := queues.queues.LoadAndDelete(sess)
+	if !ok {
+		return
+	}
+	queue := value.(*sendQueue)
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.closed = true
+	queues.depth.Sub(float64(len(queue.pending)))
+	queue.pending = nil
+}
+
+// Sent is called by the transports once a message written to the session reached the client.
+// Every message is written through the queue, so the sent messages are the in-flight ones in order.
+func (queues *SendQueues) Sent(sess Session) {
+	queue := queues.get(sess)
+	if queue == nil {
+		return
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if len(queue.inflight) > 0 {
+		queues.compression.sent(queue.inflight[0], queue.compressing)
+		queue.inflight = queue.inflight[1:]
+		queues.compressNext(queue)
+	}
+	for !queue.closed && len(queue.inflight) < sendWindow && len(queue.pending) > 0 {
+		next := queue.pending[0]
+		queue.pending = queue.pending[1:]
+		queues.depth.Dec()
+		queues.write(queue, next.data)
+	}
+}
+
+func (queues *SendQueues) send(sess Session, msg *encodedMessage) {
+	queue := queues.get(sess)
+	if queue == nil {
+		return
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	// the broker redelivers messages whose handler failed, drop the ones this session already got
+	if queue.closed || !queue.delivered.add(msg.msg.ID) {
+		return
+	}
+	queues.enqueue(queue, queuedMessage{msg.as(sess.ContentType()), msg.msg.isTyping()})
+}
+
+// sendData queues data that is not a room message on one session, e.g. the password prompt.
+func (queues *SendQueues) sendData(sess Session, data []byte) {
+	queue := queues.get(sess)
+	if queue == nil {
+		return
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if !queue.closed {
+		queues.enqueue(queue, queuedMessage{data: data})
+	}
+}
+
+func (queues *SendQueues) enqueue(queue *sendQueue, next queuedMessage) {
+	if len(queue.inflight) < sendWindow && len(queue.pending) == 0 {
+		queues.write(queue, next.data)
+		return
+	}
+	if len(queue.pending) >= queues.capacity && !queues.overflow(queue, next) {
+		return
+	}
+	queue.pending = append(queue.pending, next)
+	queues.depth.Inc()
+}
+
+// write hands data to the transport.
+func (queues *SendQueues) write(queue *sendQueue, data []byte) {
+	queue.inflight = append(queue.inflight, len(data))
+	queue.sess.Write(data)
+}
+
+// compressNext enables compression for the oldest in-flight message, the next one the write pump
+// sends. It only runs from the sent handler, which melody calls on the write pump, so the connection
+// setting never changes under a write. A message handed to an idle pump is sent with the current setting.
+func (queues *SendQueues) compressNext(queue *sendQueue) {
+	if queue.deflate == nil || len(queue.inflight) == 0 {
+		return
+	}
+	compress := queues.compression.compresses(queue.inflight[0])
+	if compress != queue.compressing {
+		queue.deflate.sess.WebsocketConnection().EnableWriteCompression(compress)
+		queue.compressing = compress
+	}
+}
+
+// overflow makes room in a full queue and reports whether next should still be queued.
+func (queues *SendQueues) overflow(queue *sendQueue, next queuedMessage) bool {
+	switch queues.policy {
+	case Disconnect:
+		queue.closed = true
+		queues.depth.Sub(float64(len(queue.pending)))
+		queue.pending = nil
+		queues.disconnects.Inc()
+		queue.sess.Close(closeSlowConsumer, "slow consumer")
+		return false
+	case DropTyping:
+		if next.typing {
+			queues.dropped.WithLabelValues("typing").Inc()
+			return false
+		}
+		for i, queued := range queue.pending {
+			if queued.typing {
+				queue.pending = append(queue.pending[:i], queue.pending[i+1:]...)
+				queues.depth.Dec()
+				queues.dropped.WithLabelValues("typing").Inc()
+				return true
+			}
+		}
+	}
+	queue.pending = queue.pending[1:]
+	queues.depth.Dec()
+	queues.dropped.WithLabelValues("oldest").Inc()
+	return true
+}
+
+func (queues *SendQueues) get(sess Session) *sendQueue {
+	queue, ok := queues.queues.Load(sess)
+	if !ok {
+		return nil
+	}
+	return queue.(*sendQueue)
+}
@@ -0,0 +1,127 @@
+package room
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// manualSession records the writes, the test reports them sent.
+type manualSession struct {
+	discardSession
+	written   []string
+	closeCode int
+}
+
+func (sess *manualSession) Write(data []byte) error {
+	sess.written = append(sess.written, string(data))
+	return nil
+}
+
+func (sess *manualSession) Close(code int, reason string) error {
+	sess.closeCode = code
+	return nil
+}
+
+func TestSendQueueWindow(t *testing.T) {
+	queues := newTestSendQueues(t, newTestConfig(t))
+	sessions := NewRoomSessions(queues)
+	sess := &manualSession{}
+	sessions.Open(sess)
+	sessions.SendData(sess, []byte("password?"))
+	sessions.Add(1, sess)
+	for i := 1; i <= sendWindow+4; i++ {
+		sessions.Broadcast(&Message{ID: uint64(i), RoomID: 1, Event: EventText, Payload: strconv.Itoa(i)}, "", nil)
+	}
+	if len(sess.written) != sendWindow || sess.written[0] != "password?" {
+		t.Fatalf("wrote %d messages starting with %q, want %d starting with the prompt", len(sess.written), sess.written[0], sendWindow)
+	}
+	for i := 0; i < 5; i++ {
+		queues.Sent(sess)
+	}
+	if len(sess.written) != sendWindow+5 {
+		t.Fatalf("wrote %d messages, want %d", len(sess.written), sendWindow+5)
+	}
+	queue := queues.get(sess)
+	if len(queue.inflight) != sendWindow || len(queue.pending) != 0 {
+		t.Fatalf("%d messages in flight and %d pending, want %d and 0", len(queue.inflight), len(queue.pending), sendWindow)
+	}
+	for range sess.written {
+		queues.Sent(sess)
+	}
+	if len(queue.inflight) != 0 {
+		t.Fatalf("%d messages in flight after all were sent", len(queue.inflight))
+	}
+
+	// a session leaving before it joined drops its queue
+	unjoined := &manualSession{}
+	sessions.Open(unjoined)
+	sessions.Discard(unjoined)
+	if queues.get(unjoined) != nil {
+		t.Fatal("the queue of a session that never joined was kept")
+	}
+}
+
+func TestSendQueueOverflowPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy    string
+		pending   []string
+		dropped   map[string]float64
+		closeCode int
+	}{
+		{DropOldest, []string{"text 3", "typing 2", "text 4"}, map[string]float64{"oldest": 3}, 0},
+		{DropTyping, []string{"text 2", "text 3", "text 4"}, map[string]float64{"typing": 2, "oldest": 1}, 0},
+		{Disconnect, nil, map[string]float64{}, closeSlowConsumer},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.Room.SendQueue.Capacity = 3
+			cfg.Room.SendQueue.OverflowPolicy = test.policy
+			queues := newTestSendQueues(t, cfg)
+			sess := &manualSession{}
+			queues.open(sess)
+			queue := queues.get(sess)
+			push := func(data string, typing bool) {
+				queue.mu.Lock()
+				defer queue.mu.Unlock()
+				if !queue.closed {
+					queues.enqueue(queue, queuedMessage{[]byte(data), typing})
+				}
+			}
+			// nothing was sent yet, the window is in flight and the next messages wait in the queue
+			for i := 0; i < sendWindow; i++ {
+				push("window", false)
+			}
+			push("text 1", false)
+			push("typing 1", true)
+			push("text 2", false)
+			push("text 3", false)
+			push("typing 2", true)
+			push("text 4", false)
+
+			var pending []string
+			for _, queued := range queue.pending {
+				pending = append(pending, string(queued.data))
+			}
+			if !slices.Equal(pending, test.pending) {
+				t.Fatalf("queue holds %q, want %q", pending, test.pending)
+			}
+			for _, reason := range []string{"oldest", "typing"} {
+				if dropped := testutil.ToFloat64(queues.dropped.WithLabelValues(reason)); dropped != test.dropped[reason] {
+					t.Errorf("dropped %v messages for reason %s, want %v", dropped, reason, test.dropped[reason])
+				}
+			}
+			if depth := testutil.ToFloat64(queues.depth); depth != float64(len(test.pending)) {
+				t.Errorf("queue depth %v, want %d", depth, len(test.pending))
+			}
+			if sess.closeCode != test.closeCode {
+				t.Errorf("session closed with %d, want %d", sess.closeCode, test.closeCode)
+			}
+			if disconnects := testutil.ToFloat64(queues.disconnects); (disconnects == 1) != (test.closeCode != 0) {
+				t.Errorf("%v slow consumer disconnects", disconnects)
+			}
+		})
+	}
+}
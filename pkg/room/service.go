@@ -2,13 +2,22 @@ package room
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/omran95/chatroom/pkg/common"
-	"github.com/omran95/chatroom/pkg/infrastructure"
 	subscriberpb "github.com/omran95/chatroom/pkg/subscriber/proto"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -23,8 +32,43 @@ type RoomService interface {
 	AddRoomSubscriber(ctx context.Context, roomID RoomID, userName string, subscriberTopic string) error
 	RemoveRoomSubscriber(ctx context.Context, roomID RoomID, userName string) error
 	HandleNewMessage(ctx context.Context, msg Message) error
+	IsRoomOwner(ctx context.Context, roomID RoomID, ownerToken string) (bool, error)
+	ExportTranscript(ctx context.Context, roomID RoomID, options ExportOptions, w io.Writer) error
+	GetHistory(ctx context.Context, roomID RoomID, afterID MessageID, limit int) ([]Message, error)
+	CreateWebhook(ctx context.Context, roomID RoomID, dto CreateWebhookDTO) (*WebhookPresenter, error)
+	ListWebhooks(ctx context.Context, roomID RoomID) ([]*WebhookPresenter, error)
+	DeleteWebhook(ctx context.Context, roomID RoomID, webhookID WebhookID) (bool, error)
+	PostIncomingMessage(ctx context.Context, roomID RoomID, token string, dto IncomingMessageDTO) (bool, error)
+	PinMessage(ctx context.Context, roomID RoomID, messageID MessageID) (*PinnedMessage, error)
+	UnpinMessage(ctx context.Context, roomID RoomID, messageID MessageID) (bool, error)
+	ListPins(ctx context.Context, roomID RoomID) ([]PinnedMessage, error)
+	RoomState(ctx context.Context, roomID RoomID) (*Message, error)
+	ScheduleMessage(ctx context.Context, roomID RoomID, authorToken string, dto ScheduleMessageDTO) (*ScheduledMessagePresenter, error)
+	ListScheduledMessages(ctx context.Context, roomID RoomID, authorToken string) ([]*ScheduledMessagePresenter, error)
+	CancelScheduledMessage(ctx context.Context, roomID RoomID, scheduledID MessageID, authorToken string) (bool, error)
+	CreateInvite(ctx context.Context, roomID RoomID, dto CreateInviteDTO) (*InvitePresenter, error)
+	ListInvites(ctx context.Context, roomID RoomID) ([]*InvitePresenter, error)
+	RevokeInvite(ctx context.Context, roomID RoomID, inviteID InviteID) (bool, error)
+	RedeemInvite(ctx context.Context, roomID RoomID, token string) (bool, error)
+	RoomVisibility(ctx context.Context, roomID RoomID) (string, error)
+	ListPublicRooms(ctx context.Context, beforeID RoomID, limit int) ([]*RoomPresenter, error)
+	RoomMember(ctx context.Context, roomID RoomID, memberToken string) (*Member, error)
+	RequestToJoin(ctx context.Context, roomID RoomID, userName string) (*MemberPresenter, error)
+	AddMember(ctx context.Context, roomID RoomID, userName string) (*MemberPresenter, error)
+	ListMembers(ctx context.Context, roomID RoomID, status string) ([]*MemberPresenter, error)
+	ApproveJoinRequest(ctx context.Context, roomID RoomID, userName string) (bool, error)
+	RemoveMember(ctx context.Context, roomID RoomID, userName string, status string) (bool, error)
 }
 
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+	defaultRoomsLimit   = 50
+	maxRoomsLimit       = 100
+)
+
+var errHistoryFull = errors.New("history limit reached")
+
 type RoomServiceImpl struct {
 	snowFlake                 common.IDGenerator
 	roomRepo                  RoomRepo
@@ -32,12 +76,22 @@ type RoomServiceImpl struct {
 	AddRoomSubscriberEndpoint endpoint.Endpoint
 	RemoveSubscriberEndpoint  endpoint.Endpoint
 	messageRepo               MessageRepo
+	roomCache                 *roomCache
+	dedup                     *MessageDeduplicator
+	webhooks                  *WebhookCache
+	commands                  *SlashCommands
+	pollRepo                  PollRepo
+	pinRepo                   PinRepo
+	scheduleRepo              ScheduledMessageRepo
+	inviteRepo                InviteRepo
+	inviteSigner              *InviteSigner
+	memberRepo                MemberRepo
 }
 
-func NewRoomService(snowflake common.IDGenerator, roomRepo RoomRepo, messagePublisher MessagePublisher, subscriberClient *SubscriberGrpcClient, messageRepo MessageRepo) *RoomServiceImpl {
-	AddRoomSubscriberEndpoint := infrastructure.NewGrpcEndpoint(subscriberClient.Conn, "subscriber", "proto.SubscriberService", "AddRoomSubscriber", &subscriberpb.AddRoomSubscriberResponse{})
-	RemoveRoomSubscriberEndpoint := infrastructure.NewGrpcEndpoint(subscriberClient.Conn, "subscriber", "proto.SubscriberService", "RemoveRoomSubscriber", &subscriberpb.RemoveRoomSubscriberResponse{})
-	return &RoomServiceImpl{snowflake, roomRepo, messagePublisher, AddRoomSubscriberEndpoint, RemoveRoomSubscriberEndpoint, messageRepo}
+func NewRoomService(snowflake common.IDGenerator, roomRepo RoomRepo, messagePublisher MessagePublisher, subscriberEndpoints SubscriberEndpoints, messageRepo MessageRepo, dedup *MessageDeduplicator, webhooks *WebhookCache, commands *SlashCommands, pollRepo PollRepo, pinRepo PinRepo, scheduleRepo ScheduledMessageRepo, inviteRepo InviteRepo, inviteSigner *InviteSigner, memberRepo MemberRepo) *RoomServiceImpl {
+	service := &RoomServiceImpl{snowflake, roomRepo, messagePublisher, subscriberEndpoints.AddRoomSubscriber, subscriberEndpoints.RemoveRoomSubscriber, messageRepo, newRoomCache(time.Minute), dedup, webhooks, commands, pollRepo, pinRepo, scheduleRepo, inviteRepo, inviteSigner, memberRepo}
+	commands.Register("poll", &pollCommand{service})
+	return service
 }
 
 func (service *RoomServiceImpl) CreateRoom(ctx context.Context, dto CreateRoomDTO) (*RoomPresenter, error) {
@@ -45,7 +99,7 @@ func (service *RoomServiceImpl) CreateRoom(ctx context.Context, dto CreateRoomDT
 	if err != nil {
 		return nil, fmt.Errorf("error create snowflake ID for new room: %w", err)
 	}
-	room := &Room{ID: roomID}
+	room := &Room{ID: roomID, LastActivityAt: time.Now().UnixMilli()}
 	room.FromDTO(dto)
 	if !room.Protected && room.Password != "" {
 		room.Password = ""
@@ -57,10 +111,17 @@ func (service *RoomServiceImpl) CreateRoom(ctx context.Context, dto CreateRoomDT
 		}
 		room.Password = hashedPassword
 	}
+	ownerToken, err := generateToken()
+	if err != nil {
+		return nil, fmt.Errorf("error creating room owner token: %w", err)
+	}
+	room.OwnerTokenHash = hashToken(ownerToken)
 	if err := service.roomRepo.CreateRoom(ctx, *room); err != nil {
 		return nil, fmt.Errorf("error creating room: %w", err)
 	}
-	return room.ToPresenter(), nil
+	presenter := room.ToPresenter()
+	presenter.OwnerToken = ownerToken
+	return presenter, nil
 }
 
 func (service *RoomServiceImpl) RoomExist(ctx context.Context, roomID RoomID) (bool, error) {
@@ -88,6 +149,9 @@ func (service *RoomServiceImpl) IsValidPassword(ctx context.Context, roomID Room
 }
 
 func (service *RoomServiceImpl) BroadcastConnectMessage(ctx context.Context, roomID RoomID, userName string) error {
+	if err := service.recordActivity(ctx, roomID); err != nil {
+		return err
+	}
 	return service.BroadcastActionMessage(ctx, roomID, userName, JoinedMessage)
 }
 
@@ -114,24 +178,66 @@ func (service *RoomServiceImpl) BroadcastActionMessage(ctx context.Context, room
 	return nil
 }
 
-func (service *RoomServiceImpl) BroadcastTextMessage(ctx context.Context, roomID RoomID, userName string, payload string) error {
+// BroadcastTextMessage stores and publishes a text message. A message resent with the same
+// clientMsgID within the dedup window is ignored.
+func (service *RoomServiceImpl) BroadcastTextMessage(ctx context.Context, roomID RoomID, userName string, payload string, clientMsgID string) error {
+	msg := Message{
+		Event:       EventText,
+		RoomID:      roomID,
+		UserName:    userName,
+		Payload:     payload,
+		ClientMsgID: clientMsgID,
+	}
+	return service.broadcastStoredMessage(ctx, msg, nil)
+}
+
+// broadcastStoredMessage stores and publishes msg like a text message, prepare runs once the
+// message has its ID and time, before it is stored.
+func (service *RoomServiceImpl) broadcastStoredMessage(ctx context.Context, msg Message, prepare func(msg *Message) error) error {
+	claimed, err := service.dedup.Claim(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("error checking duplicate text message: %w", err)
+	}
+	if !claimed {
+		return nil
+	}
+	if err := service.saveMessage(ctx, &msg, prepare); err != nil {
+		if releaseErr := service.dedup.Release(ctx, msg); releaseErr != nil {
+			return fmt.Errorf("%w, error releasing client message ID: %w", err, releaseErr)
+		}
+		return err
+	}
+	if err := service.recordActivity(ctx, msg.RoomID); err != nil {
+		return err
+	}
+	if err := service.messagePublisher.PublishMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error broadcast text message, the outbox relay will retry: %w", err)
+	}
+	if err := service.messageRepo.DeleteOutbox(ctx, msg); err != nil {
+		return fmt.Errorf("error completing text message outbox record: %w", err)
+	}
+	return nil
+}
+
+func (service *RoomServiceImpl) saveMessage(ctx context.Context, msg *Message, prepare func(msg *Message) error) error {
 	messageID, err := service.snowFlake.NextID()
 	if err != nil {
 		return fmt.Errorf("error create snowflake ID for text message: %w", err)
 	}
-	msg := Message{
-		ID:       messageID,
-		Event:    EventText,
-		RoomID:   roomID,
-		UserName: userName,
-		Payload:  payload,
-		Time:     time.Now().UnixMilli(),
+	msg.ID = messageID
+	msg.Time = time.Now().UnixMilli()
+	if prepare != nil {
+		if err := prepare(msg); err != nil {
+			return err
+		}
 	}
-	if err := service.messageRepo.InesrtMessage(ctx, msg); err != nil {
-		return fmt.Errorf("error saving text message: %w", err)
+	retention, err := service.roomRetention(ctx, msg.RoomID)
+	if err != nil {
+		return err
 	}
-	if err := service.messagePublisher.PublishMessage(ctx, msg); err != nil {
-		return fmt.Errorf("error broadcast text message: %w", err)
+	// the outbox record makes the relay publish the message if the publish below fails
+	if err := service.messageRepo.InsertMessageWithOutbox(ctx, *msg, retention.TTL()); err != nil {
+		return fmt.Errorf("error saving text message: %w", err)
 	}
 	return nil
 }
@@ -187,13 +293,718 @@ func (service *RoomServiceImpl) HandleNewMessage(ctx context.Context, msg Messag
 	case EventAction:
 		return service.BroadcastActionMessage(ctx, msg.RoomID, msg.UserName, Action(msg.Payload))
 	case EventText:
-		return service.BroadcastTextMessage(ctx, msg.RoomID, msg.UserName, msg.Payload)
+		if len(msg.ClientMsgID) > maxClientMsgIDLength {
+			return common.ErrInvalidParam
+		}
+		if name, text, ok := parseCommand(msg.Payload); ok {
+			handled, err := service.runCommand(ctx, Command{msg.RoomID, msg.UserName, name, text})
+			if handled || err != nil {
+				return err
+			}
+		}
+		return service.BroadcastTextMessage(ctx, msg.RoomID, msg.UserName, msg.Payload, msg.ClientMsgID)
 	case EventSeen:
 		seenMessageID, err := strconv.ParseUint(msg.Payload, 10, 64)
 		if err != nil {
 			return err
 		}
 		return service.MarkSeen(ctx, msg.RoomID, msg.UserName, seenMessageID)
+	case EventPoll:
+		var dto PollDTO
+		if err := json.Unmarshal([]byte(msg.Payload), &dto); err != nil || !dto.isValid() || len(msg.ClientMsgID) > maxClientMsgIDLength {
+			return common.ErrInvalidParam
+		}
+		return service.StartPoll(ctx, msg.RoomID, msg.UserName, dto, msg.ClientMsgID)
+	case EventPollVote:
+		var vote PollVote
+		if err := json.Unmarshal([]byte(msg.Payload), &vote); err != nil {
+			return common.ErrInvalidParam
+		}
+		return service.VotePoll(ctx, msg.RoomID, msg.UserName, vote)
+	case EventPollClose:
+		var pollClose PollClose
+		if err := json.Unmarshal([]byte(msg.Payload), &pollClose); err != nil {
+			return common.ErrInvalidParam
+		}
+		return service.ClosePoll(ctx, msg.RoomID, msg.UserName, pollClose)
+	}
+	return nil
+}
+
+func (service *RoomServiceImpl) IsRoomOwner(ctx context.Context, roomID RoomID, ownerToken string) (bool, error) {
+	if ownerToken == "" {
+		return false, nil
+	}
+	ownerTokenHash, err := service.roomRepo.GetOwnerTokenHash(ctx, roomID)
+	if err != nil {
+		return false, fmt.Errorf("error checking room owner: %w", err)
+	}
+	// rooms created before owner tokens have no owner
+	if ownerTokenHash == "" {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(ownerTokenHash), []byte(hashToken(ownerToken))) == 1, nil
+}
+
+func (service *RoomServiceImpl) ExportTranscript(ctx context.Context, roomID RoomID, options ExportOptions, w io.Writer) error {
+	return ExportTranscript(ctx, service.messageRepo, roomID, options, w)
+}
+
+// GetHistory returns up to limit stored messages after afterID, or the latest ones when afterID is 0.
+func (service *RoomServiceImpl) GetHistory(ctx context.Context, roomID RoomID, afterID MessageID, limit int) ([]Message, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	limit = min(limit, maxHistoryLimit)
+	msgs := make([]Message, 0, limit)
+	if afterID > 0 {
+		err := service.messageRepo.ScanMessages(ctx, roomID, afterID+1, math.MaxInt64, func(msg Message) error {
+			msgs = append(msgs, msg)
+			if len(msgs) == limit {
+				return errHistoryFull
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errHistoryFull) {
+			return nil, fmt.Errorf("error getting room history: %w", err)
+		}
+		return msgs, nil
+	}
+	msgs, err := service.messageRepo.LatestMessages(ctx, roomID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting room history: %w", err)
+	}
+	return msgs, nil
+}
+
+// StartPoll stores and publishes the poll message, the poll ID is the message ID.
+func (service *RoomServiceImpl) StartPoll(ctx context.Context, roomID RoomID, userName string, dto PollDTO, clientMsgID string) error {
+	msg := Message{
+		Event:       EventPoll,
+		RoomID:      roomID,
+		UserName:    userName,
+		ClientMsgID: clientMsgID,
+	}
+	return service.broadcastStoredMessage(ctx, msg, func(msg *Message) error {
+		poll := Poll{ID: msg.ID, RoomID: roomID, Creator: userName, CreatedAt: msg.Time}
+		poll.FromDTO(dto)
+		if err := service.pollRepo.CreatePoll(ctx, poll); err != nil {
+			return fmt.Errorf("error creating poll: %w", err)
+		}
+		msg.Payload = poll.Encode()
+		return nil
+	})
+}
+
+// VotePoll records the vote and publishes the new votes. Votes for closed polls, invalid options
+// and second votes of users who may not change their vote are ignored.
+func (service *RoomServiceImpl) VotePoll(ctx context.Context, roomID RoomID, userName string, vote PollVote) error {
+	poll, err := service.pollRepo.GetPoll(ctx, roomID, vote.PollID)
+	if err != nil {
+		return fmt.Errorf("error getting poll: %w", err)
+	}
+	if poll == nil || poll.Closed || vote.Option < 0 || vote.Option >= len(poll.Options) {
+		return nil
+	}
+	changed, err := service.pollRepo.CastVote(ctx, *poll, userName, vote.Option)
+	if err != nil {
+		return fmt.Errorf("error casting poll vote: %w", err)
+	}
+	if !changed {
+		return nil
+	}
+	return service.publishPollResult(ctx, *poll)
+}
+
+// ClosePoll closes the poll of its creator, the stored poll message is updated with the final
+// votes so the history shows the results.
+func (service *RoomServiceImpl) ClosePoll(ctx context.Context, roomID RoomID, userName string, pollClose PollClose) error {
+	poll, err := service.pollRepo.GetPoll(ctx, roomID, pollClose.PollID)
+	if err != nil {
+		return fmt.Errorf("error getting poll: %w", err)
+	}
+	if poll == nil || poll.Creator != userName {
+		return nil
+	}
+	closed, err := service.pollRepo.ClosePoll(ctx, roomID, poll.ID)
+	if err != nil {
+		return fmt.Errorf("error closing poll: %w", err)
+	}
+	if !closed {
+		return nil
+	}
+	poll.Closed = true
+	return service.publishPollResult(ctx, *poll)
+}
+
+// publishPollResult broadcasts the poll with its current votes, a closed poll also keeps them in its poll message.
+func (service *RoomServiceImpl) publishPollResult(ctx context.Context, poll Poll) error {
+	votes, err := service.pollRepo.CountVotes(ctx, poll)
+	if err != nil {
+		return fmt.Errorf("error counting poll votes: %w", err)
+	}
+	poll.Votes = votes
+	if poll.Closed {
+		if err := service.savePollResult(ctx, poll); err != nil {
+			return err
+		}
+	}
+	messageID, err := service.snowFlake.NextID()
+	if err != nil {
+		return fmt.Errorf("error create snowflake ID for poll result message: %w", err)
+	}
+	msg := Message{
+		ID:       messageID,
+		Event:    EventPollResult,
+		RoomID:   poll.RoomID,
+		UserName: poll.Creator,
+		Payload:  poll.Encode(),
+		Time:     time.Now().UnixMilli(),
+	}
+	if err := service.messagePublisher.PublishMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error broadcast poll result message: %w", err)
+	}
+	return nil
+}
+
+// savePollResult stores the final votes in the poll message, its other fields are kept. A poll
+// message that expired or was trimmed is not written back.
+func (service *RoomServiceImpl) savePollResult(ctx context.Context, poll Poll) error {
+	pollMsg, err := service.getMessage(ctx, poll.RoomID, poll.ID)
+	if err != nil || pollMsg == nil {
+		return err
+	}
+	retention, err := service.roomRetention(ctx, poll.RoomID)
+	if err != nil {
+		return err
+	}
+	pollMsg.Payload = poll.Encode()
+	if err := service.messageRepo.UpsertMessages(ctx, []Message{*pollMsg}, retention.TTL()); err != nil {
+		return fmt.Errorf("error saving poll results: %w", err)
+	}
+	return nil
+}
+
+// PinMessage pins a stored message of the room and broadcasts the pin, it returns nil when the
+// room has no such message. Pinning a pinned message returns the existing pin.
+func (service *RoomServiceImpl) PinMessage(ctx context.Context, roomID RoomID, messageID MessageID) (*PinnedMessage, error) {
+	msg, err := service.getMessage(ctx, roomID, messageID)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	pins, err := service.ListPins(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if i := slices.IndexFunc(pins, func(pin PinnedMessage) bool { return pin.ID == messageID }); i >= 0 {
+		return &pins[i], nil
+	}
+	if len(pins) >= maxPinsPerRoom {
+		return nil, common.ErrTooManyPins
+	}
+	pin := Pin{RoomID: roomID, MessageID: messageID, PinnedAt: time.Now().UnixMilli()}
+	if err := service.pinRepo.PinMessage(ctx, pin); err != nil {
+		return nil, fmt.Errorf("error pinning message: %w", err)
+	}
+	// the count is checked again after the insert, a pin made meanwhile through another request
+	// can put the room over the limit and then the new pins are withdrawn
+	if pins, err = service.ListPins(ctx, roomID); err != nil {
+		return nil, err
+	}
+	if len(pins) > maxPinsPerRoom {
+		if _, err := service.pinRepo.UnpinMessage(ctx, roomID, messageID); err != nil {
+			return nil, fmt.Errorf("error unpinning message: %w", err)
+		}
+		return nil, common.ErrTooManyPins
+	}
+	pinned := &PinnedMessage{*msg, pin.PinnedAt}
+	payload, _ := json.Marshal(pinned)
+	if err := service.publishRoomEvent(ctx, roomID, EventPin, string(payload)); err != nil {
+		return nil, err
+	}
+	return pinned, nil
+}
+
+// UnpinMessage removes the pin and broadcasts it, the unpin payload is the message ID.
+func (service *RoomServiceImpl) UnpinMessage(ctx context.Context, roomID RoomID, messageID MessageID) (bool, error) {
+	unpinned, err := service.pinRepo.UnpinMessage(ctx, roomID, messageID)
+	if err != nil {
+		return false, fmt.Errorf("error unpinning message: %w", err)
+	}
+	if !unpinned {
+		return false, nil
+	}
+	return true, service.publishRoomEvent(ctx, roomID, EventUnpin, strconv.FormatUint(messageID, 10))
+}
+
+// ListPins returns the pinned messages still stored, in message order. The messages are read in
+// one query, pins of messages deleted by the retention are deleted.
+func (service *RoomServiceImpl) ListPins(ctx context.Context, roomID RoomID) ([]PinnedMessage, error) {
+	pins, err := service.pinRepo.ListPins(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing pins: %w", err)
+	}
+	messageIDs := make([]MessageID, len(pins))
+	for i, pin := range pins {
+		messageIDs[i] = pin.MessageID
+	}
+	msgs, err := service.messageRepo.GetMessages(ctx, roomID, messageIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error getting pinned messages: %w", err)
+	}
+	pinnedAt := make(map[MessageID]int64, len(pins))
+	for _, pin := range pins {
+		pinnedAt[pin.MessageID] = pin.PinnedAt
+	}
+	pinned := make([]PinnedMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		pinned = append(pinned, PinnedMessage{msg, pinnedAt[msg.ID]})
+		delete(pinnedAt, msg.ID)
+	}
+	for messageID := range pinnedAt {
+		if _, err := service.pinRepo.UnpinMessage(ctx, roomID, messageID); err != nil {
+			return nil, fmt.Errorf("error deleting pin of a deleted message: %w", err)
+		}
+	}
+	return pinned, nil
+}
+
+// RoomState returns the EventRoomState message sent to a session that joined the room.
+func (service *RoomServiceImpl) RoomState(ctx context.Context, roomID RoomID) (*Message, error) {
+	pins, err := service.ListPins(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	messageID, err := service.snowFlake.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create snowflake ID for room state message: %w", err)
+	}
+	payload, _ := json.Marshal(RoomState{Pins: pins})
+	return &Message{
+		ID:      messageID,
+		Event:   EventRoomState,
+		RoomID:  roomID,
+		Payload: string(payload),
+		Time:    time.Now().UnixMilli(),
+	}, nil
+}
+
+// getMessage returns the stored message, nil when it does not exist or expired.
+func (service *RoomServiceImpl) getMessage(ctx context.Context, roomID RoomID, messageID MessageID) (*Message, error) {
+	var found *Message
+	err := service.messageRepo.ScanMessages(ctx, roomID, messageID, messageID+1, func(msg Message) error {
+		found = &msg
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting message: %w", err)
+	}
+	return found, nil
+}
+
+// publishRoomEvent publishes a room event that is not stored.
+func (service *RoomServiceImpl) publishRoomEvent(ctx context.Context, roomID RoomID, event int, payload string) error {
+	messageID, err := service.snowFlake.NextID()
+	if err != nil {
+		return fmt.Errorf("error create snowflake ID for event message: %w", err)
+	}
+	msg := Message{
+		ID:      messageID,
+		Event:   event,
+		RoomID:  roomID,
+		Payload: payload,
+		Time:    time.Now().UnixMilli(),
+	}
+	if err := service.messagePublisher.PublishMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error broadcast event message: %w", err)
+	}
+	return nil
+}
+
+// runCommand posts the reply of a slash command, unknown commands are not handled and sent as text.
+func (service *RoomServiceImpl) runCommand(ctx context.Context, cmd Command) (bool, error) {
+	reply, handled, err := service.commands.Run(ctx, cmd)
+	if err != nil || !handled || reply.Text == "" {
+		return handled, err
+	}
+	return true, service.BroadcastTextMessage(ctx, cmd.RoomID, reply.UserName, reply.Text, "")
+}
+
+func (service *RoomServiceImpl) CreateWebhook(ctx context.Context, roomID RoomID, dto CreateWebhookDTO) (*WebhookPresenter, error) {
+	webhookID, err := service.snowFlake.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create snowflake ID for webhook: %w", err)
+	}
+	token, err := generateToken()
+	if err != nil {
+		return nil, fmt.Errorf("error creating webhook secret: %w", err)
+	}
+	webhook := Webhook{
+		ID:        webhookID,
+		RoomID:    roomID,
+		Kind:      dto.Kind,
+		Name:      dto.Name,
+		URL:       dto.URL,
+		Secret:    token,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if webhook.Kind == WebhookIncoming {
+		webhook.URL = ""
+		webhook.Secret = hashToken(token)
+	}
+	if err := service.webhooks.repo.CreateWebhook(ctx, webhook); err != nil {
+		return nil, fmt.Errorf("error creating webhook: %w", err)
+	}
+	service.webhooks.invalidate(roomID)
+	presenter := webhook.ToPresenter()
+	if webhook.Kind == WebhookIncoming {
+		presenter.URL = fmt.Sprintf("/api/rooms/%d/incoming/%s", roomID, token)
+	} else {
+		presenter.Secret = token
+	}
+	return presenter, nil
+}
+
+func (service *RoomServiceImpl) ListWebhooks(ctx context.Context, roomID RoomID) ([]*WebhookPresenter, error) {
+	webhooks, err := service.webhooks.repo.ListWebhooks(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing webhooks: %w", err)
+	}
+	presenters := make([]*WebhookPresenter, len(webhooks))
+	for i := range webhooks {
+		presenters[i] = webhooks[i].ToPresenter()
+	}
+	return presenters, nil
+}
+
+func (service *RoomServiceImpl) DeleteWebhook(ctx context.Context, roomID RoomID, webhookID WebhookID) (bool, error) {
+	deleted, err := service.webhooks.repo.DeleteWebhook(ctx, roomID, webhookID)
+	if err != nil {
+		return false, fmt.Errorf("error deleting webhook: %w", err)
+	}
+	service.webhooks.invalidate(roomID)
+	return deleted, nil
+}
+
+// PostIncomingMessage sends the text as the bot user of the incoming webhook with the token,
+// it reports false when the room has no such webhook.
+func (service *RoomServiceImpl) PostIncomingMessage(ctx context.Context, roomID RoomID, token string, dto IncomingMessageDTO) (bool, error) {
+	// not cached, a webhook created on another instance is usable right away
+	webhooks, err := service.webhooks.repo.ListWebhooks(ctx, roomID)
+	if err != nil {
+		return false, fmt.Errorf("error listing webhooks: %w", err)
+	}
+	tokenHash := hashToken(token)
+	for _, webhook := range webhooks {
+		if webhook.Kind == WebhookIncoming && subtle.ConstantTimeCompare([]byte(webhook.Secret), []byte(tokenHash)) == 1 {
+			return true, service.BroadcastTextMessage(ctx, roomID, webhook.Name, dto.Text, dto.ClientMsgID)
+		}
+	}
+	return false, nil
+}
+
+// ScheduleMessage stores a text message sent by the scheduler at dto.SendAt. Without an author
+// token a new one is created and returned, it is needed to list and cancel the message.
+func (service *RoomServiceImpl) ScheduleMessage(ctx context.Context, roomID RoomID, authorToken string, dto ScheduleMessageDTO) (*ScheduledMessagePresenter, error) {
+	scheduledID, err := service.snowFlake.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create snowflake ID for scheduled message: %w", err)
+	}
+	newToken := authorToken == ""
+	if newToken {
+		if authorToken, err = generateToken(); err != nil {
+			return nil, fmt.Errorf("error creating author token: %w", err)
+		}
+	}
+	msg := ScheduledMessage{
+		ID:              scheduledID,
+		RoomID:          roomID,
+		UserName:        dto.UserName,
+		Payload:         dto.Text,
+		DueAt:           dto.SendAt.UnixMilli(),
+		AuthorTokenHash: hashToken(authorToken),
+	}
+	if err := service.scheduleRepo.CreateScheduledMessage(ctx, msg); err != nil {
+		return nil, fmt.Errorf("error creating scheduled message: %w", err)
+	}
+	presenter := msg.ToPresenter()
+	if newToken {
+		presenter.AuthorToken = authorToken
+	}
+	return presenter, nil
+}
+
+// ListScheduledMessages returns the pending messages of the room scheduled with the author token.
+func (service *RoomServiceImpl) ListScheduledMessages(ctx context.Context, roomID RoomID, authorToken string) ([]*ScheduledMessagePresenter, error) {
+	msgs, err := service.authorScheduledMessages(ctx, roomID, authorToken)
+	if err != nil {
+		return nil, err
+	}
+	presenters := make([]*ScheduledMessagePresenter, len(msgs))
+	for i := range msgs {
+		presenters[i] = msgs[i].ToPresenter()
+	}
+	return presenters, nil
+}
+
+// CancelScheduledMessage reports false when the author has no such pending message.
+func (service *RoomServiceImpl) CancelScheduledMessage(ctx context.Context, roomID RoomID, scheduledID MessageID, authorToken string) (bool, error) {
+	msgs, err := service.authorScheduledMessages(ctx, roomID, authorToken)
+	if err != nil {
+		return false, err
+	}
+	for _, msg := range msgs {
+		if msg.ID != scheduledID {
+			continue
+		}
+		deleted, err := service.scheduleRepo.DeleteScheduledMessage(ctx, msg)
+		if err != nil {
+			return false, fmt.Errorf("error deleting scheduled message: %w", err)
+		}
+		return deleted, nil
+	}
+	return false, nil
+}
+
+func (service *RoomServiceImpl) authorScheduledMessages(ctx context.Context, roomID RoomID, authorToken string) ([]ScheduledMessage, error) {
+	msgs, err := service.scheduleRepo.ListScheduledMessages(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing scheduled messages: %w", err)
+	}
+	tokenHash := hashToken(authorToken)
+	return slices.DeleteFunc(msgs, func(msg ScheduledMessage) bool {
+		return subtle.ConstantTimeCompare([]byte(msg.AuthorTokenHash), []byte(tokenHash)) != 1
+	}), nil
+}
+
+// CreateInvite creates an invite to the room, its token is only returned here. It returns
+// common.ErrInvalidParam when the lifetime exceeds the maximum and common.ErrNoInvites when the
+// invite secret is not set.
+func (service *RoomServiceImpl) CreateInvite(ctx context.Context, roomID RoomID, dto CreateInviteDTO) (*InvitePresenter, error) {
+	if !service.inviteSigner.enabled() {
+		return nil, common.ErrNoInvites
+	}
+	ttl, ok := service.inviteSigner.ttl(dto)
+	if !ok {
+		return nil, common.ErrInvalidParam
+	}
+	inviteID, err := service.snowFlake.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create snowflake ID for invite: %w", err)
+	}
+	now := time.Now()
+	invite := Invite{
+		ID:        inviteID,
+		RoomID:    roomID,
+		SingleUse: dto.SingleUse,
+		ExpiresAt: now.Add(ttl).UnixMilli(),
+		CreatedAt: now.UnixMilli(),
+	}
+	if err := service.inviteRepo.CreateInvite(ctx, invite); err != nil {
+		return nil, fmt.Errorf("error creating invite: %w", err)
+	}
+	presenter := invite.ToPresenter()
+	presenter.Token = service.inviteSigner.sign(invite)
+	return presenter, nil
+}
+
+// ListInvites returns the invites of the room that did not expire.
+func (service *RoomServiceImpl) ListInvites(ctx context.Context, roomID RoomID) ([]*InvitePresenter, error) {
+	invites, err := service.inviteRepo.ListInvites(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing invites: %w", err)
+	}
+	now := time.Now().UnixMilli()
+	presenters := make([]*InvitePresenter, 0, len(invites))
+	for i := range invites {
+		if invites[i].ExpiresAt > now {
+			presenters = append(presenters, invites[i].ToPresenter())
+		}
+	}
+	return presenters, nil
+}
+
+func (service *RoomServiceImpl) RevokeInvite(ctx context.Context, roomID RoomID, inviteID InviteID) (bool, error) {
+	revoked, err := service.inviteRepo.DeleteInvite(ctx, roomID, inviteID)
+	if err != nil {
+		return false, fmt.Errorf("error revoking invite: %w", err)
+	}
+	return revoked, nil
+}
+
+// RedeemInvite reports whether the token is a valid invite to the room, a single use invite is
+// used up by it. It returns common.ErrNoInvites when the invite secret is not set.
+func (service *RoomServiceImpl) RedeemInvite(ctx context.Context, roomID RoomID, token string) (bool, error) {
+	if !service.inviteSigner.enabled() {
+		return false, common.ErrNoInvites
+	}
+	inviteID, ok := service.inviteSigner.verify(roomID, token, time.Now())
+	if !ok {
+		return false, nil
+	}
+	invite, err := service.inviteRepo.GetInvite(ctx, roomID, inviteID)
+	if err != nil {
+		return false, fmt.Errorf("error getting invite: %w", err)
+	}
+	if invite == nil || invite.Used {
+		return false, nil
+	}
+	if !invite.SingleUse {
+		return true, nil
+	}
+	used, err := service.inviteRepo.UseInvite(ctx, *invite)
+	if err != nil {
+		return false, fmt.Errorf("error using invite: %w", err)
+	}
+	return used, nil
+}
+
+func (service *RoomServiceImpl) RoomVisibility(ctx context.Context, roomID RoomID) (string, error) {
+	visibility, err := service.roomRepo.GetVisibility(ctx, roomID)
+	if err != nil {
+		return "", fmt.Errorf("error getting room visibility: %w", err)
+	}
+	return visibility, nil
+}
+
+// ListPublicRooms returns the public rooms with an ID below beforeID, newest first.
+func (service *RoomServiceImpl) ListPublicRooms(ctx context.Context, beforeID RoomID, limit int) ([]*RoomPresenter, error) {
+	if limit <= 0 {
+		limit = defaultRoomsLimit
+	}
+	rooms, err := service.roomRepo.ListPublicRooms(ctx, beforeID, min(limit, maxRoomsLimit))
+	if err != nil {
+		return nil, fmt.Errorf("error listing public rooms: %w", err)
+	}
+	presenters := make([]*RoomPresenter, len(rooms))
+	for i := range rooms {
+		presenters[i] = rooms[i].ToPresenter()
+	}
+	return presenters, nil
+}
+
+// RoomMember returns the member of the room with the member token, nil when there is none or
+// their join request is pending.
+func (service *RoomServiceImpl) RoomMember(ctx context.Context, roomID RoomID, memberToken string) (*Member, error) {
+	if memberToken == "" {
+		return nil, nil
+	}
+	tokenHash := hashToken(memberToken)
+	member, err := service.memberRepo.GetMemberByToken(ctx, roomID, tokenHash)
+	if err != nil {
+		return nil, fmt.Errorf("error getting room member: %w", err)
+	}
+	if member == nil || member.Status != MemberActive || subtle.ConstantTimeCompare([]byte(member.TokenHash), []byte(tokenHash)) != 1 {
+		return nil, nil
+	}
+	return member, nil
+}
+
+// RequestToJoin stores a join request to a private room, the returned member token joins the room
+// once the owner approved it. The request expires after joinRequestTTL, so an unapproved request
+// holds the user name for a limited time. It returns common.ErrNotPrivate for other rooms and
+// common.ErrMemberExists when the user already is a member or has a pending request.
+func (service *RoomServiceImpl) RequestToJoin(ctx context.Context, roomID RoomID, userName string) (*MemberPresenter, error) {
+	return service.storeMember(ctx, roomID, userName, MemberPending)
+}
+
+// AddMember adds the user to the members of a private room, replacing their join request or
+// previous member token. It returns common.ErrNotPrivate for other rooms.
+func (service *RoomServiceImpl) AddMember(ctx context.Context, roomID RoomID, userName string) (*MemberPresenter, error) {
+	return service.storeMember(ctx, roomID, userName, MemberActive)
+}
+
+func (service *RoomServiceImpl) storeMember(ctx context.Context, roomID RoomID, userName string, status string) (*MemberPresenter, error) {
+	visibility, err := service.RoomVisibility(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if visibility != VisibilityPrivate {
+		return nil, common.ErrNotPrivate
+	}
+	token, err := generateToken()
+	if err != nil {
+		return nil, fmt.Errorf("error creating member token: %w", err)
+	}
+	now := time.Now()
+	member := Member{
+		RoomID:    roomID,
+		UserName:  userName,
+		Status:    status,
+		TokenHash: hashToken(token),
+		CreatedAt: now.UnixMilli(),
+	}
+	if status == MemberPending {
+		member.ExpiresAt = now.Add(joinRequestTTL).UnixMilli()
+		requested, err := service.memberRepo.RequestMembership(ctx, member)
+		if err != nil {
+			return nil, fmt.Errorf("error requesting membership: %w", err)
+		}
+		if !requested {
+			return nil, common.ErrMemberExists
+		}
+	} else if err := service.memberRepo.AddMember(ctx, member); err != nil {
+		return nil, fmt.Errorf("error adding member: %w", err)
+	}
+	presenter := member.ToPresenter()
+	presenter.MemberToken = token
+	return presenter, nil
+}
+
+// ListMembers returns the members or the pending join requests of the room.
+func (service *RoomServiceImpl) ListMembers(ctx context.Context, roomID RoomID, status string) ([]*MemberPresenter, error) {
+	members, err := service.memberRepo.ListMembers(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing room members: %w", err)
+	}
+	presenters := make([]*MemberPresenter, 0, len(members))
+	for i := range members {
+		if members[i].Status == status {
+			presenters = append(presenters, members[i].ToPresenter())
+		}
+	}
+	return presenters, nil
+}
+
+func (service *RoomServiceImpl) ApproveJoinRequest(ctx context.Context, roomID RoomID, userName string) (bool, error) {
+	approved, err := service.memberRepo.ApproveMember(ctx, roomID, userName)
+	if err != nil {
+		return false, fmt.Errorf("error approving join request: %w", err)
+	}
+	return approved, nil
+}
+
+// RemoveMember deletes the member or rejects the join request with the status. The sessions a
+// removed member has open stay in the room until they leave.
+func (service *RoomServiceImpl) RemoveMember(ctx context.Context, roomID RoomID, userName string, status string) (bool, error) {
+	removed, err := service.memberRepo.DeleteMember(ctx, roomID, userName, status)
+	if err != nil {
+		return false, fmt.Errorf("error removing member: %w", err)
+	}
+	return removed, nil
+}
+
+func (service *RoomServiceImpl) roomRetention(ctx context.Context, roomID RoomID) (Retention, error) {
+	now := time.Now()
+	if retention, ok := service.roomCache.retention(roomID, now); ok {
+		return retention, nil
+	}
+	retention, err := service.roomRepo.GetRetention(ctx, roomID)
+	if err != nil {
+		return Retention{}, fmt.Errorf("error getting room retention: %w", err)
+	}
+	service.roomCache.setRetention(roomID, retention, now)
+	return retention, nil
+}
+
+// recordActivity updates the room last activity used to expire inactive rooms, at most once per cache expiry.
+func (service *RoomServiceImpl) recordActivity(ctx context.Context, roomID RoomID) error {
+	now := time.Now()
+	if !service.roomCache.shouldRecordActivity(roomID, now) {
+		return nil
+	}
+	if err := service.roomRepo.TouchRoom(ctx, roomID, now.UnixMilli()); err != nil {
+		return fmt.Errorf("error recording room activity: %w", err)
 	}
 	return nil
 }
@@ -211,3 +1022,19 @@ func validPassword(roomPassword, password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(roomPassword), []byte(password))
 	return err == nil
 }
+
+// generateToken returns a random url safe token with 256 bits of entropy.
+func generateToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// hashToken hashes random tokens before they are stored, unlike passwords they have enough
+// entropy to not need a slow hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
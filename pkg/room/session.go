@@ -0,0 +1,236 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/omran95/chatroom/pkg/common"
+)
+
+// Session is a client of a room, connected through a websocket, an SSE stream or long polling.
+// The room join, authentication and message handling only see this interface.
+type Session interface {
+	RoomID() RoomID
+	UserName() string
+	// ContentType is the format of the messages written to the session
+	ContentType() string
+	// Write hands an encoded message to the transport, which reports it to SendQueues.Sent once it
+	// reached the client
+	Write(data []byte) error
+	// Close ends the session with a websocket close code and reason
+	Close(code int, reason string) error
+	// Joined reports whether the session passed the room password check and joined the room
+	Joined() bool
+	setJoined()
+}
+
+// sessionState is embedded by the transports for the parts every session shares.
+type sessionState struct {
+	roomID   RoomID
+	userName string
+	joined   atomic.Bool
+}
+
+func (state *sessionState) RoomID() RoomID {
+	return state.roomID
+}
+
+func (state *sessionState) UserName() string {
+	return state.userName
+}
+
+func (state *sessionState) Joined() bool {
+	return state.joined.Load()
+}
+
+func (state *sessionState) setJoined() {
+	state.joined.Store(true)
+}
+
+// SessionHandler joins, authenticates and leaves the room for the sessions of every transport.
+type SessionHandler struct {
+	logger        common.HttpLog
+	roomService   RoomService
+	msgSubscriber RoomMessageSubscriber
+	sessions      *RoomSessions
+}
+
+func NewSessionHandler(logger common.HttpLog, roomService RoomService, msgSubscriber RoomMessageSubscriber, sessions *RoomSessions) *SessionHandler {
+	return &SessionHandler{logger, roomService, msgSubscriber, sessions}
+}
+
+// joinCredentials are the join query parameters admitting a session to private and protected rooms.
+type joinCredentials struct {
+	// inviteToken joins a protected room without the password
+	inviteToken string
+	// memberToken is required to join a private room
+	memberToken string
+}
+
+func joinCredentialsOf(query url.Values) joinCredentials {
+	return joinCredentials{inviteToken: query.Get("invite"), memberToken: query.Get("member")}
+}
+
+// openSession joins the room right away, or asks for the password of a protected room first.
+// Private rooms only admit their members, an invite token of a protected room joins it without the password.
+func (handler *SessionHandler) openSession(sess Session, credentials joinCredentials) {
+	handler.sessions.Open(sess)
+	visibility, err := handler.roomService.RoomVisibility(context.Background(), sess.RoomID())
+	if err != nil {
+		sess.Close(500, "Error checking the room visibility: "+err.Error())
+		return
+	}
+	if visibility == VisibilityPrivate {
+		member, err := handler.roomService.RoomMember(context.Background(), sess.RoomID(), credentials.memberToken)
+		if err != nil {
+			sess.Close(500, "Error: "+err.Error())
+			return
+		}
+		if member == nil || member.UserName != sess.UserName() {
+			sess.Close(403, "Not a room member")
+			return
+		}
+	}
+	isProtectedRoom, err := handler.roomService.IsRoomProtected(context.Background(), sess.RoomID())
+	if err != nil {
+		sess.Close(500, "Error checking if the room is protected: "+err.Error())
+		return
+	}
+	if !isProtectedRoom {
+		handler.joinRoom(sess)
+		return
+	}
+	if credentials.inviteToken != "" {
+		handler.redeemInvite(sess, credentials.inviteToken)
+		return
+	}
+	handler.sendAuthRequiredMessage(sess)
+}
+
+func (handler *SessionHandler) redeemInvite(sess Session, inviteToken string) {
+	validInvite, err := handler.roomService.RedeemInvite(context.Background(), sess.RoomID(), inviteToken)
+	if errors.Is(err, common.ErrNoInvites) {
+		sess.Close(501, "Error: "+err.Error())
+		return
+	}
+	if err != nil {
+		sess.Close(500, "Error: "+err.Error())
+		return
+	}
+	if !validInvite {
+		sess.Close(400, "Invalid invite")
+		return
+	}
+	handler.joinRoom(sess)
+}
+
+func (handler *SessionHandler) leaveRoom(sess Session) error {
+	// sessions closed before passing the password check never joined
+	if !sess.Joined() {
+		handler.sessions.Discard(sess)
+		return nil
+	}
+	roomID, userName := sess.RoomID(), sess.UserName()
+	handler.msgSubscriber.LeaveRoom(roomID, sess)
+	err := handler.roomService.RemoveRoomSubscriber(context.Background(), roomID, userName)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		return err
+	}
+	if err := handler.roomService.BroadcastLeaveMessage(context.Background(), roomID, userName); err != nil {
+		handler.logger.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (handler *SessionHandler) handleMessage(sess Session, contentType string, msg []byte) {
+	if !sess.Joined() {
+		handler.authenticateRoom(sess, contentType, msg)
+		return
+	}
+	decodedMsg, err := DecodeMessage(contentType, msg)
+	if err != nil {
+		sess.Close(400, "Invalid message")
+		return
+	}
+	handler.sendMessage(sess, *decodedMsg)
+}
+
+// sendMessage handles a message of a joined session, the room and user name are the session ones.
+func (handler *SessionHandler) sendMessage(sess Session, msg Message) {
+	msg.RoomID = sess.RoomID()
+	msg.UserName = sess.UserName()
+	err := handler.roomService.HandleNewMessage(context.Background(), msg)
+
+	if err != nil {
+		handler.logger.Error(err.Error())
+	}
+}
+
+func (handler *SessionHandler) authenticateRoom(sess Session, contentType string, msg []byte) {
+	password, err := extractPassword(contentType, msg)
+
+	if err != nil || password == "" {
+		sess.Close(400, "Invalid password")
+		return
+
+	}
+	validPassword, err := handler.roomService.IsValidPassword(context.Background(), sess.RoomID(), password)
+	if err != nil {
+		sess.Close(500, "Error: "+err.Error())
+		return
+	}
+	if !validPassword {
+		sess.Close(400, "Invalid password")
+		return
+	}
+	handler.joinRoom(sess)
+}
+
+func (handler *SessionHandler) sendAuthRequiredMessage(sess Session) {
+	handler.sessions.SendData(sess, []byte("This room is protected, please enter the password"))
+}
+
+func (handler *SessionHandler) joinRoom(sess Session) {
+	err := handler.initializeChatSession(sess)
+	if err != nil {
+		sess.Close(500, "Error: "+err.Error())
+		return
+	}
+
+	// the session already receives the room messages, the room state follows the ones sent meanwhile
+	state, err := handler.roomService.RoomState(context.Background(), sess.RoomID())
+	if err != nil {
+		sess.Close(500, "Error: "+err.Error())
+		return
+	}
+	handler.sessions.Send(sess, state)
+
+	if err := handler.roomService.BroadcastConnectMessage(context.Background(), sess.RoomID(), sess.UserName()); err != nil {
+		sess.Close(500, "Error: "+err.Error())
+		return
+	}
+}
+
+func (handler *SessionHandler) initializeChatSession(sess Session) error {
+	ctx := context.Background()
+	if err := handler.roomService.AddRoomSubscriber(ctx, sess.RoomID(), sess.UserName(), handler.msgSubscriber.Topic()); err != nil {
+		return err
+	}
+	if err := handler.msgSubscriber.JoinRoom(sess.RoomID(), sess); err != nil {
+		return err
+	}
+	sess.setJoined()
+	return nil
+}
+
+func extractPassword(contentType string, msg []byte) (string, error) {
+	auth, err := decodeRoomAuth(contentType, msg)
+	if err != nil {
+		return "", err
+	}
+	return auth.Password, nil
+}
@@ -0,0 +1,140 @@
+package room
+
+import "sync"
+
+// roomSessionShards spreads the rooms over independently locked shards,
+// so joins and broadcasts of different rooms rarely wait for each other.
+const roomSessionShards = 64
+
+// RoomSessions indexes the websocket sessions of this instance by room,
+// so a room message is written only to the sessions of that room.
+type RoomSessions struct {
+	shards     [roomSessionShards]roomSessionShard
+	sendQueues *SendQueues
+}
+
+type roomSessionShard struct {
+	mu    sync.RWMutex
+	rooms map[RoomID]map[Session]struct{}
+}
+
+func NewRoomSessions(sendQueues *SendQueues) *RoomSessions {
+	sessions := &RoomSessions{sendQueues: sendQueues}
+	for i := range sessions.shards {
+		sessions.shards[i].rooms = make(map[RoomID]map[Session]struct{})
+	}
+	return sessions
+}
+
+func (sessions *RoomSessions) shard(roomID RoomID) *roomSessionShard {
+	// snowflake IDs end with the machine ID, mix the bits before picking a shard
+	roomID ^= roomID >> 33
+	roomID *= 0xff51afd7ed558ccd
+	roomID ^= roomID >> 33
+	return &sessions.shards[roomID%roomSessionShards]
+}
+
+// Open opens the send queue of a session that did not join its room yet, e.g. to ask for the password.
+func (sessions *RoomSessions) Open(sess Session) {
+	sessions.sendQueues.open(sess)
+}
+
+// Discard closes the send queue of a session that leaves without having joined its room.
+func (sessions *RoomSessions) Discard(sess Session) {
+	sessions.sendQueues.close(sess)
+}
+
+// Add opens the session send queue and reports whether sess is the first session of the room on this instance.
+func (sessions *RoomSessions) Add(roomID RoomID, sess Session) (first bool) {
+	sessions.sendQueues.open(sess)
+	shard := sessions.shard(roomID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	room, ok := shard.rooms[roomID]
+	if !ok {
+		room = make(map[Session]struct{})
+		shard.rooms[roomID] = room
+	}
+	room[sess] = struct{}{}
+	return !ok
+}
+
+// Remove reports whether sess was the last session of the room on this instance.
+func (sessions *RoomSessions) Remove(roomID RoomID, sess Session) (last bool) {
+	shard := sessions.shard(roomID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	room, ok := shard.rooms[roomID]
+	if !ok {
+		return false
+	}
+	if _, ok := room[sess]; !ok {
+		return false
+	}
+	delete(room, sess)
+	sessions.sendQueues.close(sess)
+	if len(room) > 0 {
+		return false
+	}
+	delete(shard.rooms, roomID)
+	return true
+}
+
+// HasRoom reports whether the room has sessions on this instance.
+func (sessions *RoomSessions) HasRoom(roomID RoomID) bool {
+	shard := sessions.shard(roomID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return len(shard.rooms[roomID]) > 0
+}
+
+// Sessions returns a snapshot of the room sessions.
+func (sessions *RoomSessions) Sessions(roomID RoomID) []Session {
+	shard := sessions.shard(roomID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	room := shard.rooms[roomID]
+	result := make([]Session, 0, len(room))
+	for sess := range room {
+		result = append(result, sess)
+	}
+	return result
+}
+
+// Broadcast queues msg on every session of the room. data is msg already encoded in contentType,
+// or nil. The sends happen on a snapshot, so a full queue never holds the shard lock against
+// joins and leaves.
+func (sessions *RoomSessions) Broadcast(msg *Message, contentType string, data []byte) {
+	encoded := &encodedMessage{msg: msg, encodings: make(map[string][]byte, 2)}
+	if data != nil {
+		encoded.encodings[contentType] = data
+	}
+	for _, sess := range sessions.Sessions(msg.RoomID) {
+		sessions.sendQueues.send(sess, encoded)
+	}
+}
+
+// Send queues msg on one session, e.g. the room state after it joined.
+func (sessions *RoomSessions) Send(sess Session, msg *Message) {
+	sessions.sendQueues.send(sess, &encodedMessage{msg: msg, encodings: make(map[string][]byte, 1)})
+}
+
+// SendData queues data on one session, the transports write nothing to a session past its queue.
+func (sessions *RoomSessions) SendData(sess Session, data []byte) {
+	sessions.sendQueues.sendData(sess, data)
+}
+
+// encodedMessage encodes a broadcast message at most once per websocket format.
+type encodedMessage struct {
+	msg       *Message
+	encodings map[string][]byte
+}
+
+func (encoded *encodedMessage) as(contentType string) []byte {
+	data, ok := encoded.encodings[contentType]
+	if !ok {
+		data = encoded.msg.EncodeAs(contentType)
+		encoded.encodings[contentType] = data
+	}
+	return data
+}
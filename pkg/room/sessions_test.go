@@ -0,0 +1,104 @@
+package room
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// discardSession drops what is written to it, the benchmarks report the writes sent themselves.
+type discardSession struct {
+	sessionState
+}
+
+func (sess *discardSession) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (sess *discardSession) Write(data []byte) error {
+	return nil
+}
+
+func (sess *discardSession) Close(code int, reason string) error {
+	return nil
+}
+
+// broadcastFilter is the scan BroadcastFilter did before the index, it checks the room of every
+// session of the instance.
+func broadcastFilter(all []Session, queues *SendQueues, msg *Message) {
+	encoded := &encodedMessage{msg: msg, encodings: make(map[string][]byte, 2)}
+	for _, sess := range all {
+		if sess.RoomID() == msg.RoomID {
+			queues.send(sess, encoded)
+		}
+	}
+}
+
+// BenchmarkBroadcast writes a message to a room of roomSize sessions on an instance with the given
+// number of sessions, by scanning every session and through the room index.
+func BenchmarkBroadcast(b *testing.B) {
+	const roomSize = 10
+	for _, total := range []int{1000, 20000} {
+		cfg := newTestConfig(b)
+		queues := newTestSendQueues(b, cfg)
+		sessions := NewRoomSessions(queues)
+		all := make([]Session, 0, total)
+		for i := 0; i < total; i++ {
+			roomID := RoomID(i / roomSize)
+			sess := &discardSession{sessionState{roomID: roomID}}
+			sessions.Add(roomID, sess)
+			all = append(all, sess)
+		}
+		paths := []struct {
+			name      string
+			broadcast func(msg *Message)
+		}{
+			{"filter", func(msg *Message) { broadcastFilter(all, queues, msg) }},
+			{"index", func(msg *Message) { sessions.Broadcast(msg, "", nil) }},
+		}
+		var id uint64
+		for _, path := range paths {
+			b.Run(fmt.Sprintf("%s/sessions=%d", path.name, total), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					id++
+					roomID := RoomID(i % (total / roomSize))
+					path.broadcast(&Message{ID: id, RoomID: roomID, Event: EventText, Payload: "hello, room"})
+					for _, sess := range all[int(roomID)*roomSize : int(roomID+1)*roomSize] {
+						queues.Sent(sess)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRoomSessionsBroadcastOnlyToRoom(t *testing.T) {
+	queues := newTestSendQueues(t, newTestConfig(t))
+	sessions := NewRoomSessions(queues)
+	member := newTestSession(1, "member", queues)
+	other := newTestSession(2, "other", queues)
+	if !sessions.Add(1, member) || !sessions.Add(2, other) {
+		t.Fatal("first session of a room not reported")
+	}
+	// the redelivered message is dropped by the session dedup
+	sessions.Broadcast(&Message{ID: 1, RoomID: 1, Event: EventText, Payload: "first"}, "", nil)
+	sessions.Broadcast(&Message{ID: 1, RoomID: 1, Event: EventText, Payload: "first"}, "", nil)
+	sessions.Broadcast(&Message{ID: 2, RoomID: 2, Event: EventText, Payload: "second"}, "", nil)
+	sessions.Broadcast(&Message{ID: 3, RoomID: 1, Event: EventText, Payload: "third"}, "", nil)
+	for _, want := range []struct {
+		sess    *testSession
+		payload string
+	}{{member, "first"}, {member, "third"}, {other, "second"}} {
+		select {
+		case data := <-want.sess.received:
+			if msg, err := DecodeMessage(ContentTypeJSON, data); err != nil || msg.Payload != want.payload {
+				t.Fatalf("%s got %q, want %s: %v", want.sess.UserName(), data, want.payload, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not get %s", want.sess.UserName(), want.payload)
+		}
+	}
+	if !sessions.Remove(1, member) || sessions.HasRoom(1) {
+		t.Fatal("last session of a room not removed")
+	}
+}
@@ -0,0 +1,84 @@
+package room
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/omran95/chatroom/pkg/infrastructure"
+)
+
+//go:embed migrations/sql/*.sql
+var sqlMigrations embed.FS
+
+//go:embed migrations/cql/*.cql
+var cqlMigrations embed.FS
+
+// Storage holds the repositories of the storage driver selected in config.
+type Storage struct {
+	RoomRepo             RoomRepo
+	MessageRepo          MessageRepo
+	WebhookRepo          WebhookRepo
+	PollRepo             PollRepo
+	PinRepo              PinRepo
+	ScheduledMessageRepo ScheduledMessageRepo
+	InviteRepo           InviteRepo
+	MemberRepo           MemberRepo
+}
+
+func NewStorage(config *config.Config) (*Storage, error) {
+	switch config.Storage.Driver {
+	case infrastructure.CassandraDriver:
+		session, err := infrastructure.NewCassandraSession(config)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCassandraSchema(config, session); err != nil {
+			return nil, err
+		}
+		outboxTTL := time.Duration(config.Room.Outbox.LookbackHour) * time.Hour
+		scheduleLookback := time.Duration(config.Room.Scheduler.LookbackHour) * time.Hour
+		return &Storage{NewRoomRepo(session), NewMessageRepo(session, outboxTTL), NewWebhookRepo(session), NewPollRepo(session), NewPinRepo(session), NewScheduledMessageRepo(session, scheduleLookback), NewInviteRepo(session), NewMemberRepo(session)}, nil
+	case infrastructure.SQLiteDriver, infrastructure.PostgresDriver:
+		db, err := infrastructure.NewSQLDB(config)
+		if err != nil {
+			return nil, err
+		}
+		migrations, _ := fs.Sub(sqlMigrations, "migrations/sql")
+		if err := infrastructure.MigrateSQL(context.Background(), db, migrations); err != nil {
+			return nil, err
+		}
+		return &Storage{NewSQLRoomRepo(db), NewSQLMessageRepo(db), NewSQLWebhookRepo(db), NewSQLPollRepo(db), NewSQLPinRepo(db), NewSQLScheduledMessageRepo(db), NewSQLInviteRepo(db), NewSQLMemberRepo(db)}, nil
+	}
+	return nil, fmt.Errorf("unknown storage driver: %s", config.Storage.Driver)
+}
+
+// NewCassandraMigrator creates a migrator for the room keyspace migrations.
+func NewCassandraMigrator(config *config.Config, session *gocql.Session) (*infrastructure.CassandraMigrator, error) {
+	migrationsDir, _ := fs.Sub(cqlMigrations, "migrations/cql")
+	migrations, err := infrastructure.LoadCassandraMigrations(migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	return infrastructure.NewCassandraMigrator(session, config.Cassandra.Keyspace, migrations), nil
+}
+
+// checkCassandraSchema refuses to start the room service on a keyspace with pending migrations.
+func checkCassandraSchema(config *config.Config, session *gocql.Session) error {
+	migrator, err := NewCassandraMigrator(config, session)
+	if err != nil {
+		return err
+	}
+	pending, err := migrator.Pending(context.Background())
+	if err != nil {
+		return fmt.Errorf("error checking cassandra schema: %w", err)
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("cassandra keyspace %s has %d pending migrations, run the migrate up command first", config.Cassandra.Keyspace, len(pending))
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package room
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/omran95/chatroom/pkg/infrastructure"
+)
+
+// newTestStorage creates the repositories on a migrated sqlite database of the test.
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	cfg := &config.Config{Storage: &config.StorageConfig{Driver: infrastructure.SQLiteDriver}}
+	cfg.Storage.SQL.DSN = filepath.Join(t.TempDir(), "room.db")
+	storage, err := NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestEmbeddedCassandraMigrations(t *testing.T) {
+	migrationsDir, err := fs.Sub(cqlMigrations, "migrations/cql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := infrastructure.LoadCassandraMigrations(migrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Fatalf("migration %s has version %d, want %d", migration.Name, migration.Version, i+1)
+		}
+		if len(migration.Statements) == 0 {
+			t.Fatalf("migration %s has no statements", migration.Name)
+		}
+		for _, stmt := range migration.Statements {
+			if strings.Contains(stmt, "--") {
+				t.Fatalf("migration %s kept a comment in %q", migration.Name, stmt)
+			}
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package room
 
 import (
+	"github.com/go-kit/kit/endpoint"
 	"github.com/omran95/chatroom/pkg/config"
 	"github.com/omran95/chatroom/pkg/infrastructure"
+	subscriberpb "github.com/omran95/chatroom/pkg/subscriber/proto"
 	"google.golang.org/grpc"
 )
 
@@ -20,3 +22,17 @@ func NewSubscriberGrpcClient(config *config.Config) (*SubscriberGrpcClient, erro
 	}
 	return SubscriberConn, nil
 }
+
+// SubscriberEndpoints are the subscriber service calls used by the room service,
+// requests and responses are the subscriber protobuf messages.
+type SubscriberEndpoints struct {
+	AddRoomSubscriber    endpoint.Endpoint
+	RemoveRoomSubscriber endpoint.Endpoint
+}
+
+func NewSubscriberEndpoints(subscriberClient *SubscriberGrpcClient) SubscriberEndpoints {
+	return SubscriberEndpoints{
+		AddRoomSubscriber:    infrastructure.NewGrpcEndpoint(subscriberClient.Conn, "subscriber", "proto.SubscriberService", "AddRoomSubscriber", &subscriberpb.AddRoomSubscriberResponse{}),
+		RemoveRoomSubscriber: infrastructure.NewGrpcEndpoint(subscriberClient.Conn, "subscriber", "proto.SubscriberService", "RemoveRoomSubscriber", &subscriberpb.RemoveRoomSubscriberResponse{}),
+	}
+}
@@ -0,0 +1,345 @@
+package room
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/omran95/chatroom/pkg/common"
+)
+
+// The fallback transports serve the clients behind proxies blocking websocket upgrades.
+// SSE streams the messages of an open request, long polling returns them on the next poll,
+// and both send messages with POST requests carrying the session ID.
+
+const (
+	transportSSE  = "sse"
+	transportPoll = "poll"
+)
+
+// maxFallbackMessageBytes bounds the body of a message sent through the fallback transports.
+const maxFallbackMessageBytes = 64 << 10
+
+var errSessionClosed = errors.New("session closed")
+
+// fallbackSession buffers the messages written to it until the SSE stream or the next poll takes them.
+type fallbackSession struct {
+	sessionState
+	id        string
+	transport string
+
+	mu       sync.Mutex
+	messages [][]byte
+	// offset counts the messages dropped before messages[0], polled is the number of leading
+	// messages returned by the last poll
+	offset      uint64
+	polled      int
+	ready       chan struct{}
+	done        chan struct{}
+	closed      bool
+	closeCode   int
+	closeReason string
+	idle        *time.Timer
+}
+
+func newFallbackSession(roomID RoomID, userName string, transport string) (*fallbackSession, error) {
+	id, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	return &fallbackSession{
+		sessionState: sessionState{roomID: roomID, userName: userName},
+		id:           id,
+		transport:    transport,
+		ready:        make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}, nil
+}
+
+// ContentType is always JSON, SSE is a text format and the poll responses are newline delimited.
+func (sess *fallbackSession) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (sess *fallbackSession) Write(data []byte) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return errSessionClosed
+	}
+	sess.messages = append(sess.messages, data)
+	select {
+	case sess.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (sess *fallbackSession) Close(code int, reason string) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return nil
+	}
+	sess.closed = true
+	sess.closeCode, sess.closeReason = code, reason
+	close(sess.done)
+	return nil
+}
+
+// take returns the buffered messages, and whether the session was closed.
+func (sess *fallbackSession) take() ([][]byte, bool) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	messages := sess.messages
+	sess.messages = nil
+	return messages, sess.closed
+}
+
+// ack drops the messages before offset, the clients acknowledge the offset of the last poll they got.
+// Clients sending no offset acknowledge the messages of the last poll. It returns the number of dropped messages.
+func (sess *fallbackSession) ack(offset uint64, acknowledged bool) int {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	acked := sess.polled
+	if acknowledged {
+		acked = int(min(max(offset, sess.offset)-sess.offset, uint64(len(sess.messages))))
+	}
+	sess.messages = sess.messages[acked:]
+	sess.offset += uint64(acked)
+	sess.polled = 0
+	return acked
+}
+
+// peek returns the buffered messages without dropping them, the offset after them and whether
+// the session was closed.
+func (sess *fallbackSession) peek() ([][]byte, uint64, bool) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	n := len(sess.messages)
+	return sess.messages[:n:n], sess.offset + uint64(n), sess.closed
+}
+
+// setPolled records that the first n messages were returned to a poll.
+func (sess *fallbackSession) setPolled(n int) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.polled = n
+}
+
+func (sess *fallbackSession) closeStatus() (closed bool, code int, reason string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.closed, sess.closeCode, sess.closeReason
+}
+
+// StreamRoomEvents opens an SSE session. The first event carries the session ID for sending messages,
+// then every message is a "message" event with the same payload a websocket client gets.
+func (server *HttpServer) StreamRoomEvents(c *gin.Context) {
+	sess, ok := server.createFallbackSession(c, transportSSE)
+	if !ok {
+		return
+	}
+	defer server.endFallbackSession(sess)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("session", gin.H{"session_id": sess.id})
+	c.Writer.Flush()
+	server.sessionHandler.openSession(sess, joinCredentialsOf(c.Request.URL.Query()))
+
+	keepAlive := time.NewTicker(server.fallbackKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-keepAlive.C:
+			io.WriteString(c.Writer, ": keep-alive\n\n")
+			c.Writer.Flush()
+		case <-sess.ready:
+		case <-sess.done:
+		}
+		messages, closed := sess.take()
+		for _, data := range messages {
+			c.SSEvent("message", string(data))
+		}
+		if closed {
+			_, code, reason := sess.closeStatus()
+			c.SSEvent("close", gin.H{"code": code, "reason": reason})
+		}
+		c.Writer.Flush()
+		for range messages {
+			server.sendQueues.Sent(sess)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// CreatePollSession opens a long polling session, it is closed when it is not polled for a while.
+func (server *HttpServer) CreatePollSession(c *gin.Context) {
+	sess, ok := server.createFallbackSession(c, transportPoll)
+	if !ok {
+		return
+	}
+	sess.idle = time.AfterFunc(server.fallbackSessionIdle, func() {
+		server.endFallbackSession(sess)
+	})
+	server.sessionHandler.openSession(sess, joinCredentialsOf(c.Request.URL.Query()))
+	c.JSON(http.StatusCreated, gin.H{"session_id": sess.id})
+}
+
+// PollMessages waits for messages of a long polling session and returns them one per line,
+// or 204 when none arrived before the poll timeout. The messages are kept until a poll acknowledges
+// their offset, so a client that lost a response gets the same messages again.
+func (server *HttpServer) PollMessages(c *gin.Context) {
+	sess, ok := server.getFallbackSession(c)
+	if !ok {
+		return
+	}
+	if sess.transport != transportPoll {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	sess.idle.Stop()
+	defer sess.idle.Reset(server.fallbackSessionIdle)
+
+	var ackOffset uint64
+	ack := c.Query("ack")
+	if ack != "" {
+		var err error
+		if ackOffset, err = strconv.ParseUint(ack, 10, 64); err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+	}
+	for acked := sess.ack(ackOffset, ack != ""); acked > 0; acked-- {
+		server.sendQueues.Sent(sess)
+	}
+	timeout := time.NewTimer(server.fallbackPollTimeout)
+	defer timeout.Stop()
+	messages, offset, closed := sess.peek()
+	for len(messages) == 0 && !closed {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-timeout.C:
+			c.Status(http.StatusNoContent)
+			return
+		case <-sess.ready:
+		case <-sess.done:
+		}
+		messages, offset, closed = sess.peek()
+	}
+	if len(messages) == 0 {
+		_, _, reason := sess.closeStatus()
+		server.endFallbackSession(sess)
+		response(c, http.StatusGone, errors.New(reason))
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("X-Poll-Offset", strconv.FormatUint(offset, 10))
+	c.Status(http.StatusOK)
+	for _, data := range messages {
+		c.Writer.Write(data)
+		c.Writer.Write([]byte("\n"))
+	}
+	sess.setPolled(len(messages))
+}
+
+// SendSessionMessage handles a message sent by an SSE or long polling session, the body is the
+// password of a protected room first, then the messages, like on the websocket.
+func (server *HttpServer) SendSessionMessage(c *gin.Context) {
+	sess, ok := server.getFallbackSession(c)
+	if !ok {
+		return
+	}
+	msg, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxFallbackMessageBytes))
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	server.sessionHandler.handleMessage(sess, ContentTypeJSON, msg)
+	if closed, _, reason := sess.closeStatus(); closed {
+		response(c, http.StatusGone, errors.New(reason))
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+func (server *HttpServer) LeaveSession(c *gin.Context) {
+	sess, ok := server.getFallbackSession(c)
+	if !ok {
+		return
+	}
+	server.endFallbackSession(sess)
+	c.Status(http.StatusNoContent)
+}
+
+func (server *HttpServer) createFallbackSession(c *gin.Context, transport string) (*fallbackSession, bool) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	userName := c.Query("userName")
+	if err != nil || userName == "" {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return nil, false
+	}
+	exist, err := server.roomService.RoomExist(c, roomID)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return nil, false
+	}
+	if !exist {
+		response(c, http.StatusNotFound, common.ErrRoomNotFound)
+		return nil, false
+	}
+	sess, err := newFallbackSession(roomID, userName, transport)
+	if err != nil {
+		server.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return nil, false
+	}
+	server.fallbackSessions.Store(sess.id, sess)
+	return sess, true
+}
+
+func (server *HttpServer) getFallbackSession(c *gin.Context) (*fallbackSession, bool) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return nil, false
+	}
+	value, ok := server.fallbackSessions.Load(c.Param("session"))
+	if !ok || value.(*fallbackSession).RoomID() != roomID {
+		response(c, http.StatusNotFound, common.ErrNoSession)
+		return nil, false
+	}
+	return value.(*fallbackSession), true
+}
+
+// endFallbackSession closes the session and leaves the room, once.
+func (server *HttpServer) endFallbackSession(sess *fallbackSession) {
+	if _, ok := server.fallbackSessions.LoadAndDelete(sess.id); !ok {
+		return
+	}
+	if sess.idle != nil {
+		sess.idle.Stop()
+	}
+	sess.Close(1000, "")
+	server.sessionHandler.leaveRoom(sess)
+}
+
+// closeFallbackSessions ends the open SSE streams, the server shutdown waits for their requests.
+func (server *HttpServer) closeFallbackSessions() {
+	server.fallbackSessions.Range(func(key, value any) bool {
+		value.(*fallbackSession).Close(1001, "server shutting down")
+		return true
+	})
+}
@@ -0,0 +1,48 @@
+package room
+
+import "testing"
+
+// poll acknowledges like PollMessages and returns the messages of the poll with their offset.
+func poll(sess *fallbackSession, ack uint64, acknowledged bool) ([]string, uint64) {
+	sess.ack(ack, acknowledged)
+	messages, offset, _ := sess.peek()
+	sess.setPolled(len(messages))
+	var result []string
+	for _, data := range messages {
+		result = append(result, string(data))
+	}
+	return result, offset
+}
+
+func TestFallbackSessionKeepsMessagesUntilAcknowledged(t *testing.T) {
+	sess, err := newFallbackSession(1, "alice", transportPoll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Write([]byte("first"))
+	sess.Write([]byte("second"))
+	messages, offset := poll(sess, 0, true)
+	if len(messages) != 2 || offset != 2 {
+		t.Fatalf("first poll got %q at offset %d", messages, offset)
+	}
+
+	// the response of the first poll was lost, the retry acknowledges the offset before it
+	sess.Write([]byte("third"))
+	messages, offset = poll(sess, 0, true)
+	if len(messages) != 3 || messages[0] != "first" || offset != 3 {
+		t.Fatalf("retry got %q at offset %d, want the 3 messages", messages, offset)
+	}
+	messages, offset = poll(sess, 3, true)
+	if len(messages) != 0 || offset != 3 {
+		t.Fatalf("poll after acknowledging everything got %q at offset %d", messages, offset)
+	}
+
+	// clients sending no offset acknowledge the messages of their last poll
+	sess.Write([]byte("fourth"))
+	if messages, _ = poll(sess, 0, false); len(messages) != 1 {
+		t.Fatalf("got %q, want [fourth]", messages)
+	}
+	if messages, offset = poll(sess, 0, false); len(messages) != 0 || offset != 4 {
+		t.Fatalf("got %q at offset %d after the implicit acknowledgement", messages, offset)
+	}
+}
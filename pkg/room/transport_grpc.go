@@ -0,0 +1,94 @@
+package room
+
+import (
+	"sync"
+
+	roompb "github.com/omran95/chatroom/pkg/room/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcSession is a Chat stream, the stream handler sends the messages written to it.
+type grpcSession struct {
+	sessionState
+
+	mu sync.Mutex
+	// messages holds the messages to send, the send queue keeps at most sendWindow of them in flight
+	messages    []*roompb.Message
+	ready       chan struct{}
+	done        chan struct{}
+	closed      bool
+	closeCode   int
+	closeReason string
+}
+
+func newGrpcSession(roomID RoomID, userName string) *grpcSession {
+	return &grpcSession{
+		sessionState: sessionState{roomID: roomID, userName: userName},
+		ready:        make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+func (sess *grpcSession) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (sess *grpcSession) Write(data []byte) error {
+	var pb roompb.Message
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return err
+	}
+	// the send queue calls Write under its lock, it never waits for the stream
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return errSessionClosed
+	}
+	sess.messages = append(sess.messages, &pb)
+	select {
+	case sess.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// take returns the messages written since the last call.
+func (sess *grpcSession) take() []*roompb.Message {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	messages := sess.messages
+	sess.messages = nil
+	return messages
+}
+
+func (sess *grpcSession) Close(code int, reason string) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return nil
+	}
+	sess.closed = true
+	sess.closeCode, sess.closeReason = code, reason
+	close(sess.done)
+	return nil
+}
+
+// status converts the close code of the session to the status ending the Chat stream.
+func (sess *grpcSession) status() error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	switch sess.closeCode {
+	case 1000:
+		return nil
+	case 400:
+		return status.Error(codes.InvalidArgument, sess.closeReason)
+	case 1001:
+		return status.Error(codes.Unavailable, sess.closeReason)
+	case closeSlowConsumer:
+		return status.Error(codes.ResourceExhausted, sess.closeReason)
+	default:
+		return status.Error(codes.Internal, sess.closeReason)
+	}
+}
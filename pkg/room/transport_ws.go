@@ -0,0 +1,50 @@
+package room
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/olahol/melody"
+)
+
+var wsSessionKey = "session"
+
+// wsSession is a websocket session, melody writes the messages from its write pump.
+type wsSession struct {
+	sessionState
+	sess        *melody.Session
+	contentType string
+}
+
+func newWsSession(sess *melody.Session) *wsSession {
+	userName := sess.Request.URL.Query().Get("userName")
+	// path e.g. /api/rooms/:roomID
+	pathParts := strings.Split(sess.Request.URL.Path, "/")
+	roomID, _ := strconv.ParseUint(pathParts[len(pathParts)-1], 10, 64)
+	return &wsSession{
+		sessionState: sessionState{roomID: roomID, userName: userName},
+		sess:         sess,
+		contentType:  sessionContentType(sess.Request),
+	}
+}
+
+// wsSessionOf returns the session created for sess on connect.
+func wsSessionOf(sess *melody.Session) *wsSession {
+	return sess.MustGet(wsSessionKey).(*wsSession)
+}
+
+func (sess *wsSession) ContentType() string {
+	return sess.contentType
+}
+
+// Write sends protobuf sessions binary frames and JSON sessions text frames.
+func (sess *wsSession) Write(data []byte) error {
+	if sess.contentType == ContentTypeProtobuf {
+		return sess.sess.WriteBinary(data)
+	}
+	return sess.sess.Write(data)
+}
+
+func (sess *wsSession) Close(code int, reason string) error {
+	return sess.sess.CloseWithMsg(melody.FormatCloseMessage(code, reason))
+}
@@ -10,6 +10,22 @@ func decodeToMessage(data []byte) (*Message, error) {
 	return &msg, nil
 }
 
+// BatchMetadataKey marks a broker message carrying several room messages encoded by EncodeBatch.
+var BatchMetadataKey = "batch"
+
+func EncodeBatch(msgs []Message) []byte {
+	result, _ := json.Marshal(msgs)
+	return result
+}
+
+func decodeBatch(data []byte) ([]Message, error) {
+	var msgs []Message
+	if err := json.Unmarshal(data, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
 func decodeToRoomAuth(data []byte) (*RoomAuth, error) {
 	var auth RoomAuth
 	if err := json.Unmarshal(data, &auth); err != nil {
@@ -0,0 +1,457 @@
+package room
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/omran95/chatroom/pkg/infrastructure"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Webhooks plug bots into rooms. Outgoing webhooks get a signed POST for every room message,
+// incoming webhooks post messages to the room as their bot user, and command webhooks answer
+// the slash commands of their name.
+
+type WebhookID = uint64
+
+const (
+	WebhookOutgoing = "outgoing"
+	WebhookIncoming = "incoming"
+	WebhookCommand  = "command"
+)
+
+const (
+	WebhookSignatureHeader = "X-Chat-Signature"
+	WebhookTimestampHeader = "X-Chat-Timestamp"
+	WebhookIDHeader        = "X-Chat-Webhook-Id"
+)
+
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+const maxBotNameLength = 64
+
+type Webhook struct {
+	ID     WebhookID
+	RoomID RoomID
+	Kind   string
+	// Name is the bot user name of incoming webhooks and the command name of command webhooks
+	Name string
+	URL  string
+	// Secret signs the requests to outgoing and command webhooks, it is the token hash of incoming webhooks
+	Secret    string
+	CreatedAt int64
+}
+
+type CreateWebhookDTO struct {
+	Kind string `json:"kind" binding:"required"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+func (dto *CreateWebhookDTO) isValid() bool {
+	switch dto.Kind {
+	case WebhookOutgoing:
+		return validWebhookURL(dto.URL)
+	case WebhookIncoming:
+		return dto.Name != "" && len(dto.Name) <= maxBotNameLength
+	case WebhookCommand:
+		return commandNamePattern.MatchString(dto.Name) && validWebhookURL(dto.URL)
+	}
+	return false
+}
+
+func validWebhookURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+type WebhookPresenter struct {
+	ID   WebhookID `json:"webhook_id"`
+	Kind string    `json:"kind"`
+	Name string    `json:"name,omitempty"`
+	// URL is the path to post to for incoming webhooks, it is only returned on creation
+	URL string `json:"url,omitempty"`
+	// Secret signs the requests to outgoing and command webhooks, it is only returned on creation
+	Secret    string `json:"secret,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func (webhook *Webhook) ToPresenter() *WebhookPresenter {
+	return &WebhookPresenter{
+		ID:        webhook.ID,
+		Kind:      webhook.Kind,
+		Name:      webhook.Name,
+		URL:       webhook.URL,
+		CreatedAt: webhook.CreatedAt,
+	}
+}
+
+// IncomingMessageDTO is posted to an incoming webhook.
+type IncomingMessageDTO struct {
+	Text        string `json:"text" binding:"required"`
+	ClientMsgID string `json:"client_msg_id"`
+}
+
+// signWebhookPayload signs "<timestamp>.<body>" with HMAC-SHA256, receivers recompute it with the
+// webhook secret and reject old timestamps against replays.
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook sends body as a signed JSON POST to webhook and returns the response body on 2xx.
+func postWebhook(ctx context.Context, client *http.Client, webhook Webhook, body []byte, maxResponseBytes int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, signWebhookPayload(webhook.Secret, timestamp, body))
+	req.Header.Set(WebhookIDHeader, strconv.FormatUint(webhook.ID, 10))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("webhook %d responded %d", webhook.ID, resp.StatusCode)
+	}
+	return respBody, nil
+}
+
+// WebhookCache keeps the webhooks of a room for a while, they are looked up for every room message.
+// Changes made on other instances are seen once the entry expires.
+type WebhookCache struct {
+	repo   WebhookRepo
+	expiry time.Duration
+
+	mu          sync.Mutex
+	rooms       map[RoomID]cachedWebhooks
+	lastEvicted time.Time
+}
+
+type cachedWebhooks struct {
+	webhooks  []Webhook
+	expiresAt time.Time
+}
+
+func NewWebhookCache(config *config.Config, repo WebhookRepo) *WebhookCache {
+	return &WebhookCache{
+		repo:   repo,
+		expiry: time.Duration(config.Room.Webhook.CacheSecond) * time.Second,
+		rooms:  make(map[RoomID]cachedWebhooks),
+	}
+}
+
+func (cache *WebhookCache) get(ctx context.Context, roomID RoomID) ([]Webhook, error) {
+	now := time.Now()
+	cache.mu.Lock()
+	cached, ok := cache.rooms[roomID]
+	cache.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.webhooks, nil
+	}
+	webhooks, err := cache.repo.ListWebhooks(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing room webhooks: %w", err)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if now.Sub(cache.lastEvicted) >= cache.expiry {
+		cache.lastEvicted = now
+		for id, cached := range cache.rooms {
+			if now.After(cached.expiresAt) {
+				delete(cache.rooms, id)
+			}
+		}
+	}
+	cache.rooms[roomID] = cachedWebhooks{webhooks, now.Add(cache.expiry)}
+	return webhooks, nil
+}
+
+// invalidate drops the room entry after a change made on this instance.
+func (cache *WebhookCache) invalidate(roomID RoomID) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.rooms, roomID)
+}
+
+// WebhookSubscriber consumes the room messages for the outgoing webhooks.
+type WebhookSubscriber interface {
+	message.Subscriber
+}
+
+// NewKafkaWebhookSubscriber joins the consumer group shared by the room instances, so every
+// message is delivered by one of them.
+func NewKafkaWebhookSubscriber(config *config.Config) (WebhookSubscriber, error) {
+	return infrastructure.NewKafkaGroupSubscriber(config, config.Room.Webhook.ConsumerGroup)
+}
+
+func NewGoChannelWebhookSubscriber(goChannel *gochannel.GoChannel) WebhookSubscriber {
+	return goChannel
+}
+
+// WebhookTopics are the topics the room messages are published to.
+type WebhookTopics []string
+
+func NewWebhookTopics() WebhookTopics {
+	return WebhookTopics{MessagePubTopic}
+}
+
+// NewDirectWebhookTopics returns the room partition topics of the direct mode.
+func NewDirectWebhookTopics(config *config.Config) WebhookTopics {
+	topics := make(WebhookTopics, config.Room.DirectFanout.Partitions)
+	for i := range topics {
+		topics[i] = RoomPartitionTopicPrefix + strconv.Itoa(i)
+	}
+	return topics
+}
+
+// maxWebhookResponseBytes bounds the response bodies read from the webhooks.
+const maxWebhookResponseBytes = 64 << 10
+
+// newWebhookClient returns the client posting to the webhooks. Unless allowPrivate, it refuses to
+// connect to private, loopback, link-local (e.g. the 169.254.169.254 metadata service) and other
+// non public addresses, checked on the resolved address of every connection so a DNS name cannot
+// point it at the internal network. Proxies are not used, they would connect on its behalf.
+func newWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = refusePrivateAddress
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+	}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, not reachable from the internet either.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() || sharedAddressSpace.Contains(addr) {
+		return fmt.Errorf("%w: %s", errWebhookAddressRefused, addr)
+	}
+	return nil
+}
+
+var errWebhookAddressRefused = errors.New("webhook address not allowed")
+
+// WebhookDispatcher posts the room messages to the outgoing webhooks of their room. Typing events
+// are not delivered. Every webhook has its own queue and worker, so a slow or failing webhook only
+// delays its own deliveries. A failed delivery is retried, then dropped, and messages that do not
+// fit in the queue of a webhook are dropped.
+type WebhookDispatcher struct {
+	subscriber WebhookSubscriber
+	topics     WebhookTopics
+	webhooks   *WebhookCache
+	client     *http.Client
+	retries    int
+	queueSize  int
+	logger     common.HttpLog
+	deliveries *prometheus.CounterVec
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+
+	mu     sync.Mutex
+	queues map[WebhookID]*webhookQueue
+}
+
+// webhookQueue holds the message bodies waiting for the worker of a webhook.
+type webhookQueue struct {
+	webhook Webhook
+	bodies  chan []byte
+}
+
+// webhookQueueIdle is how long the worker of a webhook without messages is kept.
+const webhookQueueIdle = time.Minute
+
+func NewWebhookDispatcher(name string, config *config.Config, logger common.HttpLog, subscriber WebhookSubscriber, topics WebhookTopics, webhooks *WebhookCache) (*WebhookDispatcher, error) {
+	webhookConfig := config.Room.Webhook
+	if webhookConfig.QueueSize <= 0 {
+		return nil, fmt.Errorf("invalid webhook queue size: %d", webhookConfig.QueueSize)
+	}
+	return &WebhookDispatcher{
+		subscriber: subscriber,
+		topics:     topics,
+		webhooks:   webhooks,
+		client:     newWebhookClient(time.Duration(webhookConfig.TimeoutMilliSecond)*time.Millisecond, webhookConfig.AllowPrivateNetworks),
+		retries:    webhookConfig.Retries,
+		queueSize:  webhookConfig.QueueSize,
+		logger:     logger,
+		deliveries: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: name,
+			Name:      "webhook_deliveries_total",
+			Help:      "Room messages posted to outgoing webhooks, by result.",
+		}, []string{"result"}),
+		queues: make(map[WebhookID]*webhookQueue),
+	}, nil
+}
+
+func (dispatcher *WebhookDispatcher) Run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatcher.cancel = cancel
+	for _, topic := range dispatcher.topics {
+		messages, err := dispatcher.subscriber.Subscribe(ctx, topic)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("error subscribing to %s: %w", topic, err)
+		}
+		dispatcher.wg.Add(1)
+		go func() {
+			defer dispatcher.wg.Done()
+			// the channel is closed once the context is canceled
+			for msg := range messages {
+				dispatcher.dispatch(ctx, msg)
+				msg.Ack()
+			}
+		}()
+	}
+	return nil
+}
+
+func (dispatcher *WebhookDispatcher) GracefulStop() error {
+	if dispatcher.cancel == nil {
+		return nil
+	}
+	dispatcher.cancel()
+	dispatcher.wg.Wait()
+	return dispatcher.subscriber.Close()
+}
+
+// dispatch queues the messages to the outgoing webhooks of their room, it never waits for a delivery.
+func (dispatcher *WebhookDispatcher) dispatch(ctx context.Context, brokerMsg *message.Message) {
+	msgs, err := DecodeBrokerMessage(brokerMsg)
+	if err != nil {
+		dispatcher.logger.Error("webhook dispatcher: " + err.Error())
+		return
+	}
+	for _, msg := range msgs {
+		if msg.isTyping() {
+			continue
+		}
+		webhooks, err := dispatcher.webhooks.get(ctx, msg.RoomID)
+		if err != nil {
+			dispatcher.logger.Error("webhook dispatcher: " + err.Error())
+			continue
+		}
+		body := msg.Encode()
+		for _, webhook := range webhooks {
+			if webhook.Kind == WebhookOutgoing {
+				dispatcher.enqueue(ctx, webhook, body)
+			}
+		}
+	}
+}
+
+func (dispatcher *WebhookDispatcher) enqueue(ctx context.Context, webhook Webhook, body []byte) {
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	queue, ok := dispatcher.queues[webhook.ID]
+	if !ok {
+		queue = &webhookQueue{webhook: webhook, bodies: make(chan []byte, dispatcher.queueSize)}
+		dispatcher.queues[webhook.ID] = queue
+		dispatcher.wg.Add(1)
+		go dispatcher.work(ctx, queue)
+	}
+	select {
+	case queue.bodies <- body:
+	default:
+		dispatcher.deliveries.WithLabelValues("dropped").Inc()
+		dispatcher.logger.Warn(fmt.Sprintf("webhook %d queue is full, message dropped", webhook.ID))
+	}
+}
+
+// work delivers the messages of a webhook in order, it stops once the webhook got no message for
+// webhookQueueIdle.
+func (dispatcher *WebhookDispatcher) work(ctx context.Context, queue *webhookQueue) {
+	defer dispatcher.wg.Done()
+	idle := time.NewTicker(webhookQueueIdle)
+	defer idle.Stop()
+	active := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case body := <-queue.bodies:
+			dispatcher.deliver(ctx, queue.webhook, body)
+			active = true
+		case <-idle.C:
+			if active {
+				active = false
+				continue
+			}
+			dispatcher.mu.Lock()
+			if len(queue.bodies) == 0 {
+				delete(dispatcher.queues, queue.webhook.ID)
+				dispatcher.mu.Unlock()
+				return
+			}
+			dispatcher.mu.Unlock()
+		}
+	}
+}
+
+func (dispatcher *WebhookDispatcher) deliver(ctx context.Context, webhook Webhook, body []byte) {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		_, err := postWebhook(ctx, dispatcher.client, webhook, body, maxWebhookResponseBytes)
+		if err == nil {
+			dispatcher.deliveries.WithLabelValues("success").Inc()
+			return
+		}
+		if attempt == dispatcher.retries || ctx.Err() != nil || errors.Is(err, errWebhookAddressRefused) {
+			dispatcher.deliveries.WithLabelValues("failure").Inc()
+			dispatcher.logger.Error("webhook delivery: " + err.Error())
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
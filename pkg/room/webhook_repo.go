@@ -0,0 +1,59 @@
+package room
+
+import (
+	"context"
+
+	"github.com/gocql/gocql"
+)
+
+type WebhookRepo interface {
+	CreateWebhook(ctx context.Context, webhook Webhook) error
+	ListWebhooks(ctx context.Context, roomID RoomID) ([]Webhook, error)
+	// DeleteWebhook reports whether the webhook existed
+	DeleteWebhook(ctx context.Context, roomID RoomID, webhookID WebhookID) (bool, error)
+	DeleteRoomWebhooks(ctx context.Context, roomID RoomID) error
+}
+
+type WebhookRepoImpl struct {
+	cassandraSession *gocql.Session
+}
+
+func NewWebhookRepo(cassandraSession *gocql.Session) *WebhookRepoImpl {
+	return &WebhookRepoImpl{cassandraSession}
+}
+
+func (repo *WebhookRepoImpl) CreateWebhook(ctx context.Context, webhook Webhook) error {
+	query := "insert into webhooks (room_id, id, kind, name, url, secret, created_at) values (?, ?, ?, ?, ?, ?, ?)"
+	return repo.cassandraSession.Query(query, webhook.RoomID, webhook.ID, webhook.Kind, webhook.Name, webhook.URL, webhook.Secret, webhook.CreatedAt).WithContext(ctx).Exec()
+}
+
+func (repo *WebhookRepoImpl) ListWebhooks(ctx context.Context, roomID RoomID) ([]Webhook, error) {
+	query := "select room_id, id, kind, name, url, secret, created_at from webhooks where room_id = ?"
+	iter := repo.cassandraSession.Query(query, roomID).WithContext(ctx).Idempotent(true).Iter()
+	var webhooks []Webhook
+	var webhook Webhook
+	for iter.Scan(&webhook.RoomID, &webhook.ID, &webhook.Kind, &webhook.Name, &webhook.URL, &webhook.Secret, &webhook.CreatedAt) {
+		webhooks = append(webhooks, webhook)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (repo *WebhookRepoImpl) DeleteWebhook(ctx context.Context, roomID RoomID, webhookID WebhookID) (bool, error) {
+	var id WebhookID
+	err := repo.cassandraSession.Query("select id from webhooks where room_id = ? and id = ?", roomID, webhookID).WithContext(ctx).Idempotent(true).Scan(&id)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = repo.cassandraSession.Query("delete from webhooks where room_id = ? and id = ?", roomID, webhookID).WithContext(ctx).Idempotent(true).Exec()
+	return err == nil, err
+}
+
+func (repo *WebhookRepoImpl) DeleteRoomWebhooks(ctx context.Context, roomID RoomID) error {
+	return repo.cassandraSession.Query("delete from webhooks where room_id = ?", roomID).WithContext(ctx).Idempotent(true).Exec()
+}
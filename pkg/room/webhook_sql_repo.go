@@ -0,0 +1,52 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+)
+
+type SQLWebhookRepoImpl struct {
+	db *sql.DB
+}
+
+func NewSQLWebhookRepo(db *sql.DB) *SQLWebhookRepoImpl {
+	return &SQLWebhookRepoImpl{db}
+}
+
+func (repo *SQLWebhookRepoImpl) CreateWebhook(ctx context.Context, webhook Webhook) error {
+	query := "INSERT INTO webhooks (room_id, id, kind, name, url, secret, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	_, err := repo.db.ExecContext(ctx, query, webhook.RoomID, webhook.ID, webhook.Kind, webhook.Name, webhook.URL, webhook.Secret, webhook.CreatedAt)
+	return err
+}
+
+func (repo *SQLWebhookRepoImpl) ListWebhooks(ctx context.Context, roomID RoomID) ([]Webhook, error) {
+	query := "SELECT room_id, id, kind, name, url, secret, created_at FROM webhooks WHERE room_id = $1 ORDER BY id"
+	rows, err := repo.db.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var webhooks []Webhook
+	for rows.Next() {
+		var webhook Webhook
+		if err := rows.Scan(&webhook.RoomID, &webhook.ID, &webhook.Kind, &webhook.Name, &webhook.URL, &webhook.Secret, &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (repo *SQLWebhookRepoImpl) DeleteWebhook(ctx context.Context, roomID RoomID, webhookID WebhookID) (bool, error) {
+	result, err := repo.db.ExecContext(ctx, "DELETE FROM webhooks WHERE room_id = $1 AND id = $2", roomID, webhookID)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (repo *SQLWebhookRepoImpl) DeleteRoomWebhooks(ctx context.Context, roomID RoomID) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM webhooks WHERE room_id = $1", roomID)
+	return err
+}
@@ -0,0 +1,161 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRefusePrivateAddress(t *testing.T) {
+	for _, test := range []struct {
+		address string
+		refused bool
+	}{
+		{"127.0.0.1:80", true},
+		{"10.1.2.3:443", true},
+		{"172.16.0.1:443", true},
+		{"192.168.1.1:80", true},
+		{"169.254.169.254:80", true},
+		{"100.64.0.1:80", true},
+		{"0.0.0.0:80", true},
+		{"[::1]:80", true},
+		{"[fd00::1]:80", true},
+		{"[fe80::1]:80", true},
+		{"[::ffff:127.0.0.1]:80", true},
+		{"93.184.215.14:443", false},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", false},
+	} {
+		err := refusePrivateAddress("tcp", test.address, nil)
+		if refused := errors.Is(err, errWebhookAddressRefused); refused != test.refused {
+			t.Errorf("%s: got %v, want refused %v", test.address, err, test.refused)
+		}
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddress(t *testing.T) {
+	var posted atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { posted.Add(1) }))
+	defer server.Close()
+	webhook := Webhook{ID: 1, URL: server.URL, Secret: "secret"}
+
+	_, err := postWebhook(context.Background(), newWebhookClient(time.Second, false), webhook, []byte("{}"), maxWebhookResponseBytes)
+	if !errors.Is(err, errWebhookAddressRefused) || posted.Load() != 0 {
+		t.Fatalf("post to %s: %v", server.URL, err)
+	}
+	// a metadata service URL is refused the same way, whatever name points at it
+	webhook.URL = "http://169.254.169.254/latest/meta-data/"
+	if _, err := postWebhook(context.Background(), newWebhookClient(time.Second, false), webhook, []byte("{}"), maxWebhookResponseBytes); !errors.Is(err, errWebhookAddressRefused) {
+		t.Fatalf("post to the metadata service: %v", err)
+	}
+	if _, err := postWebhook(context.Background(), newWebhookClient(time.Second, true), Webhook{ID: 1, URL: server.URL}, []byte("{}"), maxWebhookResponseBytes); err != nil || posted.Load() != 1 {
+		t.Fatalf("post with private networks allowed: %v", err)
+	}
+}
+
+func TestWebhookDispatcherIsolatesSlowWebhooks(t *testing.T) {
+	const roomID, sent = RoomID(7), 10
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer slow.Close()
+	defer close(release)
+	fast := make(chan string, sent)
+	fastServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, err := DecodeMessage(ContentTypeJSON, readAll(t, r))
+		if err != nil {
+			t.Error(err)
+		}
+		fast <- msg.Payload
+	}))
+	defer fastServer.Close()
+
+	cfg := newTestConfig(t)
+	cfg.Room.Webhook.AllowPrivateNetworks = true
+	cfg.Room.Webhook.QueueSize = 2
+	cfg.Room.Webhook.TimeoutMilliSecond = 60_000
+	storage := newTestStorage(t)
+	for i, url := range []string{slow.URL, fastServer.URL} {
+		if err := storage.WebhookRepo.CreateWebhook(context.Background(), Webhook{ID: WebhookID(i + 1), RoomID: roomID, Kind: WebhookOutgoing, URL: url}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// publishing waits for the ack, which the dispatcher gives without waiting for the deliveries
+	pubSub := gochannel.NewGoChannel(gochannel.Config{BlockPublishUntilSubscriberAck: true}, watermill.NopLogger{})
+	dispatcher, err := NewWebhookDispatcher("test"+strconv.FormatInt(testInstanceSeq.Add(1), 10), cfg, testLogger, pubSub, NewWebhookTopics(), NewWebhookCache(cfg, storage.WebhookRepo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dispatcher.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer dispatcher.GracefulStop()
+
+	// the fast webhook gets every message while the slow one holds its first delivery
+	for i := 0; i < sent; i++ {
+		msg := Message{ID: uint64(i + 1), RoomID: roomID, Event: EventText, UserName: "alice", Payload: "message " + strconv.Itoa(i)}
+		if err := pubSub.Publish(MessagePubTopic, NewBrokerMessage(watermill.NewUUID(), ContentTypeJSON, msg)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case payload := <-fast:
+			if payload != msg.Payload {
+				t.Fatalf("got %q, want %q", payload, msg.Payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d not delivered to the fast webhook", i)
+		}
+	}
+	// the slow webhook has a message in flight and 2 queued, or 2 queued when its worker had not
+	// taken the first one yet, the others were dropped
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var metric dto.Metric
+		dispatcher.deliveries.WithLabelValues("dropped").Write(&metric)
+		dropped := int(metric.GetCounter().GetValue())
+		if dropped == sent-3 || dropped == sent-2 {
+			break
+		}
+		if dropped > sent-2 || time.Now().After(deadline) {
+			t.Fatalf("dropped %d messages, want %d or %d", dropped, sent-3, sent-2)
+		}
+	}
+}
+
+func readAll(t *testing.T, r *http.Request) []byte {
+	t.Helper()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	return body
+}
+
+func TestGiphyCommand(t *testing.T) {
+	commands := NewSlashCommands(newTestConfig(t), NewWebhookCache(newTestConfig(t), newTestStorage(t).WebhookRepo))
+	reply, handled, err := commands.Run(context.Background(), Command{RoomID: 1, UserName: "alice", Name: "giphy", Text: "happy cats"})
+	if err != nil || !handled || reply.UserName != "giphy" || reply.Text != "https://giphy.com/search/happy-cats" {
+		t.Fatalf("without api key got %+v, handled %v: %v", reply, handled, err)
+	}
+
+	search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("api_key") != "key" || r.URL.Query().Get("q") != "happy cats" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data":[{"url":"https://giphy.com/gifs/happy-cat-123"}]}`))
+	}))
+	defer search.Close()
+	command := &giphyCommand{apiKey: "key", client: search.Client(), searchURL: search.URL}
+	reply, err = command.HandleCommand(context.Background(), Command{Name: "giphy", Text: "happy cats"})
+	if err != nil || reply.Text != "https://giphy.com/gifs/happy-cat-123" {
+		t.Fatalf("search got %+v: %v", reply, err)
+	}
+}
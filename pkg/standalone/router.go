@@ -0,0 +1,35 @@
+package standalone
+
+import (
+	"context"
+
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/subscriber"
+)
+
+// Router runs the room HTTP server together with the subscriber message handler in one process.
+// Both handlers share the broker router, which is started and closed by the room HTTP server.
+type Router struct {
+	httpServer    common.HttpServer
+	grpcServer    common.GrpcServer
+	msgSubscriber *subscriber.MessageSubscriber
+}
+
+func NewRouter(httpServer common.HttpServer, grpcServer common.GrpcServer, msgSubscriber *subscriber.MessageSubscriber) *Router {
+	return &Router{httpServer, grpcServer, msgSubscriber}
+}
+
+func (r *Router) Run() {
+	r.msgSubscriber.RegisterHandler()
+	r.httpServer.RegisterRoutes()
+	r.grpcServer.Register()
+	r.httpServer.Run()
+	r.grpcServer.Run()
+}
+
+func (r *Router) GracefulStop(ctx context.Context) error {
+	if err := r.grpcServer.GracefulStop(); err != nil {
+		return err
+	}
+	return r.httpServer.GracefulStop(ctx)
+}
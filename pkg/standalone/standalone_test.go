@@ -0,0 +1,221 @@
+package standalone
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/omran95/chatroom/pkg/common"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/omran95/chatroom/pkg/infrastructure"
+	"github.com/omran95/chatroom/pkg/room"
+	"github.com/omran95/chatroom/pkg/room/client"
+	"github.com/omran95/chatroom/pkg/subscriber"
+	"github.com/redis/go-redis/v9"
+)
+
+// testIDGenerator returns increasing IDs of the current time, sonyflake needs a private IP address.
+type testIDGenerator struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+func (generator *testIDGenerator) NextID() (uint64, error) {
+	generator.mu.Lock()
+	defer generator.mu.Unlock()
+	generator.last = max(generator.last+1, common.MinIDAt(time.Now()))
+	return generator.last, nil
+}
+
+// testInstanceSeq names the instances of the tests, their metrics are registered by name.
+var testInstanceSeq atomic.Int64
+
+// standaloneServer is the room server of the standalone mode, wired like InitializeStandaloneRoomServer
+// on sqlite and miniredis.
+type standaloneServer struct {
+	config         *config.Config
+	subscriberRepo *subscriber.SubscriberRepoImpl
+	roomClient     *client.ClientWithResponses
+}
+
+func newStandaloneServer(t *testing.T) *standaloneServer {
+	t.Helper()
+	name := "standalone" + strconv.FormatInt(testInstanceSeq.Add(1), 10)
+	cfg, err := config.NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Storage.Driver = infrastructure.SQLiteDriver
+	cfg.Storage.SQL.DSN = filepath.Join(t.TempDir(), "room.db")
+	cfg.Room.Fallback.PollTimeoutSecond = 1
+	cfg.Room.Invite.Secret = "test-secret"
+	logger, err := common.NewHttpLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+	storage, err := room.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub := infrastructure.NewGoChannel()
+	t.Cleanup(func() { pubSub.Close() })
+
+	// the subscriber service runs in-process on the memory cache
+	subscriberRepo := subscriber.NewSubscriberRepo(infrastructure.NewMemoryCache())
+	subscriberPublisher, err := subscriber.NewMessagePublisher(pubSub, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriberService := subscriber.NewSubscriberService(subscriberRepo, subscriberPublisher)
+
+	publisher, err := room.NewMessagePublisher(pubSub, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks := room.NewWebhookCache(cfg, storage.WebhookRepo)
+	inviteSigner := room.NewInviteSigner(cfg)
+	roomService := room.NewRoomService(&testIDGenerator{}, storage.RoomRepo, publisher, NewSubscriberEndpoints(subscriberService),
+		storage.MessageRepo, room.NewMessageDeduplicator(cfg, redisClient), webhooks, room.NewSlashCommands(cfg, webhooks),
+		storage.PollRepo, storage.PinRepo, storage.ScheduledMessageRepo, storage.InviteRepo, inviteSigner, storage.MemberRepo)
+
+	router, err := infrastructure.NewBrokerRouter(name, cfg, pubSub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compression, err := room.NewWsCompression(name, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendQueues, err := room.NewSendQueues(name, cfg, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := room.NewRoomSessions(sendQueues)
+	roomSubscriber, err := room.NewMessageSubscriber(router, cfg, pubSub, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionHandler := room.NewSessionHandler(logger, roomService, roomSubscriber, sessions)
+	rateLimiter, err := room.NewRateLimiterMiddleware(cfg, redisClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	engine := room.NewGinEngine(name, logger, cfg)
+	httpServer := room.NewHttpServer(name, logger, engine, room.NewWebSocketConnection(compression), cfg, roomService,
+		roomSubscriber, sessionHandler, rateLimiter, nil, sendQueues, nil, nil, nil)
+	msgSubscriber, err := subscriber.NewMessageSubscriber(router, pubSub, subscriberService, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the handlers are registered like Router.Run, the broker router is the one the room server runs
+	msgSubscriber.RegisterHandler()
+	httpServer.RegisterRoutes()
+	go roomSubscriber.Run()
+	t.Cleanup(func() { roomSubscriber.GracefulStop() })
+	<-router.Running()
+	ts := httptest.NewServer(engine)
+	t.Cleanup(ts.Close)
+
+	roomClient, err := client.NewClientWithResponses(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &standaloneServer{cfg, subscriberRepo, roomClient}
+}
+
+func (server *standaloneServer) openSession(t *testing.T, ctx context.Context, roomID uint64, userName string) string {
+	t.Helper()
+	session, err := server.roomClient.CreatePollSessionWithResponse(ctx, roomID, &client.CreatePollSessionParams{UserName: userName})
+	if err != nil || session.JSON201 == nil {
+		t.Fatalf("open session of %s: %v %v", userName, session.Status(), err)
+	}
+	return session.JSON201.SessionId
+}
+
+// pollText polls the session until it gets a text message and returns it.
+func (server *standaloneServer) pollText(t *testing.T, ctx context.Context, roomID uint64, sessionID string) *room.Message {
+	t.Helper()
+	var ack uint64
+	for {
+		resp, err := server.roomClient.PollMessagesWithResponse(ctx, roomID, sessionID, &client.PollMessagesParams{Ack: &ack})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode() == http.StatusNoContent {
+			continue
+		}
+		if resp.StatusCode() != http.StatusOK {
+			t.Fatalf("poll: %s %s", resp.Status(), resp.Body)
+		}
+		if ack, err = strconv.ParseUint(resp.HTTPResponse.Header.Get("X-Poll-Offset"), 10, 64); err != nil {
+			t.Fatal(err)
+		}
+		lines := bufio.NewScanner(bytes.NewReader(resp.Body))
+		for lines.Scan() {
+			msg, err := room.DecodeMessage(room.ContentTypeJSON, lines.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Event == room.EventText {
+				return msg
+			}
+		}
+	}
+}
+
+func TestStandaloneDelivery(t *testing.T) {
+	server := newStandaloneServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	created, err := server.roomClient.CreateRoomWithResponse(ctx, client.CreateRoomRequest{Name: "general"})
+	if err != nil || created.JSON201 == nil {
+		t.Fatalf("create room: %v %v", created.Status(), err)
+	}
+	roomID := created.JSON201.RoomId
+	alice := server.openSession(t, ctx, roomID, "alice")
+	bob := server.openSession(t, ctx, roomID, "bob")
+
+	// both sessions subscribed the topic of this instance in the memory cache
+	topics, err := server.subscriberRepo.GetRoomSubscribers(ctx, roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := topics[server.config.Room.MessageSubscriber.Topic]; len(topics) != 1 || !ok {
+		t.Fatalf("room subscribers %v, want the topic %s", topics, server.config.Room.MessageSubscriber.Topic)
+	}
+
+	sent, err := server.roomClient.SendSessionMessageWithBodyWithResponse(ctx, roomID, alice, "application/json",
+		strings.NewReader(`{"event":0,"payload":"hello from alice"}`))
+	if err != nil || sent.StatusCode() != http.StatusAccepted {
+		t.Fatalf("send: %v %v", sent.Status(), err)
+	}
+	for _, sessionID := range []string{alice, bob} {
+		if msg := server.pollText(t, ctx, roomID, sessionID); msg.Payload != "hello from alice" || msg.UserName != "alice" {
+			t.Fatalf("session %s got %+v", sessionID, msg)
+		}
+	}
+
+	for _, sessionID := range []string{alice, bob} {
+		if left, err := server.roomClient.LeaveSessionWithResponse(ctx, roomID, sessionID); err != nil || left.StatusCode() != http.StatusNoContent {
+			t.Fatalf("leave: %v %v", left.Status(), err)
+		}
+	}
+	if topics, err := server.subscriberRepo.GetRoomSubscribers(ctx, roomID); err != nil || len(topics) != 0 {
+		t.Fatalf("room subscribers after leaving %v: %v", topics, err)
+	}
+}
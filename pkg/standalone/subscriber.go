@@ -0,0 +1,29 @@
+package standalone
+
+import (
+	"context"
+
+	"github.com/omran95/chatroom/pkg/room"
+	"github.com/omran95/chatroom/pkg/subscriber"
+	subscriberpb "github.com/omran95/chatroom/pkg/subscriber/proto"
+)
+
+// NewSubscriberEndpoints serves the room service subscriber calls in-process instead of over gRPC.
+func NewSubscriberEndpoints(subscriberService subscriber.SubscriberService) room.SubscriberEndpoints {
+	return room.SubscriberEndpoints{
+		AddRoomSubscriber: func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(*subscriberpb.AddRoomSubscriberRequest)
+			if err := subscriberService.AddRoomSubscriber(ctx, req.RoomId, req.Username, req.SubscriberTopic); err != nil {
+				return nil, err
+			}
+			return &subscriberpb.AddRoomSubscriberResponse{}, nil
+		},
+		RemoveRoomSubscriber: func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(*subscriberpb.RemoveRoomSubscriberRequest)
+			if err := subscriberService.RemoveRoomSubscriber(ctx, req.RoomId, req.Username); err != nil {
+				return nil, err
+			}
+			return &subscriberpb.RemoveRoomSubscriberResponse{}, nil
+		},
+	}
+}
@@ -2,30 +2,212 @@ package subscriber
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/omran95/chatroom/pkg/config"
 	"github.com/omran95/chatroom/pkg/room"
 )
 
 type MessagePublisher interface {
 	PublishToSubscribers(ctx context.Context, subscribers map[string]struct{}, message room.Message) error
+	// PublishToTopic publishes msgs to a single subscriber topic, it is used for the messages of the retry topic
+	PublishToTopic(ctx context.Context, topic string, msgs []room.Message) error
 }
 
+// TopicMetadataKey carries the subscriber topic a message of the retry topic is published to.
+var TopicMetadataKey = "subscriber_topic"
+
+// MessagePublisherImpl publishes to the subscriber topics concurrently, at most parallelism topics at once.
+// A failing topic is retried on its own, once its retries run out the message is published to the retry
+// topic for that topic only, so the topics that received it do not get it again. A message that could not
+// be moved to the retry topic is redelivered and the sessions drop the copies they already got.
 type MessagePublisherImpl struct {
-	publisher message.Publisher
+	publisher    message.Publisher
+	parallelism  int
+	maxBatchSize int
+	retries      int
+	retryBackoff time.Duration
+	retryTopic   string
+	contentType  string
+
+	mu      sync.Mutex
+	senders map[string]*topicSender
 }
 
-func NewMessagePublisher(publisher message.Publisher) *MessagePublisherImpl {
-	return &MessagePublisherImpl{publisher}
+func NewMessagePublisher(publisher message.Publisher, config *config.Config) (*MessagePublisherImpl, error) {
+	contentType, err := room.PayloadContentType(config.Kafka.PayloadFormat)
+	if err != nil {
+		return nil, err
+	}
+	publish := config.Subscriber.Publish
+	return &MessagePublisherImpl{
+		publisher:    publisher,
+		parallelism:  max(publish.Parallelism, 1),
+		maxBatchSize: max(publish.MaxBatchSize, 1),
+		retries:      publish.Retries,
+		retryBackoff: time.Duration(publish.RetryBackoffMilliSecond) * time.Millisecond,
+		retryTopic:   publish.RetryTopic,
+		contentType:  contentType,
+		senders:      make(map[string]*topicSender),
+	}, nil
 }
 
 func (msgPub *MessagePublisherImpl) PublishToSubscribers(ctx context.Context, subscribers map[string]struct{}, msg room.Message) error {
-	for subscriber, _ := range subscribers {
-		err := msgPub.publisher.Publish(subscriber, message.NewMessage(watermill.NewULID(), msg.Encode()))
-		if err != nil {
-			return err
-		}
+	if len(subscribers) == 0 {
+		return nil
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errs   []error
+		tokens = make(chan struct{}, msgPub.parallelism)
+	)
+	for topic := range subscribers {
+		tokens <- struct{}{}
+		wg.Add(1)
+		go func(topic string) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+			err := msgPub.sender(topic).send(ctx, msg)
+			if err != nil && ctx.Err() == nil {
+				err = msgPub.moveToRetryTopic(topic, msg)
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("topic %s: %w", topic, err))
+				mu.Unlock()
+			}
+		}(topic)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("message %d reached %d of %d topics: %w", msg.ID, len(subscribers)-len(errs), len(subscribers), errors.Join(errs...))
 	}
 	return nil
 }
+
+func (msgPub *MessagePublisherImpl) PublishToTopic(ctx context.Context, topic string, msgs []room.Message) error {
+	return msgPub.publish(ctx, topic, msgs)
+}
+
+// moveToRetryTopic publishes msg to the retry topic, whose handler publishes it to topic.
+func (msgPub *MessagePublisherImpl) moveToRetryTopic(topic string, msg room.Message) error {
+	retryMsg := room.NewBrokerMessage(watermill.NewULID(), msgPub.contentType, msg)
+	retryMsg.Metadata.Set(TopicMetadataKey, topic)
+	if err := msgPub.publisher.Publish(msgPub.retryTopic, retryMsg); err != nil {
+		return fmt.Errorf("error moving the message to the retry topic: %w", err)
+	}
+	return nil
+}
+
+func (msgPub *MessagePublisherImpl) sender(topic string) *topicSender {
+	msgPub.mu.Lock()
+	defer msgPub.mu.Unlock()
+	sender, ok := msgPub.senders[topic]
+	if !ok {
+		sender = &topicSender{topic: topic, msgPub: msgPub}
+		msgPub.senders[topic] = sender
+	}
+	return sender
+}
+
+// publish sends the batch as one broker message, retrying with exponential backoff until ctx is done.
+func (msgPub *MessagePublisherImpl) publish(ctx context.Context, topic string, msgs []room.Message) error {
+	brokerMsg := room.NewBrokerMessage(watermill.NewULID(), msgPub.contentType, msgs...)
+	backoff := msgPub.retryBackoff
+	var err error
+	for attempt := 0; attempt <= msgPub.retries; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return errors.Join(err, ctx.Err())
+			case <-timer.C:
+			}
+			backoff *= 2
+		}
+		if err = msgPub.publisher.Publish(topic, brokerMsg); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// topicSender batches the messages of one topic: while a batch is being published, the next
+// messages for the topic wait and are published together once it is done. An idle topic
+// publishes right away, batching only happens under load.
+type topicSender struct {
+	topic   string
+	msgPub  *MessagePublisherImpl
+	mu      sync.Mutex
+	batches []*topicBatch
+	sending bool
+}
+
+type topicBatch struct {
+	msgs []room.Message
+	// ctx is cancelled once every sender of the batch stopped waiting for it
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+	done    chan struct{}
+	err     error
+}
+
+func (sender *topicSender) send(ctx context.Context, msg room.Message) error {
+	sender.mu.Lock()
+	last := len(sender.batches) - 1
+	if last < 0 || len(sender.batches[last].msgs) >= sender.msgPub.maxBatchSize {
+		batchCtx, cancel := context.WithCancel(context.Background())
+		sender.batches = append(sender.batches, &topicBatch{ctx: batchCtx, cancel: cancel, done: make(chan struct{})})
+		last++
+	}
+	batch := sender.batches[last]
+	batch.msgs = append(batch.msgs, msg)
+	batch.waiters++
+	if !sender.sending {
+		sender.sending = true
+		go sender.flush()
+	}
+	sender.mu.Unlock()
+
+	select {
+	case <-batch.done:
+		return batch.err
+	case <-ctx.Done():
+		sender.mu.Lock()
+		if batch.waiters--; batch.waiters == 0 {
+			batch.cancel()
+		}
+		sender.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// flush publishes the waiting batches in order until none is left.
+func (sender *topicSender) flush() {
+	for {
+		sender.mu.Lock()
+		if len(sender.batches) == 0 {
+			sender.sending = false
+			sender.mu.Unlock()
+			return
+		}
+		batch := sender.batches[0]
+		sender.batches = sender.batches[1:]
+		sender.mu.Unlock()
+
+		batch.err = sender.msgPub.publish(batch.ctx, sender.topic, batch.msgs)
+		batch.cancel()
+		close(batch.done)
+	}
+}
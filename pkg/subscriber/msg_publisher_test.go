@@ -0,0 +1,125 @@
+package subscriber
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/omran95/chatroom/pkg/config"
+	"github.com/omran95/chatroom/pkg/room"
+)
+
+// failingPublisher fails every publish to the topics in failing.
+type failingPublisher struct {
+	message.Publisher
+	failing map[string]bool
+}
+
+func (publisher *failingPublisher) Publish(topic string, msgs ...*message.Message) error {
+	if publisher.failing[topic] {
+		return errors.New("topic unavailable")
+	}
+	return publisher.Publisher.Publish(topic, msgs...)
+}
+
+func newTestPublisher(t *testing.T, retries int, backoff time.Duration) (*MessagePublisherImpl, *failingPublisher, *gochannel.GoChannel) {
+	t.Helper()
+	cfg, err := config.NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Subscriber.Publish.Retries = retries
+	cfg.Subscriber.Publish.RetryBackoffMilliSecond = backoff.Milliseconds()
+	pubSub := gochannel.NewGoChannel(gochannel.Config{OutputChannelBuffer: 16}, watermill.NopLogger{})
+	t.Cleanup(func() { pubSub.Close() })
+	publisher := &failingPublisher{Publisher: pubSub, failing: map[string]bool{}}
+	msgPub, err := NewMessagePublisher(publisher, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgPub, publisher, pubSub
+}
+
+func receive(t *testing.T, messages <-chan *message.Message) *message.Message {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		msg.Ack()
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestFailingTopicMovesToTheRetryTopic(t *testing.T) {
+	msgPub, publisher, pubSub := newTestPublisher(t, 2, time.Millisecond)
+	ctx := context.Background()
+	healthy, err := pubSub.Subscribe(ctx, "instance.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing, err := pubSub.Subscribe(ctx, "instance.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	retries, err := pubSub.Subscribe(ctx, msgPub.retryTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.failing["instance.b"] = true
+
+	msg := room.Message{ID: 1, RoomID: 1, Event: room.EventText, Payload: "hello"}
+	if err := msgPub.PublishToSubscribers(ctx, map[string]struct{}{"instance.a": {}, "instance.b": {}}, msg); err != nil {
+		t.Fatalf("the handler failed although the failing topic was moved to the retry topic: %v", err)
+	}
+	receive(t, healthy)
+	retryMsg := receive(t, retries)
+	if topic := retryMsg.Metadata.Get(TopicMetadataKey); topic != "instance.b" {
+		t.Fatalf("retry message for topic %q, want instance.b", topic)
+	}
+
+	// the retry handler publishes to the failing topic only
+	publisher.failing["instance.b"] = false
+	subscriber := &MessageSubscriber{subscriberService: NewSubscriberService(nil, msgPub)}
+	if err := subscriber.HandleRetryMessage(retryMsg); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := room.DecodeBrokerMessage(receive(t, failing))
+	if err != nil || len(msgs) != 1 || msgs[0].ID != msg.ID {
+		t.Fatalf("retried topic got %+v: %v", msgs, err)
+	}
+	select {
+	case <-healthy:
+		t.Fatal("the topic that received the message got it again")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPublishBackoffStopsWithTheContext(t *testing.T) {
+	msgPub, publisher, pubSub := newTestPublisher(t, 5, time.Hour)
+	retries, err := pubSub.Subscribe(context.Background(), msgPub.retryTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.failing["instance.a"] = true
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = msgPub.PublishToSubscribers(ctx, map[string]struct{}{"instance.a": {}}, room.Message{ID: 1, RoomID: 1})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the context error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("publish waited %s for its backoff", elapsed)
+	}
+	select {
+	case <-retries:
+		t.Fatal("a message whose handler stopped was moved to the retry topic")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -2,9 +2,10 @@ package subscriber
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/omran95/chatroom/pkg/config"
 	"github.com/omran95/chatroom/pkg/room"
 )
 
@@ -12,24 +13,39 @@ type MessageSubscriber struct {
 	router            *message.Router
 	subscriber        message.Subscriber
 	subscriberService SubscriberService
+	retryTopic        string
 }
 
-func NewMessageSubscriber(router *message.Router, subscriber message.Subscriber, subscriberService SubscriberService) (*MessageSubscriber, error) {
+func NewMessageSubscriber(router *message.Router, subscriber message.Subscriber, subscriberService SubscriberService, config *config.Config) (*MessageSubscriber, error) {
 	return &MessageSubscriber{
 		router:            router,
 		subscriber:        subscriber,
 		subscriberService: subscriberService,
+		retryTopic:        config.Subscriber.Publish.RetryTopic,
 	}, nil
 }
 
 func (subscriber *MessageSubscriber) HandleIncomingMessage(msg *message.Message) error {
-	message, err := DecodeToMessage(msg.Payload)
+	message, err := room.DecodeMessage(msg.Metadata.Get(room.ContentTypeMetadataKey), msg.Payload)
 	if err != nil {
 		return err
 	}
 	return subscriber.subscriberService.NotifySubscribers(msg.Context(), *message)
 }
 
+// HandleRetryMessage publishes a message of the retry topic to the one subscriber topic that did not get it.
+func (subscriber *MessageSubscriber) HandleRetryMessage(msg *message.Message) error {
+	topic := msg.Metadata.Get(TopicMetadataKey)
+	if topic == "" {
+		return errors.New("retry message without a subscriber topic")
+	}
+	messages, err := room.DecodeBrokerMessage(msg)
+	if err != nil {
+		return err
+	}
+	return subscriber.subscriberService.NotifyTopic(msg.Context(), topic, messages)
+}
+
 func (subscriber *MessageSubscriber) RegisterHandler() {
 	subscriber.router.AddNoPublisherHandler(
 		"subscriber_message_handler",
@@ -37,6 +53,12 @@ func (subscriber *MessageSubscriber) RegisterHandler() {
 		subscriber.subscriber,
 		subscriber.HandleIncomingMessage,
 	)
+	subscriber.router.AddNoPublisherHandler(
+		"subscriber_retry_handler",
+		subscriber.retryTopic,
+		subscriber.subscriber,
+		subscriber.HandleRetryMessage,
+	)
 }
 
 func (subscriber *MessageSubscriber) Run() error {
@@ -46,11 +68,3 @@ func (subscriber *MessageSubscriber) Run() error {
 func (subscriber *MessageSubscriber) GracefulStop() error {
 	return subscriber.router.Close()
 }
-
-func DecodeToMessage(data []byte) (*room.Message, error) {
-	var msg room.Message
-	if err := json.Unmarshal(data, &msg); err != nil {
-		return nil, err
-	}
-	return &msg, nil
-}
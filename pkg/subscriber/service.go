@@ -10,6 +10,8 @@ type SubscriberService interface {
 	AddRoomSubscriber(ctx context.Context, roomId uint64, userName, subscriber string) error
 	RemoveRoomSubscriber(ctx context.Context, roomId uint64, userName string) error
 	NotifySubscribers(ctx context.Context, message room.Message) error
+	// NotifyTopic publishes the messages to a single subscriber topic
+	NotifyTopic(ctx context.Context, topic string, messages []room.Message) error
 }
 
 type SubscriberServiceImpl struct {
@@ -36,3 +38,7 @@ func (service *SubscriberServiceImpl) NotifySubscribers(ctx context.Context, mes
 	}
 	return service.msgPublisher.PublishToSubscribers(ctx, roomSubscribers, message)
 }
+
+func (service *SubscriberServiceImpl) NotifyTopic(ctx context.Context, topic string, messages []room.Message) error {
+	return service.msgPublisher.PublishToTopic(ctx, topic, messages)
+}